@@ -0,0 +1,290 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var annotationsCommand = cli.Command{
+	Name:  "annotations",
+	Usage: "displays or compares the annotations of image manifests",
+	ArgsUsage: `--image <image-path>[:<tag>] [--diff <other-tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to display the annotations of. If --diff is specified, the
+annotations of "<tag>" are compared with those of "<other-tag>" and only the
+differences are displayed.
+
+Both the manifest annotations and the configuration labels (which act as
+annotations for the image configuration) are included.`,
+
+	// annotations gives information about a manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "diff",
+			Usage: "compare the annotations against another tag in the same image",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "output format of the annotations (text, json)",
+			Value: "text",
+		},
+	},
+
+	Action: annotations,
+
+	Before: func(ctx *cli.Context) error {
+		switch ctx.String("format") {
+		case "text", "json":
+		default:
+			return errors.Errorf("unknown --format: %s", ctx.String("format"))
+		}
+		if ctx.IsSet("diff") && !refRegexp.MatchString(ctx.String("diff")) {
+			return errors.Errorf("--diff tag is an invalid reference")
+		}
+		return nil
+	},
+}
+
+// ImageAnnotations is the set of annotations of an image manifest and its
+// configuration.
+type ImageAnnotations struct {
+	// Manifest contains the annotations of the manifest.
+	Manifest map[string]string `json:"manifest"`
+
+	// Config contains the labels of the image configuration.
+	Config map[string]string `json:"config"`
+}
+
+// AnnotationChange describes a single annotation which differs between two
+// images. Old is empty if the annotation was added, and New is empty if the
+// annotation was removed.
+type AnnotationChange struct {
+	// Source is either "manifest" or "config".
+	Source string `json:"source"`
+	Key    string `json:"key"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// AnnotationsDiff is the set of annotation changes between two images. Each
+// slice is sorted by source and then by key.
+type AnnotationsDiff struct {
+	Added   []AnnotationChange `json:"added"`
+	Changed []AnnotationChange `json:"changed"`
+	Removed []AnnotationChange `json:"removed"`
+}
+
+// getImageAnnotations fetches the ImageAnnotations for the given manifest
+// descriptor.
+func getImageAnnotations(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.Descriptor) (ImageAnnotations, error) {
+	var annotations ImageAnnotations
+
+	// FIXME: Implement support for manifest lists.
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return annotations, errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType), "invalid saved from descriptor")
+	}
+
+	manifestBlob, err := engine.FromDescriptor(ctx, manifestDescriptor)
+	if err != nil {
+		return annotations, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return annotations, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	configBlob, err := engine.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return annotations, errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return annotations, errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
+	}
+
+	annotations.Manifest = manifest.Annotations
+	annotations.Config = config.Config.Labels
+	if annotations.Manifest == nil {
+		annotations.Manifest = map[string]string{}
+	}
+	if annotations.Config == nil {
+		annotations.Config = map[string]string{}
+	}
+	return annotations, nil
+}
+
+// sortedKeys returns the keys of the given map in sorted order.
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diffAnnotations computes the changes required to go from the old set of
+// annotations to the new set of annotations.
+func diffAnnotations(old, new ImageAnnotations) AnnotationsDiff {
+	diff := AnnotationsDiff{
+		Added:   []AnnotationChange{},
+		Changed: []AnnotationChange{},
+		Removed: []AnnotationChange{},
+	}
+
+	for _, source := range []struct {
+		name     string
+		old, new map[string]string
+	}{
+		{"manifest", old.Manifest, new.Manifest},
+		{"config", old.Config, new.Config},
+	} {
+		for _, key := range sortedKeys(source.new) {
+			newValue := source.new[key]
+			oldValue, ok := source.old[key]
+			change := AnnotationChange{Source: source.name, Key: key, Old: oldValue, New: newValue}
+			switch {
+			case !ok:
+				diff.Added = append(diff.Added, change)
+			case oldValue != newValue:
+				diff.Changed = append(diff.Changed, change)
+			}
+		}
+		for _, key := range sortedKeys(source.old) {
+			if _, ok := source.new[key]; !ok {
+				diff.Removed = append(diff.Removed, AnnotationChange{Source: source.name, Key: key, Old: source.old[key]})
+			}
+		}
+	}
+	return diff
+}
+
+// Format formats ImageAnnotations using the default formatting, and writes the
+// result to the given writer.
+func (a ImageAnnotations) Format(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "SOURCE\tKEY\tVALUE\n")
+	for _, source := range []struct {
+		name   string
+		values map[string]string
+	}{
+		{"manifest", a.Manifest},
+		{"config", a.Config},
+	} {
+		for _, key := range sortedKeys(source.values) {
+			value := strings.Replace(source.values[key], "\t", " ", -1)
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", source.name, key, value)
+		}
+	}
+	return tw.Flush()
+}
+
+// Format formats an AnnotationsDiff using the default formatting (similar to
+// a unified diff), and writes the result to the given writer.
+func (d AnnotationsDiff) Format(w io.Writer) error {
+	for _, change := range d.Removed {
+		fmt.Fprintf(w, "- %s %s=%s\n", change.Source, change.Key, change.Old)
+	}
+	for _, change := range d.Changed {
+		fmt.Fprintf(w, "- %s %s=%s\n", change.Source, change.Key, change.Old)
+		fmt.Fprintf(w, "+ %s %s=%s\n", change.Source, change.Key, change.New)
+	}
+	for _, change := range d.Added {
+		fmt.Fprintf(w, "+ %s %s=%s\n", change.Source, change.Key, change.New)
+	}
+	return nil
+}
+
+func annotations(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	getAnnotations := func(name string) (ImageAnnotations, error) {
+		descriptorPaths, err := engineExt.ResolveReference(context.Background(), name)
+		if err != nil {
+			return ImageAnnotations{}, errors.Wrap(err, "get descriptor")
+		}
+		if len(descriptorPaths) == 0 {
+			return ImageAnnotations{}, errors.Errorf("tag not found: %s", name)
+		}
+		if len(descriptorPaths) != 1 {
+			// TODO: Handle this more nicely.
+			return ImageAnnotations{}, errors.Errorf("tag is ambiguous: %s", name)
+		}
+		return getImageAnnotations(context.Background(), engineExt, descriptorPaths[0].Descriptor())
+	}
+
+	imageAnnotations, err := getAnnotations(tagName)
+	if err != nil {
+		return errors.Wrapf(err, "get annotations of %s", tagName)
+	}
+
+	// What are we going to output?
+	var output interface {
+		Format(io.Writer) error
+	}
+	output = imageAnnotations
+	if ctx.IsSet("diff") {
+		otherName := ctx.String("diff")
+		otherAnnotations, err := getAnnotations(otherName)
+		if err != nil {
+			return errors.Wrapf(err, "get annotations of %s", otherName)
+		}
+		output = diffAnnotations(imageAnnotations, otherAnnotations)
+	}
+
+	if ctx.String("format") == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(output); err != nil {
+			return errors.Wrap(err, "encoding annotations")
+		}
+	} else {
+		if err := output.Format(os.Stdout); err != nil {
+			return errors.Wrap(err, "format annotations")
+		}
+	}
+	return nil
+}
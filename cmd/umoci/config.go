@@ -238,7 +238,9 @@ func config(ctx *cli.Context) error {
 			if err != nil {
 				return errors.Wrap(err, "config.env")
 			}
-			g.AddConfigEnv(name, value)
+			if err := g.SetConfigEnv(name, value); err != nil {
+				return errors.Wrap(err, "config.env")
+			}
 		}
 	}
 	// FIXME: This interface is weird.
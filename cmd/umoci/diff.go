@@ -0,0 +1,163 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var diffCommand = cli.Command{
+	Name:  "diff",
+	Usage: "shows the differences between two tags in an OCI image",
+	ArgsUsage: `--image <image-path>[:<tag>] <other-tag>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to compare from and "<other-tag>" is the name of the tagged image
+to compare to (both must be in the same image).
+
+The paths in the root filesystem which were added, modified or deleted are
+output, followed by the changes to the environment, labels, command and
+entrypoint of the image configuration. Modification times are ignored.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// diff reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the differences as a JSON encoded blob",
+		},
+	},
+
+	Action: diff,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <other-tag>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("other tag cannot be empty")
+		}
+		if !refRegexp.MatchString(ctx.Args().First()) {
+			return errors.Errorf("other tag is an invalid reference")
+		}
+		ctx.App.Metadata["other-tag"] = ctx.Args().First()
+		return nil
+	},
+}
+
+// tagMutator returns a mutator for the image manifest referenced by the given
+// tag.
+func tagMutator(engine cas.Engine, tagName string) (*mutate.Mutator, error) {
+	engineExt := casext.NewEngine(engine)
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return nil, errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return nil, errors.Errorf("tag not found: %s", tagName)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return nil, errors.Errorf("tag is ambiguous: %s", tagName)
+	}
+
+	// FIXME: Implement support for manifest lists.
+	if mediaType := descriptorPaths[0].Descriptor().MediaType; mediaType != ispec.MediaTypeImageManifest {
+		return nil, errors.Wrapf(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", mediaType), "invalid tag %s", tagName)
+	}
+
+	mutator, err := mutate.New(engine, descriptorPaths[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "create mutator for manifest")
+	}
+	return mutator, nil
+}
+
+// formatConfigValue formats an old or new value of a ConfigChange.
+func formatConfigValue(value interface{}) string {
+	if value == nil {
+		return "(none)"
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
+
+func diff(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	toName := ctx.App.Metadata["other-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	from, err := tagMutator(engine, fromName)
+	if err != nil {
+		return errors.Wrapf(err, "open %s", fromName)
+	}
+	to, err := tagMutator(engine, toName)
+	if err != nil {
+		return errors.Wrapf(err, "open %s", toName)
+	}
+
+	imageDiff, err := mutate.Diff(context.Background(), from, to)
+	if err != nil {
+		return errors.Wrap(err, "compute diff")
+	}
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(imageDiff); err != nil {
+			return errors.Wrap(err, "encoding diff")
+		}
+		return nil
+	}
+
+	for _, change := range imageDiff.Paths {
+		fmt.Printf("%s\t%s\n", change.Type, change.Path)
+	}
+	for _, change := range imageDiff.Config {
+		field := "config." + change.Field
+		if change.Key != "" {
+			field += "." + change.Key
+		}
+		fmt.Printf("%s\t%s\t%s -> %s\n", change.Type, field, formatConfigValue(change.Old), formatConfigValue(change.New))
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var digestMapCommand = cli.Command{
+	Name:  "digest-map",
+	Usage: "outputs the content digest of every file in an image",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image whose files will be listed.
+
+The output is a JSON object mapping the path of every regular file in the root
+filesystem of the image to the digest of its contents.`,
+
+	// digest-map reads manifest information.
+	Category: "image",
+
+	Action: digestMap,
+}
+
+func digestMap(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	mutator, err := tagMutator(engine, tagName)
+	if err != nil {
+		return err
+	}
+	digests, err := mutator.DigestMap(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "compute digest map")
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(digests); err != nil {
+		return errors.Wrap(err, "encoding digest map")
+	}
+	return nil
+}
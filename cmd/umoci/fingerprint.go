@@ -0,0 +1,100 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var fingerprintCommand = cli.Command{
+	Name:  "fingerprint",
+	Usage: "outputs a stable fingerprint of the contents of an image",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to fingerprint.
+
+The fingerprint is a digest of the DiffIDs, configuration and annotations of
+the image, which only changes if the meaningful contents of the image change.
+It is not affected by how the layers are compressed, and by default creation
+timestamps are ignored. This makes it suitable as a CI cache key.`,
+
+	// fingerprint reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "exclude-annotation",
+			Usage: "manifest annotation to exclude from the fingerprint (can be given several times)",
+		},
+		cli.BoolFlag{
+			Name:  "include-created",
+			Usage: "include creation timestamps (of the image and its history) in the fingerprint",
+		},
+	},
+
+	Action: fingerprint,
+}
+
+func fingerprint(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifestDescriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(manifestDescriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", tagName)
+	}
+	if len(manifestDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", tagName)
+	}
+	manifestDescriptor := manifestDescriptorPaths[0].Descriptor()
+
+	// FIXME: Implement support for manifest lists.
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType), "invalid --image tag")
+	}
+
+	fp, err := engineExt.Fingerprint(context.Background(), manifestDescriptor, &casext.FingerprintOptions{
+		ExcludeAnnotations: ctx.StringSlice("exclude-annotation"),
+		IncludeCreated:     ctx.Bool("include-created"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "fingerprint")
+	}
+	fmt.Println(fp)
+	return nil
+}
@@ -18,6 +18,7 @@
 package main
 
 import (
+	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/pkg/errors"
@@ -61,5 +62,10 @@ func gc(ctx *cli.Context) error {
 	defer engine.Close()
 
 	// Run the GC.
-	return errors.Wrap(engineExt.GC(context.Background()), "gc")
+	report, err := engineExt.GC(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "gc")
+	}
+	log.Infof("garbage collected %d blobs (%d bytes)", report.RemovedBlobs, report.RemovedBytes)
+	return nil
 }
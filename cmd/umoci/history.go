@@ -0,0 +1,265 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var historyCommand = cli.Command{
+	Name:  "history",
+	Usage: "reconstructs how an image was built from its history",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image whose history will be output.
+
+With --format=dockerfile (the default), the history entries of the image are
+converted into an approximate Dockerfile. This is a best-effort
+reconstruction, as image history is not a complete record of how an image was
+built. Entries which cannot be converted are included as comments.`,
+
+	// history reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "output format of the history (dockerfile, json)",
+			Value: "dockerfile",
+		},
+	},
+
+	Action: history,
+
+	Before: func(ctx *cli.Context) error {
+		switch ctx.String("format") {
+		case "dockerfile", "json":
+		default:
+			return errors.Errorf("unknown --format: %s", ctx.String("format"))
+		}
+		return nil
+	},
+}
+
+func history(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifestDescriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(manifestDescriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", tagName)
+	}
+	if len(manifestDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", tagName)
+	}
+	manifestDescriptor := manifestDescriptorPaths[0].Descriptor()
+
+	// FIXME: Implement support for manifest lists.
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType), "invalid --image tag")
+	}
+
+	ms, err := Stat(context.Background(), engineExt, manifestDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "stat")
+	}
+	var entries []ispec.History
+	for _, histEntry := range ms.History {
+		entries = append(entries, histEntry.History)
+	}
+
+	switch ctx.String("format") {
+	case "json":
+		if err := json.NewEncoder(os.Stdout).Encode(entries); err != nil {
+			return errors.Wrap(err, "encoding history")
+		}
+	case "dockerfile":
+		if err := writeHistoryDockerfile(os.Stdout, entries); err != nil {
+			return errors.Wrap(err, "write dockerfile")
+		}
+	}
+	return nil
+}
+
+// dockerfileInstructions is the set of Dockerfile instructions that can
+// appear in a history entry.
+var dockerfileInstructions = map[string]struct{}{
+	"ADD":         {},
+	"ARG":         {},
+	"CMD":         {},
+	"COPY":        {},
+	"ENTRYPOINT":  {},
+	"ENV":         {},
+	"EXPOSE":      {},
+	"HEALTHCHECK": {},
+	"LABEL":       {},
+	"MAINTAINER":  {},
+	"ONBUILD":     {},
+	"RUN":         {},
+	"SHELL":       {},
+	"STOPSIGNAL":  {},
+	"USER":        {},
+	"VOLUME":      {},
+	"WORKDIR":     {},
+}
+
+const (
+	// historyShellPrefix is the prefix used by "docker build" for the
+	// CreatedBy of every history entry.
+	historyShellPrefix = "/bin/sh -c "
+
+	// historyNopPrefix is the marker used by "docker build" for instructions
+	// which were not run in a shell.
+	historyNopPrefix = "#(nop)"
+
+	// historyBuildkitSuffix is the suffix used by BuildKit for the CreatedBy
+	// of history entries.
+	historyBuildkitSuffix = " # buildkit"
+)
+
+// historyCopyRegexp matches the "ADD <src> in <dest>" form that "docker build"
+// uses for ADD and COPY instructions.
+var historyCopyRegexp = regexp.MustCompile(`^(ADD|COPY) (.*) in (.*)$`)
+
+// isDockerfileInstruction returns whether the given line starts with a
+// Dockerfile instruction.
+func isDockerfileInstruction(line string) bool {
+	keyword := strings.Fields(line)
+	if len(keyword) == 0 {
+		return false
+	}
+	_, ok := dockerfileInstructions[keyword[0]]
+	return ok
+}
+
+// stripBuildArgs removes the "|<n> <arg>=<value>..." prefix that "docker
+// build" adds to RUN history entries when build arguments were set, and
+// returns the build arguments separately.
+func stripBuildArgs(createdBy string) (string, []string) {
+	if !strings.HasPrefix(createdBy, "|") {
+		return createdBy, nil
+	}
+	fields := strings.SplitN(createdBy[1:], " ", 2)
+	n, err := strconv.Atoi(fields[0])
+	if err != nil || len(fields) != 2 {
+		return createdBy, nil
+	}
+	rest := fields[1]
+	var args []string
+	for i := 0; i < n; i++ {
+		fields := strings.SplitN(rest, " ", 2)
+		if len(fields) != 2 {
+			return createdBy, nil
+		}
+		args = append(args, fields[0])
+		rest = fields[1]
+	}
+	return rest, args
+}
+
+// historyInstruction attempts to convert the CreatedBy of a history entry
+// into a Dockerfile instruction. The common formats used by "docker build"
+// and BuildKit (as well as plain Dockerfile instructions) are recognised. If
+// the entry could not be converted, ok is false.
+func historyInstruction(createdBy string) (instruction string, ok bool) {
+	createdBy = strings.TrimSpace(createdBy)
+	createdBy = strings.TrimSuffix(createdBy, historyBuildkitSuffix)
+
+	createdBy, buildArgs := stripBuildArgs(createdBy)
+	switch {
+	case strings.HasPrefix(createdBy, historyShellPrefix):
+		command := strings.TrimPrefix(createdBy, historyShellPrefix)
+		if strings.HasPrefix(command, historyNopPrefix) {
+			instruction = strings.TrimSpace(strings.TrimPrefix(command, historyNopPrefix))
+			if !isDockerfileInstruction(instruction) {
+				return "", false
+			}
+			instruction = historyCopyRegexp.ReplaceAllString(instruction, "$1 $2 $3")
+			return strings.TrimSpace(instruction), true
+		}
+		// Build arguments are set in the environment of RUN instructions.
+		return "RUN " + strings.Join(append(buildArgs, command), " "), true
+	case isDockerfileInstruction(createdBy):
+		return strings.Replace(createdBy, "RUN "+historyShellPrefix, "RUN ", 1), true
+	}
+	return "", false
+}
+
+// commentLines returns the given text as Dockerfile comment lines.
+func commentLines(text string) string {
+	return "# " + strings.Replace(text, "\n", "\n# ", -1) + "\n"
+}
+
+// writeHistoryDockerfile writes an approximate Dockerfile describing how an
+// image with the given history was built.
+func writeHistoryDockerfile(w io.Writer, entries []ispec.History) error {
+	var out bytes.Buffer
+	out.WriteString(commentLines("Reconstructed from the image history by umoci. This is a best-effort\nreconstruction and might not build the same image."))
+	out.WriteString("FROM scratch\n")
+	for _, entry := range entries {
+		out.WriteString("\n")
+		if entry.Created != nil {
+			out.WriteString(commentLines("created: " + entry.Created.Format(igen.ISO8601)))
+		}
+		if entry.Comment != "" {
+			out.WriteString(commentLines(entry.Comment))
+		}
+
+		instruction, ok := historyInstruction(entry.CreatedBy)
+		if !ok {
+			layer := "adds a layer"
+			if entry.EmptyLayer {
+				layer = "empty layer"
+			}
+			out.WriteString(commentLines(fmt.Sprintf("unknown instruction (%s): %s", layer, entry.CreatedBy)))
+			continue
+		}
+		// Multi-line commands need to be continued.
+		out.WriteString(strings.Replace(instruction, "\n", " \\\n", -1) + "\n")
+	}
+	_, err := out.WriteTo(w)
+	return err
+}
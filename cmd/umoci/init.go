@@ -18,9 +18,6 @@
 package main
 
 import (
-	"fmt"
-	"os"
-
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/pkg/errors"
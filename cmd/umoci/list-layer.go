@@ -0,0 +1,140 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var listLayerCommand = cli.Command{
+	Name:  "list-layer",
+	Usage: "lists the entries of a layer blob without extracting it",
+	ArgsUsage: `--layout <image-path> <digest>
+
+Where "<image-path>" is the path to the OCI image, and "<digest>" is the digest
+of the layer blob to list.
+
+Each entry is output on a separate line, similar to "tar -tv". Whiteouts are
+output as the path they remove, marked as a whiteout. The layer may be
+compressed with gzip or zstd, or uncompressed.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// list-layer reads blobs from an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the entries of the layer as a JSON encoded blob",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <digest>")
+		}
+		layerDigest, err := digest.Parse(ctx.Args().First())
+		if err != nil {
+			return errors.Wrap(err, "invalid <digest>")
+		}
+		ctx.App.Metadata["digest"] = layerDigest
+		return nil
+	},
+
+	Action: listLayer,
+}
+
+func listLayer(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	layerDigest := ctx.App.Metadata["digest"].(digest.Digest)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	entries := []layer.LayerEntry{}
+	if err := layer.ListLayer(context.Background(), engine, layerDigest, func(entry layer.LayerEntry) error {
+		if ctx.Bool("json") {
+			entries = append(entries, entry)
+			return nil
+		}
+		// Stream the output, as layers can be very large.
+		return printLayerEntry(entry)
+	}); err != nil {
+		return errors.Wrap(err, "list layer")
+	}
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(entries); err != nil {
+			return errors.Wrap(err, "encoding layer entries")
+		}
+	}
+	return nil
+}
+
+// layerEntryTypes maps the type of a layer entry to the character used for it
+// by "tar -tv".
+var layerEntryTypes = map[string]string{
+	layer.EntryFile:      "-",
+	layer.EntryDirectory: "d",
+	layer.EntrySymlink:   "l",
+	layer.EntryHardlink:  "h",
+	layer.EntryCharDev:   "c",
+	layer.EntryBlockDev:  "b",
+	layer.EntryFifo:      "p",
+}
+
+// printLayerEntry outputs a single layer entry in a format similar to
+// "tar -tv".
+func printLayerEntry(entry layer.LayerEntry) error {
+	var err error
+	switch entry.Type {
+	case layer.EntryWhiteout:
+		_, err = fmt.Printf("[whiteout] %s\n", entry.Path)
+	case layer.EntryOpaque:
+		_, err = fmt.Printf("[opaque whiteout] %s/\n", entry.Path)
+	default:
+		name := entry.Path
+		switch entry.Type {
+		case layer.EntrySymlink:
+			name += " -> " + entry.Linkname
+		case layer.EntryHardlink:
+			name += " link to " + entry.Linkname
+		}
+		_, err = fmt.Printf("%s%04o %d/%d %d %s\n", layerEntryTypes[entry.Type], entry.Mode, entry.UID, entry.GID, entry.Size, name)
+	}
+	return err
+}
@@ -102,14 +102,22 @@ func main() {
 	app.Commands = []cli.Command{
 		configCommand,
 		unpackCommand,
+		unpackLayersCommand,
 		repackCommand,
 		gcCommand,
+		repairCommand,
 		initCommand,
 		newCommand,
 		tagAddCommand,
 		tagRemoveCommand,
 		tagListCommand,
 		statCommand,
+		digestMapCommand,
+		listLayerCommand,
+		diffCommand,
+		historyCommand,
+		fingerprintCommand,
+		annotationsCommand,
 		rawSubcommand,
 	}
 
@@ -0,0 +1,133 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var rawBundleMetaCommand = cli.Command{
+	Name:  "bundle-meta",
+	Usage: "stores, extracts or lists arbitrary metadata files in a bundle",
+	ArgsUsage: `[--add <name>=<file>]... [--extract <name>] [--remove <name>]... <bundle>
+
+Where "<bundle>" is a bundle created by umoci-unpack(1), "<name>" is the name
+of a metadata file and "<file>" is the path of a file to store as metadata (or
+"-" for stdin). If no flags are given, the names of all of the metadata files
+in the bundle are listed.
+
+Metadata files are stored alongside the umoci.json file of the bundle, and are
+not interpreted by umoci. They are preserved by umoci-repack(1), so tools which
+use umoci can store per-bundle state in them rather than in the rootfs.`,
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "add",
+			Usage: "store the contents of a file as the named metadata file (<name>=<file>)",
+		},
+		cli.StringFlag{
+			Name:  "extract",
+			Usage: "write the contents of the named metadata file to stdout",
+		},
+		cli.StringSliceFlag{
+			Name:  "remove",
+			Usage: "remove the named metadata file",
+		},
+	},
+
+	Action: rawBundleMeta,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <bundle>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("bundle path cannot be empty")
+		}
+		ctx.App.Metadata["bundle"] = ctx.Args().First()
+
+		for _, add := range ctx.StringSlice("add") {
+			if parts := strings.SplitN(add, "=", 2); len(parts) != 2 || parts[1] == "" {
+				return errors.Errorf("--add must be of the form <name>=<file>: %s", add)
+			}
+		}
+		return nil
+	},
+}
+
+func rawBundleMeta(ctx *cli.Context) error {
+	bundlePath := ctx.App.Metadata["bundle"].(string)
+
+	// Make sure this is actually a bundle.
+	if _, err := ReadBundleMeta(bundlePath); err != nil {
+		return errors.Wrap(err, "read umoci.json metadata")
+	}
+
+	for _, name := range ctx.StringSlice("remove") {
+		if err := RemoveBundleMetaFile(bundlePath, name); err != nil {
+			return errors.Wrapf(err, "remove %s", name)
+		}
+	}
+
+	for _, add := range ctx.StringSlice("add") {
+		parts := strings.SplitN(add, "=", 2)
+		name, path := parts[0], parts[1]
+
+		var r io.Reader = os.Stdin
+		if path != "-" {
+			fh, err := os.Open(path)
+			if err != nil {
+				return errors.Wrapf(err, "open %s", path)
+			}
+			defer fh.Close()
+			r = fh
+		}
+		if err := WriteBundleMetaFile(bundlePath, name, r); err != nil {
+			return errors.Wrapf(err, "add %s", name)
+		}
+	}
+
+	if ctx.IsSet("extract") {
+		name := ctx.String("extract")
+		fh, err := OpenBundleMetaFile(bundlePath, name)
+		if err != nil {
+			return errors.Wrapf(err, "extract %s", name)
+		}
+		defer fh.Close()
+		if _, err := io.Copy(os.Stdout, fh); err != nil {
+			return errors.Wrapf(err, "extract %s", name)
+		}
+	}
+
+	if !ctx.IsSet("add") && !ctx.IsSet("extract") && !ctx.IsSet("remove") {
+		names, err := ListBundleMetaFiles(bundlePath)
+		if err != nil {
+			return errors.Wrap(err, "list metadata files")
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	}
+	return nil
+}
@@ -18,20 +18,32 @@
 package main
 
 import (
+	"archive/tar"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/apex/log"
+	"github.com/docker/go-units"
 	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	"github.com/openSUSE/umoci/oci/layer"
 	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/iohelpers"
+	"github.com/openSUSE/umoci/pkg/mtreecache"
 	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -39,7 +51,7 @@ import (
 	"golang.org/x/net/context"
 )
 
-var repackCommand = uxHistory(cli.Command{
+var repackCommand = uxMetaPath(uxHistory(cli.Command{
 	Name:  "repack",
 	Usage: "repacks an OCI runtime bundle into a reference",
 	ArgsUsage: `--image <image-path>[:<new-tag>] <bundle>
@@ -71,14 +83,133 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			Name:  "mask-path",
 			Usage: "set of path prefixes in which deltas will be ignored when generating new layers",
 		},
+		cli.StringSliceFlag{
+			Name:  "mask-regex",
+			Usage: "set of regular expressions matching paths whose deltas will be ignored when generating new layers",
+		},
 		cli.BoolFlag{
 			Name:  "no-mask-volumes",
 			Usage: "do not add the Config.Volumes of the image to the set of masked paths",
 		},
+		cli.StringFlag{
+			Name:  "since",
+			Usage: "only include files modified after the given ISO8601 timestamp in the new layer",
+		},
+		cli.BoolFlag{
+			Name:  "since-ignore-deletions",
+			Usage: "do not include deletions in the new layer when using --since",
+		},
+		cli.BoolFlag{
+			Name:  "deletions-only",
+			Usage: "only include deletions (whiteouts) in the new layer, ignoring added and modified files",
+		},
+		cli.BoolFlag{
+			Name:  "from-scratch",
+			Usage: "discard the layers of the base image and build a single layer from the entire rootfs",
+		},
+		cli.StringFlag{
+			Name:  "created-annotation",
+			Usage: "ISO8601 timestamp for the org.opencontainers.image.created annotation of the new manifest (defaults to the history entry's created time)",
+		},
+		cli.BoolFlag{
+			Name:  "no-created-annotation",
+			Usage: "do not set the org.opencontainers.image.created annotation of the new manifest",
+		},
+		cli.BoolFlag{
+			Name:  "verify-bundle",
+			Usage: "fail if the bundle's mtree manifest was modified since it was unpacked",
+		},
+		cli.BoolFlag{
+			Name:  "digest-cache",
+			Usage: "cache the digests of unchanged files in the bundle to speed up repeated repacks",
+		},
 		cli.BoolFlag{
 			Name:  "refresh-bundle",
 			Usage: "update the bundle metadata to reflect the packed rootfs",
 		},
+		cli.StringFlag{
+			Name:  "max-file-size",
+			Usage: "maximum size of a single file in the new layer (such as 100MB)",
+		},
+		cli.StringFlag{
+			Name:  "max-layer-size",
+			Usage: "split the changes into several layers of at most this (uncompressed) size (such as 500MB)",
+		},
+		cli.IntFlag{
+			Name:  "max-layers",
+			Usage: "raise --max-layer-size as needed so that at most this many layers are added",
+		},
+		cli.StringFlag{
+			Name:  "max-compressed-layer-size",
+			Usage: "maximum size of the new layer once compressed (such as 500MB)",
+		},
+		cli.StringFlag{
+			Name:  "max-file-size-policy",
+			Usage: "what to do with files larger than --max-file-size (error, skip)",
+			Value: "error",
+		},
+		cli.StringFlag{
+			Name:  "on-unreadable",
+			Usage: "what to do with files in the rootfs that cannot be read (error, skip, whiteout)",
+			Value: "error",
+		},
+		cli.StringFlag{
+			Name:  "metadata-overrides",
+			Usage: "JSON file describing ownership and permissions to apply to paths in the new layer",
+		},
+		cli.BoolFlag{
+			Name:  "dedup-whiteouts",
+			Usage: "omit whiteouts for paths inside directories which are also being whited out",
+		},
+		cli.BoolFlag{
+			Name:  "preserve-file-flags",
+			Usage: "store inode flags (such as immutable and append-only) in the new layer",
+		},
+		cli.StringFlag{
+			Name:  "layer-cache-dir",
+			Usage: "directory used to cache generated layers between repacks",
+		},
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "compression to use for the new layer (gzip, zstd, none)",
+			Value: "gzip",
+		},
+		cli.BoolFlag{
+			Name:  "seekable-gzip",
+			Usage: "compress each file in the new layer as a separate gzip member, and store an index of their offsets",
+		},
+		cli.BoolFlag{
+			Name:  "rsyncable-gzip",
+			Usage: "reset the gzip compression state at content-defined boundaries so that similar layers compress similarly",
+		},
+		cli.BoolFlag{
+			Name:  "record-deletions",
+			Usage: "store the list of paths deleted by the new layer as a sidecar blob",
+		},
+		cli.StringFlag{
+			Name:  "layer-media-type",
+			Usage: "media type to use for the new layer instead of the default for its compression",
+		},
+		cli.BoolFlag{
+			Name:  "verify-reproducible",
+			Usage: "generate the new layer twice and fail if the two layers differ",
+		},
+		cli.BoolFlag{
+			Name:  "transactional",
+			Usage: "remove any blobs written to the image if the repack fails",
+		},
+		cli.StringFlag{
+			Name:  "changes-out",
+			Usage: "write a JSON list of the paths changed by the new layer to the given file",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print the changes and estimated size of the new layer without modifying the image",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output a summary of the repack as a JSON encoded blob",
+		},
 	},
 
 	Action: repack,
@@ -91,17 +222,164 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			return errors.Errorf("bundle path cannot be empty")
 		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
+
+		var maskRegexps []*regexp.Regexp
+		for _, pattern := range ctx.StringSlice("mask-regex") {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return errors.Wrapf(err, "invalid --mask-regex %q", pattern)
+			}
+			maskRegexps = append(maskRegexps, re)
+		}
+		ctx.App.Metadata["--mask-regex"] = maskRegexps
+
+		if ctx.IsSet("since") {
+			since, err := time.Parse(igen.ISO8601, ctx.String("since"))
+			if err != nil {
+				return errors.Wrap(err, "parsing --since")
+			}
+			ctx.App.Metadata["--since"] = since
+		} else if ctx.IsSet("since-ignore-deletions") {
+			return errors.Errorf("--since-ignore-deletions can only be used with --since")
+		}
+		if ctx.Bool("dry-run") {
+			switch {
+			case ctx.Bool("refresh-bundle"):
+				return errors.Errorf("--refresh-bundle cannot be used with --dry-run")
+			case ctx.IsSet("changes-out"):
+				// The changes are printed instead.
+				return errors.Errorf("--changes-out cannot be used with --dry-run")
+			case ctx.Bool("json"):
+				return errors.Errorf("--json cannot be used with --dry-run")
+			}
+		}
+		if ctx.Bool("from-scratch") && ctx.IsSet("since") {
+			return errors.Errorf("--since cannot be used with --from-scratch")
+		}
+		if ctx.IsSet("created-annotation") {
+			if ctx.Bool("no-created-annotation") {
+				return errors.Errorf("--created-annotation cannot be used with --no-created-annotation")
+			}
+			created, err := time.Parse(igen.ISO8601, ctx.String("created-annotation"))
+			if err != nil {
+				return errors.Wrap(err, "parsing --created-annotation")
+			}
+			ctx.App.Metadata["--created-annotation"] = created
+		}
+		if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+			seconds, err := strconv.ParseInt(epoch, 10, 64)
+			if err != nil {
+				return errors.Wrap(err, "parsing SOURCE_DATE_EPOCH")
+			}
+			ctx.App.Metadata["SOURCE_DATE_EPOCH"] = time.Unix(seconds, 0).UTC()
+		}
+		if ctx.Bool("from-scratch") && ctx.Bool("verify-bundle") {
+			// --from-scratch doesn't use the mtree manifest at all.
+			return errors.Errorf("--verify-bundle cannot be used with --from-scratch")
+		}
+		if ctx.Bool("deletions-only") {
+			switch {
+			case ctx.Bool("from-scratch"):
+				return errors.Errorf("--deletions-only cannot be used with --from-scratch")
+			case ctx.IsSet("since"):
+				return errors.Errorf("--deletions-only cannot be used with --since")
+			case ctx.Bool("refresh-bundle"):
+				// The refreshed metadata would include the ignored changes.
+				return errors.Errorf("--deletions-only cannot be used with --refresh-bundle")
+			}
+		}
+
+		if ctx.IsSet("max-file-size") {
+			maxFileSize, err := units.FromHumanSize(ctx.String("max-file-size"))
+			if err != nil {
+				return errors.Wrap(err, "parsing --max-file-size")
+			}
+			if maxFileSize <= 0 {
+				return errors.Errorf("--max-file-size must be positive")
+			}
+			ctx.App.Metadata["--max-file-size"] = maxFileSize
+		}
+		if ctx.IsSet("max-layer-size") {
+			maxLayerSize, err := units.FromHumanSize(ctx.String("max-layer-size"))
+			if err != nil {
+				return errors.Wrap(err, "parsing --max-layer-size")
+			}
+			if maxLayerSize <= 0 {
+				return errors.Errorf("--max-layer-size must be positive")
+			}
+			ctx.App.Metadata["--max-layer-size"] = maxLayerSize
+		}
+		if ctx.IsSet("max-layers") {
+			if !ctx.IsSet("max-layer-size") {
+				return errors.Errorf("--max-layers can only be used with --max-layer-size")
+			}
+			if ctx.Int("max-layers") <= 0 {
+				return errors.Errorf("--max-layers must be positive")
+			}
+			ctx.App.Metadata["--max-layers"] = ctx.Int("max-layers")
+		}
+		if ctx.IsSet("max-compressed-layer-size") {
+			maxLayerSize, err := units.FromHumanSize(ctx.String("max-compressed-layer-size"))
+			if err != nil {
+				return errors.Wrap(err, "parsing --max-compressed-layer-size")
+			}
+			if maxLayerSize <= 0 {
+				return errors.Errorf("--max-compressed-layer-size must be positive")
+			}
+			ctx.App.Metadata["--max-compressed-layer-size"] = maxLayerSize
+		}
+		switch ctx.String("max-file-size-policy") {
+		case "error":
+			ctx.App.Metadata["--max-file-size-policy"] = layer.FileSizeError
+		case "skip":
+			ctx.App.Metadata["--max-file-size-policy"] = layer.FileSizeSkip
+		default:
+			return errors.Errorf("unknown --max-file-size-policy: %s", ctx.String("max-file-size-policy"))
+		}
+		switch ctx.String("on-unreadable") {
+		case "error":
+			ctx.App.Metadata["--on-unreadable"] = layer.UnreadableError
+		case "skip":
+			ctx.App.Metadata["--on-unreadable"] = layer.UnreadableSkip
+		case "whiteout":
+			ctx.App.Metadata["--on-unreadable"] = layer.UnreadableWhiteout
+		default:
+			return errors.Errorf("unknown --on-unreadable: %s", ctx.String("on-unreadable"))
+		}
+		switch ctx.String("compress") {
+		case "gzip":
+			ctx.App.Metadata["--compress"] = mutate.GzipCompressor
+		case "zstd":
+			ctx.App.Metadata["--compress"] = mutate.ZstdCompressor
+		case "none":
+			ctx.App.Metadata["--compress"] = mutate.NewNoopCompressor()
+		default:
+			return errors.Errorf("unknown --compress: %s", ctx.String("compress"))
+		}
+		if ctx.Bool("seekable-gzip") && ctx.String("compress") != "gzip" {
+			return errors.Errorf("--seekable-gzip cannot be used with --compress=%s", ctx.String("compress"))
+		}
+		if ctx.Bool("rsyncable-gzip") {
+			switch {
+			case ctx.String("compress") != "gzip":
+				return errors.Errorf("--rsyncable-gzip cannot be used with --compress=%s", ctx.String("compress"))
+			case ctx.Bool("seekable-gzip"):
+				return errors.Errorf("--rsyncable-gzip cannot be used with --seekable-gzip")
+			}
+			ctx.App.Metadata["--compress"] = mutate.RsyncableGzipCompressor
+		}
 		return nil
 	},
-})
+}))
 
-func repack(ctx *cli.Context) error {
+func repack(ctx *cli.Context) (Err error) {
+	start := time.Now()
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 	bundlePath := ctx.App.Metadata["bundle"].(string)
 
 	// Read the metadata first.
-	meta, err := ReadBundleMeta(bundlePath)
+	meta, err := ReadBundleMetaPath(bundleMetaPath(ctx, bundlePath))
 	if err != nil {
 		return errors.Wrap(err, "read umoci.json metadata")
 	}
@@ -117,13 +395,42 @@ func repack(ctx *cli.Context) error {
 	}
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	var engine cas.Engine
+	engine, err = dir.Open(imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
-	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
 
+	// With --transactional, remove any blobs we wrote if the repack fails.
+	if ctx.Bool("transactional") {
+		txn, err := casext.NewTransaction(context.Background(), engine)
+		if err != nil {
+			return errors.Wrap(err, "start transaction")
+		}
+		defer func() {
+			if Err != nil {
+				log.Info("repack failed: removing blobs written by repack ...")
+				if err := txn.Rollback(context.Background()); err != nil {
+					log.Warnf("could not remove blobs written by failed repack: %v", err)
+				}
+			}
+		}()
+		engine = txn
+	}
+	counter := &countingEngine{Engine: engine}
+	engine = counter
+	engineExt := casext.NewEngine(engine)
+
+	// Make sure the base image is complete before generating the layer. With
+	// --from-scratch the layers of the base image are discarded, so they are
+	// allowed to be missing.
+	if !ctx.Bool("from-scratch") {
+		if err := engineExt.VerifyDescriptor(context.Background(), meta.From.Descriptor()); err != nil {
+			return errors.Wrap(err, "verify base image")
+		}
+	}
+
 	// Create the mutator.
 	mutator, err := mutate.New(engine, meta.From)
 	if err != nil {
@@ -141,32 +448,73 @@ func repack(ctx *cli.Context) error {
 		"mtree":  mtreePath,
 	}).Debugf("umoci: repacking OCI image")
 
-	mfh, err := os.Open(mtreePath)
-	if err != nil {
-		return errors.Wrap(err, "open mtree")
+	fsEval := fseval.DefaultFsEval
+	if meta.MapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
 	}
-	defer mfh.Close()
 
-	spec, err := mtree.ParseSpec(mfh)
-	if err != nil {
-		return errors.Wrap(err, "parse mtree")
+	var cache *mtreecache.Cache
+	if ctx.Bool("digest-cache") {
+		cache, err = readDigestCache(bundlePath)
+		if err != nil {
+			return errors.Wrap(err, "read digest cache")
+		}
 	}
 
-	log.WithFields(log.Fields{
-		"keywords": MtreeKeywords,
-	}).Debugf("umoci: parsed mtree spec")
+	var diffs []mtree.InodeDelta
+	if ctx.Bool("from-scratch") {
+		// Rebuild the image from the entire rootfs, without trusting the
+		// mtree manifest or the existing layers of the image.
+		log.Info("computing full filesystem layer ...")
+		diffs, err = rootfsDeltas(fullRootfsPath, fsEval)
+		if err != nil {
+			return errors.Wrap(err, "compute rootfs deltas")
+		}
+		log.Info("... done")
 
-	fsEval := fseval.DefaultFsEval
-	if meta.MapOptions.Rootless {
-		fsEval = fseval.RootlessFsEval
-	}
+		if err := mutator.ClearLayers(context.Background()); err != nil {
+			return errors.Wrap(err, "clear base image layers")
+		}
+	} else {
+		if ctx.Bool("verify-bundle") {
+			if err := verifyBundleManifest(mtreePath, meta.MtreeDigest); err != nil {
+				return errors.Wrap(err, "verify bundle")
+			}
+		}
 
-	log.Info("computing filesystem diff ...")
-	diffs, err := mtree.Check(fullRootfsPath, spec, MtreeKeywords, fsEval)
-	if err != nil {
-		return errors.Wrap(err, "check mtree")
+		mfh, err := os.Open(mtreePath)
+		if err != nil {
+			return errors.Wrap(err, "open mtree")
+		}
+		defer mfh.Close()
+
+		spec, err := mtree.ParseSpec(mfh)
+		if err != nil {
+			return errors.Wrap(err, "parse mtree")
+		}
+
+		log.WithFields(log.Fields{
+			"keywords": MtreeKeywords,
+		}).Debugf("umoci: parsed mtree spec")
+
+		check := mtree.Check
+		if cache != nil {
+			check = cache.Check
+		}
+
+		log.Info("computing filesystem diff ...")
+		diffs, err = check(fullRootfsPath, spec, MtreeKeywords, fsEval)
+		if err != nil {
+			return errors.Wrap(err, "check mtree")
+		}
+		log.Info("... done")
+
+		if cache != nil {
+			if err := writeDigestCache(bundlePath, cache); err != nil {
+				return errors.Wrap(err, "write digest cache")
+			}
+		}
 	}
-	log.Info("... done")
 
 	log.WithFields(log.Fields{
 		"ndiff": len(diffs),
@@ -183,13 +531,63 @@ func repack(ctx *cli.Context) error {
 			maskedPaths = append(maskedPaths, v)
 		}
 	}
-	diffs = mtreefilter.FilterDeltas(diffs, mtreefilter.MaskFilter(maskedPaths))
+	unmasked := mtreefilter.MaskFilter(maskedPaths)
+	unmaskedRegexp := mtreefilter.MaskRegexpFilter(ctx.App.Metadata["--mask-regex"].([]*regexp.Regexp))
+	diffs = layer.MaskDeltas(diffs, func(path string) bool { return !unmasked(path) || !unmaskedRegexp(path) })
+	if val, ok := ctx.App.Metadata["--since"]; ok {
+		diffs = mtreefilter.FilterInodeDeltas(diffs, mtreefilter.SinceFilter(val.(time.Time), !ctx.Bool("since-ignore-deletions")))
+	}
+	if ctx.Bool("deletions-only") {
+		diffs = mtreefilter.FilterInodeDeltas(diffs, mtreefilter.TypeFilter(mtree.Missing))
+	}
 
-	reader, err := layer.GenerateLayer(fullRootfsPath, diffs, &meta.MapOptions)
-	if err != nil {
-		return errors.Wrap(err, "generate diff layer")
+	// Files which only had their metadata changed (such as after an SELinux
+	// relabel) still have to be included in full in the new layer, which can
+	// be surprisingly expensive.
+	if stats := layer.CountMetadataOnly(diffs); stats.Files > 0 {
+		log.WithFields(log.Fields{
+			"files": stats.Files,
+			"bytes": stats.Bytes,
+		}).Warnf("repack: %d files (%s) only had metadata changes but will be included in full in the new layer", stats.Files, units.HumanSize(float64(stats.Bytes)))
+	}
+
+	packOptions := &layer.PackOptions{
+		MapOptions:     meta.MapOptions,
+		FileSizePolicy: ctx.App.Metadata["--max-file-size-policy"].(layer.FileSizePolicy),
+		OnUnreadable:   ctx.App.Metadata["--on-unreadable"].(layer.UnreadablePolicy),
+		LayerCacheDir:  ctx.String("layer-cache-dir"),
+
+		DeduplicateWhiteouts: ctx.Bool("dedup-whiteouts"),
+		PreserveFileFlags:    ctx.Bool("preserve-file-flags"),
+	}
+	if val, ok := ctx.App.Metadata["--max-file-size"]; ok {
+		packOptions.MaxFileSize = val.(int64)
+	}
+	if ctx.IsSet("metadata-overrides") {
+		packOptions.MetadataOverrides, err = readMetadataOverrides(ctx.String("metadata-overrides"))
+		if err != nil {
+			return errors.Wrap(err, "read --metadata-overrides")
+		}
+	}
+
+	// With --max-layer-size the changes may be split over several layers,
+	// each of which gets its own history entry.
+	var maxLayerSize int64
+	if val, ok := ctx.App.Metadata["--max-layer-size"]; ok {
+		maxLayerSize = val.(int64)
+	}
+	var maxLayers int
+	if val, ok := ctx.App.Metadata["--max-layers"]; ok {
+		maxLayers = val.(int)
+	}
+
+	if ctx.Bool("dry-run") {
+		compressor := ctx.App.Metadata["--compress"].(mutate.Compressor)
+		if ctx.Bool("seekable-gzip") {
+			compressor = mutate.SeekableGzipCompressor
+		}
+		return repackDryRun(os.Stdout, fullRootfsPath, diffs, maxLayerSize, maxLayers, packOptions, compressor)
 	}
-	defer reader.Close()
 
 	imageMeta, err := mutator.Meta(context.Background())
 	if err != nil {
@@ -197,12 +595,15 @@ func repack(ctx *cli.Context) error {
 	}
 
 	created := time.Now()
+	if val, ok := ctx.App.Metadata["SOURCE_DATE_EPOCH"]; ok {
+		created = val.(time.Time)
+	}
 	history := ispec.History{
 		Author:     imageMeta.Author,
 		Comment:    "",
 		Created:    &created,
 		CreatedBy:  "umoci config", // XXX: Should we append argv to this?
-		EmptyLayer: false,
+		EmptyLayer: len(diffs) == 0,
 	}
 
 	if val, ok := ctx.App.Metadata["--history.author"]; ok {
@@ -222,10 +623,94 @@ func repack(ctx *cli.Context) error {
 		history.CreatedBy = val.(string)
 	}
 
-	// TODO: We should add a flag to allow for a new layer to be made
-	//       non-distributable.
-	if err := mutator.Add(context.Background(), reader, history); err != nil {
-		return errors.Wrap(err, "add diff layer")
+	addOptions := &mutate.AddOptions{
+		Compressor: ctx.App.Metadata["--compress"].(mutate.Compressor),
+	}
+	if ctx.Bool("seekable-gzip") {
+		addOptions.Compressor = mutate.SeekableGzipCompressor
+	}
+	if ctx.IsSet("layer-media-type") {
+		addOptions.MediaType = ctx.String("layer-media-type")
+	}
+	if val, ok := ctx.App.Metadata["--max-compressed-layer-size"]; ok {
+		addOptions.MaxCompressedSize = val.(int64)
+	}
+	summary := repackSummary{
+		Tag:    tagName,
+		Layers: []ispec.Descriptor{},
+	}
+
+	if len(diffs) == 0 {
+		// Don't add an empty layer if nothing changed, just record the step
+		// in the history.
+		log.Info("no changes in rootfs, not adding a new layer")
+		if err := mutator.AddEmptyHistory(context.Background(), history); err != nil {
+			return errors.Wrap(err, "add empty history")
+		}
+	} else {
+		groups, err := splitDiffs(fullRootfsPath, diffs, maxLayerSize, maxLayers, packOptions)
+		if err != nil {
+			return errors.Wrap(err, "split diff layer")
+		}
+		if len(groups) > 1 {
+			log.Infof("splitting changes into %d layers", len(groups))
+		}
+
+		for _, group := range groups {
+			if ctx.Bool("verify-reproducible") {
+				log.Info("verifying that the layer is reproducible ...")
+				if err := verifyReproducibleLayer(fullRootfsPath, group, packOptions); err != nil {
+					return errors.Wrap(err, "verify reproducible layer")
+				}
+				log.Info("... done")
+			}
+
+			reader, err := layer.GenerateLayer(fullRootfsPath, group, packOptions)
+			if err != nil {
+				return errors.Wrap(err, "generate diff layer")
+			}
+
+			layerOptions := *addOptions
+			if ctx.Bool("record-deletions") {
+				layerOptions.Sidecars = map[string]interface{}{
+					layer.DeletionsSidecar: layer.Deletions(group),
+				}
+			}
+
+			// TODO: We should add a flag to allow for a new layer to be made
+			//       non-distributable.
+			layerDescriptor, err := mutator.AddLayer(context.Background(), reader, history, &layerOptions)
+			reader.Close()
+			if err != nil {
+				return errors.Wrap(err, "add diff layer")
+			}
+
+			log.WithFields(log.Fields{
+				"digest":    layerDescriptor.Digest,
+				"size":      layerDescriptor.Size,
+				"mediatype": layerDescriptor.MediaType,
+			}).Infof("new layer created: %s", layerDescriptor.Digest)
+			summary.Layers = append(summary.Layers, layerDescriptor)
+		}
+	}
+
+	// Record when the new image was created in the manifest, unless asked
+	// not to (in which case any stale value from the base image is removed).
+	annotations, err := mutator.Annotations(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get annotations")
+	}
+	if ctx.Bool("no-created-annotation") {
+		delete(annotations, ispec.AnnotationCreated)
+	} else {
+		created := *history.Created
+		if val, ok := ctx.App.Metadata["--created-annotation"]; ok {
+			created = val.(time.Time)
+		}
+		annotations[ispec.AnnotationCreated] = created.UTC().Format(time.RFC3339)
+	}
+	if err := mutator.SetAnnotations(context.Background(), annotations); err != nil {
+		return errors.Wrap(err, "set annotations")
 	}
 
 	newDescriptorPath, err := mutator.Commit(context.Background())
@@ -240,20 +725,373 @@ func repack(ctx *cli.Context) error {
 	}
 
 	log.Infof("created new tag for image manifest: %s", tagName)
+	summary.Manifest = newDescriptorPath.Descriptor()
+	summary.BytesWritten = counter.written
+
+	if ctx.IsSet("changes-out") {
+		if err := writeLayerChanges(ctx.String("changes-out"), diffs); err != nil {
+			return errors.Wrap(err, "write --changes-out")
+		}
+	}
 
 	if ctx.Bool("refresh-bundle") {
 		newMtreeName := strings.Replace(newDescriptorPath.Descriptor().Digest.String(), ":", "_", 1)
-		if err := generateBundleManifest(newMtreeName, bundlePath, fsEval); err != nil {
+		mtreeDigest, err := generateBundleManifest(newMtreeName, bundlePath, fsEval, cache)
+		if err != nil {
 			return errors.Wrap(err, "write mtree metadata")
 		}
-		if err := os.Remove(mtreePath); err != nil {
+		// With --from-scratch the old mtree metadata might not exist.
+		if err := os.Remove(mtreePath); err != nil && !(ctx.Bool("from-scratch") && os.IsNotExist(err)) {
 			return errors.Wrap(err, "remove old mtree metadata")
 		}
 		meta.From = newDescriptorPath
-		if err := WriteBundleMeta(bundlePath, meta); err != nil {
+		meta.MtreeDigest = mtreeDigest
+		if err := WriteBundleMetaPath(bundleMetaPath(ctx, bundlePath), meta); err != nil {
 			return errors.Wrap(err, "write umoci.json metadata")
 		}
 	}
 
+	if ctx.Bool("json") {
+		summary.Duration = time.Since(start).Seconds()
+		if err := json.NewEncoder(os.Stdout).Encode(summary); err != nil {
+			return errors.Wrap(err, "encode summary")
+		}
+	}
+	return nil
+}
+
+// repackSummary is the summary of a repack, as output by --json.
+type repackSummary struct {
+	// Tag is the tag of the new image.
+	Tag string `json:"tag"`
+
+	// Manifest is the descriptor of the new image manifest.
+	Manifest ispec.Descriptor `json:"manifest"`
+
+	// Layers are the descriptors of the layers added to the image.
+	Layers []ispec.Descriptor `json:"layers"`
+
+	// BytesWritten is the total size of the blobs written to the image.
+	BytesWritten int64 `json:"bytes_written"`
+
+	// Duration is the time taken by the repack, in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// countingEngine is a cas.Engine which records the total size of the blobs
+// written through it.
+type countingEngine struct {
+	cas.Engine
+	written int64
+}
+
+// PutBlob is the same as cas.Engine.PutBlob.
+func (ce *countingEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	blobDigest, size, err := ce.Engine.PutBlob(ctx, reader)
+	if err == nil {
+		ce.written += size
+	}
+	return blobDigest, size, err
+}
+
+// PrettyBlobs implements cas.PrettyEngine by deferring to the wrapped engine.
+func (ce *countingEngine) PrettyBlobs() bool {
+	pretty, ok := ce.Engine.(cas.PrettyEngine)
+	return ok && pretty.PrettyBlobs()
+}
+
+// rootfsDeltas returns a set of deltas which add every path in the given
+// rootfs, as though it was being compared against an empty filesystem. This
+// is used to generate a layer containing the entire rootfs.
+func rootfsDeltas(rootfs string, fsEval mtree.FsEval) ([]mtree.InodeDelta, error) {
+	dh, err := mtree.Walk(rootfs, nil, MtreeKeywords, fsEval)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate mtree spec")
+	}
+	diffs, err := mtree.Compare(&mtree.DirectoryHierarchy{}, dh, MtreeKeywords)
+	if err != nil {
+		return nil, errors.Wrap(err, "compare against empty spec")
+	}
+	return diffs, nil
+}
+
+// LayerChange describes a single path changed by a layer generated with
+// umoci-repack(1), as written by --changes-out.
+type LayerChange struct {
+	// Path is the path (relative to the root filesystem) that was changed.
+	Path string `json:"path"`
+
+	// Type is either "added", "modified" or "deleted".
+	Type string `json:"type"`
+}
+
+// layerChanges returns the list of LayerChanges corresponding to the given
+// set of deltas.
+func layerChanges(diffs []mtree.InodeDelta) ([]LayerChange, error) {
+	changes := []LayerChange{}
+	for _, diff := range diffs {
+		change := LayerChange{Path: diff.Path()}
+		switch diff.Type() {
+		case mtree.Extra:
+			change.Type = "added"
+		case mtree.Modified:
+			change.Type = "modified"
+		case mtree.Missing:
+			change.Type = "deleted"
+		default:
+			return nil, errors.Errorf("unknown delta type for %s: %s", diff.Path(), diff.Type())
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// writeLayerChanges writes the list of LayerChanges corresponding to the
+// given set of deltas to the file at the given path.
+func writeLayerChanges(path string, diffs []mtree.InodeDelta) error {
+	changes, err := layerChanges(diffs)
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "create changes file")
+	}
+	defer fh.Close()
+
+	if err := json.NewEncoder(fh).Encode(changes); err != nil {
+		return errors.Wrap(err, "encode changes")
+	}
+	return errors.Wrap(fh.Close(), "close changes file")
+}
+
+// repackDryRun writes the changes that would be included in a layer generated
+// from the given deltas to w, sorted by path, followed by the size of the
+// layer. The layer is generated and compressed (so that the sizes are
+// accurate) but is then discarded, and the layer cache is not used.
+func repackDryRun(w io.Writer, rootfs string, diffs []mtree.InodeDelta, maxLayerSize int64, maxLayers int, opt *layer.PackOptions, compressor mutate.Compressor) error {
+	changes, err := layerChanges(diffs)
+	if err != nil {
+		return errors.Wrap(err, "compute changes")
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	for _, change := range changes {
+		fmt.Fprintf(w, "%s\t%s\n", change.Type, change.Path)
+	}
+
+	if len(diffs) == 0 {
+		fmt.Fprintln(w, "no changes in rootfs, no layer would be added")
+		return nil
+	}
+
+	packOptions := *opt
+	packOptions.LayerCacheDir = ""
+
+	groups, err := splitDiffs(rootfs, diffs, maxLayerSize, maxLayers, &packOptions)
+	if err != nil {
+		return errors.Wrap(err, "split diff layer")
+	}
+	for idx, group := range groups {
+		size, uncompressed, err := dryRunLayerSize(rootfs, group, &packOptions, compressor)
+		if err != nil {
+			return err
+		}
+		if len(groups) == 1 {
+			fmt.Fprintf(w, "estimated layer size: %d bytes (%d bytes uncompressed)\n", size, uncompressed)
+		} else {
+			fmt.Fprintf(w, "estimated size of layer %d/%d: %d bytes (%d bytes uncompressed)\n", idx+1, len(groups), size, uncompressed)
+		}
+	}
+	return nil
+}
+
+// splitDiffs splits the diffs into groups of at most maxLayerSize bytes of
+// (estimated) tar data with layer.SplitDeltas. If maxLayers is positive, the
+// size limit is raised as needed so that there are at most maxLayers groups
+// -- that is, --max-layers takes precedence over --max-layer-size.
+func splitDiffs(rootfs string, diffs []mtree.InodeDelta, maxLayerSize int64, maxLayers int, opt *layer.PackOptions) ([][]mtree.InodeDelta, error) {
+	if maxLayers > 0 && maxLayerSize > 0 {
+		// Start with the smallest limit that could fit the estimated size of
+		// all of the diffs into maxLayers layers.
+		total := layer.EstimateLayerSize(diffs)
+		if minSize := (total + int64(maxLayers) - 1) / int64(maxLayers); minSize > maxLayerSize {
+			log.Infof("raising the layer size limit to %d bytes to add at most %d layers", minSize, maxLayers)
+			maxLayerSize = minSize
+		}
+	}
+	for {
+		groups, err := layer.SplitDeltas(rootfs, diffs, maxLayerSize, 0, opt)
+		if err != nil {
+			return nil, err
+		}
+		if maxLayers <= 0 || len(groups) <= maxLayers {
+			return groups, nil
+		}
+		// Groups are filled in order, so they can't all be filled up to the
+		// limit. Keep raising it until the diffs fit (which they eventually
+		// will, once they all fit into one group).
+		maxLayerSize = maxLayerSize*int64(len(groups))/int64(maxLayers) + 1
+		log.Debugf("split into %d layers, raising the layer size limit to %d bytes", len(groups), maxLayerSize)
+	}
+}
+
+// dryRunLayerSize generates and compresses the layer for the given deltas,
+// returning its compressed and uncompressed sizes.
+func dryRunLayerSize(rootfs string, diffs []mtree.InodeDelta, opt *layer.PackOptions, compressor mutate.Compressor) (int64, int64, error) {
+	reader, err := layer.GenerateLayer(rootfs, diffs, opt)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "generate diff layer")
+	}
+	defer reader.Close()
+
+	counter := &iohelpers.CountingReader{R: reader}
+	compressed, err := compressor.Compress(counter)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "compress diff layer")
+	}
+	defer compressed.Close()
+
+	size, err := io.Copy(ioutil.Discard, compressed)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "compute diff layer size")
+	}
+	return size, counter.N, nil
+}
+
+// errLayerDiverged is returned by divergenceWriter once the two layers have
+// been found to differ.
+var errLayerDiverged = errors.New("layers diverged")
+
+// divergenceWriter compares everything written to it with the contents of
+// another reader, and records the offset of the first byte which differs.
+type divergenceWriter struct {
+	other    io.Reader
+	offset   int64
+	diverged bool
+}
+
+func (dw *divergenceWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	n, err := io.ReadFull(dw.other, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, errors.Wrap(err, "read second layer")
+	}
+	for idx := 0; idx < len(p); idx++ {
+		if idx >= n || p[idx] != buf[idx] {
+			dw.offset += int64(idx)
+			dw.diverged = true
+			return idx, errLayerDiverged
+		}
+	}
+	dw.offset += int64(len(p))
+	return len(p), nil
+}
+
+// verifyReproducibleLayer generates the layer for the given deltas twice, and
+// returns an error describing where the two layers first differ (if they do).
+// The layer cache is not used, as it would hide any non-determinism.
+func verifyReproducibleLayer(rootfs string, diffs []mtree.InodeDelta, opt *layer.PackOptions) error {
+	packOptions := *opt
+	packOptions.LayerCacheDir = ""
+
+	first, err := layer.GenerateLayer(rootfs, diffs, &packOptions)
+	if err != nil {
+		return errors.Wrap(err, "generate first layer")
+	}
+	defer first.Close()
+	second, err := layer.GenerateLayer(rootfs, diffs, &packOptions)
+	if err != nil {
+		return errors.Wrap(err, "generate second layer")
+	}
+	defer second.Close()
+
+	// We parse the first layer while comparing it, so that we can tell the
+	// user which entry contained the first difference.
+	dw := &divergenceWriter{other: second}
+	tr := tar.NewReader(io.TeeReader(first, dw))
+	entry := "<start of layer>"
+	for {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err != nil {
+			break
+		}
+		entry = hdr.Name
+		if _, err = io.Copy(ioutil.Discard, tr); err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		// Compare any trailing padding, and make sure the second layer
+		// doesn't have any extra data.
+		if _, err = io.Copy(dw, first); err == nil {
+			var extra [1]byte
+			if n, _ := second.Read(extra[:]); n > 0 {
+				dw.diverged = true
+			}
+		}
+	}
+	if dw.diverged || errors.Cause(err) == errLayerDiverged {
+		return errors.Errorf("layer is not reproducible: generated layers differ at byte offset %d (in or after entry %s)", dw.offset, entry)
+	}
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "compare layers")
+	}
 	return nil
 }
+
+// metadataOverride is the format of a single entry in a --metadata-overrides
+// file. It is equivalent to layer.MetadataOverride, except that the mode is
+// given as an octal string (such as "0755").
+type metadataOverride struct {
+	Path string `json:"path"`
+	UID  *int   `json:"uid,omitempty"`
+	GID  *int   `json:"gid,omitempty"`
+	Mode string `json:"mode,omitempty"`
+}
+
+// readMetadataOverrides reads the list of metadata overrides from the given
+// --metadata-overrides file.
+func readMetadataOverrides(path string) ([]layer.MetadataOverride, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open metadata overrides")
+	}
+	defer fh.Close()
+
+	var entries []metadataOverride
+	if err := json.NewDecoder(fh).Decode(&entries); err != nil {
+		return nil, errors.Wrap(err, "parse metadata overrides")
+	}
+
+	var overrides []layer.MetadataOverride
+	for idx, entry := range entries {
+		if entry.Path == "" {
+			return nil, errors.Errorf("override %d: path must be specified", idx)
+		}
+		override := layer.MetadataOverride{
+			Path: entry.Path,
+			UID:  entry.UID,
+			GID:  entry.GID,
+		}
+		if override.UID != nil && *override.UID < 0 {
+			return nil, errors.Errorf("override %d: invalid uid %d", idx, *override.UID)
+		}
+		if override.GID != nil && *override.GID < 0 {
+			return nil, errors.Errorf("override %d: invalid gid %d", idx, *override.GID)
+		}
+		if entry.Mode != "" {
+			mode, err := strconv.ParseUint(entry.Mode, 8, 32)
+			if err != nil || mode > 07777 {
+				return nil, errors.Errorf("override %d: invalid mode %q", idx, entry.Mode)
+			}
+			override.Mode = new(uint32)
+			*override.Mode = uint32(mode)
+		}
+		overrides = append(overrides, override)
+	}
+	return overrides, nil
+}
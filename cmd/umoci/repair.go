@@ -0,0 +1,102 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var repairCommand = cli.Command{
+	Name:  "repair",
+	Usage: "validates and repairs an OCI image layout",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+This command will validate the provided OCI image layout and fix any
+inconsistencies found. A missing or corrupt "oci-layout" file is rewritten,
+entries in "index.json" which reference blobs that don't exist are removed and
+blobs which are not reachable from "index.json" are reported. If --gc is
+specified, unreferenced blobs are also removed. Blobs which are reachable from
+"index.json" are never removed.`,
+
+	// repair modifies an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "gc",
+			Usage: "remove blobs which are not referenced by the image",
+		},
+	},
+
+	Action: repair,
+}
+
+func repair(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// We have to fix the layout before we can open the image.
+	layoutRepairs, err := dir.RepairLayout(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "repair layout")
+	}
+	if layoutRepairs.RewroteLayout {
+		fmt.Printf("rewrote oci-layout\n")
+	}
+	if layoutRepairs.CreatedIndex {
+		fmt.Printf("created empty index.json\n")
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	report, err := engineExt.Repair(context.Background(), &casext.RepairOptions{
+		RemoveUnreferenced: ctx.Bool("gc"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "repair")
+	}
+
+	for _, descriptor := range report.DanglingReferences {
+		fmt.Printf("removed dangling reference %q: %s\n", descriptor.Annotations[ispec.AnnotationRefName], descriptor.Digest)
+	}
+	for _, digest := range report.MissingBlobs {
+		fmt.Printf("missing referenced blob: %s\n", digest)
+	}
+	for _, digest := range report.UnreferencedBlobs {
+		if ctx.Bool("gc") {
+			fmt.Printf("removed unreferenced blob: %s\n", digest)
+		} else {
+			fmt.Printf("unreferenced blob: %s\n", digest)
+		}
+	}
+	return nil
+}
@@ -19,6 +19,8 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/cas/dir"
@@ -69,23 +71,9 @@ func tagAdd(ctx *cli.Context) error {
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
 
-	// Get original descriptor.
-	descriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
-	if err != nil {
-		return errors.Wrap(err, "get descriptor")
-	}
-	if len(descriptorPaths) == 0 {
-		return errors.Errorf("tag not found: %s", fromName)
-	}
-	if len(descriptorPaths) != 1 {
-		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", fromName)
-	}
-	descriptor := descriptorPaths[0].Descriptor()
-
-	// Add it.
-	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
-		return errors.Wrap(err, "put reference")
+	// Add it. Existing tags are replaced.
+	if err := engineExt.Tag(context.Background(), fromName, tagName, true); err != nil {
+		return errors.Wrap(err, "tag")
 	}
 
 	log.Infof("created new tag: %q -> %q", tagName, fromName)
@@ -143,6 +131,22 @@ line. See umoci-stat(1) to get more information about each tagged image.`,
 	// tag modifies an image layout.
 	Category: "layout",
 
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "sort",
+			Usage: "sort the list of tags (name, created)",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		switch ctx.String("sort") {
+		case "", "name", "created":
+		default:
+			return errors.Errorf("unknown --sort: %s", ctx.String("sort"))
+		}
+		return nil
+	},
+
 	Action: tagList,
 }
 
@@ -162,6 +166,30 @@ func tagList(ctx *cli.Context) error {
 		return errors.Wrap(err, "list references")
 	}
 
+	switch ctx.String("sort") {
+	case "name":
+		sort.Strings(names)
+	case "created":
+		// Images without a creation time are sorted first, and ties are
+		// sorted by name so that the output is stable.
+		created := map[string]time.Time{}
+		for _, name := range names {
+			if _, ok := created[name]; ok {
+				continue
+			}
+			created[name], err = engineExt.ReferenceCreated(context.Background(), name)
+			if err != nil {
+				return errors.Wrapf(err, "get creation time of %s", name)
+			}
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if ti, tj := created[names[i]], created[names[j]]; !ti.Equal(tj) {
+				return ti.Before(tj)
+			}
+			return names[i] < names[j]
+		})
+	}
+
 	for _, name := range names {
 		fmt.Println(name)
 	}
@@ -0,0 +1,151 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var unpackLayersCommand = cli.Command{
+	Name:  "unpack-layers",
+	Usage: "unpacks each layer of a reference into a separate directory",
+	ArgsUsage: `--image <image-path>[:<tag>] <dest>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to unpack (if not specified, defaults to "latest") and "<dest>" is
+the directory the layers are unpacked into.
+
+Each layer is unpacked into its own "layerN" directory inside "<dest>" (where N
+is the index of the layer, starting from 0) without being merged with the
+other layers. Whiteouts are not applied, and are instead unpacked as regular
+files. This is intended for analysing each layer of an image independently.`,
+
+	// unpack-layers reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "uid-map",
+			Usage: "specifies a uid mapping to use when unpacking (container:host:size)",
+		},
+		cli.StringSliceFlag{
+			Name:  "gid-map",
+			Usage: "specifies a gid mapping to use when unpacking (container:host:size)",
+		},
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "enable rootless unpacking support",
+		},
+		cli.IntFlag{
+			Name:  "parallel",
+			Usage: "maximum number of layers to unpack concurrently",
+			Value: 1,
+		},
+	},
+
+	Action: unpackLayers,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <dest>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("destination path cannot be empty")
+		}
+		ctx.App.Metadata["dest"] = ctx.Args().First()
+
+		if ctx.Int("parallel") < 1 {
+			return errors.Errorf("--parallel must be at least 1")
+		}
+		return nil
+	},
+}
+
+func unpackLayers(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	destPath := ctx.App.Metadata["dest"].(string)
+	parallel := ctx.Int("parallel")
+
+	mapOptions, err := parseMapOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return errors.Errorf("tag is not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+	fromDescriptor := fromDescriptorPaths[0].Descriptor()
+
+	// Make sure the image is complete before we start extracting it.
+	if err := engineExt.VerifyDescriptor(context.Background(), fromDescriptor); err != nil {
+		return errors.Wrap(err, "verify image")
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	if manifestBlob.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.MediaType), "invalid --image tag")
+	}
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	log.Infof("unpacking %d layers ...", len(manifest.Layers))
+	unpackOptions := &layer.UnpackOptions{
+		MapOptions: mapOptions,
+	}
+	if err := layer.UnpackLayers(context.Background(), engine, destPath, manifest, parallel, unpackOptions); err != nil {
+		return errors.Wrap(err, "unpack layers")
+	}
+	log.Info("... done")
+
+	log.Infof("unpacked image layers: %s", destPath)
+	return nil
+}
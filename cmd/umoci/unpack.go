@@ -18,9 +18,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/cas/dir"
@@ -34,14 +40,15 @@ import (
 	"golang.org/x/net/context"
 )
 
-var unpackCommand = cli.Command{
+var unpackCommand = uxMetaPath(cli.Command{
 	Name:  "unpack",
 	Usage: "unpacks a reference into an OCI runtime bundle",
 	ArgsUsage: `--image <image-path>[:<tag>] <bundle>
 
 Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
 tagged image to unpack (if not specified, defaults to "latest") and "<bundle>"
-is the destination to unpack the image to.
+is the destination to unpack the image to. "<bundle>" may be omitted if
+--squashfs is specified, in which case a temporary bundle is used.
 
 It should be noted that this is not the same as oci-create-runtime-bundle,
 because this command also will create an mtree specification to allow for layer
@@ -63,56 +70,93 @@ creation with umoci-repack(1).`,
 			Name:  "rootless",
 			Usage: "enable rootless unpacking support",
 		},
+		cli.StringFlag{
+			Name:  "hardlink-fallback",
+			Usage: "what to do with hardlinks whose target is on a different filesystem (error, copy)",
+			Value: "error",
+		},
+		cli.StringFlag{
+			Name:  "extract-path",
+			Usage: "only extract the given path (and everything inside it) from the rootfs",
+		},
+		cli.StringFlag{
+			Name:  "squashfs",
+			Usage: "also generate a squashfs image of the unpacked rootfs at the given path (requires mksquashfs)",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output a summary of the unpack as a JSON encoded blob",
+		},
 	},
 
 	Action: unpack,
 
 	Before: func(ctx *cli.Context) error {
-		if ctx.NArg() != 1 {
-			return errors.Errorf("invalid number of positional arguments: expected <bundle>")
+		if ctx.IsSet("squashfs") {
+			if ctx.String("squashfs") == "" {
+				return errors.Errorf("--squashfs path cannot be empty")
+			}
+			if _, err := exec.LookPath(mksquashfsPath); err != nil {
+				return errors.Wrap(err, "--squashfs requires mksquashfs (from squashfs-tools)")
+			}
+			if ctx.NArg() == 0 {
+				ctx.App.Metadata["bundle"] = ""
+			}
 		}
-		if ctx.Args().First() == "" {
-			return errors.Errorf("bundle path cannot be empty")
+		if _, ok := ctx.App.Metadata["bundle"]; !ok {
+			if ctx.NArg() != 1 {
+				return errors.Errorf("invalid number of positional arguments: expected <bundle>")
+			}
+			if ctx.Args().First() == "" {
+				return errors.Errorf("bundle path cannot be empty")
+			}
+			ctx.App.Metadata["bundle"] = ctx.Args().First()
+		}
+
+		if ctx.IsSet("extract-path") {
+			if ctx.String("extract-path") == "" {
+				return errors.Errorf("--extract-path cannot be empty")
+			}
+			ctx.App.Metadata["--extract-path"] = ctx.String("extract-path")
+		}
+
+		switch ctx.String("hardlink-fallback") {
+		case "error":
+			ctx.App.Metadata["--hardlink-fallback"] = layer.HardlinkFallbackError
+		case "copy":
+			ctx.App.Metadata["--hardlink-fallback"] = layer.HardlinkFallbackCopy
+		default:
+			return errors.Errorf("unknown --hardlink-fallback: %s", ctx.String("hardlink-fallback"))
 		}
-		ctx.App.Metadata["bundle"] = ctx.Args().First()
 		return nil
 	},
-}
+})
 
 func unpack(ctx *cli.Context) error {
+	start := time.Now()
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	fromName := ctx.App.Metadata["--image-tag"].(string)
 	bundlePath := ctx.App.Metadata["bundle"].(string)
 
-	var meta UmociMeta
-	meta.Version = UmociMetaVersion
-
-	// Parse map options.
-	// We need to set mappings if we're in rootless mode.
-	meta.MapOptions.Rootless = ctx.Bool("rootless")
-	if meta.MapOptions.Rootless {
-		if !ctx.IsSet("uid-map") {
-			ctx.Set("uid-map", fmt.Sprintf("0:%d:1", os.Geteuid()))
-		}
-		if !ctx.IsSet("gid-map") {
-			ctx.Set("gid-map", fmt.Sprintf("0:%d:1", os.Getegid()))
-		}
-	}
-	// Parse and set up the mapping options.
-	for _, uidmap := range ctx.StringSlice("uid-map") {
-		idMap, err := idtools.ParseMapping(uidmap)
+	// Only --squashfs can be used without a bundle, in which case the bundle
+	// is only needed until the squashfs image has been generated.
+	if bundlePath == "" {
+		tempDir, err := ioutil.TempDir("", "umoci-unpack-")
 		if err != nil {
-			return errors.Wrapf(err, "failure parsing --uid-map %s: %s", uidmap)
+			return errors.Wrap(err, "create temporary bundle")
 		}
-		meta.MapOptions.UIDMappings = append(meta.MapOptions.UIDMappings, idMap)
+		defer os.RemoveAll(tempDir)
+		bundlePath = filepath.Join(tempDir, "bundle")
 	}
-	for _, gidmap := range ctx.StringSlice("gid-map") {
-		idMap, err := idtools.ParseMapping(gidmap)
-		if err != nil {
-			return errors.Wrapf(err, "failure parsing --gid-map %s: %s", gidmap)
-		}
-		meta.MapOptions.GIDMappings = append(meta.MapOptions.GIDMappings, idMap)
+
+	var meta UmociMeta
+	meta.Version = UmociMetaVersion
+
+	mapOptions, err := parseMapOptions(ctx)
+	if err != nil {
+		return err
 	}
+	meta.MapOptions = mapOptions
 
 	log.WithFields(log.Fields{
 		"map.uid": meta.MapOptions.UIDMappings,
@@ -140,6 +184,11 @@ func unpack(ctx *cli.Context) error {
 	}
 	meta.From = fromDescriptorPaths[0]
 
+	// Make sure the image is complete before we start extracting it.
+	if err := engineExt.VerifyDescriptor(context.Background(), meta.From.Descriptor()); err != nil {
+		return errors.Wrap(err, "verify image")
+	}
+
 	manifestBlob, err := engineExt.FromDescriptor(context.Background(), meta.From.Descriptor())
 	if err != nil {
 		return errors.Wrap(err, "get manifest")
@@ -175,7 +224,14 @@ func unpack(ctx *cli.Context) error {
 	//        should be fixed once the CAS engine PR is merged into
 	//        image-tools. https://github.com/opencontainers/image-tools/pull/5
 	log.Info("unpacking bundle ...")
-	if err := layer.UnpackManifest(context.Background(), engineExt, bundlePath, manifest, &meta.MapOptions); err != nil {
+	unpackOptions := &layer.UnpackOptions{
+		MapOptions:       meta.MapOptions,
+		HardlinkFallback: ctx.App.Metadata["--hardlink-fallback"].(layer.HardlinkFallback),
+	}
+	if extractPath, ok := ctx.App.Metadata["--extract-path"].(string); ok {
+		unpackOptions.IncludePrefix = extractPath
+	}
+	if err := layer.UnpackManifest(context.Background(), engineExt, bundlePath, manifest, unpackOptions); err != nil {
 		return errors.Wrap(err, "create runtime bundle")
 	}
 	log.Info("... done")
@@ -185,20 +241,127 @@ func unpack(ctx *cli.Context) error {
 		fsEval = fseval.RootlessFsEval
 	}
 
-	if err := generateBundleManifest(mtreeName, bundlePath, fsEval); err != nil {
+	mtreeDigest, err := generateBundleManifest(mtreeName, bundlePath, fsEval, nil)
+	if err != nil {
 		return errors.Wrap(err, "write mtree")
 	}
+	meta.MtreeDigest = mtreeDigest
 
 	log.WithFields(log.Fields{
 		"version":     meta.Version,
 		"from":        meta.From,
 		"map_options": meta.MapOptions,
+		"mtree":       meta.MtreeDigest,
 	}).Debugf("umoci: saving UmociMeta metadata")
 
-	if err := WriteBundleMeta(bundlePath, meta); err != nil {
+	if err := WriteBundleMetaPath(bundleMetaPath(ctx, bundlePath), meta); err != nil {
 		return errors.Wrap(err, "write umoci.json metadata")
 	}
 
 	log.Infof("unpacked image bundle: %s", bundlePath)
+
+	if ctx.IsSet("squashfs") {
+		squashfsPath := ctx.String("squashfs")
+		log.Info("generating squashfs image ...")
+		if err := makeSquashfs(filepath.Join(bundlePath, layer.RootfsName), squashfsPath, meta.MapOptions.Rootless); err != nil {
+			return errors.Wrap(err, "generate squashfs")
+		}
+		log.Info("... done")
+		log.Infof("generated squashfs image: %s", squashfsPath)
+	}
+
+	if ctx.Bool("json") {
+		summary := unpackSummary{
+			Tag:      fromName,
+			Manifest: meta.From.Descriptor(),
+			Layers:   manifest.Layers,
+			Duration: time.Since(start).Seconds(),
+		}
+		// A temporary bundle (with --squashfs) no longer exists.
+		if ctx.App.Metadata["bundle"].(string) != "" {
+			summary.Bundle = bundlePath
+		}
+		if summary.Layers == nil {
+			summary.Layers = []ispec.Descriptor{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(summary); err != nil {
+			return errors.Wrap(err, "encode summary")
+		}
+	}
 	return nil
 }
+
+// unpackSummary is the summary of an unpack, as output by --json.
+type unpackSummary struct {
+	// Tag is the tag of the unpacked image.
+	Tag string `json:"tag"`
+
+	// Manifest is the descriptor of the unpacked image manifest.
+	Manifest ispec.Descriptor `json:"manifest"`
+
+	// Layers are the descriptors of the layers extracted to the bundle.
+	Layers []ispec.Descriptor `json:"layers"`
+
+	// Bundle is the path of the bundle, unless a temporary bundle was used.
+	Bundle string `json:"bundle,omitempty"`
+
+	// Duration is the time taken by the unpack, in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// mksquashfsPath is the name of the mksquashfs(1) binary used by --squashfs.
+const mksquashfsPath = "mksquashfs"
+
+// makeSquashfs generates a squashfs image at output containing the contents of
+// the given rootfs, using mksquashfs(1). Ownership, permissions and xattrs are
+// preserved. In rootless mode, the files in rootfs are all owned by the
+// current user (which maps to root inside the container), so every file in the
+// image is owned by root.
+func makeSquashfs(rootfs, output string, rootless bool) error {
+	args := []string{rootfs, output, "-noappend", "-no-progress"}
+	if rootless {
+		log.Warn("rootless unpack: ownership of files is not preserved in the squashfs image")
+		args = append(args, "-all-root")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(mksquashfsPath, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "run %s: %s", mksquashfsPath, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// parseMapOptions parses the --rootless, --uid-map and --gid-map flags. In
+// rootless mode, the current user is mapped to root by default.
+func parseMapOptions(ctx *cli.Context) (layer.MapOptions, error) {
+	var mapOptions layer.MapOptions
+
+	// We need to set mappings if we're in rootless mode.
+	mapOptions.Rootless = ctx.Bool("rootless")
+	if mapOptions.Rootless {
+		if !ctx.IsSet("uid-map") {
+			ctx.Set("uid-map", fmt.Sprintf("0:%d:1", os.Geteuid()))
+		}
+		if !ctx.IsSet("gid-map") {
+			ctx.Set("gid-map", fmt.Sprintf("0:%d:1", os.Getegid()))
+		}
+	}
+	// Parse and set up the mapping options.
+	for _, uidmap := range ctx.StringSlice("uid-map") {
+		idMap, err := idtools.ParseMapping(uidmap)
+		if err != nil {
+			return mapOptions, errors.Wrapf(err, "failure parsing --uid-map %s", uidmap)
+		}
+		mapOptions.UIDMappings = append(mapOptions.UIDMappings, idMap)
+	}
+	for _, gidmap := range ctx.StringSlice("gid-map") {
+		idMap, err := idtools.ParseMapping(gidmap)
+		if err != nil {
+			return mapOptions, errors.Wrapf(err, "failure parsing --gid-map %s", gidmap)
+		}
+		mapOptions.GIDMappings = append(mapOptions.GIDMappings, idMap)
+	}
+	return mapOptions, nil
+}
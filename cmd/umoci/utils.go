@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -32,6 +33,8 @@ import (
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/mtreecache"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
@@ -87,6 +90,13 @@ type UmociMeta struct {
 	// umoci-repack(1) calls, changing them is not recommended and so the
 	// default should be that they are the same.
 	MapOptions layer.MapOptions `json:"map_options"`
+
+	// MtreeDigest is the digest of the mtree manifest of the rootfs that was
+	// generated by umoci-unpack(1) (or by umoci-repack(1) with
+	// --refresh-bundle). It is used by umoci-repack(1) with --verify-bundle to
+	// check that the manifest has not been modified since it was generated.
+	// Bundles unpacked by older versions of umoci do not have this field.
+	MtreeDigest digest.Digest `json:"mtree_digest,omitempty"`
 }
 
 // WriteTo writes a JSON-serialised version of UmociMeta to the given io.Writer.
@@ -98,7 +108,14 @@ func (m UmociMeta) WriteTo(w io.Writer) (int64, error) {
 
 // WriteBundleMeta writes an umoci.json file to the given bundle path.
 func WriteBundleMeta(bundle string, meta UmociMeta) error {
-	fh, err := os.Create(filepath.Join(bundle, UmociMetaName))
+	return WriteBundleMetaPath(filepath.Join(bundle, UmociMetaName), meta)
+}
+
+// WriteBundleMetaPath is the same as WriteBundleMeta, except that the metadata
+// is written to the given path rather than to the bundle. This allows the
+// metadata to be stored separately from the bundle (see --meta-path).
+func WriteBundleMetaPath(path string, meta UmociMeta) error {
+	fh, err := os.Create(path)
 	if err != nil {
 		return errors.Wrap(err, "create metadata")
 	}
@@ -110,9 +127,15 @@ func WriteBundleMeta(bundle string, meta UmociMeta) error {
 
 // ReadBundleMeta reads and parses the umoci.json file from a given bundle path.
 func ReadBundleMeta(bundle string) (UmociMeta, error) {
+	return ReadBundleMetaPath(filepath.Join(bundle, UmociMetaName))
+}
+
+// ReadBundleMetaPath is the same as ReadBundleMeta, except that the metadata
+// is read from the given path rather than from the bundle.
+func ReadBundleMetaPath(path string) (UmociMeta, error) {
 	var meta UmociMeta
 
-	fh, err := os.Open(filepath.Join(bundle, UmociMetaName))
+	fh, err := os.Open(path)
 	if err != nil {
 		return meta, errors.Wrap(err, "open metadata")
 	}
@@ -127,6 +150,91 @@ func ReadBundleMeta(bundle string) (UmociMeta, error) {
 	return meta, errors.Wrap(err, "decode metadata")
 }
 
+// BundleMetaDirName is the name of the directory (alongside umoci.json) in
+// which arbitrary named metadata files can be stored in a bundle. umoci does
+// not interpret these files, but they are preserved by umoci-repack(1)
+// (including with --refresh-bundle) so that tools using umoci can store their
+// own per-bundle state without modifying the rootfs.
+const BundleMetaDirName = "umoci.d"
+
+// validBundleMetaName returns an error if the given name is not a valid name
+// for a bundle metadata file.
+func validBundleMetaName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsRune(name, '/') {
+		return errors.Errorf("invalid bundle metadata name: %q", name)
+	}
+	return nil
+}
+
+// WriteBundleMetaFile stores the contents of the given reader as the named
+// metadata file in the given bundle, replacing any existing file with the
+// same name.
+func WriteBundleMetaFile(bundle, name string, r io.Reader) error {
+	if err := validBundleMetaName(name); err != nil {
+		return err
+	}
+	metaDir := filepath.Join(bundle, BundleMetaDirName)
+	if err := os.MkdirAll(metaDir, 0755); err != nil {
+		return errors.Wrap(err, "create bundle metadata directory")
+	}
+
+	// Write to a temporary file first so that we never leave a partially
+	// written metadata file.
+	fh, err := ioutil.TempFile(metaDir, "."+name+".")
+	if err != nil {
+		return errors.Wrap(err, "create temporary metadata file")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if _, err := io.Copy(fh, r); err != nil {
+		return errors.Wrap(err, "write metadata file")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close metadata file")
+	}
+	return errors.Wrap(os.Rename(fh.Name(), filepath.Join(metaDir, name)), "rename metadata file")
+}
+
+// OpenBundleMetaFile opens the named metadata file in the given bundle for
+// reading.
+func OpenBundleMetaFile(bundle, name string) (*os.File, error) {
+	if err := validBundleMetaName(name); err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(filepath.Join(bundle, BundleMetaDirName, name))
+	return fh, errors.Wrap(err, "open metadata file")
+}
+
+// RemoveBundleMetaFile removes the named metadata file from the given bundle.
+func RemoveBundleMetaFile(bundle, name string) error {
+	if err := validBundleMetaName(name); err != nil {
+		return err
+	}
+	return errors.Wrap(os.Remove(filepath.Join(bundle, BundleMetaDirName, name)), "remove metadata file")
+}
+
+// ListBundleMetaFiles returns the sorted names of all of the metadata files
+// stored in the given bundle.
+func ListBundleMetaFiles(bundle string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(bundle, BundleMetaDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read bundle metadata directory")
+	}
+	var names []string
+	for _, info := range infos {
+		// Skip any leftover temporary files.
+		if strings.HasPrefix(info.Name(), ".") || !info.Mode().IsRegular() {
+			continue
+		}
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
+
 // ManifestStat has information about a given OCI manifest.
 // TODO: Implement support for manifest lists, this should also be able to
 //       contain stat information for a list of manifests.
@@ -248,8 +356,9 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 }
 
 // generateBundleManifest creates and writes an mtree of the rootfs in the given
-// bundle path, using the supplied fsEval method
-func generateBundleManifest(mtreeName string, bundlePath string, fsEval mtree.FsEval) error {
+// bundle path, using the supplied fsEval method. The digest of the written
+// manifest is returned so that it can be recorded in the bundle's UmociMeta.
+func generateBundleManifest(mtreeName string, bundlePath string, fsEval mtree.FsEval, cache *mtreecache.Cache) (digest.Digest, error) {
 	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
 
@@ -258,25 +367,100 @@ func generateBundleManifest(mtreeName string, bundlePath string, fsEval mtree.Fs
 		"mtree":    mtreePath,
 	}).Debugf("umoci: generating mtree manifest")
 
+	walk := mtree.Walk
+	if cache != nil {
+		walk = cache.Walk
+	}
+
 	log.Info("computing filesystem manifest ...")
-	dh, err := mtree.Walk(fullRootfsPath, nil, MtreeKeywords, fsEval)
+	dh, err := walk(fullRootfsPath, nil, MtreeKeywords, fsEval)
 	if err != nil {
-		return errors.Wrap(err, "generate mtree spec")
+		return "", errors.Wrap(err, "generate mtree spec")
 	}
 	log.Info("... done")
 
 	flags := os.O_CREATE | os.O_WRONLY | os.O_EXCL
 	fh, err := os.OpenFile(mtreePath, flags, 0644)
 	if err != nil {
-		return errors.Wrap(err, "open mtree")
+		return "", errors.Wrap(err, "open mtree")
 	}
 	defer fh.Close()
 
 	log.Debugf("umoci: saving mtree manifest")
 
-	if _, err := dh.WriteTo(fh); err != nil {
-		return errors.Wrap(err, "write mtree")
+	digester := digest.Canonical.Digester()
+	if _, err := dh.WriteTo(io.MultiWriter(fh, digester.Hash())); err != nil {
+		return "", errors.Wrap(err, "write mtree")
+	}
+
+	return digester.Digest(), nil
+}
+
+// DigestCacheName is the name of the file (alongside umoci.json) in which
+// umoci-repack(1) --digest-cache stores the digests of the files in the rootfs
+// of a bundle.
+const DigestCacheName = "umoci-digests.json"
+
+// readDigestCache reads the digest cache of the given bundle. If the bundle
+// has no digest cache (or it cannot be parsed) an empty cache is returned.
+func readDigestCache(bundle string) (*mtreecache.Cache, error) {
+	fh, err := os.Open(filepath.Join(bundle, DigestCacheName))
+	if os.IsNotExist(err) {
+		return mtreecache.New(), nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "open digest cache")
 	}
+	defer fh.Close()
+
+	cache, err := mtreecache.Load(fh)
+	if err != nil {
+		log.Warnf("ignoring invalid digest cache: %v", err)
+		return mtreecache.New(), nil
+	}
+	return cache, nil
+}
 
+// writeDigestCache atomically replaces the digest cache of the given bundle.
+func writeDigestCache(bundle string, cache *mtreecache.Cache) error {
+	fh, err := ioutil.TempFile(bundle, "."+DigestCacheName+".")
+	if err != nil {
+		return errors.Wrap(err, "create temporary digest cache")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if err := cache.Save(fh); err != nil {
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close digest cache")
+	}
+	return errors.Wrap(os.Rename(fh.Name(), filepath.Join(bundle, DigestCacheName)), "rename digest cache")
+}
+
+// verifyBundleManifest checks that the mtree manifest at the given path has
+// the expected digest, returning an error if it has been modified (or if no
+// digest was recorded).
+func verifyBundleManifest(mtreePath string, expected digest.Digest) error {
+	if expected == "" {
+		return errors.Errorf("bundle metadata has no recorded mtree digest (was the bundle unpacked by an older umoci?)")
+	}
+	if err := expected.Validate(); err != nil {
+		return errors.Wrap(err, "invalid recorded mtree digest")
+	}
+
+	fh, err := os.Open(mtreePath)
+	if err != nil {
+		return errors.Wrap(err, "open mtree")
+	}
+	defer fh.Close()
+
+	verifier := expected.Verifier()
+	if _, err := io.Copy(verifier, fh); err != nil {
+		return errors.Wrap(err, "read mtree")
+	}
+	if !verifier.Verified() {
+		return errors.Errorf("mtree manifest %s has been modified since the bundle was unpacked (expected digest %s)", mtreePath, expected)
+	}
 	return nil
 }
@@ -19,6 +19,7 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
 	"regexp"
 	"strings"
 
@@ -125,6 +126,48 @@ func uxTag(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// uxMetaPath adds a --meta-path flag to the given cli.Command as well as
+// adding relevant validation logic to the .Before of the command. The value
+// will be stored in ctx.Metadata["--meta-path"] as a string (or nil if
+// --meta-path was not specified). Use bundleMetaPath to get the path of the
+// metadata of a bundle.
+func uxMetaPath(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.StringFlag{
+		Name:  "meta-path",
+		Usage: "path of the umoci.json metadata of the bundle (default: <bundle>/umoci.json)",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify meta-path value.
+		if ctx.IsSet("meta-path") {
+			metaPath := ctx.String("meta-path")
+			if metaPath == "" {
+				return errors.Wrap(fmt.Errorf("path is empty"), "invalid --meta-path")
+			}
+			ctx.App.Metadata["--meta-path"] = metaPath
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// bundleMetaPath returns the path of the umoci.json metadata of the given
+// bundle, which is the value of --meta-path if it was specified (see
+// uxMetaPath).
+func bundleMetaPath(ctx *cli.Context, bundle string) string {
+	if val, ok := ctx.App.Metadata["--meta-path"]; ok {
+		return val.(string)
+	}
+	return filepath.Join(bundle, UmociMetaName)
+}
+
 // uxImage adds an --image flag to the given cli.Command as well as adding
 // relevant validation logic to the .Before of the command. The values (image,
 // tag) will be stored in ctx.Metadata["--image-path"] and
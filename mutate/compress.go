@@ -0,0 +1,301 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/system"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Compressor is an interface which users can use to implement different
+// compression types for the layers added by a Mutator.
+type Compressor interface {
+	// Compress sets up the streaming compressor for this compression type.
+	// The returned reader produces the compressed form of the given
+	// (uncompressed) stream.
+	Compress(reader io.Reader) (io.ReadCloser, error)
+
+	// MediaType returns the (distributable) layer media type of layers
+	// compressed with this compressor.
+	MediaType() string
+}
+
+// sidecarReader is implemented by the readers returned by Compressors which
+// generate a sidecar blob describing the compressed layer. The sidecar is
+// stored in the image and referenced from the layer descriptor (see
+// casext.AnnotationSidecarPrefix).
+type sidecarReader interface {
+	// Sidecar returns the name of the sidecar and a value which will be
+	// stored as a JSON blob. It must only be called after the compressed
+	// stream has been read in its entirety.
+	Sidecar() (string, interface{})
+}
+
+// noopCompressor is a Compressor which does no compression at all.
+type noopCompressor struct{}
+
+// NewNoopCompressor returns a Compressor which does not compress layers, and
+// thus produces layers with the ispec.MediaTypeImageLayer media type.
+func NewNoopCompressor() Compressor {
+	return noopCompressor{}
+}
+
+func (nc noopCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(reader), nil
+}
+
+func (nc noopCompressor) MediaType() string {
+	return ispec.MediaTypeImageLayer
+}
+
+// gzipBlockSize is the size of the blocks compressed in parallel by
+// gzipCompressor.
+const gzipBlockSize = 256 << 10
+
+// gzipCompressor is a Compressor which compresses layers using gzip.
+type gzipCompressor struct {
+	// level is the gzip compression level.
+	level int
+
+	// blockSize and blocks are the pgzip concurrency parameters. If they are
+	// zero, gzipBlockSize and twice the number of available CPUs are used.
+	blockSize, blocks int
+}
+
+// GzipCompressor is the default Compressor, which compresses layers using
+// gzip. Blocks of the layer are compressed in parallel, with the number of
+// blocks in flight limited by the number of CPUs available to umoci (taking
+// into account any cgroup CPU quota).
+var GzipCompressor Compressor = gzipCompressor{level: gzip.DefaultCompression}
+
+// GzipOptions are the options used to create a gzip Compressor with
+// NewGzipCompressor. The zero value is equivalent to GzipCompressor.
+type GzipOptions struct {
+	// Level is the gzip compression level, from gzip.BestSpeed to
+	// gzip.BestCompression. If zero, gzip.DefaultCompression is used.
+	Level int
+
+	// BlockSize is the size (in bytes) of the blocks of the layer which are
+	// compressed in parallel. If zero, a default block size is used.
+	BlockSize int
+
+	// Blocks is the maximum number of blocks which are compressed at once,
+	// which bounds the memory used by compression. A value of 1 effectively
+	// disables parallel compression. If zero, twice the number of CPUs
+	// available to umoci is used.
+	Blocks int
+}
+
+// NewGzipCompressor returns a Compressor which is equivalent to
+// GzipCompressor, except that it uses the compression level and concurrency
+// given in opt. A nil opt is equivalent to the zero GzipOptions.
+func NewGzipCompressor(opt *GzipOptions) (Compressor, error) {
+	var gzOptions GzipOptions
+	if opt != nil {
+		gzOptions = *opt
+	}
+
+	level := gzOptions.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if level != gzip.DefaultCompression && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+		return nil, errors.Errorf("invalid gzip compression level %d: must be between %d and %d", level, gzip.BestSpeed, gzip.BestCompression)
+	}
+
+	blockSize, blocks := gzOptions.BlockSize, gzOptions.Blocks
+	if blockSize == 0 {
+		blockSize = gzipBlockSize
+	}
+	if blocks == 0 {
+		blocks = 2 * system.EffectiveCPUs()
+	}
+	// Let pgzip validate the parameters, so we don't have to duplicate its
+	// limits here.
+	if err := pgzip.NewWriter(ioutil.Discard).SetConcurrency(blockSize, blocks); err != nil {
+		return nil, errors.Wrap(err, "invalid gzip concurrency")
+	}
+
+	return gzipCompressor{
+		level:     level,
+		blockSize: gzOptions.BlockSize,
+		blocks:    gzOptions.Blocks,
+	}, nil
+}
+
+// NewGzipCompressorLevel returns a Compressor which is equivalent to
+// GzipCompressor, except that it uses the given gzip compression level (from
+// gzip.BestSpeed to gzip.BestCompression). It is equivalent to calling
+// NewGzipCompressor with only GzipOptions.Level set.
+func NewGzipCompressorLevel(level int) (Compressor, error) {
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return nil, errors.Errorf("invalid gzip compression level %d: must be between %d and %d", level, gzip.BestSpeed, gzip.BestCompression)
+	}
+	return NewGzipCompressor(&GzipOptions{Level: level})
+}
+
+// NewGzipCompressorConcurrency returns a Compressor which is equivalent to
+// GzipCompressor, except that the layer is compressed in blocks of blockSize
+// bytes with at most the given number of blocks being compressed at once. This
+// bounds the memory used by compression, and a blocks value of 1 effectively
+// disables parallel compression. Unlike with GzipOptions, both values must be
+// given explicitly.
+func NewGzipCompressorConcurrency(blockSize, blocks int) (Compressor, error) {
+	if blockSize == 0 || blocks == 0 {
+		return nil, errors.Errorf("invalid gzip concurrency: block size %d and block count %d must be non-zero", blockSize, blocks)
+	}
+	return NewGzipCompressor(&GzipOptions{BlockSize: blockSize, Blocks: blocks})
+}
+
+func (gz gzipCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
+	blockSize, blocks := gz.blockSize, gz.blocks
+	if blockSize == 0 {
+		blockSize = gzipBlockSize
+	}
+	if blocks == 0 {
+		blocks = 2 * system.EffectiveCPUs()
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+
+	gzw, err := pgzip.NewWriterLevel(pipeWriter, gz.level)
+	if err != nil {
+		return nil, errors.Wrap(err, "create gzip writer")
+	}
+	if err := gzw.SetConcurrency(blockSize, blocks); err != nil {
+		return nil, errors.Wrap(err, "set gzip concurrency")
+	}
+	go func() {
+		if _, err := io.Copy(gzw, reader); err != nil {
+			pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
+			return
+		}
+		if err := gzw.Close(); err != nil {
+			pipeWriter.CloseWithError(errors.Wrap(err, "close gzip writer"))
+			return
+		}
+		pipeWriter.Close()
+	}()
+
+	return pipeReader, nil
+}
+
+func (gz gzipCompressor) MediaType() string {
+	return ispec.MediaTypeImageLayerGzip
+}
+
+// zstdCompressor is a Compressor which compresses layers using zstd.
+type zstdCompressor struct{}
+
+// ZstdCompressor is a Compressor which compresses layers using zstd, and thus
+// produces layers with the casext.MediaTypeImageLayerZstd media type. Note
+// that older image consumers might not support zstd compressed layers.
+var ZstdCompressor Compressor = zstdCompressor{}
+
+func (zs zstdCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	zw, err := zstd.NewWriter(pipeWriter)
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd writer")
+	}
+	go func() {
+		if _, err := io.Copy(zw, reader); err != nil {
+			zw.Close()
+			pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
+			return
+		}
+		if err := zw.Close(); err != nil {
+			pipeWriter.CloseWithError(errors.Wrap(err, "close zstd writer"))
+			return
+		}
+		pipeWriter.Close()
+	}()
+
+	return pipeReader, nil
+}
+
+func (zs zstdCompressor) MediaType() string {
+	return casext.MediaTypeImageLayerZstd
+}
+
+// nonDistributableMediaType returns the non-distributable equivalent of the
+// given layer media type.
+func nonDistributableMediaType(mediaType string) (string, error) {
+	switch mediaType {
+	case ispec.MediaTypeImageLayer:
+		return ispec.MediaTypeImageLayerNonDistributable, nil
+	case ispec.MediaTypeImageLayerGzip:
+		return ispec.MediaTypeImageLayerNonDistributableGzip, nil
+	case casext.MediaTypeImageLayerZstd:
+		return casext.MediaTypeImageLayerNonDistributableZstd, nil
+	}
+	return "", errors.Errorf("no non-distributable equivalent of media type %s", mediaType)
+}
+
+// layerCompression returns the compression suffix (such as "gzip") of a
+// layer media type, or "" if it has none.
+func layerCompression(mediaType string) string {
+	for _, compression := range []string{"gzip", "zstd"} {
+		if strings.HasSuffix(mediaType, compression) {
+			return compression
+		}
+	}
+	return ""
+}
+
+// validateLayerMediaType checks that mediaType is a plausible media type for
+// a layer compressed with the given Compressor. It must be a valid media type
+// for a tar archive, and must have the same compression suffix (such as
+// "gzip") as the compressor's own media type.
+func validateLayerMediaType(mediaType string, compressor Compressor) error {
+	base, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return errors.Wrapf(err, "parse media type %q", mediaType)
+	}
+	if base != mediaType {
+		return errors.Errorf("media type %q is not in canonical form (expected %q)", mediaType, base)
+	}
+	if !strings.Contains(base, "tar") {
+		return errors.Errorf("media type %q does not describe a tar layer", mediaType)
+	}
+	if layerCompression(base) != layerCompression(compressor.MediaType()) {
+		return errors.Errorf("media type %q does not match the compression of media type %s", mediaType, compressor.MediaType())
+	}
+	return nil
+}
+
+// Decompress returns a reader which produces the uncompressed contents of a
+// layer blob with the given media type, read from reader. gzip and zstd
+// compressed layers are decompressed, while uncompressed tar layers are passed
+// through unchanged. An error is returned for any other media type. Closing
+// the returned reader does not close reader. This is a wrapper around
+// casext.DecompressLayer.
+func Decompress(reader io.Reader, mediaType string) (io.ReadCloser, error) {
+	return casext.DecompressLayer(reader, mediaType)
+}
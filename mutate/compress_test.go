@@ -0,0 +1,259 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestGzipCompressorLevel(t *testing.T) {
+	// Generate some compressible (but not trivially compressible) data.
+	var buffer bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&buffer, "line %d: %d\n", i, i*i%7919)
+	}
+	data := buffer.Bytes()
+
+	compress := func(compressor Compressor) []byte {
+		reader, err := compressor.Compress(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("compress: %+v", err)
+		}
+		defer reader.Close()
+		compressed, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("read compressed data: %+v", err)
+		}
+
+		gzr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("create gzip reader: %+v", err)
+		}
+		decompressed, err := ioutil.ReadAll(gzr)
+		if err != nil {
+			t.Fatalf("decompress: %+v", err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Errorf("decompressed data doesn't match original data")
+		}
+		return compressed
+	}
+
+	fast, err := NewGzipCompressorLevel(gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	best, err := NewGzipCompressorLevel(gzip.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fast.MediaType() != GzipCompressor.MediaType() || best.MediaType() != GzipCompressor.MediaType() {
+		t.Errorf("gzip compressors with a level have a different media type to GzipCompressor")
+	}
+
+	fastSize, bestSize := len(compress(fast)), len(compress(best))
+	if fastSize <= bestSize {
+		t.Errorf("expected level %d output (%d bytes) to be larger than level %d output (%d bytes)", gzip.BestSpeed, fastSize, gzip.BestCompression, bestSize)
+	}
+	compress(GzipCompressor)
+
+	// Both the level and the concurrency can be set at once.
+	serialBest, err := NewGzipCompressor(&GzipOptions{Level: gzip.BestCompression, Blocks: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serialBestSize := len(compress(serialBest)); serialBestSize >= fastSize {
+		t.Errorf("expected level %d output with 1 block (%d bytes) to be smaller than level %d output (%d bytes)", gzip.BestCompression, serialBestSize, gzip.BestSpeed, fastSize)
+	}
+
+	for _, opt := range []*GzipOptions{nil, {}, {Level: gzip.DefaultCompression}} {
+		if _, err := NewGzipCompressor(opt); err != nil {
+			t.Errorf("%+v: unexpected error: %+v", opt, err)
+		}
+	}
+	for _, level := range []int{gzip.HuffmanOnly, gzip.BestCompression + 1} {
+		if _, err := NewGzipCompressor(&GzipOptions{Level: level}); err == nil {
+			t.Errorf("expected an error with gzip compression level %d", level)
+		}
+	}
+	for _, level := range []int{gzip.NoCompression, gzip.DefaultCompression, gzip.HuffmanOnly, gzip.BestCompression + 1} {
+		if _, err := NewGzipCompressorLevel(level); err == nil {
+			t.Errorf("expected an error from NewGzipCompressorLevel with gzip compression level %d", level)
+		}
+	}
+}
+
+func TestGzipCompressorConcurrency(t *testing.T) {
+	// Generate enough data to span many blocks.
+	var buffer bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&buffer, "line %d: %d\n", i, i*i%7919)
+	}
+	data := buffer.Bytes()
+
+	for _, test := range []struct {
+		blockSize, blocks int
+	}{
+		{64 << 10, 1},
+		{64 << 10, 4},
+		{1 << 20, 1},
+		{0, 2},
+		{64 << 10, 0},
+	} {
+		// Zero values only mean "use the default" with GzipOptions.
+		var compressor Compressor
+		var err error
+		if test.blockSize != 0 && test.blocks != 0 {
+			compressor, err = NewGzipCompressorConcurrency(test.blockSize, test.blocks)
+		} else {
+			compressor, err = NewGzipCompressor(&GzipOptions{BlockSize: test.blockSize, Blocks: test.blocks})
+		}
+		if err != nil {
+			t.Errorf("blockSize=%d blocks=%d: unexpected error: %+v", test.blockSize, test.blocks, err)
+			continue
+		}
+		if compressor.MediaType() != GzipCompressor.MediaType() {
+			t.Errorf("blockSize=%d blocks=%d: unexpected media type %s", test.blockSize, test.blocks, compressor.MediaType())
+		}
+
+		reader, err := compressor.Compress(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("compress: %+v", err)
+		}
+		compressed, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("read compressed data: %+v", err)
+		}
+
+		gzr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("create gzip reader: %+v", err)
+		}
+		decompressed, err := ioutil.ReadAll(gzr)
+		if err != nil {
+			t.Fatalf("decompress: %+v", err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Errorf("blockSize=%d blocks=%d: decompressed data doesn't match original data", test.blockSize, test.blocks)
+		}
+	}
+
+	for _, test := range []struct {
+		blockSize, blocks int
+	}{
+		{-1, 1},
+		{1024, 1},
+		{64 << 10, -1},
+	} {
+		if _, err := NewGzipCompressor(&GzipOptions{BlockSize: test.blockSize, Blocks: test.blocks}); err == nil {
+			t.Errorf("blockSize=%d blocks=%d: expected an error", test.blockSize, test.blocks)
+		}
+	}
+	for _, test := range []struct {
+		blockSize, blocks int
+	}{
+		{0, 1},
+		{1024, 1},
+		{64 << 10, 0},
+		{64 << 10, -1},
+	} {
+		if _, err := NewGzipCompressorConcurrency(test.blockSize, test.blocks); err == nil {
+			t.Errorf("blockSize=%d blocks=%d: expected an error from NewGzipCompressorConcurrency", test.blockSize, test.blocks)
+		}
+	}
+}
+
+func TestZstdCompressor(t *testing.T) {
+	data := bytes.Repeat([]byte("some layer contents "), 10000)
+
+	reader, err := ZstdCompressor.Compress(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("compress: %+v", err)
+	}
+	compressed, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("read compressed data: %+v", err)
+	}
+	if len(compressed) >= len(data) {
+		t.Errorf("expected compressed size (%d) to be smaller than uncompressed size (%d)", len(compressed), len(data))
+	}
+
+	decompressor, err := Decompress(bytes.NewReader(compressed), ZstdCompressor.MediaType())
+	if err != nil {
+		t.Fatalf("create decompressor: %+v", err)
+	}
+	defer decompressor.Close()
+	decompressed, err := ioutil.ReadAll(decompressor)
+	if err != nil {
+		t.Fatalf("decompress: %+v", err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Errorf("decompressed data doesn't match original data")
+	}
+
+	mediaType, err := nonDistributableMediaType(ZstdCompressor.MediaType())
+	if err != nil {
+		t.Errorf("unexpected error getting non-distributable media type: %+v", err)
+	} else if mediaType != "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd" {
+		t.Errorf("unexpected non-distributable media type: %s", mediaType)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	data := bytes.Repeat([]byte("some layer contents "), 1000)
+
+	// Every Compressor must round-trip through Decompress with its own media
+	// type (and the non-distributable variant of it).
+	for _, compressor := range []Compressor{NewNoopCompressor(), GzipCompressor, ZstdCompressor} {
+		nonDistributable, err := nonDistributableMediaType(compressor.MediaType())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mediaType := range []string{compressor.MediaType(), nonDistributable} {
+			compressed, err := compressor.Compress(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("%s: compress: %+v", mediaType, err)
+			}
+			reader, err := Decompress(compressed, mediaType)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %+v", mediaType, err)
+			}
+			got, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Errorf("%s: unexpected read error: %+v", mediaType, err)
+			}
+			reader.Close()
+			compressed.Close()
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s: decompressed data doesn't match original data", mediaType)
+			}
+		}
+	}
+
+	for _, mediaType := range []string{"", "application/vnd.oci.image.layer.v1.tar+bzip2"} {
+		if _, err := Decompress(bytes.NewReader(data), mediaType); err == nil {
+			t.Errorf("%q: expected Decompress to fail", mediaType)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ChangeType is the type of a change between two images.
+type ChangeType string
+
+const (
+	// ChangeAdded indicates that the path (or configuration value) only
+	// exists in the new image.
+	ChangeAdded ChangeType = "added"
+
+	// ChangeModified indicates that the path (or configuration value) exists
+	// in both images but differs.
+	ChangeModified ChangeType = "modified"
+
+	// ChangeDeleted indicates that the path (or configuration value) only
+	// exists in the old image.
+	ChangeDeleted ChangeType = "deleted"
+)
+
+// PathChange is a path in the root filesystem which differs between two
+// images.
+type PathChange struct {
+	// Path is the path (relative to the root filesystem) that was changed.
+	Path string `json:"path"`
+
+	// Type is the type of the change.
+	Type ChangeType `json:"type"`
+}
+
+// ConfigChange is a value in the image configuration which differs between
+// two images.
+type ConfigChange struct {
+	// Field is the configuration field that was changed, one of "env",
+	// "labels", "cmd" or "entrypoint".
+	Field string `json:"field"`
+
+	// Key is the name of the environment variable or label that was changed.
+	// It is empty for fields which are compared as a whole.
+	Key string `json:"key,omitempty"`
+
+	// Type is the type of the change.
+	Type ChangeType `json:"type"`
+
+	// Old and New are the values in the old and new image, and are omitted
+	// if the value was added or deleted respectively.
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+// ImageDiff describes the differences between two images.
+type ImageDiff struct {
+	// Paths are the changed paths in the root filesystem, sorted by path.
+	Paths []PathChange `json:"paths"`
+
+	// Config are the changed configuration values, sorted by field and key.
+	Config []ConfigChange `json:"config"`
+}
+
+// pathState is the state of a path in the root filesystem of an image, which
+// is used to decide whether a path has been modified. Modification times are
+// deliberately not included, so that rebuilding an identical file is not
+// reported as a change.
+type pathState struct {
+	typeflag byte
+	mode     int64
+	uid, gid int
+	linkname string
+	devmajor int64
+	devminor int64
+	xattrs   string
+	contents digest.Digest
+}
+
+// rootfsState returns the state of every path in the root filesystem of the
+// image, with the layers applied in order (and whiteouts resolved) in the same
+// way as DigestMap. The root directory itself is not included.
+func (m *Mutator) rootfsState(ctx context.Context) (map[string]pathState, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, errors.Wrap(err, "getting cache failed")
+	}
+
+	layers := m.manifest.Layers
+	kept, err := m.mergedEntries(ctx, layers, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute merged entries")
+	}
+
+	states := map[string]pathState{}
+	for layerIdx, descriptor := range layers {
+		layer, err := m.openLayer(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open layer %s", descriptor.Digest)
+		}
+		err = forEachEntry(layer, func(idx int, hdr *tar.Header, tr *tar.Reader) error {
+			name := cleanEntryName(hdr.Name)
+			if name == "" || kept[name] != (layerEntry{layer: layerIdx, index: idx}) {
+				return nil
+			}
+
+			state := pathState{
+				typeflag: hdr.Typeflag,
+				mode:     hdr.Mode,
+				uid:      hdr.Uid,
+				gid:      hdr.Gid,
+				linkname: hdr.Linkname,
+				devmajor: hdr.Devmajor,
+				devminor: hdr.Devminor,
+			}
+			if state.typeflag == tar.TypeRegA {
+				state.typeflag = tar.TypeReg
+			}
+			if state.typeflag == tar.TypeLink {
+				state.linkname = cleanEntryName(hdr.Linkname)
+			}
+			var xattrs []string
+			for key, value := range hdr.Xattrs {
+				xattrs = append(xattrs, key+"="+value)
+			}
+			sort.Strings(xattrs)
+			state.xattrs = strings.Join(xattrs, "\x00")
+
+			if state.typeflag == tar.TypeReg {
+				digester := digest.Canonical.Digester()
+				if _, err := io.Copy(digester.Hash(), tr); err != nil {
+					return errors.Wrapf(err, "hash contents of %s", hdr.Name)
+				}
+				state.contents = digester.Digest()
+			}
+			states[name] = state
+			return nil
+		})
+		layer.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read layer %s", descriptor.Digest)
+		}
+	}
+	return states, nil
+}
+
+// envMap converts a list of environment variables to a map. Later values of
+// the same variable override earlier ones.
+func envMap(env []string) map[string]string {
+	vars := map[string]string{}
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		vars[parts[0]] = parts[1]
+	}
+	return vars
+}
+
+// diffMaps returns the changes between two maps, with the given field name.
+func diffMaps(field string, from, to map[string]string) []ConfigChange {
+	var changes []ConfigChange
+	for key, before := range from {
+		if after, ok := to[key]; !ok {
+			changes = append(changes, ConfigChange{Field: field, Key: key, Type: ChangeDeleted, Old: before})
+		} else if after != before {
+			changes = append(changes, ConfigChange{Field: field, Key: key, Type: ChangeModified, Old: before, New: after})
+		}
+	}
+	for key, after := range to {
+		if _, ok := from[key]; !ok {
+			changes = append(changes, ConfigChange{Field: field, Key: key, Type: ChangeAdded, New: after})
+		}
+	}
+	return changes
+}
+
+// diffSlices returns the change (if any) between two values of a field which
+// is compared as a whole.
+func diffSlices(field string, from, to []string) []ConfigChange {
+	switch {
+	case reflect.DeepEqual(from, to), len(from) == 0 && len(to) == 0:
+		return nil
+	case len(from) == 0:
+		return []ConfigChange{{Field: field, Type: ChangeAdded, New: to}}
+	case len(to) == 0:
+		return []ConfigChange{{Field: field, Type: ChangeDeleted, Old: from}}
+	}
+	return []ConfigChange{{Field: field, Type: ChangeModified, Old: from, New: to}}
+}
+
+// Diff returns the differences between the images referenced by from and to.
+// The root filesystems are compared without extracting them (as with
+// DigestMap), and a path is modified if its type, contents, permissions,
+// ownership, link target, device numbers or extended attributes differ.
+// Modification times are ignored. The environment, labels, command and
+// entrypoint of the image configurations are also compared.
+func Diff(ctx context.Context, from, to *Mutator) (*ImageDiff, error) {
+	fromStates, err := from.rootfsState(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get old root filesystem")
+	}
+	toStates, err := to.rootfsState(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get new root filesystem")
+	}
+
+	diff := &ImageDiff{
+		Paths:  []PathChange{},
+		Config: []ConfigChange{},
+	}
+	for name, before := range fromStates {
+		if after, ok := toStates[name]; !ok {
+			diff.Paths = append(diff.Paths, PathChange{Path: name, Type: ChangeDeleted})
+		} else if after != before {
+			diff.Paths = append(diff.Paths, PathChange{Path: name, Type: ChangeModified})
+		}
+	}
+	for name := range toStates {
+		if _, ok := fromStates[name]; !ok {
+			diff.Paths = append(diff.Paths, PathChange{Path: name, Type: ChangeAdded})
+		}
+	}
+	sort.Slice(diff.Paths, func(i, j int) bool {
+		return diff.Paths[i].Path < diff.Paths[j].Path
+	})
+
+	fromConfig, toConfig := from.config.Config, to.config.Config
+	diff.Config = append(diff.Config, diffMaps("env", envMap(fromConfig.Env), envMap(toConfig.Env))...)
+	diff.Config = append(diff.Config, diffMaps("labels", fromConfig.Labels, toConfig.Labels)...)
+	diff.Config = append(diff.Config, diffSlices("cmd", fromConfig.Cmd, toConfig.Cmd)...)
+	diff.Config = append(diff.Config, diffSlices("entrypoint", fromConfig.Entrypoint, toConfig.Entrypoint)...)
+	sort.Slice(diff.Config, func(i, j int) bool {
+		if diff.Config[i].Field != diff.Config[j].Field {
+			return diff.Config[i].Field < diff.Config[j].Field
+		}
+		return diff.Config[i].Key < diff.Config[j].Key
+	})
+	return diff, nil
+}
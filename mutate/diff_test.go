@@ -0,0 +1,157 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// commitAndReopen commits the changes of the mutator, and returns a new
+// mutator for the committed image.
+func commitAndReopen(t *testing.T, engine cas.Engine, mutator *Mutator) *Mutator {
+	path, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	newMutator, err := New(engine, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newMutator
+}
+
+func TestDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestDiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	if err := mutator.Add(context.Background(), makeTestLayer(t, []testEntry{
+		{"etc/", tar.TypeDir, ""},
+		{"etc/a", tar.TypeReg, "a"},
+		{"etc/b", tar.TypeReg, "b"},
+	}), ispec.History{}); err != nil {
+		t.Fatal(err)
+	}
+	base := commitAndReopen(t, engine, mutator)
+
+	// Adding a single file must only report that file.
+	if err := mutator.Add(context.Background(), makeTestLayer(t, []testEntry{
+		{"etc/new", tar.TypeReg, "new"},
+	}), ispec.History{}); err != nil {
+		t.Fatal(err)
+	}
+	added := commitAndReopen(t, engine, mutator)
+
+	diff, err := Diff(context.Background(), base, added)
+	if err != nil {
+		t.Fatalf("unexpected error computing diff: %+v", err)
+	}
+	expected := &ImageDiff{
+		Paths:  []PathChange{{Path: "etc/new", Type: ChangeAdded}},
+		Config: []ConfigChange{},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("unexpected diff: expected %#v, got %#v", expected, diff)
+	}
+
+	// An image has no differences to itself.
+	diff, err = Diff(context.Background(), added, added)
+	if err != nil {
+		t.Fatalf("unexpected error computing diff: %+v", err)
+	}
+	if len(diff.Paths) != 0 || len(diff.Config) != 0 {
+		t.Errorf("unexpected diff of image with itself: %#v", diff)
+	}
+
+	// Modify and remove files, and change the configuration.
+	if err := mutator.Add(context.Background(), makeTestLayer(t, []testEntry{
+		{"etc/a", tar.TypeReg, "modified a"},
+		{"etc/.wh.b", tar.TypeReg, ""},
+		// Rewriting a file with the same contents is not a change.
+		{"etc/new", tar.TypeReg, "new"},
+	}), ispec.History{}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Env = []string{"PATH=/bin"}
+	config.Labels = map[string]string{"version": "1"}
+	config.Cmd = []string{"/bin/sh"}
+	if err := mutator.Set(context.Background(), config, meta, nil, ispec.History{}); err != nil {
+		t.Fatal(err)
+	}
+	modified := commitAndReopen(t, engine, mutator)
+
+	diff, err = Diff(context.Background(), added, modified)
+	if err != nil {
+		t.Fatalf("unexpected error computing diff: %+v", err)
+	}
+	expected = &ImageDiff{
+		Paths: []PathChange{
+			{Path: "etc/a", Type: ChangeModified},
+			{Path: "etc/b", Type: ChangeDeleted},
+		},
+		Config: []ConfigChange{
+			{Field: "cmd", Type: ChangeAdded, New: []string{"/bin/sh"}},
+			{Field: "env", Key: "PATH", Type: ChangeAdded, New: "/bin"},
+			{Field: "labels", Key: "version", Type: ChangeAdded, New: "1"},
+		},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("unexpected diff: expected %#v, got %#v", expected, diff)
+	}
+
+	// Diffing in the other direction reverses the changes.
+	diff, err = Diff(context.Background(), modified, added)
+	if err != nil {
+		t.Fatalf("unexpected error computing diff: %+v", err)
+	}
+	expected = &ImageDiff{
+		Paths: []PathChange{
+			{Path: "etc/a", Type: ChangeModified},
+			{Path: "etc/b", Type: ChangeAdded},
+		},
+		Config: []ConfigChange{
+			{Field: "cmd", Type: ChangeDeleted, Old: []string{"/bin/sh"}},
+			{Field: "env", Key: "PATH", Type: ChangeDeleted, Old: "/bin"},
+			{Field: "labels", Key: "version", Type: ChangeDeleted, Old: "1"},
+		},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("unexpected diff: expected %#v, got %#v", expected, diff)
+	}
+}
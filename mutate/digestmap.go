@@ -0,0 +1,97 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"io"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// DigestMap returns the digest of the contents of every regular file in the
+// root filesystem of the image, keyed by the path of the file (relative to
+// the root). The layers of the image are applied in order (with whiteouts
+// resolved as they would be when unpacking the image) but nothing is written
+// to disk, which makes it possible to find out what content an image contains
+// without extracting it. Hardlinks have the digest of the file they link to.
+// The digests are computed with digest.Canonical, regardless of the digest
+// algorithm of the image.
+func (m *Mutator) DigestMap(ctx context.Context) (map[string]digest.Digest, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, errors.Wrap(err, "getting cache failed")
+	}
+
+	layers := m.manifest.Layers
+	kept, err := m.mergedEntries(ctx, layers, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute merged entries")
+	}
+
+	digests := map[string]digest.Digest{}
+	hardlinks := map[string]string{}
+	for layerIdx, descriptor := range layers {
+		layer, err := m.openLayer(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open layer %s", descriptor.Digest)
+		}
+		err = forEachEntry(layer, func(idx int, hdr *tar.Header, tr *tar.Reader) error {
+			name := cleanEntryName(hdr.Name)
+			if kept[name] != (layerEntry{layer: layerIdx, index: idx}) {
+				return nil
+			}
+
+			switch hdr.Typeflag {
+			case tar.TypeReg, tar.TypeRegA:
+				digester := digest.Canonical.Digester()
+				if _, err := io.Copy(digester.Hash(), tr); err != nil {
+					return errors.Wrapf(err, "hash contents of %s", hdr.Name)
+				}
+				digests[name] = digester.Digest()
+			case tar.TypeLink:
+				hardlinks[name] = cleanEntryName(hdr.Linkname)
+			}
+			return nil
+		})
+		layer.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read layer %s", descriptor.Digest)
+		}
+	}
+
+	// mergedEntries has already made sure that each hardlink refers to the
+	// file that is present in the final root filesystem. The hardlinks are
+	// resolved in sorted order so that the same error is returned every time.
+	var names []string
+	for name := range hardlinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		target := hardlinks[name]
+		targetDigest, ok := digests[target]
+		if !ok {
+			return nil, errors.Errorf("hardlink %s refers to %s which is not a regular file", name, target)
+		}
+		digests[name] = targetDigest
+	}
+	return digests, nil
+}
@@ -0,0 +1,93 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestMutateDigestMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateDigestMap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range []struct {
+		hdr      tar.Header
+		contents string
+	}{
+		{tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "etc/a", Typeflag: tar.TypeReg, Mode: 0644}, "old a"},
+		{tar.Header{Name: "etc/b", Typeflag: tar.TypeReg, Mode: 0644}, "b"},
+		{tar.Header{Name: "removed/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "removed/c", Typeflag: tar.TypeReg, Mode: 0644}, "c"},
+		{tar.Header{Name: "target", Typeflag: tar.TypeReg, Mode: 0644}, "target"},
+		{tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "target"}, ""},
+		{tar.Header{Name: "symlink", Typeflag: tar.TypeSymlink, Linkname: "target"}, ""},
+	} {
+		entry.hdr.Size = int64(len(entry.contents))
+		if err := tw.WriteHeader(&entry.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	if err := mutator.Add(context.Background(), &buf, ispec.History{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Add(context.Background(), makeTestLayer(t, []testEntry{
+		{"etc/a", tar.TypeReg, "new a"},
+		{"etc/.wh.b", tar.TypeReg, ""},
+		{".wh.removed", tar.TypeReg, ""},
+		{"new", tar.TypeReg, "new"},
+	}), ispec.History{}); err != nil {
+		t.Fatal(err)
+	}
+
+	digests, err := mutator.DigestMap(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting digest map: %+v", err)
+	}
+	expected := map[string]digest.Digest{
+		"etc/a":  digest.FromString("new a"),
+		"target": digest.FromString("target"),
+		"link":   digest.FromString("target"),
+		"new":    digest.FromString("new"),
+	}
+	if !reflect.DeepEqual(digests, expected) {
+		t.Errorf("unexpected digest map: expected %v, got %v", expected, digests)
+	}
+}
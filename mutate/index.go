@@ -0,0 +1,128 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// samePlatform returns whether the two platforms describe the same
+// os/architecture/variant combination.
+func samePlatform(a, b *ispec.Platform) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.OS == b.OS && a.Architecture == b.Architecture && a.Variant == b.Variant
+}
+
+// AddToIndex adds the image manifest with the given descriptor to the image
+// index (manifest list) referenced by refname, associating it with the given
+// platform. If refname does not exist, a new image index is created. Any
+// existing entry in the index for the same os, architecture and variant is
+// replaced. The new index is written to the image and refname is updated to
+// point to it. The descriptor of the new index is returned.
+func AddToIndex(ctx context.Context, engine cas.Engine, refname string, manifest ispec.Descriptor, platform ispec.Platform) (ispec.Descriptor, error) {
+	engineExt := casext.NewEngine(engine)
+
+	if manifest.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Descriptor{}, errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: %s", manifest.MediaType)
+	}
+	if platform.OS == "" || platform.Architecture == "" {
+		return ispec.Descriptor{}, errors.Errorf("platform must have an os and architecture")
+	}
+
+	// Find the existing index for refname (if there is one). We can't use
+	// ResolveReference, as it resolves the index to its manifests.
+	topIndex, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get top-level index")
+	}
+	var existing []ispec.Descriptor
+	for _, descriptor := range topIndex.Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] == refname {
+			existing = append(existing, descriptor)
+		}
+	}
+
+	index := ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+	}
+	switch len(existing) {
+	case 0:
+		// Create a new index.
+	case 1:
+		if existing[0].MediaType != ispec.MediaTypeImageIndex {
+			return ispec.Descriptor{}, errors.Errorf("reference %s does not point to an image index: %s", refname, existing[0].MediaType)
+		}
+		blob, err := engineExt.FromDescriptor(ctx, existing[0])
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "get existing index")
+		}
+		defer blob.Close()
+		var ok bool
+		index, ok = blob.Data.(ispec.Index)
+		if !ok {
+			// Should _never_ be reached.
+			return ispec.Descriptor{}, errors.Errorf("[internal error] unknown index blob type: %s", blob.MediaType)
+		}
+	default:
+		// TODO: Handle this more nicely.
+		return ispec.Descriptor{}, errors.Errorf("reference is ambiguous: %s", refname)
+	}
+
+	// The reference name belongs to the index, not its children.
+	annotations := map[string]string{}
+	for key, value := range manifest.Annotations {
+		if key != ispec.AnnotationRefName {
+			annotations[key] = value
+		}
+	}
+	manifest.Annotations = nil
+	if len(annotations) > 0 {
+		manifest.Annotations = annotations
+	}
+	manifest.Platform = &platform
+	var manifests []ispec.Descriptor
+	for _, descriptor := range index.Manifests {
+		if !samePlatform(descriptor.Platform, manifest.Platform) {
+			manifests = append(manifests, descriptor)
+		}
+	}
+	index.Manifests = append(manifests, manifest)
+
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(cas.WithMediaType(ctx, ispec.MediaTypeImageIndex), index)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put index blob")
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}
+	if err := engineExt.UpdateReference(ctx, refname, descriptor); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "update reference")
+	}
+	return descriptor, nil
+}
@@ -0,0 +1,122 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestAddToIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestAddToIndex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	// Build two different single-architecture manifests.
+	var manifests []ispec.Descriptor
+	for _, contents := range []string{"amd64 layer", "arm64 layer"} {
+		if err := mutator.Add(context.Background(), bytes.NewBufferString(contents), ispec.History{}); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+		newDescriptor, err := mutator.Commit(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error committing changes: %+v", err)
+		}
+		manifests = append(manifests, newDescriptor.Descriptor())
+	}
+	platforms := []ispec.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	}
+
+	for idx := range manifests {
+		if _, err := AddToIndex(context.Background(), engine, "multi", manifests[idx], platforms[idx]); err != nil {
+			t.Fatalf("unexpected error adding manifest %d to index: %+v", idx, err)
+		}
+	}
+	// Adding the same platform again replaces the existing entry.
+	indexDescriptor, err := AddToIndex(context.Background(), engine, "multi", manifests[1], platforms[1])
+	if err != nil {
+		t.Fatalf("unexpected error re-adding manifest to index: %+v", err)
+	}
+	if indexDescriptor.MediaType != ispec.MediaTypeImageIndex {
+		t.Errorf("unexpected index media type: %s", indexDescriptor.MediaType)
+	}
+
+	// The reference must point to the index.
+	topIndex, err := engineExt.GetIndex(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []ispec.Descriptor
+	for _, descriptor := range topIndex.Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] == "multi" {
+			found = append(found, descriptor)
+		}
+	}
+	if len(found) != 1 || found[0].Digest != indexDescriptor.Digest || found[0].MediaType != ispec.MediaTypeImageIndex {
+		t.Fatalf("reference does not point to the new index: %v", found)
+	}
+
+	blob, err := engineExt.FromDescriptor(context.Background(), indexDescriptor)
+	if err != nil {
+		t.Fatalf("unexpected error getting index: %+v", err)
+	}
+	defer blob.Close()
+	index := blob.Data.(ispec.Index)
+	if len(index.Manifests) != 2 {
+		t.Fatalf("expected 2 entries in index, got %d: %v", len(index.Manifests), index.Manifests)
+	}
+	for idx, descriptor := range index.Manifests {
+		if descriptor.Digest != manifests[idx].Digest {
+			t.Errorf("entry %d: expected digest %s, got %s", idx, manifests[idx].Digest, descriptor.Digest)
+		}
+		if descriptor.Platform == nil || !samePlatform(descriptor.Platform, &platforms[idx]) {
+			t.Errorf("entry %d: expected platform %v, got %v", idx, platforms[idx], descriptor.Platform)
+		}
+	}
+
+	// Both manifests can be resolved through the reference.
+	paths, err := engineExt.ResolveReference(context.Background(), "multi")
+	if err != nil {
+		t.Fatalf("unexpected error resolving reference: %+v", err)
+	}
+	if len(paths) != 2 {
+		t.Errorf("expected reference to resolve to 2 manifests, got %d", len(paths))
+	}
+
+	// References to manifests cannot be turned into an index.
+	if err := engineExt.UpdateReference(context.Background(), "single", manifests[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddToIndex(context.Background(), engine, "single", manifests[1], platforms[1]); err == nil {
+		t.Errorf("expected an error adding to a reference to a manifest")
+	}
+}
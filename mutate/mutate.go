@@ -23,13 +23,15 @@
 package mutate
 
 import (
-	"compress/gzip"
 	"io"
 	"reflect"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/iohelpers"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -188,6 +190,24 @@ func (m *Mutator) Annotations(ctx context.Context) (map[string]string, error) {
 	return annotations, nil
 }
 
+// SetAnnotations replaces the set of annotations in the current manifest with
+// the given annotations. Unlike Set, the image configuration and history are
+// not modified.
+func (m *Mutator) SetAnnotations(ctx context.Context, annotations map[string]string) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	m.manifest.Annotations = map[string]string{}
+	for k, v := range annotations {
+		m.manifest.Annotations[k] = v
+	}
+	if len(m.manifest.Annotations) == 0 {
+		m.manifest.Annotations = nil
+	}
+	return nil
+}
+
 // Set sets the image configuration and metadata to the given values. The
 // provided ispec.History entry is appended to the image's history and should
 // correspond to what operations were made to the configuration.
@@ -215,97 +235,266 @@ func (m *Mutator) Set(ctx context.Context, config ispec.ImageConfig, meta Meta,
 	return nil
 }
 
+// AddEmptyHistory appends the given ispec.History entry to the image's history
+// without adding a layer, which is how a build step that didn't modify the
+// root filesystem (such as a configuration change) is recorded. The entry is
+// always marked as an empty layer, so that the number of non-empty history
+// entries still matches the number of layers in the image.
+func (m *Mutator) AddEmptyHistory(ctx context.Context, history ispec.History) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	history.EmptyLayer = true
+	m.config.History = append(m.config.History, history)
+	return nil
+}
+
+// ClearLayers removes all of the layers (and DiffIDs) from the image, as well
+// as its history (which describes the removed layers). The rest of the
+// configuration is kept as-is. This is intended for rebuilding an image from
+// scratch, with new layers being added afterwards.
+func (m *Mutator) ClearLayers(ctx context.Context) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	m.manifest.Layers = []ispec.Descriptor{}
+	m.config.RootFS.DiffIDs = []digest.Digest{}
+	m.config.History = nil
+	return nil
+}
+
+// AnnotationUncompressedSize is the layer descriptor annotation containing
+// the size (in bytes) of the uncompressed layer, which consumers can use for
+// progress reporting or to plan space usage before unpacking.
+const AnnotationUncompressedSize = "org.opensuse.umoci.uncompressed_size"
+
+// sizeLimitReader is an io.Reader which returns an error once more than max
+// bytes have been read from the underlying reader.
+type sizeLimitReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (lr *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.n += int64(n)
+	if lr.n > lr.max {
+		return n, errors.Errorf("compressed layer exceeds maximum size of %d bytes", lr.max)
+	}
+	return n, err
+}
+
 // add adds the given layer to the CAS, and mutates the configuration to
-// include the diffID. The returned string is the digest of the *compressed*
-// layer (which is compressed by us).
-func (m *Mutator) add(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+// include the diffID. The returned descriptor describes the *compressed*
+// layer (which is compressed by us using the given Compressor), and has an
+// AnnotationUncompressedSize annotation. If maxSize is positive, adding the
+// layer fails if the compressed layer is larger than maxSize bytes.
+func (m *Mutator) add(ctx context.Context, reader io.Reader, compressor Compressor, maxSize int64) (ispec.Descriptor, error) {
 	if err := m.cache(ctx); err != nil {
-		return "", -1, errors.Wrap(err, "getting cache failed")
+		return ispec.Descriptor{}, errors.Wrap(err, "getting cache failed")
 	}
 
-	diffidDigester := cas.BlobAlgorithm.Digester()
-	hashReader := io.TeeReader(reader, diffidDigester.Hash())
+	// The DiffID must use the same algorithm as the rest of the image.
+	diffidDigester := m.engine.DigestAlgorithm().Digester()
+	counter := &iohelpers.CountingWriter{W: diffidDigester.Hash()}
+	hashReader := io.TeeReader(reader, counter)
 
-	pipeReader, pipeWriter := io.Pipe()
-	defer pipeReader.Close()
+	compressed, err := compressor.Compress(hashReader)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "set up compressor")
+	}
+	defer compressed.Close()
 
-	gzw := gzip.NewWriter(pipeWriter)
-	defer gzw.Close()
-	go func() {
-		_, err := io.Copy(gzw, hashReader)
-		if err != nil {
-			pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
-			return
-		}
-		gzw.Close()
-		pipeWriter.Close()
-	}()
+	var blob io.Reader = compressed
+	if maxSize > 0 {
+		blob = &sizeLimitReader{r: compressed, max: maxSize}
+	}
 
-	layerDigest, layerSize, err := m.engine.PutBlob(ctx, pipeReader)
+	layerDigest, layerSize, err := m.engine.PutBlob(cas.WithMediaType(ctx, compressor.MediaType()), blob)
 	if err != nil {
-		return "", -1, errors.Wrap(err, "put layer blob")
+		return ispec.Descriptor{}, errors.Wrap(err, "put layer blob")
+	}
+
+	descriptor := ispec.Descriptor{
+		MediaType: compressor.MediaType(),
+		Digest:    layerDigest,
+		Size:      layerSize,
+		Annotations: map[string]string{
+			AnnotationUncompressedSize: strconv.FormatInt(counter.N, 10),
+		},
+	}
+
+	// Store any sidecar generated by the compressor.
+	if sidecar, ok := compressed.(sidecarReader); ok {
+		name, data := sidecar.Sidecar()
+		sidecarDigest, _, err := m.engine.PutBlobJSON(ctx, data)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "put %s sidecar blob", name)
+		}
+		descriptor.Annotations[casext.AnnotationSidecarPrefix+name] = sidecarDigest.String()
 	}
 
 	// Add DiffID to configuration.
 	layerDiffID := diffidDigester.Digest()
 	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs, layerDiffID)
 
-	return layerDigest, layerSize, nil
+	return descriptor, nil
 }
 
-// Add adds a layer to the image, by reading the layer changeset blob from the
-// provided reader. The stream must not be compressed, as it is used to
-// generate the DiffIDs for the image metatadata. The provided history entry is
-// appended to the image's history and should correspond to what operations
-// were made to the configuration.
-func (m *Mutator) Add(ctx context.Context, r io.Reader, history ispec.History) error {
+// AddOptions are the options used when adding a new layer to an image with
+// AddWithOptions.
+type AddOptions struct {
+	// Compressor is the compressor used to compress the layer. If nil,
+	// GzipCompressor is used.
+	Compressor Compressor
+
+	// NonDistributable indicates that the layer should use a
+	// non-distributable media type.
+	NonDistributable bool
+
+	// MediaType, if set, is used as the media type of the layer instead of
+	// the media type of the Compressor. This allows callers to emit a
+	// particular (possibly older) layer media type expected by a consumer. It
+	// must be a plausible media type for the compressed layer, and cannot be
+	// used with NonDistributable.
+	MediaType string
+
+	// OmitUncompressedSize stops the AnnotationUncompressedSize annotation
+	// from being added to the layer descriptor. By default it is added.
+	OmitUncompressedSize bool
+
+	// MaxCompressedSize is the maximum size (in bytes) of the compressed
+	// layer. If the compressed layer would be larger, the layer is not added
+	// and an error is returned. If zero, there is no limit.
+	MaxCompressedSize int64
+
+	// Sidecars are additional sidecar blobs describing the layer, keyed by
+	// the sidecar name. Each value is stored as a JSON blob and referenced
+	// from the layer descriptor (see casext.AnnotationSidecarPrefix). The
+	// names must not conflict with any sidecar generated by the Compressor.
+	Sidecars map[string]interface{}
+
+	// Annotations are additional annotations to set on the layer descriptor
+	// (such as a build ID or source commit). The keys must not conflict with
+	// any annotation that umoci sets on the layer descriptor itself.
+	Annotations map[string]string
+}
+
+// AddWithOptions adds a layer to the image, by reading the layer changeset
+// blob from the provided reader. The stream must not be compressed, as it is
+// used to generate the DiffIDs for the image metatadata. The provided history
+// entry is appended to the image's history and should correspond to what
+// operations were made to the configuration. If opt is nil, the default
+// options are used.
+func (m *Mutator) AddWithOptions(ctx context.Context, r io.Reader, history ispec.History, opt *AddOptions) error {
+	_, err := m.AddLayer(ctx, r, history, opt)
+	return err
+}
+
+// AddLayer is the same as AddWithOptions, except that it also returns the
+// descriptor of the new layer (as it will appear in the manifest).
+func (m *Mutator) AddLayer(ctx context.Context, r io.Reader, history ispec.History, opt *AddOptions) (ispec.Descriptor, error) {
+	var addOpt AddOptions
+	if opt != nil {
+		addOpt = *opt
+	}
+	if addOpt.Compressor == nil {
+		addOpt.Compressor = GzipCompressor
+	}
+
+	if addOpt.MediaType != "" {
+		if addOpt.NonDistributable {
+			return ispec.Descriptor{}, errors.Errorf("cannot use a custom media type with a non-distributable layer")
+		}
+		if err := validateLayerMediaType(addOpt.MediaType, addOpt.Compressor); err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "invalid layer media type")
+		}
+	}
+
 	if err := m.cache(ctx); err != nil {
-		return errors.Wrap(err, "getting cache failed")
+		return ispec.Descriptor{}, errors.Wrap(err, "getting cache failed")
 	}
 
-	digest, size, err := m.add(ctx, r)
+	descriptor, err := m.add(ctx, r, addOpt.Compressor, addOpt.MaxCompressedSize)
 	if err != nil {
-		return errors.Wrap(err, "add layer")
+		return ispec.Descriptor{}, errors.Wrap(err, "add layer")
+	}
+	if addOpt.MediaType != "" {
+		descriptor.MediaType = addOpt.MediaType
+	}
+	if addOpt.NonDistributable {
+		descriptor.MediaType, err = nonDistributableMediaType(descriptor.MediaType)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "add non-distributable layer")
+		}
+	}
+	if addOpt.OmitUncompressedSize {
+		delete(descriptor.Annotations, AnnotationUncompressedSize)
+		if len(descriptor.Annotations) == 0 {
+			descriptor.Annotations = nil
+		}
+	}
+
+	if len(addOpt.Sidecars) > 0 {
+		if descriptor.Annotations == nil {
+			descriptor.Annotations = map[string]string{}
+		}
+		var names []string
+		for name := range addOpt.Sidecars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			key := casext.AnnotationSidecarPrefix + name
+			if _, ok := descriptor.Annotations[key]; ok {
+				return ispec.Descriptor{}, errors.Errorf("sidecar %s conflicts with compressor sidecar", name)
+			}
+			sidecarDigest, _, err := m.engine.PutBlobJSON(ctx, addOpt.Sidecars[name])
+			if err != nil {
+				return ispec.Descriptor{}, errors.Wrapf(err, "put %s sidecar blob", name)
+			}
+			descriptor.Annotations[key] = sidecarDigest.String()
+		}
+	}
+
+	if len(addOpt.Annotations) > 0 {
+		if descriptor.Annotations == nil {
+			descriptor.Annotations = map[string]string{}
+		}
+		for key, value := range addOpt.Annotations {
+			if _, ok := descriptor.Annotations[key]; ok {
+				return ispec.Descriptor{}, errors.Errorf("annotation %s conflicts with generated layer annotation", key)
+			}
+			descriptor.Annotations[key] = value
+		}
 	}
 
 	// Append to layers.
-	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{
-		// TODO: Detect whether the layer is gzip'd or not...
-		MediaType: ispec.MediaTypeImageLayerGzip,
-		Digest:    digest,
-		Size:      size,
-	})
+	m.manifest.Layers = append(m.manifest.Layers, descriptor)
 
 	// Append history.
 	history.EmptyLayer = false
 	m.config.History = append(m.config.History, history)
-	return nil
+	return descriptor, nil
+}
+
+// Add adds a layer to the image, by reading the layer changeset blob from the
+// provided reader. The stream must not be compressed, as it is used to
+// generate the DiffIDs for the image metatadata. The provided history entry is
+// appended to the image's history and should correspond to what operations
+// were made to the configuration. The layer is compressed with
+// GzipCompressor.
+func (m *Mutator) Add(ctx context.Context, r io.Reader, history ispec.History) error {
+	return m.AddWithOptions(ctx, r, history, nil)
 }
 
 // AddNonDistributable is the same as Add, except it adds a non-distributable
 // layer to the image.
 func (m *Mutator) AddNonDistributable(ctx context.Context, r io.Reader, history ispec.History) error {
-	if err := m.cache(ctx); err != nil {
-		return errors.Wrap(err, "getting cache failed")
-	}
-
-	digest, size, err := m.add(ctx, r)
-	if err != nil {
-		return errors.Wrap(err, "add non-distributable layer")
-	}
-
-	// Append to layers.
-	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{
-		// TODO: Detect whether the layer is gzip'd or not...
-		MediaType: ispec.MediaTypeImageLayerNonDistributableGzip,
-		Digest:    digest,
-		Size:      size,
-	})
-
-	// Append history.
-	history.EmptyLayer = false
-	m.config.History = append(m.config.History, history)
-	return nil
+	return m.AddWithOptions(ctx, r, history, &AddOptions{NonDistributable: true})
 }
 
 // Commit writes all of the temporary changes made to the configuration,
@@ -318,7 +507,7 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 	}
 
 	// We first have to commit the configuration blob.
-	configDigest, configSize, err := m.engine.PutBlobJSON(ctx, m.config)
+	configDigest, configSize, err := m.engine.PutBlobJSON(cas.WithMediaType(ctx, m.manifest.Config.MediaType), m.config)
 	if err != nil {
 		return casext.DescriptorPath{}, errors.Wrap(err, "commit mutated config blob")
 	}
@@ -330,7 +519,7 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 	}
 
 	// Now commit the manifest.
-	manifestDigest, manifestSize, err := m.engine.PutBlobJSON(ctx, m.manifest)
+	manifestDigest, manifestSize, err := m.engine.PutBlobJSON(cas.WithMediaType(ctx, m.source.Descriptor().MediaType), m.manifest)
 	if err != nil {
 		return casext.DescriptorPath{}, errors.Wrap(err, "commit mutated manifest blob")
 	}
@@ -374,7 +563,7 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 		// Re-commit the blob.
 		// TODO: This won't handle foreign blobs correctly, we need to make it
 		//       possible to write a modified blob through the blob API.
-		blobDigest, blobSize, err := m.engine.PutBlobJSON(ctx, parentBlob.Data)
+		blobDigest, blobSize, err := m.engine.PutBlobJSON(cas.WithMediaType(ctx, parentBlob.MediaType), parentBlob.Data)
 		if err != nil {
 			return casext.DescriptorPath{}, errors.Wrapf(err, "put json parent-%d blob", idx)
 		}
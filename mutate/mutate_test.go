@@ -20,12 +20,15 @@ package mutate
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"testing"
 
 	"github.com/openSUSE/umoci/oci/cas"
@@ -564,3 +567,589 @@ func TestMutatePath(t *testing.T) {
 		}
 	}
 }
+
+func TestMutateAddSHA512(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddSHA512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "image")
+	if err := casdir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := casdir.OpenWithOptions(image, &casdir.Options{DigestAlgorithm: digest.SHA512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	// Create an empty image.
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Image{
+		RootFS: ispec.RootFS{Type: "layers"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("contents"), ispec.History{}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	// Every digest in the new image must use sha512.
+	if algo := newDescriptor.Descriptor().Digest.Algorithm(); algo != digest.SHA512 {
+		t.Errorf("manifest digest uses the wrong algorithm: %s", algo)
+	}
+	if algo := mutator.manifest.Config.Digest.Algorithm(); algo != digest.SHA512 {
+		t.Errorf("config digest uses the wrong algorithm: %s", algo)
+	}
+	if algo := mutator.manifest.Layers[0].Digest.Algorithm(); algo != digest.SHA512 {
+		t.Errorf("layer digest uses the wrong algorithm: %s", algo)
+	}
+	if diffID := mutator.config.RootFS.DiffIDs[0]; diffID != digest.SHA512.FromString("contents") {
+		t.Errorf("layer diffid is incorrect: %s", diffID)
+	}
+}
+
+// setupEmpty creates an image with no layers and no history inside the given
+// directory, and returns a Mutator for it. Unlike setup, the digests of the
+// image are not compared against any expected values.
+func setupEmpty(t *testing.T, dir string) (cas.Engine, *Mutator) {
+	image := filepath.Join(dir, "image")
+	if err := casdir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := casdir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Image{
+		RootFS: ispec.RootFS{Type: "layers"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine, mutator
+}
+
+func TestMutateAddEmptyHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddEmptyHistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	// Mix layers with config-only steps. The EmptyLayer values given by the
+	// caller must be ignored.
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("layer 1"), ispec.History{CreatedBy: "add 1", EmptyLayer: true}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if err := mutator.AddEmptyHistory(context.Background(), ispec.History{CreatedBy: "ENV a=b"}); err != nil {
+		t.Fatalf("unexpected error adding empty history: %+v", err)
+	}
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("layer 2"), ispec.History{CreatedBy: "add 2"}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if err := mutator.AddEmptyHistory(context.Background(), ispec.History{CreatedBy: "ENV c=d", EmptyLayer: false}); err != nil {
+		t.Fatalf("unexpected error adding empty history: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	// Re-read the committed image.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	history := mutator.config.History
+	if len(history) != 4 {
+		t.Fatalf("expected 4 history entries, got %d", len(history))
+	}
+	nonEmpty := 0
+	for idx, expected := range []struct {
+		createdBy  string
+		emptyLayer bool
+	}{
+		{"add 1", false},
+		{"ENV a=b", true},
+		{"add 2", false},
+		{"ENV c=d", true},
+	} {
+		if history[idx].CreatedBy != expected.createdBy {
+			t.Errorf("history[%d]: expected created_by %q, got %q", idx, expected.createdBy, history[idx].CreatedBy)
+		}
+		if history[idx].EmptyLayer != expected.emptyLayer {
+			t.Errorf("history[%d]: expected empty_layer=%v, got %v", idx, expected.emptyLayer, history[idx].EmptyLayer)
+		}
+		if !history[idx].EmptyLayer {
+			nonEmpty++
+		}
+	}
+	if nonEmpty != len(mutator.manifest.Layers) || nonEmpty != len(mutator.config.RootFS.DiffIDs) {
+		t.Errorf("non-empty history entries (%d) don't match layers (%d) and diffids (%d)", nonEmpty, len(mutator.manifest.Layers), len(mutator.config.RootFS.DiffIDs))
+	}
+}
+
+func TestMutateSetAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSetAnnotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	annotations := map[string]string{
+		ispec.AnnotationCreated: "2017-01-02T03:04:05Z",
+		"org.example.key":       "value",
+	}
+	if err := mutator.SetAnnotations(context.Background(), annotations); err != nil {
+		t.Fatalf("unexpected error setting annotations: %+v", err)
+	}
+	// Later modifications of the map must not affect the manifest.
+	annotations["org.example.key"] = "changed"
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := mutator.Annotations(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		ispec.AnnotationCreated: "2017-01-02T03:04:05Z",
+		"org.example.key":       "value",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected annotations %v, got %v", expected, got)
+	}
+	if len(mutator.config.History) != 0 {
+		t.Errorf("SetAnnotations should not add history, got %v", mutator.config.History)
+	}
+
+	// Clearing the annotations removes them from the manifest.
+	if err := mutator.SetAnnotations(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error clearing annotations: %+v", err)
+	}
+	if mutator.manifest.Annotations != nil {
+		t.Errorf("expected no annotations, got %v", mutator.manifest.Annotations)
+	}
+}
+
+func TestMutateAddUncompressedSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddUncompressedSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	layer := bytes.Repeat([]byte("some layer contents "), 1000)
+	if err := mutator.Add(context.Background(), bytes.NewReader(layer), ispec.History{CreatedBy: "add 1"}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if err := mutator.AddWithOptions(context.Background(), bytes.NewReader(layer), ispec.History{CreatedBy: "add 2"}, &AddOptions{OmitUncompressedSize: true}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	layers := mutator.manifest.Layers
+	if len(layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(layers))
+	}
+	if size := layers[0].Annotations[AnnotationUncompressedSize]; size != strconv.Itoa(len(layer)) {
+		t.Errorf("expected uncompressed size annotation %d, got %q", len(layer), size)
+	}
+	if layers[0].Size >= int64(len(layer)) {
+		t.Errorf("expected compressed size (%d) to be smaller than uncompressed size (%d)", layers[0].Size, len(layer))
+	}
+	if size, ok := layers[1].Annotations[AnnotationUncompressedSize]; ok {
+		t.Errorf("expected no uncompressed size annotation with OmitUncompressedSize, got %q", size)
+	}
+}
+
+func TestMutateAddMediaType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddMediaType")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	const dockerLayer = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	if err := mutator.AddWithOptions(context.Background(), bytes.NewBufferString("layer"), ispec.History{}, &AddOptions{MediaType: dockerLayer}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if mediaType := mutator.manifest.Layers[0].MediaType; mediaType != dockerLayer {
+		t.Errorf("expected layer media type %q, got %q", dockerLayer, mediaType)
+	}
+
+	for _, test := range []struct {
+		name string
+		opt  AddOptions
+	}{
+		{"Invalid", AddOptions{MediaType: "not a media type"}},
+		{"NotLayer", AddOptions{MediaType: ispec.MediaTypeImageConfig}},
+		{"Uncompressed", AddOptions{MediaType: ispec.MediaTypeImageLayer}},
+		{"Compressed", AddOptions{MediaType: ispec.MediaTypeImageLayerGzip, Compressor: NewNoopCompressor()}},
+		{"NonDistributable", AddOptions{MediaType: ispec.MediaTypeImageLayerGzip, NonDistributable: true}},
+		{"WrongCompression", AddOptions{MediaType: ispec.MediaTypeImageLayerGzip, Compressor: ZstdCompressor}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := mutator.AddWithOptions(context.Background(), bytes.NewBufferString("layer"), ispec.History{}, &test.opt); err == nil {
+				t.Errorf("expected an error with media type %q", test.opt.MediaType)
+			}
+		})
+	}
+	if len(mutator.manifest.Layers) != 1 {
+		t.Errorf("expected failed adds to not add layers, got %d layers", len(mutator.manifest.Layers))
+	}
+}
+
+func TestMutateAddUncompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddUncompressed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	layer := "uncompressed layer"
+	for _, test := range []struct {
+		opt       AddOptions
+		mediaType string
+	}{
+		{AddOptions{Compressor: NewNoopCompressor()}, ispec.MediaTypeImageLayer},
+		{AddOptions{Compressor: NewNoopCompressor(), NonDistributable: true}, ispec.MediaTypeImageLayerNonDistributable},
+	} {
+		if err := mutator.AddWithOptions(context.Background(), bytes.NewBufferString(layer), ispec.History{}, &test.opt); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+		descriptor := mutator.manifest.Layers[len(mutator.manifest.Layers)-1]
+		diffID := mutator.config.RootFS.DiffIDs[len(mutator.config.RootFS.DiffIDs)-1]
+		if descriptor.MediaType != test.mediaType {
+			t.Errorf("expected layer media type %q, got %q", test.mediaType, descriptor.MediaType)
+		}
+		// The blob of an uncompressed layer is the layer itself.
+		if descriptor.Digest != diffID {
+			t.Errorf("expected layer digest to match diffid %s, got %s", diffID, descriptor.Digest)
+		}
+		if descriptor.Size != int64(len(layer)) {
+			t.Errorf("expected layer size %d, got %d", len(layer), descriptor.Size)
+		}
+	}
+}
+
+func TestMutateAddSidecars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddSidecars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	sidecar := map[string][]string{"paths": {"a", "b"}}
+	if err := mutator.AddWithOptions(context.Background(), bytes.NewBufferString("layer"), ispec.History{}, &AddOptions{
+		OmitUncompressedSize: true,
+		Sidecars:             map[string]interface{}{"test": sidecar},
+	}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	value, ok := mutator.manifest.Layers[0].Annotations[casext.AnnotationSidecarPrefix+"test"]
+	if !ok {
+		t.Fatalf("expected sidecar annotation on layer: %v", mutator.manifest.Layers[0].Annotations)
+	}
+	blob, err := engine.GetBlob(context.Background(), digest.Digest(value))
+	if err != nil {
+		t.Fatalf("unexpected error getting sidecar blob: %+v", err)
+	}
+	defer blob.Close()
+	var got map[string][]string
+	if err := json.NewDecoder(blob).Decode(&got); err != nil {
+		t.Fatalf("unexpected error decoding sidecar blob: %+v", err)
+	}
+	if !reflect.DeepEqual(got, sidecar) {
+		t.Errorf("unexpected sidecar contents: expected %v, got %v", sidecar, got)
+	}
+
+	// Sidecars cannot conflict with the sidecar of the compressor.
+	if err := mutator.AddWithOptions(context.Background(), bytes.NewBufferString("layer"), ispec.History{}, &AddOptions{
+		Compressor: SeekableGzipCompressor,
+		Sidecars:   map[string]interface{}{SeekableIndexSidecar: sidecar},
+	}); err == nil {
+		t.Errorf("expected an error with a conflicting sidecar")
+	}
+}
+
+func TestMutateAddAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddAnnotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	annotations := map[string]string{
+		"org.example.build-id": "1234",
+		"org.example.commit":   "deadbeef",
+	}
+	if err := mutator.AddWithOptions(context.Background(), bytes.NewBufferString("layer"), ispec.History{}, &AddOptions{
+		Annotations: annotations,
+	}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	// The annotations must survive re-reading the manifest, alongside the
+	// annotations generated by umoci.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	got := mutator.manifest.Layers[0].Annotations
+	for key, value := range annotations {
+		if got[key] != value {
+			t.Errorf("expected annotation %s=%s on layer, got %v", key, value, got)
+		}
+	}
+	if _, ok := got[AnnotationUncompressedSize]; !ok {
+		t.Errorf("expected %s annotation on layer, got %v", AnnotationUncompressedSize, got)
+	}
+
+	// Annotations cannot conflict with the annotations generated by umoci.
+	if err := mutator.AddWithOptions(context.Background(), bytes.NewBufferString("layer"), ispec.History{}, &AddOptions{
+		Annotations: map[string]string{AnnotationUncompressedSize: "1"},
+	}); err == nil {
+		t.Errorf("expected an error with a conflicting annotation")
+	}
+	if len(mutator.manifest.Layers) != 1 {
+		t.Errorf("expected failed add to not modify the image")
+	}
+}
+
+func TestMutateAddMaxCompressedSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddMaxCompressedSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	// Random data doesn't compress, so the compressed layer is larger than
+	// the limit.
+	layer := make([]byte, 64*1024)
+	if _, err := rand.Read(layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.AddWithOptions(context.Background(), bytes.NewReader(layer), ispec.History{}, &AddOptions{MaxCompressedSize: 32 * 1024}); err == nil {
+		t.Errorf("expected an error adding a layer larger than MaxCompressedSize")
+	}
+	if len(mutator.manifest.Layers) != 0 || len(mutator.config.RootFS.DiffIDs) != 0 {
+		t.Errorf("expected failed add to not modify the image")
+	}
+
+	if err := mutator.AddWithOptions(context.Background(), bytes.NewReader(layer), ispec.History{}, &AddOptions{MaxCompressedSize: 128 * 1024}); err != nil {
+		t.Errorf("unexpected error adding a layer smaller than MaxCompressedSize: %+v", err)
+	}
+	if len(mutator.manifest.Layers) != 1 {
+		t.Errorf("expected 1 layer, got %d", len(mutator.manifest.Layers))
+	}
+}
+
+func TestMutateAddLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	descriptor, err := mutator.AddLayer(context.Background(), bytes.NewBufferString("contents"), ispec.History{}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if descriptor.MediaType != ispec.MediaTypeImageLayerGzip {
+		t.Errorf("unexpected layer media type: %s", descriptor.MediaType)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	// The returned descriptor must be the one in the new manifest.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	if len(mutator.manifest.Layers) != 1 {
+		t.Fatalf("expected 1 layer, got %d", len(mutator.manifest.Layers))
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers[0], descriptor) {
+		t.Errorf("returned descriptor %#v doesn't match manifest layer %#v", descriptor, mutator.manifest.Layers[0])
+	}
+
+	// And it must match the blob in the CAS.
+	blob, err := engine.GetBlob(context.Background(), descriptor.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting layer blob: %+v", err)
+	}
+	defer blob.Close()
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != descriptor.Size {
+		t.Errorf("layer blob size %d doesn't match descriptor size %d", len(data), descriptor.Size)
+	}
+	if digest.FromBytes(data) != descriptor.Digest {
+		t.Errorf("layer blob digest doesn't match descriptor digest %s", descriptor.Digest)
+	}
+}
+
+func TestMutateClearLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateClearLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	for _, layer := range []string{"layer 1", "layer 2"} {
+		if err := mutator.Add(context.Background(), bytes.NewBufferString(layer), ispec.History{CreatedBy: layer}); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.User = "some-user"
+	if err := mutator.Set(context.Background(), config, Meta{}, nil, ispec.History{CreatedBy: "config"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mutator.ClearLayers(context.Background()); err != nil {
+		t.Fatalf("unexpected error clearing layers: %+v", err)
+	}
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("new layer"), ispec.History{CreatedBy: "new layer"}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	// Re-read the committed image.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mutator.manifest.Layers) != 1 || len(mutator.config.RootFS.DiffIDs) != 1 {
+		t.Errorf("expected only 1 layer and diffid, got %d layers and %d diffids", len(mutator.manifest.Layers), len(mutator.config.RootFS.DiffIDs))
+	}
+	if len(mutator.config.History) != 1 || mutator.config.History[0].CreatedBy != "new layer" {
+		t.Errorf("expected only the new history entry, got %v", mutator.config.History)
+	}
+	if mutator.config.Config.User != "some-user" {
+		t.Errorf("configuration was not kept: expected user %q, got %q", "some-user", mutator.config.Config.User)
+	}
+}
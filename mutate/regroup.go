@@ -0,0 +1,368 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// validateGroups makes sure that groups is a list of inclusive [start, end]
+// layer ranges that covers all of the nLayers layers of an image, in order and
+// without any overlaps.
+func validateGroups(groups [][2]int, nLayers int) error {
+	next := 0
+	for idx, group := range groups {
+		if group[0] != next {
+			return errors.Errorf("group %d starts at layer %d: expected layer %d", idx, group[0], next)
+		}
+		if group[1] < group[0] {
+			return errors.Errorf("group %d is empty: [%d, %d]", idx, group[0], group[1])
+		}
+		if group[1] >= nLayers {
+			return errors.Errorf("group %d ends at layer %d: image only has %d layers", idx, group[1], nLayers)
+		}
+		next = group[1] + 1
+	}
+	if next != nLayers {
+		return errors.Errorf("groups only cover %d of %d layers", next, nLayers)
+	}
+	return nil
+}
+
+// Regroup changes the layer structure of the image by merging each of the
+// given groups of layers into a single layer. Each group is an inclusive
+// [start, end] range of layer indices, and the groups must cover every layer
+// of the image contiguously and in order. For instance, {{0, 3}, {4, 4}, {5,
+// 7}} merges layers 0-3 into one layer, keeps layer 4 and merges layers 5-7
+// into another layer.
+//
+// Single-layer groups are kept as-is. The merged layers are compressed with
+// the given Compressor (GzipCompressor if nil), and are marked as
+// non-distributable if any of the original layers were. The DiffIDs of the
+// image are updated, and the history entries of all but the last layer in
+// each merged group are marked as empty layers so that the history still
+// matches the layers of the image.
+func (m *Mutator) Regroup(ctx context.Context, groups [][2]int, compressor Compressor) error {
+	return m.regroup(ctx, groups, compressor, false)
+}
+
+// Squash flattens all of the layers of the image into a single layer, as
+// though Regroup had been called with a single group covering every layer.
+// Because the squashed layer is the base layer of the image, there is nothing
+// for its whiteouts to apply to and so they are not included. Images with
+// only one layer are left unmodified.
+func (m *Mutator) Squash(ctx context.Context, compressor Compressor) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if len(m.manifest.Layers) == 0 {
+		return errors.Errorf("cannot squash image with no layers")
+	}
+	return m.regroup(ctx, [][2]int{{0, len(m.manifest.Layers) - 1}}, compressor, true)
+}
+
+// regroup implements Regroup. If dropBaseWhiteouts is set, whiteouts are not
+// included in a merged group that starts at the base layer of the image.
+func (m *Mutator) regroup(ctx context.Context, groups [][2]int, compressor Compressor, dropBaseWhiteouts bool) (Err error) {
+	if compressor == nil {
+		compressor = GzipCompressor
+	}
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	oldLayers := m.manifest.Layers
+	oldDiffIDs := m.config.RootFS.DiffIDs
+	if len(oldLayers) != len(oldDiffIDs) {
+		return errors.Errorf("image has %d layers but %d diffids", len(oldLayers), len(oldDiffIDs))
+	}
+	if err := validateGroups(groups, len(oldLayers)); err != nil {
+		return errors.Wrap(err, "validate groups")
+	}
+
+	// Restore the original layers if anything goes wrong, so that the
+	// Mutator isn't left with a half-regrouped image.
+	m.manifest.Layers = []ispec.Descriptor{}
+	m.config.RootFS.DiffIDs = []digest.Digest{}
+	defer func() {
+		if Err != nil {
+			m.manifest.Layers = oldLayers
+			m.config.RootFS.DiffIDs = oldDiffIDs
+		}
+	}()
+
+	for _, group := range groups {
+		if group[0] == group[1] {
+			m.manifest.Layers = append(m.manifest.Layers, oldLayers[group[0]])
+			m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs, oldDiffIDs[group[0]])
+			continue
+		}
+
+		log.Infof("regroup: merging layers %d-%d", group[0], group[1])
+		layers := oldLayers[group[0] : group[1]+1]
+		descriptor, err := m.mergeLayers(ctx, layers, compressor, dropBaseWhiteouts && group[0] == 0)
+		if err != nil {
+			return errors.Wrapf(err, "merge layers %d-%d", group[0], group[1])
+		}
+		for _, layer := range layers {
+			if casext.IsNonDistributableMediaType(layer.MediaType) {
+				descriptor.MediaType, err = nonDistributableMediaType(descriptor.MediaType)
+				if err != nil {
+					return errors.Wrap(err, "mark merged layer as non-distributable")
+				}
+				break
+			}
+		}
+		m.manifest.Layers = append(m.manifest.Layers, descriptor)
+	}
+
+	// Fix up the history. Each non-empty history entry corresponds to a
+	// layer, so we only keep the entry of the last layer in each group.
+	var nonEmpty []int
+	for idx, history := range m.config.History {
+		if !history.EmptyLayer {
+			nonEmpty = append(nonEmpty, idx)
+		}
+	}
+	if len(nonEmpty) != len(oldLayers) {
+		log.Warnf("regroup: image history has %d non-empty entries but %d layers -- not updating history", len(nonEmpty), len(oldLayers))
+		return nil
+	}
+	history := make([]ispec.History, len(m.config.History))
+	copy(history, m.config.History)
+	for _, group := range groups {
+		for layer := group[0]; layer < group[1]; layer++ {
+			history[nonEmpty[layer]].EmptyLayer = true
+		}
+	}
+	m.config.History = history
+	return nil
+}
+
+// openLayer returns the uncompressed contents of the given layer.
+func (m *Mutator) openLayer(ctx context.Context, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	blob, err := m.engine.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "get layer blob")
+	}
+
+	reader, err := casext.DecompressLayer(blob, descriptor.MediaType)
+	if err != nil {
+		blob.Close()
+		return nil, errors.Wrap(err, "decompress layer")
+	}
+	return layerReader{ReadCloser: reader, blob: blob}, nil
+}
+
+// layerReader is the uncompressed reader of a layer blob, which closes both
+// the decompressor and the blob.
+type layerReader struct {
+	io.ReadCloser
+	blob io.Closer
+}
+
+func (lr layerReader) Close() error {
+	err := lr.ReadCloser.Close()
+	if err2 := lr.blob.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// layerEntry identifies an entry in one of the layers being merged.
+type layerEntry struct {
+	layer, index int
+}
+
+// hardlink is a hardlink entry in one of the layers being merged.
+type hardlink struct {
+	entry  layerEntry
+	target string
+}
+
+// cleanEntryName returns the normalised form of a tar entry name.
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// forEachEntry calls fn for every entry in the (uncompressed) layer.
+func forEachEntry(r io.Reader, fn func(idx int, hdr *tar.Header, tr *tar.Reader) error) error {
+	tr := tar.NewReader(r)
+	for idx := 0; ; idx++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		if err := fn(idx, hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// mergedEntries computes which entries of the given layers are visible when
+// the layers are applied in order, and thus need to be included in the merged
+// layer. Whiteouts are kept (they may apply to layers below the ones being
+// merged) unless dropWhiteouts is set, but the entries they hide are always
+// dropped. Whiteouts only apply to lower layers, as per the image-spec.
+func (m *Mutator) mergedEntries(ctx context.Context, layers []ispec.Descriptor, dropWhiteouts bool) (map[string]layerEntry, error) {
+	kept := map[string]layerEntry{}
+	seen := map[string]struct{}{}
+	hardlinks := map[string]hardlink{}
+
+	// removeLower removes all entries from lower layers which match the
+	// given predicate.
+	removeLower := func(layer int, match func(string) bool) {
+		for name, entry := range kept {
+			if entry.layer < layer && match(name) {
+				delete(kept, name)
+			}
+		}
+	}
+
+	for layerIdx, descriptor := range layers {
+		layerRaw, err := m.openLayer(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open layer %s", descriptor.Digest)
+		}
+		err = forEachEntry(layerRaw, func(idx int, hdr *tar.Header, tr *tar.Reader) error {
+			name := cleanEntryName(hdr.Name)
+			dir, file := path.Split(name)
+			entry := layerEntry{layer: layerIdx, index: idx}
+
+			switch {
+			case file == layer.WhiteoutOpaque:
+				// Everything inside the directory is hidden.
+				removeLower(layerIdx, func(other string) bool {
+					return dir == "" || strings.HasPrefix(other, dir)
+				})
+				if dropWhiteouts {
+					return nil
+				}
+			case strings.HasPrefix(file, layer.WhiteoutPrefix):
+				target := path.Join(dir, strings.TrimPrefix(file, layer.WhiteoutPrefix))
+				removeLower(layerIdx, func(other string) bool {
+					return other == target || strings.HasPrefix(other, target+"/")
+				})
+				if dropWhiteouts {
+					return nil
+				}
+			default:
+				// A non-directory hides the contents of any directory it
+				// replaces.
+				if hdr.Typeflag != tar.TypeDir {
+					removeLower(layerIdx, func(other string) bool {
+						return strings.HasPrefix(other, name+"/")
+					})
+				}
+				if hdr.Typeflag == tar.TypeLink {
+					hardlinks[name] = hardlink{entry: entry, target: cleanEntryName(hdr.Linkname)}
+				}
+				seen[name] = struct{}{}
+			}
+			kept[name] = entry
+			return nil
+		})
+		layerRaw.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read layer %s", descriptor.Digest)
+		}
+	}
+
+	// Make sure that we aren't going to produce a hardlink to a file that was
+	// removed or replaced in the merged layer. The hardlinks are checked in
+	// sorted order so that the same error is returned every time.
+	var names []string
+	for name := range hardlinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		link := hardlinks[name]
+		if entry, ok := kept[name]; !ok || entry != link.entry {
+			continue
+		}
+		if entry, ok := kept[link.target]; ok {
+			if entry.layer > link.entry.layer {
+				return nil, errors.Errorf("hardlink %s refers to %s which is replaced in a later layer", name, link.target)
+			}
+		} else if _, ok := seen[link.target]; ok {
+			return nil, errors.Errorf("hardlink %s refers to %s which is removed in a later layer", name, link.target)
+		}
+	}
+	return kept, nil
+}
+
+// mergeLayers generates a single layer equivalent to applying the given
+// layers in order, and adds it to the image (updating the DiffIDs). If
+// dropWhiteouts is set, whiteouts are not included in the merged layer.
+func (m *Mutator) mergeLayers(ctx context.Context, layers []ispec.Descriptor, compressor Compressor, dropWhiteouts bool) (ispec.Descriptor, error) {
+	kept, err := m.mergedEntries(ctx, layers, dropWhiteouts)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "compute merged entries")
+	}
+
+	reader, writer := io.Pipe()
+	go func() (Err error) {
+		defer func() {
+			writer.CloseWithError(errors.Wrap(Err, "generate merged layer"))
+		}()
+
+		tw := tar.NewWriter(writer)
+		for layerIdx, descriptor := range layers {
+			layerRaw, err := m.openLayer(ctx, descriptor)
+			if err != nil {
+				return errors.Wrapf(err, "open layer %s", descriptor.Digest)
+			}
+			err = forEachEntry(layerRaw, func(idx int, hdr *tar.Header, tr *tar.Reader) error {
+				if kept[cleanEntryName(hdr.Name)] != (layerEntry{layer: layerIdx, index: idx}) {
+					return nil
+				}
+				if err := tw.WriteHeader(hdr); err != nil {
+					return errors.Wrapf(err, "write header %s", hdr.Name)
+				}
+				if _, err := io.Copy(tw, tr); err != nil {
+					return errors.Wrapf(err, "copy contents of %s", hdr.Name)
+				}
+				return nil
+			})
+			layerRaw.Close()
+			if err != nil {
+				return errors.Wrapf(err, "copy layer %s", descriptor.Digest)
+			}
+		}
+		return tw.Close()
+	}()
+	defer reader.Close()
+
+	return m.add(ctx, reader, compressor, 0)
+}
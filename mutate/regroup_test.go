@@ -0,0 +1,382 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// testEntry is a simplified tar entry used to build and check test layers.
+type testEntry struct {
+	name     string
+	typ      byte
+	contents string
+}
+
+func makeTestLayer(t *testing.T, entries []testEntry) io.Reader {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typ,
+			Mode:     0644,
+			Size:     int64(len(entry.contents)),
+		}
+		if entry.typ == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, entry.contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func readTestLayer(t *testing.T, mutator *Mutator, descriptor ispec.Descriptor) []testEntry {
+	layer, err := mutator.openLayer(context.Background(), descriptor)
+	if err != nil {
+		t.Fatalf("unexpected error opening layer: %+v", err)
+	}
+	defer layer.Close()
+
+	entries := []testEntry{}
+	if err := forEachEntry(layer, func(idx int, hdr *tar.Header, tr *tar.Reader) error {
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, testEntry{name: hdr.Name, typ: hdr.Typeflag, contents: string(contents)})
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error reading layer: %+v", err)
+	}
+	return entries
+}
+
+func TestMutateRegroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRegroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	layers := [][]testEntry{
+		{
+			{"a", tar.TypeReg, "a0"},
+			{"d/", tar.TypeDir, ""},
+			{"d/x", tar.TypeReg, "x0"},
+			{"d/y", tar.TypeReg, "y0"},
+		},
+		{
+			{"a", tar.TypeReg, "a1"},
+			{"d/.wh.x", tar.TypeReg, ""},
+			{"b", tar.TypeReg, "b1"},
+		},
+		{
+			{".wh.b", tar.TypeReg, ""},
+			{"e/", tar.TypeDir, ""},
+			{"e/z", tar.TypeReg, "z2"},
+		},
+		{
+			{"e/.wh..wh..opq", tar.TypeReg, ""},
+			{"e/w", tar.TypeReg, "w3"},
+		},
+		{
+			{"f", tar.TypeReg, "f4"},
+		},
+	}
+	for idx, layer := range layers {
+		if err := mutator.Add(context.Background(), makeTestLayer(t, layer), ispec.History{CreatedBy: fmt.Sprintf("layer %d", idx)}); err != nil {
+			t.Fatalf("unexpected error adding layer %d: %+v", idx, err)
+		}
+	}
+	if err := mutator.AddEmptyHistory(context.Background(), ispec.History{CreatedBy: "config"}); err != nil {
+		t.Fatal(err)
+	}
+	keptLayer := mutator.manifest.Layers[4]
+	keptDiffID := mutator.config.RootFS.DiffIDs[4]
+
+	// Invalid groupings must fail without modifying the image.
+	for _, groups := range [][][2]int{
+		{},
+		{{0, 3}},
+		{{0, 2}, {2, 4}},
+		{{0, 1}, {3, 4}},
+		{{1, 4}},
+		{{0, 5}},
+		{{0, 1}, {2, 1}, {2, 4}},
+	} {
+		if err := mutator.Regroup(context.Background(), groups, nil); err == nil {
+			t.Errorf("expected error with invalid groups %v", groups)
+		}
+		if len(mutator.manifest.Layers) != 5 || len(mutator.config.RootFS.DiffIDs) != 5 {
+			t.Fatalf("image modified by failed Regroup with groups %v", groups)
+		}
+	}
+
+	if err := mutator.Regroup(context.Background(), [][2]int{{0, 1}, {2, 3}, {4, 4}}, nil); err != nil {
+		t.Fatalf("unexpected error regrouping: %+v", err)
+	}
+
+	if len(mutator.manifest.Layers) != 3 {
+		t.Fatalf("expected 3 layers after regroup, got %d", len(mutator.manifest.Layers))
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 3 {
+		t.Fatalf("expected 3 diffids after regroup, got %d", len(mutator.config.RootFS.DiffIDs))
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers[2], keptLayer) || mutator.config.RootFS.DiffIDs[2] != keptDiffID {
+		t.Errorf("single-layer group was modified by regroup")
+	}
+
+	expected := [][]testEntry{
+		{
+			{"d/", tar.TypeDir, ""},
+			{"d/y", tar.TypeReg, "y0"},
+			{"a", tar.TypeReg, "a1"},
+			{"d/.wh.x", tar.TypeReg, ""},
+			{"b", tar.TypeReg, "b1"},
+		},
+		{
+			{".wh.b", tar.TypeReg, ""},
+			{"e/", tar.TypeDir, ""},
+			{"e/.wh..wh..opq", tar.TypeReg, ""},
+			{"e/w", tar.TypeReg, "w3"},
+		},
+	}
+	for idx, entries := range expected {
+		descriptor := mutator.manifest.Layers[idx]
+		if descriptor.MediaType != ispec.MediaTypeImageLayerGzip {
+			t.Errorf("layer %d: unexpected media type %s", idx, descriptor.MediaType)
+		}
+		if got := readTestLayer(t, mutator, descriptor); !reflect.DeepEqual(got, entries) {
+			t.Errorf("layer %d: unexpected entries: expected %v got %v", idx, entries, got)
+		}
+
+		// Make sure the DiffID matches the uncompressed layer.
+		layer, err := mutator.openLayer(context.Background(), descriptor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digester := mutator.config.RootFS.DiffIDs[idx].Algorithm().Digester()
+		if _, err := io.Copy(digester.Hash(), layer); err != nil {
+			t.Fatal(err)
+		}
+		layer.Close()
+		if digester.Digest() != mutator.config.RootFS.DiffIDs[idx] {
+			t.Errorf("layer %d: diffid mismatch: expected %s got %s", idx, mutator.config.RootFS.DiffIDs[idx], digester.Digest())
+		}
+	}
+
+	var emptyLayers []bool
+	for _, history := range mutator.config.History {
+		emptyLayers = append(emptyLayers, history.EmptyLayer)
+	}
+	if expected := []bool{true, false, true, false, false, true}; !reflect.DeepEqual(emptyLayers, expected) {
+		t.Errorf("unexpected history empty_layer values: expected %v got %v", expected, emptyLayers)
+	}
+}
+
+func TestMutateRegroupHardlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRegroupHardlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "target", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "link", Typeflag: tar.TypeLink, Linkname: "target"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	if err := mutator.Add(context.Background(), &buf, ispec.History{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Add(context.Background(), makeTestLayer(t, []testEntry{{".wh.target", tar.TypeReg, ""}}), ispec.History{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Merging the layers would result in a dangling hardlink.
+	if err := mutator.Regroup(context.Background(), [][2]int{{0, 1}}, nil); err == nil {
+		t.Errorf("expected error when merging layers with a removed hardlink target")
+	}
+	if len(mutator.manifest.Layers) != 2 {
+		t.Errorf("image modified by failed Regroup")
+	}
+}
+
+func TestMutateRegroupNonDistributable(t *testing.T) {
+	for _, compressor := range []Compressor{GzipCompressor, ZstdCompressor} {
+		dir, err := ioutil.TempDir("", "umoci-TestMutateRegroupNonDistributable")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		engine, mutator := setupEmpty(t, dir)
+		defer engine.Close()
+
+		if err := mutator.Add(context.Background(), makeTestLayer(t, []testEntry{{"a", tar.TypeReg, "a0"}}), ispec.History{}); err != nil {
+			t.Fatal(err)
+		}
+		// Only one of the merged layers is non-distributable, and it uses a
+		// different compression to the merged layer.
+		if err := mutator.AddWithOptions(context.Background(), makeTestLayer(t, []testEntry{{"b", tar.TypeReg, "b1"}}), ispec.History{}, &AddOptions{
+			Compressor:       ZstdCompressor,
+			NonDistributable: true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if mediaType := mutator.manifest.Layers[1].MediaType; mediaType != casext.MediaTypeImageLayerNonDistributableZstd {
+			t.Fatalf("unexpected media type of non-distributable zstd layer: %s", mediaType)
+		}
+
+		if err := mutator.Regroup(context.Background(), [][2]int{{0, 1}}, compressor); err != nil {
+			t.Fatalf("unexpected error regrouping: %+v", err)
+		}
+		expected, err := nonDistributableMediaType(compressor.MediaType())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mediaType := mutator.manifest.Layers[0].MediaType; mediaType != expected {
+			t.Errorf("merged layer with non-distributable zstd layer: expected media type %s got %s", expected, mediaType)
+		}
+	}
+}
+
+func TestMutateSquash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSquash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	// Squashing an image without any layers is an error.
+	if err := mutator.Squash(context.Background(), nil); err == nil {
+		t.Errorf("expected error squashing image with no layers")
+	}
+
+	layers := [][]testEntry{
+		{
+			{"a", tar.TypeReg, "a0"},
+			{"d/", tar.TypeDir, ""},
+			{"d/x", tar.TypeReg, "x0"},
+			{"e/", tar.TypeDir, ""},
+			{"e/y", tar.TypeReg, "y0"},
+		},
+		{
+			{"d/.wh.x", tar.TypeReg, ""},
+			{"e/.wh..wh..opq", tar.TypeReg, ""},
+			{"e/z", tar.TypeReg, "z1"},
+		},
+		{
+			{"a", tar.TypeReg, "a2"},
+			{".wh.nonexistent", tar.TypeReg, ""},
+		},
+	}
+	for idx, layer := range layers {
+		if err := mutator.Add(context.Background(), makeTestLayer(t, layer), ispec.History{CreatedBy: fmt.Sprintf("layer %d", idx)}); err != nil {
+			t.Fatalf("unexpected error adding layer %d: %+v", idx, err)
+		}
+	}
+
+	if err := mutator.Squash(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error squashing: %+v", err)
+	}
+
+	if len(mutator.manifest.Layers) != 1 {
+		t.Fatalf("expected 1 layer after squash, got %d", len(mutator.manifest.Layers))
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 1 {
+		t.Fatalf("expected 1 diffid after squash, got %d", len(mutator.config.RootFS.DiffIDs))
+	}
+
+	// The removed files and the whiteouts must not be in the squashed layer.
+	descriptor := mutator.manifest.Layers[0]
+	expected := []testEntry{
+		{"d/", tar.TypeDir, ""},
+		{"e/", tar.TypeDir, ""},
+		{"e/z", tar.TypeReg, "z1"},
+		{"a", tar.TypeReg, "a2"},
+	}
+	if got := readTestLayer(t, mutator, descriptor); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected entries: expected %v got %v", expected, got)
+	}
+
+	layer, err := mutator.openLayer(context.Background(), descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digester := mutator.config.RootFS.DiffIDs[0].Algorithm().Digester()
+	if _, err := io.Copy(digester.Hash(), layer); err != nil {
+		t.Fatal(err)
+	}
+	layer.Close()
+	if digester.Digest() != mutator.config.RootFS.DiffIDs[0] {
+		t.Errorf("diffid mismatch: expected %s got %s", mutator.config.RootFS.DiffIDs[0], digester.Digest())
+	}
+
+	var emptyLayers []bool
+	for _, history := range mutator.config.History {
+		emptyLayers = append(emptyLayers, history.EmptyLayer)
+	}
+	if expected := []bool{true, true, false}; !reflect.DeepEqual(emptyLayers, expected) {
+		t.Errorf("unexpected history empty_layer values: expected %v got %v", expected, emptyLayers)
+	}
+
+	// Squashing a single-layer image is a no-op.
+	if err := mutator.Squash(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error squashing single layer: %+v", err)
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers, []ispec.Descriptor{descriptor}) {
+		t.Errorf("single-layer image was modified by squash")
+	}
+}
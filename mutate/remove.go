@@ -0,0 +1,229 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// layerProblems replays the given layers in order and returns every entry
+// which is inconsistent with the tree produced by the layers below it: a
+// whiteout of a path that doesn't exist, an entry whose parent is not a
+// directory, or a hardlink to a path which isn't a file. The entries are keyed
+// by the index of their layer in layerIdxs, so that the layers of different
+// lists can be compared.
+func (m *Mutator) layerProblems(ctx context.Context, layers []ispec.Descriptor, layerIdxs []int) (map[layerEntry]string, error) {
+	problems := map[layerEntry]string{}
+	tree := map[string]byte{}
+
+	// children maps each path to the paths directly below it, so that a
+	// subtree can be removed without scanning the whole tree. Every ancestor
+	// of a path in the tree is linked to its parent, even if the ancestor
+	// itself is missing from the tree.
+	children := map[string]map[string]struct{}{}
+	parentOf := func(name string) string {
+		if dir := path.Dir(name); dir != "." {
+			return dir
+		}
+		return ""
+	}
+
+	// addTree adds the given path to the tree.
+	addTree := func(name string, typ byte) {
+		tree[name] = typ
+		for child := name; child != ""; {
+			parent := parentOf(child)
+			siblings, ok := children[parent]
+			if !ok {
+				siblings = map[string]struct{}{}
+				children[parent] = siblings
+			}
+			if _, ok := siblings[child]; ok {
+				break
+			}
+			siblings[child] = struct{}{}
+			child = parent
+		}
+	}
+
+	// removeChildren removes everything below the given path from the tree,
+	// and removeTree removes the given path (and anything below it).
+	var removeChildren, removeTree func(name string)
+	removeChildren = func(name string) {
+		for child := range children[name] {
+			removeTree(child)
+		}
+		delete(children, name)
+	}
+	removeTree = func(name string) {
+		removeChildren(name)
+		delete(tree, name)
+		delete(children[parentOf(name)], name)
+	}
+
+	for idx, descriptor := range layers {
+		layerRaw, err := m.openLayer(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open layer %s", descriptor.Digest)
+		}
+		err = forEachEntry(layerRaw, func(entryIdx int, hdr *tar.Header, tr *tar.Reader) error {
+			entry := layerEntry{layer: layerIdxs[idx], index: entryIdx}
+			name := cleanEntryName(hdr.Name)
+			dir, file := path.Split(name)
+			dir = strings.TrimSuffix(dir, "/")
+
+			if dir != "" {
+				if typ, ok := tree[dir]; !ok {
+					problems[entry] = "parent directory of " + name + " does not exist"
+				} else if typ != tar.TypeDir {
+					problems[entry] = "parent of " + name + " is not a directory"
+				}
+			}
+
+			switch {
+			case file == layer.WhiteoutOpaque:
+				removeChildren(dir)
+			case strings.HasPrefix(file, layer.WhiteoutPrefix):
+				target := path.Join(dir, strings.TrimPrefix(file, layer.WhiteoutPrefix))
+				if _, ok := tree[target]; !ok {
+					problems[entry] = "whiteout of " + target + " which does not exist"
+				}
+				removeTree(target)
+			default:
+				if hdr.Typeflag == tar.TypeLink {
+					target := cleanEntryName(hdr.Linkname)
+					if typ, ok := tree[target]; !ok {
+						problems[entry] = "hardlink " + name + " refers to " + target + " which does not exist"
+					} else if typ == tar.TypeDir {
+						problems[entry] = "hardlink " + name + " refers to directory " + target
+					}
+				}
+				if hdr.Typeflag != tar.TypeDir {
+					removeTree(name)
+				}
+				addTree(name, hdr.Typeflag)
+			}
+			return nil
+		})
+		layerRaw.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read layer %s", descriptor.Digest)
+		}
+	}
+	return problems, nil
+}
+
+// RemoveLayer removes the layer with the given index (and its DiffID) from the
+// image, along with the history entry describing that layer. The remaining
+// layers are replayed to make sure that removing the layer doesn't leave the
+// image inconsistent -- if any later layer contains a whiteout of a path that
+// only existed due to the removed layer, or an entry that depends on a
+// directory or hardlink target created by the removed layer, an error is
+// returned and the image is not modified. Any such problems that were already
+// present in the image are ignored.
+//
+// Note that the removed layer blob is not deleted from the image store until
+// it is garbage collected.
+func (m *Mutator) RemoveLayer(ctx context.Context, index int) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	oldLayers := m.manifest.Layers
+	oldDiffIDs := m.config.RootFS.DiffIDs
+	if len(oldLayers) != len(oldDiffIDs) {
+		return errors.Errorf("image has %d layers but %d diffids", len(oldLayers), len(oldDiffIDs))
+	}
+	if index < 0 || index >= len(oldLayers) {
+		return errors.Errorf("layer %d out of range: image has %d layers", index, len(oldLayers))
+	}
+
+	var oldIdxs, newIdxs []int
+	var newLayers []ispec.Descriptor
+	var newDiffIDs []digest.Digest
+	for idx := range oldLayers {
+		oldIdxs = append(oldIdxs, idx)
+		if idx != index {
+			newIdxs = append(newIdxs, idx)
+			newLayers = append(newLayers, oldLayers[idx])
+			newDiffIDs = append(newDiffIDs, oldDiffIDs[idx])
+		}
+	}
+
+	// Only the problems introduced by removing the layer are errors.
+	oldProblems, err := m.layerProblems(ctx, oldLayers, oldIdxs)
+	if err != nil {
+		return errors.Wrap(err, "check original layers")
+	}
+	newProblems, err := m.layerProblems(ctx, newLayers, newIdxs)
+	if err != nil {
+		return errors.Wrap(err, "check remaining layers")
+	}
+	var problems []layerEntry
+	for entry := range newProblems {
+		if _, ok := oldProblems[entry]; !ok {
+			problems = append(problems, entry)
+		}
+	}
+	if len(problems) > 0 {
+		// Return the same error every time.
+		sort.Slice(problems, func(i, j int) bool {
+			if problems[i].layer != problems[j].layer {
+				return problems[i].layer < problems[j].layer
+			}
+			return problems[i].index < problems[j].index
+		})
+		entry := problems[0]
+		return errors.Errorf("removing layer %d would leave layer %d inconsistent: %s", index, entry.layer, newProblems[entry])
+	}
+
+	if newLayers == nil {
+		newLayers = []ispec.Descriptor{}
+		newDiffIDs = []digest.Digest{}
+	}
+	m.manifest.Layers = newLayers
+	m.config.RootFS.DiffIDs = newDiffIDs
+
+	// Drop the history entry of the removed layer. Each non-empty history
+	// entry corresponds to a layer.
+	var nonEmpty []int
+	for idx, history := range m.config.History {
+		if !history.EmptyLayer {
+			nonEmpty = append(nonEmpty, idx)
+		}
+	}
+	if len(nonEmpty) != len(oldLayers) {
+		log.Warnf("remove layer: image history has %d non-empty entries but %d layers -- not updating history", len(nonEmpty), len(oldLayers))
+		return nil
+	}
+	var history []ispec.History
+	history = append(history, m.config.History[:nonEmpty[index]]...)
+	history = append(history, m.config.History[nonEmpty[index]+1:]...)
+	m.config.History = history
+	return nil
+}
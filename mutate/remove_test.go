@@ -0,0 +1,173 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestMutateRemoveLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRemoveLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	layers := [][]testEntry{
+		{
+			{"a", tar.TypeReg, "a0"},
+			{"d/", tar.TypeDir, ""},
+			{"d/x", tar.TypeReg, "x0"},
+		},
+		{
+			{"secret", tar.TypeReg, "hunter2"},
+		},
+		{
+			{"n/", tar.TypeDir, ""},
+			{"n/y", tar.TypeReg, "y2"},
+		},
+		{
+			{"n/z", tar.TypeReg, "z3"},
+			{".wh.a", tar.TypeReg, ""},
+			// Already orphaned, so it doesn't stop layers being removed.
+			{".wh.nonexistent", tar.TypeReg, ""},
+		},
+	}
+	for idx, layer := range layers {
+		if err := mutator.Add(context.Background(), makeTestLayer(t, layer), ispec.History{CreatedBy: fmt.Sprintf("layer %d", idx)}); err != nil {
+			t.Fatalf("unexpected error adding layer %d: %+v", idx, err)
+		}
+	}
+	if err := mutator.AddEmptyHistory(context.Background(), ispec.History{CreatedBy: "config"}); err != nil {
+		t.Fatal(err)
+	}
+	oldLayers := mutator.manifest.Layers
+	oldDiffIDs := mutator.config.RootFS.DiffIDs
+
+	// Invalid removals must fail without modifying the image. Layer 0
+	// contains the whiteout target of layer 3, and layer 2 contains the
+	// parent directory of an entry in layer 3.
+	for _, index := range []int{-1, 4, 0, 2} {
+		if err := mutator.RemoveLayer(context.Background(), index); err == nil {
+			t.Errorf("expected error removing layer %d", index)
+		}
+		if !reflect.DeepEqual(mutator.manifest.Layers, oldLayers) || !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, oldDiffIDs) {
+			t.Fatalf("image modified by failed RemoveLayer(%d)", index)
+		}
+	}
+
+	if err := mutator.RemoveLayer(context.Background(), 1); err != nil {
+		t.Fatalf("unexpected error removing layer: %+v", err)
+	}
+
+	if len(mutator.manifest.Layers) != len(oldLayers)-1 {
+		t.Errorf("expected %d layers after removal, got %d", len(oldLayers)-1, len(mutator.manifest.Layers))
+	}
+	if len(mutator.config.RootFS.DiffIDs) != len(oldDiffIDs)-1 {
+		t.Errorf("expected %d diffids after removal, got %d", len(oldDiffIDs)-1, len(mutator.config.RootFS.DiffIDs))
+	}
+	expectedLayers := []ispec.Descriptor{oldLayers[0], oldLayers[2], oldLayers[3]}
+	if !reflect.DeepEqual(mutator.manifest.Layers, expectedLayers) {
+		t.Errorf("unexpected layers after removal: expected %v got %v", expectedLayers, mutator.manifest.Layers)
+	}
+	expectedDiffIDs := []digest.Digest{oldDiffIDs[0], oldDiffIDs[2], oldDiffIDs[3]}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, expectedDiffIDs) {
+		t.Errorf("unexpected diffids after removal: expected %v got %v", expectedDiffIDs, mutator.config.RootFS.DiffIDs)
+	}
+
+	var createdBy []string
+	for _, history := range mutator.config.History {
+		createdBy = append(createdBy, history.CreatedBy)
+	}
+	if expected := []string{"layer 0", "layer 2", "layer 3", "config"}; !reflect.DeepEqual(createdBy, expected) {
+		t.Errorf("unexpected history after removal: expected %v got %v", expected, createdBy)
+	}
+
+	digests, err := mutator.DigestMap(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting digest map: %+v", err)
+	}
+	if _, ok := digests["secret"]; ok {
+		t.Errorf("removed file still present in image")
+	}
+}
+
+func TestMutateLayerProblems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateLayerProblems")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	layers := [][]testEntry{
+		{
+			{"d/", tar.TypeDir, ""},
+			{"d/x", tar.TypeReg, "x0"},
+			{"d/sub/", tar.TypeDir, ""},
+			{"d/sub/y", tar.TypeReg, "y0"},
+			{"e/", tar.TypeDir, ""},
+			{"e/z", tar.TypeReg, "z0"},
+		},
+		{
+			// Replacing a directory removes everything below it, and an
+			// opaque whiteout removes everything below its directory.
+			{"d", tar.TypeReg, "d1"},
+			{"e/.wh..wh..opq", tar.TypeReg, ""},
+		},
+		{
+			{"e/w", tar.TypeReg, "w2"},
+			{"e/.wh.z", tar.TypeReg, ""},
+			{"d/sub/y", tar.TypeReg, "y2"},
+			{"e/.wh.w", tar.TypeReg, ""},
+		},
+	}
+	for idx, layer := range layers {
+		if err := mutator.Add(context.Background(), makeTestLayer(t, layer), ispec.History{CreatedBy: fmt.Sprintf("layer %d", idx)}); err != nil {
+			t.Fatalf("unexpected error adding layer %d: %+v", idx, err)
+		}
+	}
+
+	problems, err := mutator.layerProblems(context.Background(), mutator.manifest.Layers, []int{0, 1, 2})
+	if err != nil {
+		t.Fatalf("unexpected error checking layers: %+v", err)
+	}
+	var got []layerEntry
+	for entry := range problems {
+		got = append(got, entry)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].index < got[j].index })
+	if expected := []layerEntry{{layer: 2, index: 1}, {layer: 2, index: 2}}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected problems: expected %v got %v (%v)", expected, got, problems)
+	}
+}
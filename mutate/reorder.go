@@ -0,0 +1,153 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// rootfsDigests returns a digest of the header and contents of every entry in
+// the root filesystem produced by applying the given layers in order. Two
+// sets of layers produce the same root filesystem if (and only if) they have
+// the same digests.
+func (m *Mutator) rootfsDigests(ctx context.Context, layers []ispec.Descriptor) (map[string]digest.Digest, error) {
+	kept, err := m.mergedEntries(ctx, layers, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute merged entries")
+	}
+
+	digests := map[string]digest.Digest{}
+	for layerIdx, descriptor := range layers {
+		layer, err := m.openLayer(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open layer %s", descriptor.Digest)
+		}
+		err = forEachEntry(layer, func(idx int, hdr *tar.Header, tr *tar.Reader) error {
+			name := cleanEntryName(hdr.Name)
+			if kept[name] != (layerEntry{layer: layerIdx, index: idx}) {
+				return nil
+			}
+
+			// The name is normalised so that equivalent spellings of the
+			// same path aren't treated as different.
+			hdrCopy := *hdr
+			hdrCopy.Name = name
+			digester := digest.Canonical.Digester()
+			if err := json.NewEncoder(digester.Hash()).Encode(hdrCopy); err != nil {
+				return errors.Wrapf(err, "hash header of %s", hdr.Name)
+			}
+			if _, err := io.Copy(digester.Hash(), tr); err != nil {
+				return errors.Wrapf(err, "hash contents of %s", hdr.Name)
+			}
+			digests[name] = digester.Digest()
+			return nil
+		})
+		layer.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read layer %s", descriptor.Digest)
+		}
+	}
+	return digests, nil
+}
+
+// ReorderLayers changes the order of the layers of the image, such that the
+// new layer i is the original layer newOrder[i]. Because layers are applied
+// in order, this is only possible if the root filesystem of the image is left
+// unchanged by the reordering (for instance, if the layers being reordered
+// modify different paths) -- otherwise an error is returned and the image is
+// not modified. The DiffIDs and history entries of the layers are reordered
+// along with the layers.
+func (m *Mutator) ReorderLayers(ctx context.Context, newOrder []int) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	oldLayers := m.manifest.Layers
+	oldDiffIDs := m.config.RootFS.DiffIDs
+	if len(oldLayers) != len(oldDiffIDs) {
+		return errors.Errorf("image has %d layers but %d diffids", len(oldLayers), len(oldDiffIDs))
+	}
+	if len(newOrder) != len(oldLayers) {
+		return errors.Errorf("new order has %d layers: image has %d layers", len(newOrder), len(oldLayers))
+	}
+	used := make([]bool, len(oldLayers))
+	newLayers := make([]ispec.Descriptor, len(oldLayers))
+	newDiffIDs := make([]digest.Digest, len(oldDiffIDs))
+	for idx, oldIdx := range newOrder {
+		if oldIdx < 0 || oldIdx >= len(oldLayers) {
+			return errors.Errorf("layer %d out of range: image has %d layers", oldIdx, len(oldLayers))
+		}
+		if used[oldIdx] {
+			return errors.Errorf("layer %d appears more than once in new order", oldIdx)
+		}
+		used[oldIdx] = true
+		newLayers[idx] = oldLayers[oldIdx]
+		newDiffIDs[idx] = oldDiffIDs[oldIdx]
+	}
+
+	oldRootfs, err := m.rootfsDigests(ctx, oldLayers)
+	if err != nil {
+		return errors.Wrap(err, "compute original rootfs")
+	}
+	newRootfs, err := m.rootfsDigests(ctx, newLayers)
+	if err != nil {
+		return errors.Wrap(err, "compute reordered rootfs")
+	}
+	for name, oldDigest := range oldRootfs {
+		if newDigest, ok := newRootfs[name]; !ok || newDigest != oldDigest {
+			return errors.Errorf("reordering layers would change rootfs: %s differs", name)
+		}
+	}
+	for name := range newRootfs {
+		if _, ok := oldRootfs[name]; !ok {
+			return errors.Errorf("reordering layers would change rootfs: %s differs", name)
+		}
+	}
+
+	m.manifest.Layers = newLayers
+	m.config.RootFS.DiffIDs = newDiffIDs
+
+	// Reorder the history. Each non-empty history entry corresponds to a
+	// layer, so we permute the non-empty entries and leave the empty ones
+	// where they are.
+	var nonEmpty []int
+	for idx, history := range m.config.History {
+		if !history.EmptyLayer {
+			nonEmpty = append(nonEmpty, idx)
+		}
+	}
+	if len(nonEmpty) != len(oldLayers) {
+		log.Warnf("reorder layers: image history has %d non-empty entries but %d layers -- not updating history", len(nonEmpty), len(oldLayers))
+		return nil
+	}
+	history := make([]ispec.History, len(m.config.History))
+	copy(history, m.config.History)
+	for idx, oldIdx := range newOrder {
+		history[nonEmpty[idx]] = m.config.History[nonEmpty[oldIdx]]
+	}
+	m.config.History = history
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// flattenTestLayers returns the entries of the root filesystem of the image,
+// sorted by name.
+func flattenTestLayers(t *testing.T, mutator *Mutator) []testEntry {
+	layers := mutator.manifest.Layers
+	kept, err := mutator.mergedEntries(context.Background(), layers, true)
+	if err != nil {
+		t.Fatalf("unexpected error merging layers: %+v", err)
+	}
+
+	entries := []testEntry{}
+	for layerIdx, descriptor := range layers {
+		for idx, entry := range readTestLayer(t, mutator, descriptor) {
+			if kept[cleanEntryName(entry.name)] == (layerEntry{layer: layerIdx, index: idx}) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries
+}
+
+func TestMutateReorderLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateReorderLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	layers := [][]testEntry{
+		{
+			{"a", tar.TypeReg, "a0"},
+			{"d/", tar.TypeDir, ""},
+		},
+		{
+			{"d/x", tar.TypeReg, "x1"},
+		},
+		{
+			{"d/y", tar.TypeReg, "y2"},
+			{"b", tar.TypeReg, "b2"},
+		},
+		{
+			{"b", tar.TypeReg, "b3"},
+			{".wh.a", tar.TypeReg, ""},
+		},
+	}
+	for idx, layer := range layers {
+		if err := mutator.Add(context.Background(), makeTestLayer(t, layer), ispec.History{CreatedBy: fmt.Sprintf("layer %d", idx)}); err != nil {
+			t.Fatalf("unexpected error adding layer %d: %+v", idx, err)
+		}
+	}
+	if err := mutator.AddEmptyHistory(context.Background(), ispec.History{CreatedBy: "config"}); err != nil {
+		t.Fatal(err)
+	}
+	oldLayers := mutator.manifest.Layers
+	oldDiffIDs := mutator.config.RootFS.DiffIDs
+	oldRootfs := flattenTestLayers(t, mutator)
+
+	// Invalid orders, and orders which would change the rootfs (layers 2 and
+	// 3 both modify b, and layer 3 removes a), must fail without modifying
+	// the image.
+	for _, order := range [][]int{
+		{0, 1, 2},
+		{0, 1, 2, 4},
+		{0, 1, 1, 3},
+		{0, 1, 3, 2},
+		{3, 0, 1, 2},
+	} {
+		if err := mutator.ReorderLayers(context.Background(), order); err == nil {
+			t.Errorf("expected error reordering layers to %v", order)
+		}
+		if !reflect.DeepEqual(mutator.manifest.Layers, oldLayers) || !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, oldDiffIDs) {
+			t.Fatalf("image modified by failed ReorderLayers(%v)", order)
+		}
+	}
+
+	// Layers 1 and 2 touch disjoint paths.
+	if err := mutator.ReorderLayers(context.Background(), []int{0, 2, 1, 3}); err != nil {
+		t.Fatalf("unexpected error reordering layers: %+v", err)
+	}
+
+	expectedLayers := []ispec.Descriptor{oldLayers[0], oldLayers[2], oldLayers[1], oldLayers[3]}
+	if !reflect.DeepEqual(mutator.manifest.Layers, expectedLayers) {
+		t.Errorf("unexpected layers after reorder: expected %v got %v", expectedLayers, mutator.manifest.Layers)
+	}
+	expectedDiffIDs := []digest.Digest{oldDiffIDs[0], oldDiffIDs[2], oldDiffIDs[1], oldDiffIDs[3]}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, expectedDiffIDs) {
+		t.Errorf("unexpected diffids after reorder: expected %v got %v", expectedDiffIDs, mutator.config.RootFS.DiffIDs)
+	}
+
+	var createdBy []string
+	for _, history := range mutator.config.History {
+		createdBy = append(createdBy, history.CreatedBy)
+	}
+	if expected := []string{"layer 0", "layer 2", "layer 1", "layer 3", "config"}; !reflect.DeepEqual(createdBy, expected) {
+		t.Errorf("unexpected history after reorder: expected %v got %v", expected, createdBy)
+	}
+
+	if newRootfs := flattenTestLayers(t, mutator); !reflect.DeepEqual(newRootfs, oldRootfs) {
+		t.Errorf("rootfs changed by reorder: expected %v got %v", oldRootfs, newRootfs)
+	}
+}
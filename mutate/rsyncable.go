@@ -0,0 +1,170 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// These constants define the rolling hash used to find the content-defined
+// boundaries of an rsyncable gzip stream. They are the same as those used by
+// pigz, so that the hash only depends on the last rsyncBits bytes of input and
+// boundaries occur on average every 1<<rsyncBits bytes.
+const (
+	rsyncBits = 12
+	rsyncMask = (1 << rsyncBits) - 1
+	rsyncHit  = rsyncMask >> 1
+)
+
+// rsyncableGzipCompressor is a Compressor which produces "rsyncable" gzip
+// streams.
+type rsyncableGzipCompressor struct {
+	// level is the gzip compression level.
+	level int
+}
+
+// RsyncableGzipCompressor is a Compressor which compresses layers using gzip,
+// but resets the compression state at content-defined boundaries of the
+// uncompressed stream (equivalent to the --rsyncable option of gzip and
+// pigz). Because the compressed form of each chunk only depends on the
+// contents of that chunk, a small change to a layer only changes the
+// compressed output around the change, which allows for much better
+// deduplication of similar layers (at the cost of slightly worse compression).
+// Unlike GzipCompressor, the layer is not compressed in parallel.
+var RsyncableGzipCompressor Compressor = rsyncableGzipCompressor{level: gzip.DefaultCompression}
+
+func (rgz rsyncableGzipCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		// The gzip header is written when the writer is created, so this has
+		// to be done after the reader has been returned.
+		rw, err := newRsyncableWriter(pipeWriter, rgz.level)
+		if err != nil {
+			pipeWriter.CloseWithError(errors.Wrap(err, "create rsyncable gzip writer"))
+			return
+		}
+		if _, err := io.Copy(rw, reader); err != nil {
+			pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
+			return
+		}
+		if err := rw.Close(); err != nil {
+			pipeWriter.CloseWithError(errors.Wrap(err, "close rsyncable gzip writer"))
+			return
+		}
+		pipeWriter.Close()
+	}()
+
+	return pipeReader, nil
+}
+
+func (rgz rsyncableGzipCompressor) MediaType() string {
+	return ispec.MediaTypeImageLayerGzip
+}
+
+// rsyncableWriter is an io.WriteCloser which writes a single-member gzip
+// stream to the underlying writer, doing a full flush of the deflate stream
+// whenever the rolling hash of the input hits a boundary. compress/gzip
+// doesn't support full flushes, so the gzip header and trailer are written
+// by hand around a raw flate.Writer.
+type rsyncableWriter struct {
+	w     io.Writer
+	fw    *flate.Writer
+	crc   hash.Hash32
+	size  uint32
+	rhash uint32
+}
+
+func newRsyncableWriter(w io.Writer, level int) (*rsyncableWriter, error) {
+	fw, err := flate.NewWriter(w, level)
+	if err != nil {
+		return nil, errors.Wrap(err, "create flate writer")
+	}
+	// We use the same header as compress/gzip with no metadata set.
+	header := []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+	switch level {
+	case gzip.BestCompression:
+		header[8] = 2
+	case gzip.BestSpeed:
+		header[8] = 4
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, errors.Wrap(err, "write gzip header")
+	}
+	return &rsyncableWriter{
+		w:   w,
+		fw:  fw,
+		crc: crc32.NewIEEE(),
+	}, nil
+}
+
+// boundary returns the length of the prefix of p which ends at the next
+// rsyncable boundary, and whether a boundary was found at all.
+func (rw *rsyncableWriter) boundary(p []byte) (int, bool) {
+	for i, c := range p {
+		rw.rhash = ((rw.rhash << 1) ^ uint32(c)) & rsyncMask
+		if rw.rhash == rsyncHit {
+			return i + 1, true
+		}
+	}
+	return len(p), false
+}
+
+func (rw *rsyncableWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n, hit := rw.boundary(p)
+		m, err := rw.fw.Write(p[:n])
+		rw.crc.Write(p[:m])
+		rw.size += uint32(m)
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if hit {
+			// A full flush: byte-align the output with a sync flush and then
+			// discard the compression dictionary so that later output doesn't
+			// reference anything before this point.
+			if err := rw.fw.Flush(); err != nil {
+				return written, err
+			}
+			rw.fw.Reset(rw.w)
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (rw *rsyncableWriter) Close() error {
+	if err := rw.fw.Close(); err != nil {
+		return err
+	}
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], rw.crc.Sum32())
+	binary.LittleEndian.PutUint32(trailer[4:], rw.size)
+	_, err := rw.w.Write(trailer[:])
+	return err
+}
@@ -0,0 +1,114 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// rsyncableTestData generates some reasonably compressible data which doesn't
+// have a short period (which would make the test meaningless).
+func rsyncableTestData(size int) []byte {
+	words := []string{"umoci", "layer", "image", "rootfs", "bundle", "manifest", "blob", "tar", "gzip", "mtree"}
+	rng := rand.New(rand.NewSource(1337))
+
+	var buffer bytes.Buffer
+	for buffer.Len() < size {
+		fmt.Fprintf(&buffer, "%s %d ", words[rng.Intn(len(words))], rng.Intn(1000))
+	}
+	return buffer.Bytes()[:size]
+}
+
+func compressAndCheck(t *testing.T, compressor Compressor, data []byte) []byte {
+	reader, err := compressor.Compress(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("compress: %+v", err)
+	}
+	defer reader.Close()
+	compressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read compressed data: %+v", err)
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("create gzip reader: %+v", err)
+	}
+	decompressed, err := ioutil.ReadAll(gzr)
+	if err != nil {
+		t.Fatalf("decompress: %+v", err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Fatalf("decompressed data doesn't match original data")
+	}
+	return compressed
+}
+
+// syncBlocks splits a compressed stream at every sync flush marker.
+func syncBlocks(compressed []byte) [][]byte {
+	return bytes.SplitAfter(compressed, []byte{0x00, 0x00, 0xff, 0xff})
+}
+
+func TestRsyncableGzipCompressor(t *testing.T) {
+	if RsyncableGzipCompressor.MediaType() != GzipCompressor.MediaType() {
+		t.Errorf("RsyncableGzipCompressor has a different media type to GzipCompressor")
+	}
+
+	// Empty input must still produce a valid gzip stream.
+	compressAndCheck(t, RsyncableGzipCompressor, []byte{})
+
+	data := rsyncableTestData(4 << 20)
+	modified := append([]byte{}, data...)
+	modified[len(modified)/2] ^= 0xff
+
+	oldCompressed := compressAndCheck(t, RsyncableGzipCompressor, data)
+	newCompressed := compressAndCheck(t, RsyncableGzipCompressor, modified)
+
+	oldBlocks := map[string]struct{}{}
+	for _, block := range syncBlocks(oldCompressed) {
+		oldBlocks[string(block)] = struct{}{}
+	}
+	newBlocks := syncBlocks(newCompressed)
+	if len(newBlocks) < 100 {
+		t.Fatalf("expected many rsyncable blocks, only got %d", len(newBlocks))
+	}
+
+	var changed int
+	for _, block := range newBlocks {
+		if _, ok := oldBlocks[string(block)]; !ok {
+			changed++
+		}
+	}
+	// Only the blocks around the modified byte (and the final block, which
+	// contains the gzip trailer) should differ.
+	if changed > 5 {
+		t.Errorf("expected at most 5 of %d compressed blocks to change, got %d", len(newBlocks), changed)
+	}
+
+	// Resetting the dictionary makes compression worse, but the output should
+	// still be in the same ballpark as plain gzip.
+	plainSize := len(compressAndCheck(t, GzipCompressor, data))
+	if len(oldCompressed) > plainSize*5/4 {
+		t.Errorf("rsyncable output (%d bytes) is more than 25%% larger than gzip output (%d bytes)", len(oldCompressed), plainSize)
+	}
+}
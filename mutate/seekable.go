@@ -0,0 +1,232 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/openSUSE/umoci/pkg/iohelpers"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// SeekableIndexSidecar is the name of the sidecar generated by
+// SeekableGzipCompressor. The layer descriptor will have an annotation of
+// casext.AnnotationSidecarPrefix+SeekableIndexSidecar referencing the
+// SeekableIndex blob.
+const SeekableIndexSidecar = "seekable-index"
+
+// SeekableIndexEntry describes where a single tar entry is stored within a
+// layer compressed with SeekableGzipCompressor.
+type SeekableIndexEntry struct {
+	// Name is the path of the entry, as stored in the tar archive.
+	Name string `json:"name"`
+
+	// Offset is the offset of the entry's headers in the uncompressed
+	// stream.
+	Offset int64 `json:"offset"`
+
+	// CompressedOffset is the offset in the compressed stream of the gzip
+	// member containing the entry. Decompression can start at this offset
+	// without reading any of the preceding data.
+	CompressedOffset int64 `json:"compressed_offset"`
+}
+
+// SeekableIndex is the sidecar blob generated by SeekableGzipCompressor.
+type SeekableIndex struct {
+	// Entries is the list of entries in the layer, in archive order.
+	Entries []SeekableIndexEntry `json:"entries"`
+}
+
+// seekableGzipCompressor is a Compressor which compresses each tar entry as a
+// separate gzip member.
+type seekableGzipCompressor struct{}
+
+// SeekableGzipCompressor is a Compressor which starts a new gzip member at
+// every tar entry boundary of the layer, and records the compressed offset of
+// each entry in a SeekableIndex sidecar. Concatenated gzip members are still a
+// valid gzip stream, so the layer can be read by any consumer -- but a reader
+// with the index can decompress individual files without decompressing the
+// rest of the layer. The layer stream must be a tar archive.
+var SeekableGzipCompressor Compressor = seekableGzipCompressor{}
+
+func (sgz seekableGzipCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	sr := &seekableReader{
+		PipeReader: pipeReader,
+		index:      SeekableIndex{Entries: []SeekableIndexEntry{}},
+	}
+	go func() {
+		if err := sr.compress(pipeWriter, reader); err != nil {
+			pipeWriter.CloseWithError(errors.Wrap(err, "compressing seekable layer"))
+			return
+		}
+		pipeWriter.Close()
+	}()
+
+	return sr, nil
+}
+
+func (sgz seekableGzipCompressor) MediaType() string {
+	return ispec.MediaTypeImageLayerGzip
+}
+
+// seekableReader is the reader returned by SeekableGzipCompressor.Compress.
+// The index is filled while compressing, and is complete once the pipe has
+// returned io.EOF.
+type seekableReader struct {
+	*io.PipeReader
+	index SeekableIndex
+}
+
+// Sidecar implements sidecarReader.
+func (sr *seekableReader) Sidecar() (string, interface{}) {
+	return SeekableIndexSidecar, sr.index
+}
+
+// tarBlockSize is the size of tar header and padding blocks.
+const tarBlockSize = 512
+
+// parseTarNumeric parses a numeric field of a tar header, which is either
+// base-256 encoded or an octal string.
+func parseTarNumeric(field []byte) (int64, error) {
+	if len(field) > 0 && field[0]&0x80 != 0 {
+		var n int64
+		for idx, b := range field {
+			if idx == 0 {
+				b &= 0x7f
+			}
+			if n > (1<<62)>>8 {
+				return 0, errors.Errorf("numeric field overflow")
+			}
+			n = n<<8 | int64(b)
+		}
+		return n, nil
+	}
+	str := strings.Trim(string(field), " \x00")
+	if str == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(str, 8, 64)
+}
+
+// compress reads the uncompressed tar stream from reader, and writes a new
+// gzip member to w for every entry. Extended headers (PAX and GNU long names)
+// are kept in the same member as the entry they apply to.
+func (sr *seekableReader) compress(w io.Writer, reader io.Reader) error {
+	cw := &iohelpers.CountingWriter{W: w}
+
+	var offset int64
+	block := make([]byte, tarBlockSize)
+	for {
+		// Collect all of the header blocks of the next entry.
+		var headers bytes.Buffer
+		var size int64
+		var trailer bool
+		for {
+			if _, err := io.ReadFull(reader, block); err != nil {
+				if err == io.EOF && headers.Len() == 0 {
+					break
+				}
+				return errors.Wrap(err, "read tar header")
+			}
+			headers.Write(block)
+
+			// The end-of-archive marker is a zero block.
+			if bytes.Equal(block, make([]byte, tarBlockSize)) {
+				trailer = true
+				break
+			}
+
+			var err error
+			size, err = parseTarNumeric(block[124:136])
+			if err != nil {
+				return errors.Wrap(err, "parse tar header size")
+			}
+			size = (size + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+
+			// Extended headers have their data stored with the header.
+			switch block[156] {
+			case tar.TypeXHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+				if _, err := io.CopyN(&headers, reader, size); err != nil {
+					return errors.Wrap(err, "read extended tar header")
+				}
+				continue
+			}
+			break
+		}
+		if headers.Len() == 0 {
+			break
+		}
+
+		gzw := gzip.NewWriter(cw)
+		compressedOffset := cw.N
+		entryOffset := offset
+
+		if trailer {
+			// This is the end of the archive, so we just compress the rest of
+			// the stream (the trailing padding) in a final member.
+			headers.WriteTo(gzw)
+			if _, err := io.Copy(gzw, reader); err != nil {
+				return errors.Wrap(err, "compress archive trailer")
+			}
+			if err := gzw.Close(); err != nil {
+				return errors.Wrap(err, "close gzip writer")
+			}
+			return nil
+		}
+
+		// Figure out the name of the entry (taking into account any extended
+		// headers) by parsing just the headers.
+		hdr, err := tar.NewReader(bytes.NewReader(headers.Bytes())).Next()
+		if err != nil {
+			return errors.Wrap(err, "parse tar header")
+		}
+		sr.index.Entries = append(sr.index.Entries, SeekableIndexEntry{
+			Name:             hdr.Name,
+			Offset:           entryOffset,
+			CompressedOffset: compressedOffset,
+		})
+
+		offset += int64(headers.Len()) + size
+		if _, err := headers.WriteTo(gzw); err != nil {
+			return errors.Wrap(err, "compress tar header")
+		}
+		if _, err := io.CopyN(gzw, reader, size); err != nil {
+			return errors.Wrapf(err, "compress tar entry %s", hdr.Name)
+		}
+		if err := gzw.Close(); err != nil {
+			return errors.Wrap(err, "close gzip writer")
+		}
+	}
+
+	// We hit EOF without an end-of-archive marker. We still need to produce
+	// a valid gzip stream if there was no data at all.
+	if cw.N == 0 {
+		if err := gzip.NewWriter(cw).Close(); err != nil {
+			return errors.Wrap(err, "close gzip writer")
+		}
+	}
+	return nil
+}
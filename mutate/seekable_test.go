@@ -0,0 +1,209 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	casdir "github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// seekableTestArchive generates a tar archive containing the given files (in
+// order), including one file with a name long enough to require extended
+// headers.
+func seekableTestArchive(t *testing.T, files []string) []byte {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, name := range files {
+		contents := strings.Repeat(name, 100)
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestSeekableGzipCompressor(t *testing.T) {
+	files := []string{"a", "dir/b", strings.Repeat("long/", 50) + "c", "d"}
+	archive := seekableTestArchive(t, files)
+
+	compressed, err := SeekableGzipCompressor.Compress(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("unexpected error setting up compressor: %+v", err)
+	}
+	layer, err := ioutil.ReadAll(compressed)
+	if err != nil {
+		t.Fatalf("unexpected error compressing: %+v", err)
+	}
+	compressed.Close()
+
+	// The layer must be a valid gzip stream of the original archive.
+	gzr, err := gzip.NewReader(bytes.NewReader(layer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := ioutil.ReadAll(gzr)
+	if err != nil {
+		t.Fatalf("unexpected error decompressing: %+v", err)
+	}
+	if !bytes.Equal(uncompressed, archive) {
+		t.Errorf("decompressed layer doesn't match original archive")
+	}
+
+	name, index := compressed.(sidecarReader).Sidecar()
+	if name != SeekableIndexSidecar {
+		t.Errorf("unexpected sidecar name: %s", name)
+	}
+	entries := index.(SeekableIndex).Entries
+	if len(entries) != len(files) {
+		t.Fatalf("expected %d index entries, got %d", len(files), len(entries))
+	}
+
+	// Every entry must be readable by starting decompression at its offset.
+	for idx, entry := range entries {
+		if entry.Name != files[idx] {
+			t.Errorf("index entry %d: expected name %q, got %q", idx, files[idx], entry.Name)
+		}
+		gzr, err := gzip.NewReader(bytes.NewReader(layer[entry.CompressedOffset:]))
+		if err != nil {
+			t.Errorf("index entry %s: unexpected error seeking: %+v", entry.Name, err)
+			continue
+		}
+		hdr, err := tar.NewReader(gzr).Next()
+		if err != nil {
+			t.Errorf("index entry %s: unexpected error reading header: %+v", entry.Name, err)
+			continue
+		}
+		if hdr.Name != entry.Name {
+			t.Errorf("index entry %s: got entry %s at offset", entry.Name, hdr.Name)
+		}
+		if hdr, err := tar.NewReader(bytes.NewReader(archive[entry.Offset:])).Next(); err != nil || hdr.Name != entry.Name {
+			t.Errorf("index entry %s: uncompressed offset is wrong", entry.Name)
+		}
+	}
+}
+
+func TestMutateAddSeekable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddSeekable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "image")
+	if err := casdir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := casdir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	// Create an empty image.
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Image{
+		RootFS: ispec.RootFS{Type: "layers"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := seekableTestArchive(t, []string{"a", "b"})
+	if err := mutator.AddWithOptions(context.Background(), bytes.NewReader(archive), ispec.History{}, &AddOptions{
+		Compressor: SeekableGzipCompressor,
+	}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if err := engineExt.UpdateReference(context.Background(), "seekable", newDescriptor.Root()); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := mutator.manifest.Layers[0]
+	if layer.MediaType != ispec.MediaTypeImageLayerGzip {
+		t.Errorf("unexpected layer media type: %s", layer.MediaType)
+	}
+	sidecar, ok := layer.Annotations[casext.AnnotationSidecarPrefix+SeekableIndexSidecar]
+	if !ok {
+		t.Fatalf("layer descriptor is missing sidecar annotation: %v", layer.Annotations)
+	}
+
+	// The sidecar must be reachable, so that it isn't garbage collected.
+	reachable, err := engineExt.Reachable(context.Background(), newDescriptor.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, digest := range reachable {
+		if digest.String() == sidecar {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("sidecar blob %s is not reachable from the image", sidecar)
+	}
+}
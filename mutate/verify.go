@@ -0,0 +1,69 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"io"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// VerifyDiffIDs checks that the DiffIDs in the image configuration match the
+// uncompressed contents of the layers in the manifest, including any layers
+// added (but not yet committed) with the Mutator. Each layer is decompressed
+// and hashed with the algorithm of its recorded DiffID. This is intended as a
+// safety check that the image configuration doesn't misdescribe the layers,
+// such as after a bug in the compression of a new layer.
+func (m *Mutator) VerifyDiffIDs(ctx context.Context) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	layers := m.manifest.Layers
+	diffIDs := m.config.RootFS.DiffIDs
+	if len(layers) != len(diffIDs) {
+		return errors.Errorf("image has %d layers but %d diffids", len(layers), len(diffIDs))
+	}
+
+	for idx, descriptor := range layers {
+		diffID := diffIDs[idx]
+		if err := diffID.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid diffid of layer %d", idx)
+		}
+		if !cas.IsSupportedAlgorithm(diffID.Algorithm()) {
+			return errors.Errorf("unsupported diffid algorithm of layer %d: %q", idx, diffID.Algorithm())
+		}
+
+		layer, err := m.openLayer(ctx, descriptor)
+		if err != nil {
+			return errors.Wrapf(err, "open layer %s", descriptor.Digest)
+		}
+		verifier := diffID.Verifier()
+		_, err = io.Copy(verifier, layer)
+		layer.Close()
+		if err != nil {
+			return errors.Wrapf(err, "read layer %s", descriptor.Digest)
+		}
+		if !verifier.Verified() {
+			return errors.Errorf("layer %d (%s) does not match its diffid %s", idx, descriptor.Digest, diffID)
+		}
+	}
+	return nil
+}
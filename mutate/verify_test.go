@@ -0,0 +1,74 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestMutateVerifyDiffIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateVerifyDiffIDs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, mutator := setupEmpty(t, dir)
+	defer engine.Close()
+
+	for _, compressor := range []Compressor{GzipCompressor, ZstdCompressor, NewNoopCompressor()} {
+		if _, err := mutator.AddLayer(context.Background(), makeTestLayer(t, []testEntry{
+			{"file", tar.TypeReg, "contents"},
+		}), ispec.History{}, &AddOptions{Compressor: compressor}); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+	}
+	if err := mutator.VerifyDiffIDs(context.Background()); err != nil {
+		t.Errorf("unexpected error verifying new layers: %+v", err)
+	}
+
+	committed := commitAndReopen(t, engine, mutator)
+	if err := committed.VerifyDiffIDs(context.Background()); err != nil {
+		t.Errorf("unexpected error verifying committed image: %+v", err)
+	}
+
+	// Record the wrong DiffID for one of the layers.
+	if err := committed.cache(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	diffIDs := committed.config.RootFS.DiffIDs
+	correct := diffIDs[1]
+	diffIDs[1] = digest.FromString("not the layer contents")
+	if err := committed.VerifyDiffIDs(context.Background()); err == nil {
+		t.Errorf("expected an error verifying an incorrect diffid")
+	}
+
+	// The number of DiffIDs must match the number of layers.
+	diffIDs[1] = correct
+	committed.config.RootFS.DiffIDs = diffIDs[:2]
+	if err := committed.VerifyDiffIDs(context.Background()); err == nil {
+		t.Errorf("expected an error verifying a missing diffid")
+	}
+}
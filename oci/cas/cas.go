@@ -21,10 +21,11 @@ import (
 	"fmt"
 	"io"
 
-	// We need to include sha256 in order for go-digest to properly handle such
-	// hashes, since Go's crypto library like to lazy-load cryptographic
-	// libraries.
+	// We need to include sha256 and sha512 in order for go-digest to properly
+	// handle such hashes, since Go's crypto library like to lazy-load
+	// cryptographic libraries.
 	_ "crypto/sha256"
+	_ "crypto/sha512"
 
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -32,11 +33,30 @@ import (
 )
 
 const (
-	// BlobAlgorithm is the name of the only supported digest algorithm for blobs.
-	// FIXME: We can make this a list.
+	// BlobAlgorithm is the name of the default digest algorithm for blobs.
+	// Engines may be configured to use any of the SupportedAlgorithms when
+	// writing new blobs, but must be able to read blobs using any of them.
 	BlobAlgorithm = digest.SHA256
 )
 
+// SupportedAlgorithms is the set of digest algorithms which are supported for
+// blobs (and thus descriptors and DiffIDs) by umoci.
+var SupportedAlgorithms = []digest.Algorithm{
+	digest.SHA256,
+	digest.SHA512,
+}
+
+// IsSupportedAlgorithm returns whether the given digest algorithm is one of
+// the SupportedAlgorithms.
+func IsSupportedAlgorithm(algo digest.Algorithm) bool {
+	for _, supported := range SupportedAlgorithms {
+		if algo == supported {
+			return true
+		}
+	}
+	return false
+}
+
 // Exposed errors.
 var (
 	// ErrNotExist is effectively an implementation-neutral version of
@@ -72,6 +92,12 @@ type Engine interface {
 	// caller must Close(). Returns ErrNotExist if the digest is not found.
 	GetBlob(ctx context.Context, digest digest.Digest) (reader io.ReadCloser, err error)
 
+	// DigestAlgorithm returns the digest algorithm used by PutBlob when
+	// computing the digest of new blobs. Users generating their own digests
+	// of content (such as DiffIDs) should use the same algorithm to ensure
+	// that an image uses a single algorithm consistently.
+	DigestAlgorithm() digest.Algorithm
+
 	// PutIndex sets the index of the OCI image to the given index, replacing
 	// the previously existing index. This operation is atomic; any readers
 	// attempting to access the OCI image while it is being modified will only
@@ -107,3 +133,17 @@ type Engine interface {
 	// may fail.
 	Close() (err error)
 }
+
+// PrettyEngine is an optional interface implemented by Engines which can be
+// configured to store JSON blobs (such as manifests and configurations) in an
+// indented, human-editable form rather than the default compact form. Note
+// that indenting a blob changes its digest, so images written this way will
+// have different digests to those produced by other tools. JSON blobs are
+// read the same way regardless of how they were written.
+type PrettyEngine interface {
+	Engine
+
+	// PrettyBlobs returns whether JSON blobs written to the image should be
+	// indented.
+	PrettyBlobs() bool
+}
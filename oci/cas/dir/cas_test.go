@@ -26,6 +26,7 @@ import (
 	"testing"
 
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
@@ -300,3 +301,78 @@ func TestEngineValidate(t *testing.T) {
 		engine.Close()
 	}
 }
+
+func TestEngineBlobSHA512(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobSHA512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := OpenWithOptions(image, &Options{DigestAlgorithm: digest.SHA512})
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	if algo := engine.DigestAlgorithm(); algo != digest.SHA512 {
+		t.Errorf("DigestAlgorithm: expected %s, got %s", digest.SHA512, algo)
+	}
+
+	data := []byte("some blob contents")
+	blobDigest, size, err := engine.PutBlob(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	if expected := digest.SHA512.FromBytes(data); blobDigest != expected {
+		t.Errorf("PutBlob: digest doesn't match: expected=%s got=%s", expected, blobDigest)
+	}
+	if size != int64(len(data)) {
+		t.Errorf("PutBlob: length doesn't match: expected=%d got=%d", len(data), size)
+	}
+
+	// The blob must be stored under the sha512 directory.
+	if _, err := os.Lstat(filepath.Join(image, blobDirectory, "sha512", blobDigest.Hex())); err != nil {
+		t.Errorf("blob not stored in sha512 directory: %+v", err)
+	}
+
+	// The blob must be readable even through a default engine.
+	defaultEngine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer defaultEngine.Close()
+
+	blobReader, err := defaultEngine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	defer blobReader.Close()
+
+	gotBytes, err := ioutil.ReadAll(blobReader)
+	if err != nil {
+		t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+	}
+	if !bytes.Equal(data, gotBytes) {
+		t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(data), string(gotBytes))
+	}
+
+	if blobs, err := defaultEngine.ListBlobs(ctx); err != nil {
+		t.Errorf("ListBlobs: unexpected error: %+v", err)
+	} else if len(blobs) != 1 || blobs[0] != blobDigest {
+		t.Errorf("ListBlobs: expected only %s, got %v", blobDigest, blobs)
+	}
+
+	// Unsupported algorithms must be rejected.
+	if engine, err := OpenWithOptions(image, &Options{DigestAlgorithm: digest.SHA384}); err == nil {
+		engine.Close()
+		t.Errorf("OpenWithOptions: expected an error with an unsupported algorithm")
+	}
+}
@@ -64,17 +64,40 @@ func blobPath(digest digest.Digest) (string, error) {
 	algo := digest.Algorithm()
 	hash := digest.Hex()
 
-	if algo != cas.BlobAlgorithm {
+	if !cas.IsSupportedAlgorithm(algo) {
 		return "", errors.Errorf("unsupported algorithm: %q", algo)
 	}
 
 	return filepath.Join(blobDirectory, algo.String(), hash), nil
 }
 
+// Options specifies optional settings for a directory-backed OCI image opened
+// with OpenWithOptions.
+type Options struct {
+	// DigestAlgorithm is the digest algorithm used when writing new blobs to
+	// the image. If unset, cas.BlobAlgorithm is used. Blobs using any of the
+	// cas.SupportedAlgorithms can be read regardless of this setting.
+	DigestAlgorithm digest.Algorithm
+
+	// PrettyBlobs causes JSON blobs (manifests, configurations and so on)
+	// written through casext to be indented, which makes them easier to edit
+	// and diff by hand. This changes the digests of those blobs, so it is
+	// disabled by default. Both forms can always be read.
+	PrettyBlobs bool
+
+	// BlobHook is called before blobs are stored in or removed from the
+	// image, and can veto the modification by returning an error. If unset,
+	// cas.NoopBlobHook is used.
+	BlobHook cas.BlobHook
+}
+
 type dirEngine struct {
-	path     string
-	temp     string
-	tempFile *os.File
+	path      string
+	temp      string
+	tempFile  *os.File
+	algorithm digest.Algorithm
+	pretty    bool
+	hook      cas.BlobHook
 }
 
 func (e *dirEngine) ensureTempDir() error {
@@ -101,6 +124,21 @@ func (e *dirEngine) ensureTempDir() error {
 	return nil
 }
 
+// validateLayout ensures that the given oci-layout file contents are valid.
+func validateLayout(content []byte) error {
+	var ociLayout ispec.ImageLayout
+	if err := json.Unmarshal(content, &ociLayout); err != nil {
+		return errors.Wrap(err, "parse oci-layout")
+	}
+
+	// XXX: Currently the meaning of this field is not adequately defined by
+	//      the spec, nor is the "official" value determined by the spec.
+	if ociLayout.Version != ImageLayoutVersion {
+		return errors.Wrap(cas.ErrInvalid, "layout version is not supported")
+	}
+	return nil
+}
+
 // verify ensures that the image is valid.
 func (e *dirEngine) validate() error {
 	content, err := ioutil.ReadFile(filepath.Join(e.path, layoutFile))
@@ -111,20 +149,13 @@ func (e *dirEngine) validate() error {
 		return errors.Wrap(err, "read oci-layout")
 	}
 
-	var ociLayout ispec.ImageLayout
-	if err := json.Unmarshal(content, &ociLayout); err != nil {
-		return errors.Wrap(err, "parse oci-layout")
-	}
-
-	// XXX: Currently the meaning of this field is not adequately defined by
-	//      the spec, nor is the "official" value determined by the spec.
-	if ociLayout.Version != ImageLayoutVersion {
-		return errors.Wrap(cas.ErrInvalid, "layout version is not supported")
+	if err := validateLayout(content); err != nil {
+		return err
 	}
 
 	// Check that "blobs" and "index.json" exist in the image.
-	// FIXME: We also should check that blobs *only* contains a cas.BlobAlgorithm
-	//        directory (with no subdirectories) and that refs *only* contains
+	// FIXME: We also should check that blobs *only* contains cas.SupportedAlgorithms
+	//        directories (with no subdirectories) and that refs *only* contains
 	//        files (optionally also making sure they're all JSON descriptors).
 	if fi, err := os.Stat(filepath.Join(e.path, blobDirectory)); err != nil {
 		if os.IsNotExist(err) {
@@ -150,12 +181,17 @@ func (e *dirEngine) validate() error {
 // PutBlob adds a new blob to the image. This is idempotent; a nil error
 // means that "the content is stored at DIGEST" without implying "because
 // of this PutBlob() call".
-func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+//
+// The blob is streamed into a temporary file (computing its digest as it is
+// written) which is then renamed to its content-addressed path, so the
+// contents are never buffered in memory and the digest doesn't need to be
+// known in advance. If anything goes wrong, the temporary file is removed.
+func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (_ digest.Digest, _ int64, Err error) {
 	if err := e.ensureTempDir(); err != nil {
 		return "", -1, errors.Wrap(err, "ensure tempdir")
 	}
 
-	digester := cas.BlobAlgorithm.Digester()
+	digester := e.algorithm.Digester()
 
 	// We copy this into a temporary file because we need to get the blob hash,
 	// but also to avoid half-writing an invalid blob.
@@ -165,6 +201,15 @@ func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Diges
 	}
 	tempPath := fh.Name()
 	defer fh.Close()
+	defer func() {
+		if Err != nil {
+			// Don't leave partially-written blobs lying around until the
+			// tempdir is cleaned up.
+			if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+				log.Warnf("failed to remove temporary blob %s: %v", tempPath, err)
+			}
+		}
+	}()
 
 	writer := io.MultiWriter(fh, digester.Hash())
 	size, err := io.Copy(writer, reader)
@@ -173,14 +218,27 @@ func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Diges
 	}
 	fh.Close()
 
+	desc := ispec.Descriptor{
+		MediaType: cas.MediaTypeFromContext(ctx),
+		Digest:    digester.Digest(),
+		Size:      size,
+	}
+	if err := e.hook.BeforePutBlob(ctx, desc); err != nil {
+		return "", -1, errors.Wrap(err, "blob hook")
+	}
+
 	// Get the digest.
 	path, err := blobPath(digester.Digest())
 	if err != nil {
 		return "", -1, errors.Wrap(err, "compute blob name")
 	}
 
-	// Move the blob to its correct path.
+	// Move the blob to its correct path. The algorithm directory might not
+	// exist if we're the first user of a non-default algorithm.
 	path = filepath.Join(e.path, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", -1, errors.Wrap(err, "mkdir algorithm")
+	}
 	if err := os.Rename(tempPath, path); err != nil {
 		return "", -1, errors.Wrap(err, "rename temporary blob")
 	}
@@ -199,6 +257,18 @@ func (e *dirEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadC
 	return fh, errors.Wrap(err, "open blob")
 }
 
+// DigestAlgorithm returns the digest algorithm used by PutBlob when computing
+// the digest of new blobs.
+func (e *dirEngine) DigestAlgorithm() digest.Algorithm {
+	return e.algorithm
+}
+
+// PrettyBlobs returns whether JSON blobs written to the image should be
+// indented (see Options.PrettyBlobs).
+func (e *dirEngine) PrettyBlobs() bool {
+	return e.pretty
+}
+
 // PutIndex sets the index of the OCI image to the given index, replacing the
 // previously existing index. This operation is atomic; any readers attempting
 // to access the OCI image while it is being modified will only ever see the
@@ -217,10 +287,15 @@ func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
 	tempPath := fh.Name()
 	defer fh.Close()
 
-	// Encode the index.
+	// Encode the index. We need to make sure the contents have hit the disk
+	// before the rename, otherwise a crash could leave us with a truncated
+	// index.json.
 	if err := json.NewEncoder(fh).Encode(index); err != nil {
 		return errors.Wrap(err, "write temporary index")
 	}
+	if err := fh.Sync(); err != nil {
+		return errors.Wrap(err, "sync temporary index")
+	}
 	fh.Close()
 
 	// Move the blob to its correct path.
@@ -228,7 +303,18 @@ func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
 	if err := os.Rename(tempPath, path); err != nil {
 		return errors.Wrap(err, "rename temporary index")
 	}
-	return nil
+	return errors.Wrap(syncDir(e.path), "sync image directory")
+}
+
+// syncDir calls fsync(2) on the given directory, to ensure that any renames
+// within the directory are durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
 }
 
 // GetIndex returns the index of the OCI image. Return ErrNotExist if the
@@ -266,6 +352,10 @@ func (e *dirEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error
 		return errors.Wrap(err, "compute blob path")
 	}
 
+	if err := e.hook.BeforeDeleteBlob(ctx, digest); err != nil {
+		return errors.Wrap(err, "blob hook")
+	}
+
 	err = os.Remove(filepath.Join(e.path, path))
 	if err != nil && !os.IsNotExist(err) {
 		return errors.Wrap(err, "remove blob")
@@ -276,20 +366,27 @@ func (e *dirEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error
 // ListBlobs returns the set of blob digests stored in the image.
 func (e *dirEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
 	digests := []digest.Digest{}
-	blobDir := filepath.Join(e.path, blobDirectory, cas.BlobAlgorithm.String())
 
-	if err := filepath.Walk(blobDir, func(path string, _ os.FileInfo, _ error) error {
-		// Skip the actual directory.
-		if path == blobDir {
-			return nil
+	for _, algo := range cas.SupportedAlgorithms {
+		blobDir := filepath.Join(e.path, blobDirectory, algo.String())
+		if _, err := os.Lstat(blobDir); os.IsNotExist(err) {
+			// Not all algorithms will be used by every image.
+			continue
 		}
 
-		// XXX: Do we need to handle multiple-directory-deep cases?
-		digest := digest.NewDigestFromHex(cas.BlobAlgorithm.String(), filepath.Base(path))
-		digests = append(digests, digest)
-		return nil
-	}); err != nil {
-		return nil, errors.Wrap(err, "walk blobdir")
+		if err := filepath.Walk(blobDir, func(path string, _ os.FileInfo, _ error) error {
+			// Skip the actual directory.
+			if path == blobDir {
+				return nil
+			}
+
+			// XXX: Do we need to handle multiple-directory-deep cases?
+			digest := digest.NewDigestFromHex(algo.String(), filepath.Base(path))
+			digests = append(digests, digest)
+			return nil
+		}); err != nil {
+			return nil, errors.Wrapf(err, "walk blobdir %s", algo)
+		}
 	}
 
 	return digests, nil
@@ -357,11 +454,44 @@ func (e *dirEngine) Close() error {
 }
 
 // Open opens a new reference to the directory-backed OCI image referenced by
-// the provided path.
+// the provided path. If the path is a regular file rather than a directory, it
+// is opened as a (read-only) tar archive of an OCI image layout with OpenTar.
 func Open(path string) (cas.Engine, error) {
+	return OpenWithOptions(path, nil)
+}
+
+// OpenWithOptions is the same as Open, except that it allows for the caller to
+// specify non-default options for the opened engine. The options have no
+// effect on tar archives, as they only affect how images are modified.
+func OpenWithOptions(path string, opt *Options) (cas.Engine, error) {
+	var options Options
+	if opt != nil {
+		options = *opt
+	}
+
+	if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+		return OpenTar(path)
+	}
+
+	algorithm := options.DigestAlgorithm
+	if algorithm == "" {
+		algorithm = cas.BlobAlgorithm
+	}
+	if !cas.IsSupportedAlgorithm(algorithm) {
+		return nil, errors.Errorf("unsupported digest algorithm: %q", algorithm)
+	}
+
+	hook := options.BlobHook
+	if hook == nil {
+		hook = cas.NoopBlobHook{}
+	}
+
 	engine := &dirEngine{
-		path: path,
-		temp: "",
+		path:      path,
+		temp:      "",
+		algorithm: algorithm,
+		pretty:    options.PrettyBlobs,
+		hook:      hook,
 	}
 
 	if err := engine.validate(); err != nil {
@@ -385,7 +515,7 @@ func Create(path string) error {
 	}
 	if err := os.Mkdir(path, 0755); err != nil {
 		if os.IsExist(err) {
-			return fmt.Errorf("path already exists %", path)
+			return fmt.Errorf("path already exists: %s", path)
 		}
 		return errors.Wrap(err, "mkdir")
 	}
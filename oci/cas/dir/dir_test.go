@@ -19,13 +19,19 @@ package dir
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 	"golang.org/x/sys/unix"
@@ -277,3 +283,241 @@ func TestEngineGCLocking(t *testing.T) {
 		}
 	}
 }
+
+func TestEnginePutIndexAtomic(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEnginePutIndexAtomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	// Continually read index.json while it is being replaced, to make sure
+	// that a partially-written index is never observable.
+	done := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(errCh)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			data, err := ioutil.ReadFile(filepath.Join(image, indexFile))
+			if err != nil {
+				errCh <- errors.Wrap(err, "read index")
+				return
+			}
+			var index ispec.Index
+			if err := json.Unmarshal(data, &index); err != nil {
+				errCh <- errors.Wrapf(err, "partial index observed: %q", data)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		var index ispec.Index
+		index.SchemaVersion = 2
+		for j := 0; j < i; j++ {
+			index.Manifests = append(index.Manifests, ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageManifest,
+				Digest:    digest.FromString(fmt.Sprintf("manifest-%d-%d", i, j)),
+				Size:      int64(j),
+			})
+		}
+		if err := engine.PutIndex(ctx, index); err != nil {
+			t.Fatalf("PutIndex: unexpected error: %+v", err)
+		}
+	}
+	close(done)
+
+	if err := <-errCh; err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	// No temporary index files should be left behind in the image.
+	matches, err := filepath.Glob(filepath.Join(image, "index-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) > 0 {
+		t.Errorf("temporary index files left in image: %v", matches)
+	}
+}
+
+// recordingHook is a cas.BlobHook which records every call, and vetoes writes
+// of blobs larger than maxSize.
+type recordingHook struct {
+	maxSize int64
+	puts    []ispec.Descriptor
+	deletes []digest.Digest
+}
+
+func (h *recordingHook) BeforePutBlob(ctx context.Context, desc ispec.Descriptor) error {
+	if desc.Size > h.maxSize {
+		return errors.Errorf("blob too large: %d > %d", desc.Size, h.maxSize)
+	}
+	h.puts = append(h.puts, desc)
+	return nil
+}
+
+func (h *recordingHook) BeforeDeleteBlob(ctx context.Context, digest digest.Digest) error {
+	h.deletes = append(h.deletes, digest)
+	return nil
+}
+
+func TestEngineBlobHook(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobHook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	hook := &recordingHook{maxSize: 16}
+	engine, err := OpenWithOptions(image, &Options{BlobHook: hook})
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	small := []byte("small blob")
+	smallDigest, _, err := engine.PutBlob(cas.WithMediaType(ctx, "application/x-small"), bytes.NewReader(small))
+	if err != nil {
+		t.Fatalf("unexpected error putting small blob: %+v", err)
+	}
+	expected := ispec.Descriptor{
+		MediaType: "application/x-small",
+		Digest:    digest.FromBytes(small),
+		Size:      int64(len(small)),
+	}
+	if len(hook.puts) != 1 || !reflect.DeepEqual(hook.puts[0], expected) {
+		t.Errorf("unexpected hook calls: expected [%v], got %v", expected, hook.puts)
+	}
+
+	// The hook can veto writes.
+	large := bytes.Repeat([]byte("large blob "), 10)
+	if _, _, err := engine.PutBlob(ctx, bytes.NewReader(large)); err == nil {
+		t.Errorf("expected hook to veto large blob")
+	}
+	if _, err := engine.GetBlob(ctx, digest.FromBytes(large)); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("expected vetoed blob to not be stored: got %v", err)
+	}
+
+	if err := engine.DeleteBlob(ctx, smallDigest); err != nil {
+		t.Fatalf("unexpected error deleting blob: %+v", err)
+	}
+	if len(hook.deletes) != 1 || hook.deletes[0] != smallDigest {
+		t.Errorf("unexpected hook calls: expected [%v], got %v", smallDigest, hook.deletes)
+	}
+}
+
+// failingReader returns an error once n bytes have been read from r.
+type failingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if fr.n <= 0 {
+		return 0, fmt.Errorf("failingReader: injected error")
+	}
+	if int64(len(p)) > fr.n {
+		p = p[:fr.n]
+	}
+	n, err := fr.r.Read(p)
+	fr.n -= int64(n)
+	return n, err
+}
+
+func TestEnginePutBlobStream(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEnginePutBlobStream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	// Stream a large random blob, computing the expected digest as it is
+	// read by PutBlob.
+	const size = 64 * 1024 * 1024
+	digester := digest.SHA256.Digester()
+	reader := io.TeeReader(io.LimitReader(rand.Reader, size), digester.Hash())
+
+	gotDigest, gotSize, err := engine.PutBlob(ctx, reader)
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	if gotDigest != digester.Digest() {
+		t.Errorf("PutBlob: digest doesn't match: expected %s got %s", digester.Digest(), gotDigest)
+	}
+	if gotSize != size {
+		t.Errorf("PutBlob: size doesn't match: expected %d got %d", size, gotSize)
+	}
+
+	blobReader, err := engine.GetBlob(ctx, gotDigest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	verifier := gotDigest.Verifier()
+	n, err := io.Copy(verifier, blobReader)
+	blobReader.Close()
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error reading blob: %+v", err)
+	}
+	if n != size || !verifier.Verified() {
+		t.Errorf("GetBlob: stored blob doesn't match the streamed blob")
+	}
+
+	// A failed stream must not leave a partial blob behind.
+	tempDir := engine.(*dirEngine).temp
+	if _, _, err := engine.PutBlob(ctx, &failingReader{r: rand.Reader, n: 1024 * 1024}); err == nil {
+		t.Fatalf("PutBlob: expected error with failing reader")
+	}
+	tempFiles, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tempFiles) != 0 {
+		t.Errorf("PutBlob: temporary files left behind after failed stream: %v", tempFiles)
+	}
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	if len(blobs) != 1 {
+		t.Errorf("ListBlobs: expected only the streamed blob: %v", blobs)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// LayoutRepairs describes the changes made to an OCI image layout by
+// RepairLayout.
+type LayoutRepairs struct {
+	// RewroteLayout is true if the "oci-layout" file was missing or corrupt,
+	// and was rewritten.
+	RewroteLayout bool `json:"rewrote_layout"`
+
+	// CreatedIndex is true if the "index.json" file was missing, and an empty
+	// index was created in its place.
+	CreatedIndex bool `json:"created_index"`
+}
+
+// writeJSONFile atomically replaces the file at the given path with the JSON
+// encoding of the given value.
+func writeJSONFile(path string, v interface{}) error {
+	fh, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary file")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if err := json.NewEncoder(fh).Encode(v); err != nil {
+		return errors.Wrap(err, "encode json")
+	}
+	if err := fh.Sync(); err != nil {
+		return errors.Wrap(err, "sync temporary file")
+	}
+	if err := os.Chmod(fh.Name(), 0644); err != nil {
+		return errors.Wrap(err, "chmod temporary file")
+	}
+	return errors.Wrap(os.Rename(fh.Name(), path), "rename temporary file")
+}
+
+// RepairLayout fixes the structural files of the OCI image layout at the
+// given path, so that it can be opened with Open. A missing or corrupt
+// "oci-layout" is rewritten and a missing "index.json" is replaced with an
+// empty index. RepairLayout is conservative: it will never remove or modify
+// any blobs, it will refuse to touch a layout with an unsupported (but
+// otherwise valid) "oci-layout" version, and a corrupt "index.json" is
+// treated as an error (because it contains the only copy of the references).
+func RepairLayout(path string) (LayoutRepairs, error) {
+	var repairs LayoutRepairs
+
+	// We have to at least have a blob directory, otherwise this probably
+	// isn't an image at all.
+	if fi, err := os.Stat(filepath.Join(path, blobDirectory)); err != nil {
+		return repairs, errors.Wrap(err, "check blobdir")
+	} else if !fi.IsDir() {
+		return repairs, errors.Errorf("blobdir is not a directory")
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(path, layoutFile))
+	if err != nil && !os.IsNotExist(err) {
+		return repairs, errors.Wrap(err, "read oci-layout")
+	}
+	if err == nil {
+		var ociLayout ispec.ImageLayout
+		if err := json.Unmarshal(content, &ociLayout); err != nil {
+			log.Infof("repair: oci-layout is corrupt: %v", err)
+			repairs.RewroteLayout = true
+		} else if ociLayout.Version == "" {
+			log.Infof("repair: oci-layout is missing imageLayoutVersion")
+			repairs.RewroteLayout = true
+		} else if ociLayout.Version != ImageLayoutVersion {
+			return repairs, errors.Errorf("refusing to repair layout with unsupported version %q", ociLayout.Version)
+		}
+	} else {
+		log.Infof("repair: oci-layout is missing")
+		repairs.RewroteLayout = true
+	}
+
+	if repairs.RewroteLayout {
+		if err := writeJSONFile(filepath.Join(path, layoutFile), ispec.ImageLayout{
+			Version: ImageLayoutVersion,
+		}); err != nil {
+			return repairs, errors.Wrap(err, "write oci-layout")
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(path, indexFile)); err != nil {
+		if !os.IsNotExist(err) {
+			return repairs, errors.Wrap(err, "check index")
+		}
+		log.Infof("repair: index.json is missing")
+		if err := writeJSONFile(filepath.Join(path, indexFile), ispec.Index{
+			Versioned: imeta.Versioned{
+				SchemaVersion: 2, // FIXME: This is hardcoded at the moment.
+			},
+		}); err != nil {
+			return repairs, errors.Wrap(err, "write index.json")
+		}
+		repairs.CreatedIndex = true
+	}
+
+	return repairs, nil
+}
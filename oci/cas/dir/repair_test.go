@@ -0,0 +1,97 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepairLayout(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRepairLayout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	// A valid layout shouldn't be touched.
+	if repairs, err := RepairLayout(image); err != nil {
+		t.Errorf("unexpected error repairing valid layout: %+v", err)
+	} else if repairs.RewroteLayout || repairs.CreatedIndex {
+		t.Errorf("unexpected repairs of valid layout: %+v", repairs)
+	}
+
+	for _, test := range []struct {
+		name     string
+		layout   *string
+		index    bool
+		repairs  LayoutRepairs
+		expectOK bool
+	}{
+		{"MissingLayout", nil, true, LayoutRepairs{RewroteLayout: true}, true},
+		{"CorruptLayout", strPtr("{not json"), true, LayoutRepairs{RewroteLayout: true}, true},
+		{"EmptyVersion", strPtr(`{}`), true, LayoutRepairs{RewroteLayout: true}, true},
+		{"UnsupportedVersion", strPtr(`{"imageLayoutVersion":"9.9.9"}`), true, LayoutRepairs{}, false},
+		{"MissingIndex", strPtr(`{"imageLayoutVersion":"1.0.0"}`), false, LayoutRepairs{CreatedIndex: true}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			image := filepath.Join(root, test.name)
+			if err := Create(image); err != nil {
+				t.Fatalf("unexpected error creating image: %+v", err)
+			}
+			os.Remove(filepath.Join(image, layoutFile))
+			if test.layout != nil {
+				if err := ioutil.WriteFile(filepath.Join(image, layoutFile), []byte(*test.layout), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !test.index {
+				os.Remove(filepath.Join(image, indexFile))
+			}
+
+			repairs, err := RepairLayout(image)
+			if !test.expectOK {
+				if err == nil {
+					t.Errorf("expected an error repairing layout")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error repairing layout: %+v", err)
+			}
+			if repairs != test.repairs {
+				t.Errorf("unexpected repairs: expected %+v, got %+v", test.repairs, repairs)
+			}
+
+			engine, err := Open(image)
+			if err != nil {
+				t.Fatalf("unexpected error opening repaired image: %+v", err)
+			}
+			engine.Close()
+		})
+	}
+}
+
+func strPtr(s string) *string { return &s }
@@ -0,0 +1,221 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/iohelpers"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// errReadOnly is returned by all operations which would modify a tar-backed
+// image.
+var errReadOnly = errors.Wrap(cas.ErrNotImplemented, "tar archive images are read-only")
+
+// tarFile is the location of a regular file inside a tar archive.
+type tarFile struct {
+	offset, size int64
+}
+
+type tarEngine struct {
+	path  string
+	fh    *os.File
+	files map[string]tarFile
+}
+
+// cleanTarPath returns the path of a tar entry, relative to the root of the
+// archive.
+func cleanTarPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// index records the location of every regular file in the archive, so that
+// they can be read without having to scan the archive again.
+func (e *tarEngine) index() error {
+	cr := &iohelpers.CountingReader{R: e.fh}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		// archive/tar only reads the headers of an entry in Next(), so the
+		// contents of the entry start at the current offset.
+		e.files[cleanTarPath(hdr.Name)] = tarFile{
+			offset: cr.N,
+			size:   hdr.Size,
+		}
+	}
+	return nil
+}
+
+// open returns a reader for the file at the given path in the archive. If
+// the file doesn't exist, an error satisfying os.IsNotExist is returned.
+func (e *tarEngine) open(name string) (io.ReadCloser, error) {
+	file, ok := e.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: e.path + ":" + name, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(io.NewSectionReader(e.fh, file.offset, file.size)), nil
+}
+
+// validate ensures that the image is valid.
+func (e *tarEngine) validate() error {
+	reader, err := e.open(layoutFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = cas.ErrInvalid
+		}
+		return errors.Wrap(err, "read oci-layout")
+	}
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errors.Wrap(err, "read oci-layout")
+	}
+	if err := validateLayout(content); err != nil {
+		return err
+	}
+
+	if _, ok := e.files[indexFile]; !ok {
+		return errors.Wrap(cas.ErrInvalid, "check index")
+	}
+	return nil
+}
+
+// PutBlob is not supported for tar archives.
+func (e *tarEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	return "", -1, errReadOnly
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns os.ErrNotExist if the digest is not found.
+func (e *tarEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute blob path")
+	}
+	reader, err := e.open(path)
+	return reader, errors.Wrap(err, "open blob")
+}
+
+// DigestAlgorithm returns the default digest algorithm, as blobs cannot be
+// written to tar archives.
+func (e *tarEngine) DigestAlgorithm() digest.Algorithm {
+	return cas.BlobAlgorithm
+}
+
+// PutIndex is not supported for tar archives.
+func (e *tarEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	return errReadOnly
+}
+
+// GetIndex returns the index of the OCI image. If the image doesn't have an
+// index, ErrInvalid is returned (a valid OCI image MUST have an image index).
+func (e *tarEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	reader, err := e.open(indexFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = cas.ErrInvalid
+		}
+		return ispec.Index{}, errors.Wrap(err, "read index")
+	}
+	defer reader.Close()
+
+	var index ispec.Index
+	if err := json.NewDecoder(reader).Decode(&index); err != nil {
+		return ispec.Index{}, errors.Wrap(err, "parse index")
+	}
+	return index, nil
+}
+
+// DeleteBlob is not supported for tar archives.
+func (e *tarEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	return errReadOnly
+}
+
+// ListBlobs returns the set of blob digests stored in the image.
+func (e *tarEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	digests := []digest.Digest{}
+	for name := range e.files {
+		for _, algo := range cas.SupportedAlgorithms {
+			prefix := path.Join(blobDirectory, algo.String()) + "/"
+			if hash := strings.TrimPrefix(name, prefix); hash != name && !strings.Contains(hash, "/") {
+				digests = append(digests, digest.NewDigestFromHex(algo.String(), hash))
+			}
+		}
+	}
+	return digests, nil
+}
+
+// Clean does nothing, as tar archives don't contain any temporary files.
+func (e *tarEngine) Clean(ctx context.Context) error {
+	return nil
+}
+
+// Close releases all references held by the e. Subsequent operations may
+// fail.
+func (e *tarEngine) Close() error {
+	return errors.Wrap(e.fh.Close(), "close archive")
+}
+
+// OpenTar opens a new reference to the OCI image contained in the tar archive
+// at the provided path. The archive must contain an OCI image layout at its
+// root (as produced by "tar -C <image> -cf <path> ."). The archive is only
+// scanned once, and blobs are read directly from the archive without being
+// extracted. Images opened this way are read-only -- all operations which
+// would modify the image return an error wrapping cas.ErrNotImplemented.
+func OpenTar(path string) (cas.Engine, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open archive")
+	}
+
+	engine := &tarEngine{
+		path:  path,
+		fh:    fh,
+		files: map[string]tarFile{},
+	}
+	if err := engine.index(); err != nil {
+		fh.Close()
+		return nil, errors.Wrap(err, "index archive")
+	}
+	if err := engine.validate(); err != nil {
+		fh.Close()
+		return nil, errors.Wrap(err, "validate")
+	}
+	return engine, nil
+}
@@ -0,0 +1,224 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// tarLayout creates a tar archive of the directory at src (in the same way
+// as "tar -C src -cf dst .").
+func tarLayout(t *testing.T, src, dst string) {
+	fh, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	tw := tar.NewWriter(fh)
+	if err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = "./" + filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if _, err := tw.Write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEngineTar(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineTar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+
+	blobs := map[digest.Digest][]byte{}
+	for _, data := range [][]byte{
+		[]byte("some blob"),
+		bytes.Repeat([]byte("another blob"), 4096),
+		[]byte(""),
+	} {
+		digest, _, err := engine.PutBlob(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("PutBlob: unexpected error: %+v", err)
+		}
+		blobs[digest] = data
+	}
+
+	var descriptors []ispec.Descriptor
+	for digest, data := range blobs {
+		descriptors = append(descriptors, ispec.Descriptor{
+			MediaType: "application/octet-stream",
+			Digest:    digest,
+			Size:      int64(len(data)),
+		})
+	}
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	index.Manifests = descriptors
+	if err := engine.PutIndex(ctx, index); err != nil {
+		t.Fatalf("PutIndex: unexpected error: %+v", err)
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(root, "image.tar")
+	tarLayout(t, image, archive)
+
+	engine, err = Open(archive)
+	if err != nil {
+		t.Fatalf("unexpected error opening archive: %+v", err)
+	}
+	defer engine.Close()
+
+	gotIndex, err := engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	if !reflect.DeepEqual(gotIndex, index) {
+		t.Errorf("GetIndex: index doesn't match: expected %v got %v", index, gotIndex)
+	}
+
+	for digest, data := range blobs {
+		reader, err := engine.GetBlob(ctx, digest)
+		if err != nil {
+			t.Fatalf("GetBlob: unexpected error: %+v", err)
+		}
+		gotData, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("GetBlob: unexpected error reading blob: %+v", err)
+		}
+		if !bytes.Equal(gotData, data) {
+			t.Errorf("GetBlob: blob %s doesn't match", digest)
+		}
+	}
+
+	gotBlobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	if len(gotBlobs) != len(blobs) {
+		t.Errorf("ListBlobs: expected %d blobs, got %v", len(blobs), gotBlobs)
+	}
+	for _, digest := range gotBlobs {
+		if _, ok := blobs[digest]; !ok {
+			t.Errorf("ListBlobs: unexpected blob %s", digest)
+		}
+	}
+
+	if _, err := engine.GetBlob(ctx, digest.FromString("does not exist")); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("GetBlob: expected a not-exist error with a missing blob: %+v", err)
+	}
+
+	// The archive is read-only.
+	if _, _, err := engine.PutBlob(ctx, bytes.NewReader([]byte("new blob"))); errors.Cause(err) != cas.ErrNotImplemented {
+		t.Errorf("PutBlob: expected cas.ErrNotImplemented: %+v", err)
+	}
+	if err := engine.PutIndex(ctx, index); errors.Cause(err) != cas.ErrNotImplemented {
+		t.Errorf("PutIndex: expected cas.ErrNotImplemented: %+v", err)
+	}
+	for digest := range blobs {
+		if err := engine.DeleteBlob(ctx, digest); errors.Cause(err) != cas.ErrNotImplemented {
+			t.Errorf("DeleteBlob: expected cas.ErrNotImplemented: %+v", err)
+		}
+	}
+}
+
+func TestEngineTarInvalid(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestEngineTarInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// An archive without an image layout.
+	empty := filepath.Join(root, "empty")
+	if err := os.Mkdir(empty, 0755); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(root, "empty.tar")
+	tarLayout(t, empty, archive)
+	if _, err := Open(archive); errors.Cause(err) != cas.ErrInvalid {
+		t.Errorf("expected cas.ErrInvalid opening archive without a layout: %+v", err)
+	}
+
+	// A file which isn't an archive.
+	notArchive := filepath.Join(root, "not-archive")
+	if err := ioutil.WriteFile(notArchive, bytes.Repeat([]byte("not a tar archive"), 64), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(notArchive); err == nil {
+		t.Errorf("expected error opening file which isn't an archive")
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// BlobHook allows users of an Engine to observe (and veto) modifications of
+// the blobs stored in an image, such as for auditing or enforcing quotas.
+// Engines which support hooks call them before the modification is made
+// visible, and abort the modification if the hook returns an error.
+type BlobHook interface {
+	// BeforePutBlob is called once the contents of a new blob have been
+	// written (but before the blob is stored in the image) with a descriptor
+	// describing the new blob. The MediaType of the descriptor is only set if
+	// the caller of PutBlob provided one with WithMediaType. Returning an
+	// error stops the blob from being stored.
+	BeforePutBlob(ctx context.Context, desc ispec.Descriptor) error
+
+	// BeforeDeleteBlob is called before a blob is removed from the image,
+	// including when blobs are removed by a garbage collection. Returning an
+	// error stops the blob from being removed.
+	BeforeDeleteBlob(ctx context.Context, digest digest.Digest) error
+}
+
+// NoopBlobHook is a BlobHook which allows all modifications.
+type NoopBlobHook struct{}
+
+// BeforePutBlob allows the blob to be stored.
+func (NoopBlobHook) BeforePutBlob(ctx context.Context, desc ispec.Descriptor) error {
+	return nil
+}
+
+// BeforeDeleteBlob allows the blob to be removed.
+func (NoopBlobHook) BeforeDeleteBlob(ctx context.Context, digest digest.Digest) error {
+	return nil
+}
+
+// mediaTypeKey is the context key used by WithMediaType.
+type mediaTypeKey struct{}
+
+// WithMediaType returns a copy of ctx which records the media type of a blob
+// about to be written with PutBlob, so that it can be passed to BlobHooks.
+func WithMediaType(ctx context.Context, mediaType string) context.Context {
+	return context.WithValue(ctx, mediaTypeKey{}, mediaType)
+}
+
+// MediaTypeFromContext returns the media type recorded in ctx with
+// WithMediaType, or "" if there is none.
+func MediaTypeFromContext(ctx context.Context) string {
+	mediaType, _ := ctx.Value(mediaTypeKey{}).(string)
+	return mediaType
+}
@@ -0,0 +1,262 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mem provides an implementation of cas.Engine which keeps the entire
+// image in memory. This is useful for tests and for building images which are
+// only needed transiently, as no temporary directories are required. Nothing
+// is persisted once the engine is closed.
+package mem
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// errClosed is returned by operations on an engine which has been closed.
+var errClosed = errors.New("memory image has been closed")
+
+// Options specifies optional settings for a memory-backed OCI image created
+// with NewWithOptions. They have the same meaning as the equivalent dir.Options.
+type Options struct {
+	// DigestAlgorithm is the digest algorithm used when writing new blobs to
+	// the image. If unset, cas.BlobAlgorithm is used.
+	DigestAlgorithm digest.Algorithm
+
+	// PrettyBlobs causes JSON blobs written through casext to be indented.
+	PrettyBlobs bool
+
+	// BlobHook is called before blobs are stored in or removed from the
+	// image, and can veto the modification by returning an error. If unset,
+	// cas.NoopBlobHook is used.
+	BlobHook cas.BlobHook
+}
+
+type memEngine struct {
+	lock      sync.RWMutex
+	blobs     map[digest.Digest][]byte
+	index     []byte
+	closed    bool
+	algorithm digest.Algorithm
+	pretty    bool
+	hook      cas.BlobHook
+}
+
+// PutBlob adds a new blob to the image. This is idempotent; a nil error
+// means that "the content is stored at DIGEST" without implying "because
+// of this PutBlob() call".
+func (e *memEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	digester := e.algorithm.Digester()
+	var buf bytes.Buffer
+	size, err := io.Copy(io.MultiWriter(&buf, digester.Hash()), reader)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "copy blob")
+	}
+
+	desc := ispec.Descriptor{
+		MediaType: cas.MediaTypeFromContext(ctx),
+		Digest:    digester.Digest(),
+		Size:      size,
+	}
+	if err := e.hook.BeforePutBlob(ctx, desc); err != nil {
+		return "", -1, errors.Wrap(err, "blob hook")
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.closed {
+		return "", -1, errClosed
+	}
+	e.blobs[desc.Digest] = buf.Bytes()
+	return desc.Digest, size, nil
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns os.ErrNotExist if the digest is not found.
+func (e *memEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	if err := digest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if e.closed {
+		return nil, errClosed
+	}
+	blob, ok := e.blobs[digest]
+	if !ok {
+		return nil, errors.Wrap(&os.PathError{Op: "open", Path: digest.String(), Err: os.ErrNotExist}, "open blob")
+	}
+	// Blobs are never modified once stored, so they can be shared.
+	return ioutil.NopCloser(bytes.NewReader(blob)), nil
+}
+
+// DigestAlgorithm returns the digest algorithm used by PutBlob when computing
+// the digest of new blobs.
+func (e *memEngine) DigestAlgorithm() digest.Algorithm {
+	return e.algorithm
+}
+
+// PrettyBlobs returns whether JSON blobs written to the image should be
+// indented (see Options.PrettyBlobs).
+func (e *memEngine) PrettyBlobs() bool {
+	return e.pretty
+}
+
+// PutIndex sets the index of the OCI image to the given index, replacing the
+// previously existing index. The index is stored in its encoded form, so later
+// modifications of index by the caller don't affect the image.
+func (e *memEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	content, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "encode index")
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.closed {
+		return errClosed
+	}
+	e.index = content
+	return nil
+}
+
+// GetIndex returns the index of the OCI image.
+func (e *memEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if e.closed {
+		return ispec.Index{}, errClosed
+	}
+
+	var index ispec.Index
+	if err := json.Unmarshal(e.index, &index); err != nil {
+		return ispec.Index{}, errors.Wrap(err, "parse index")
+	}
+	return index, nil
+}
+
+// DeleteBlob removes a blob from the image. This is idempotent; a nil
+// error means "the content is not in the store" without implying "because
+// of this DeleteBlob() call".
+func (e *memEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	if err := digest.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+	if err := e.hook.BeforeDeleteBlob(ctx, digest); err != nil {
+		return errors.Wrap(err, "blob hook")
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.closed {
+		return errClosed
+	}
+	delete(e.blobs, digest)
+	return nil
+}
+
+// ListBlobs returns the set of blob digests stored in the image.
+func (e *memEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if e.closed {
+		return nil, errClosed
+	}
+
+	digests := []digest.Digest{}
+	for digest := range e.blobs {
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+// Clean executes a garbage collection of any non-blob garbage in the store.
+// Memory images never contain any such garbage, so this is a no-op.
+func (e *memEngine) Clean(ctx context.Context) error {
+	return nil
+}
+
+// Close releases the contents of the image. Subsequent operations will fail.
+func (e *memEngine) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.closed = true
+	e.blobs = nil
+	e.index = nil
+	return nil
+}
+
+// New creates a new empty memory-backed OCI image, equivalent to an image
+// layout created by dir.Create.
+func New() cas.Engine {
+	engine, err := NewWithOptions(nil)
+	if err != nil {
+		// The default options are always valid.
+		panic(err)
+	}
+	return engine
+}
+
+// NewWithOptions is the same as New, except that it allows for the caller to
+// specify non-default options for the created engine.
+func NewWithOptions(opt *Options) (cas.Engine, error) {
+	var options Options
+	if opt != nil {
+		options = *opt
+	}
+
+	algorithm := options.DigestAlgorithm
+	if algorithm == "" {
+		algorithm = cas.BlobAlgorithm
+	}
+	if !cas.IsSupportedAlgorithm(algorithm) {
+		return nil, errors.Errorf("unsupported digest algorithm: %q", algorithm)
+	}
+
+	hook := options.BlobHook
+	if hook == nil {
+		hook = cas.NoopBlobHook{}
+	}
+
+	engine := &memEngine{
+		blobs:     map[digest.Digest][]byte{},
+		algorithm: algorithm,
+		pretty:    options.PrettyBlobs,
+		hook:      hook,
+	}
+
+	defaultIndex := ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+	}
+	if err := engine.PutIndex(context.Background(), defaultIndex); err != nil {
+		return nil, errors.Wrap(err, "put default index")
+	}
+	return engine, nil
+}
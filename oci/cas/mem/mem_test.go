@@ -0,0 +1,258 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mem
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestEngineBlob(t *testing.T) {
+	ctx := context.Background()
+
+	engine := New()
+	defer engine.Close()
+
+	// A new image has an empty index and no blobs.
+	if index, err := engine.GetIndex(ctx); err != nil {
+		t.Errorf("unexpected error getting top-level index: %+v", err)
+	} else if index.SchemaVersion != 2 || len(index.Manifests) > 0 {
+		t.Errorf("new image has unexpected index: %#v", index)
+	}
+	if blobs, err := engine.ListBlobs(ctx); err != nil {
+		t.Errorf("unexpected error listing blobs: %+v", err)
+	} else if len(blobs) > 0 {
+		t.Errorf("new image has blobs: %v", blobs)
+	}
+
+	for _, test := range []struct {
+		bytes []byte
+	}{
+		{[]byte("")},
+		{[]byte("some blob")},
+		{[]byte("another blob")},
+	} {
+		hash := digest.SHA256.FromBytes(test.bytes)
+
+		blobDigest, blobSize, err := engine.PutBlob(ctx, bytes.NewReader(test.bytes))
+		if err != nil {
+			t.Errorf("PutBlob: unexpected error: %+v", err)
+		}
+		if blobDigest != hash {
+			t.Errorf("PutBlob: digest doesn't match: expected=%s got=%s", hash, blobDigest)
+		}
+		if blobSize != int64(len(test.bytes)) {
+			t.Errorf("PutBlob: length doesn't match: expected=%d got=%d", len(test.bytes), blobSize)
+		}
+
+		blobReader, err := engine.GetBlob(ctx, blobDigest)
+		if err != nil {
+			t.Errorf("GetBlob: unexpected error: %+v", err)
+		}
+		gotBytes, err := ioutil.ReadAll(blobReader)
+		if err != nil {
+			t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+		}
+		blobReader.Close()
+		if !bytes.Equal(test.bytes, gotBytes) {
+			t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(test.bytes), string(gotBytes))
+		}
+
+		if err := engine.DeleteBlob(ctx, blobDigest); err != nil {
+			t.Errorf("DeleteBlob: unexpected error: %+v", err)
+		}
+		// Deleting is idempotent.
+		if err := engine.DeleteBlob(ctx, blobDigest); err != nil {
+			t.Errorf("DeleteBlob: unexpected error deleting again: %+v", err)
+		}
+
+		if br, err := engine.GetBlob(ctx, blobDigest); !os.IsNotExist(errors.Cause(err)) {
+			if err == nil {
+				br.Close()
+				t.Errorf("GetBlob: still got blob contents after DeleteBlob!")
+			} else {
+				t.Errorf("GetBlob: unexpected error: %+v", err)
+			}
+		}
+	}
+
+	// Operations on a closed image must fail.
+	if err := engine.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %+v", err)
+	}
+	if _, _, err := engine.PutBlob(ctx, bytes.NewReader(nil)); err == nil {
+		t.Errorf("PutBlob: expected an error after Close")
+	}
+	if _, err := engine.GetIndex(ctx); err == nil {
+		t.Errorf("GetIndex: expected an error after Close")
+	}
+}
+
+func TestEngineBlobSHA512(t *testing.T) {
+	ctx := context.Background()
+
+	engine, err := NewWithOptions(&Options{DigestAlgorithm: digest.SHA512})
+	if err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	defer engine.Close()
+
+	data := []byte("some blob")
+	blobDigest, _, err := engine.PutBlob(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	if expected := digest.SHA512.FromBytes(data); blobDigest != expected {
+		t.Errorf("PutBlob: digest doesn't match: expected=%s got=%s", expected, blobDigest)
+	}
+
+	if _, err := NewWithOptions(&Options{DigestAlgorithm: digest.Algorithm("md5")}); err == nil {
+		t.Errorf("expected an error with an unsupported digest algorithm")
+	}
+}
+
+func TestMemoryImage(t *testing.T) {
+	ctx := context.Background()
+
+	engine := New()
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	// Create an empty image.
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		RootFS: ispec.RootFS{Type: "layers"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a layer to it with a mutator.
+	mutator, err := mutate.New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	data := []byte("some contents")
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "test",
+		Mode:     0644,
+		Typeflag: tar.TypeReg,
+		Size:     int64(len(data)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mutator.Add(ctx, &buffer, ispec.History{Comment: "new layer"}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "latest", newPath.Root()); err != nil {
+		t.Fatalf("unexpected error updating reference: %+v", err)
+	}
+
+	// Read the image back.
+	paths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error resolving reference: %+v", err)
+	}
+	if len(paths) != 1 {
+		t.Fatalf("expected one descriptor for latest, got %d", len(paths))
+	}
+	blob, err := engineExt.FromDescriptor(ctx, paths[0].Descriptor())
+	if err != nil {
+		t.Fatalf("unexpected error reading manifest: %+v", err)
+	}
+	defer blob.Close()
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		t.Fatalf("latest is not a manifest: %#v", blob.Data)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("expected one layer, got %d", len(manifest.Layers))
+	}
+
+	var entries []layer.LayerEntry
+	if err := layer.ListLayer(ctx, engine, manifest.Layers[0].Digest, func(entry layer.LayerEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error listing layer: %+v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "test" || entries[0].Size != int64(len(data)) {
+		t.Errorf("unexpected layer entries: %#v", entries)
+	}
+
+	// Every blob referenced by the image must be stored.
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing blobs: %+v", err)
+	}
+	stored := map[digest.Digest]bool{}
+	for _, blob := range blobs {
+		stored[blob] = true
+	}
+	for _, desc := range []ispec.Descriptor{paths[0].Descriptor(), manifest.Config, manifest.Layers[0]} {
+		if !stored[desc.Digest] {
+			t.Errorf("blob %s is not stored in the image", desc.Digest)
+		}
+	}
+}
+
+// Make sure memEngine implements the optional interfaces of dirEngine.
+var _ cas.PrettyEngine = &memEngine{}
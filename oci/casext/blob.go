@@ -102,8 +102,11 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 	// ispec.MediaTypeImageLayerGzip => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributable => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributableGzip => io.ReadCloser
+	// MediaTypeImageLayerZstd => io.ReadCloser
+	// MediaTypeImageLayerNonDistributableZstd => io.ReadCloser
 	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
-		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip,
+		MediaTypeImageLayerZstd, MediaTypeImageLayerNonDistributableZstd:
 		// There isn't anything else we can practically do here.
 		b.Data = reader
 		return nil
@@ -125,10 +128,16 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 func (b *Blob) Close() {
 	switch b.MediaType {
 	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
-		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip,
+		MediaTypeImageLayerZstd, MediaTypeImageLayerNonDistributableZstd:
 		if b.Data != nil {
 			b.Data.(io.Closer).Close()
 		}
+	default:
+		// Unknown blobs are also left as an io.ReadCloser.
+		if closer, ok := b.Data.(io.Closer); ok {
+			closer.Close()
+		}
 	}
 }
 
@@ -0,0 +1,91 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"time"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ImageCreated returns the creation time of the image described by the given
+// manifest descriptor. The ispec.AnnotationCreated annotation of the manifest
+// takes precedence over the Created field of the image configuration. If
+// neither is set (or the annotation is not a valid RFC 3339 timestamp and the
+// configuration has no Created field), the zero time.Time is returned.
+func (e Engine) ImageCreated(ctx context.Context, manifestDescriptor ispec.Descriptor) (time.Time, error) {
+	// FIXME: Implement support for manifest lists.
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return time.Time{}, errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType)
+	}
+
+	manifestBlob, err := e.FromDescriptor(ctx, manifestDescriptor)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return time.Time{}, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	if value, ok := manifest.Annotations[ispec.AnnotationCreated]; ok {
+		created, err := time.Parse(time.RFC3339, value)
+		if err == nil {
+			return created, nil
+		}
+		log.Warnf("ignoring invalid %s annotation in manifest %s: %v", ispec.AnnotationCreated, manifestDescriptor.Digest, err)
+	}
+
+	configBlob, err := e.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return time.Time{}, errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
+	}
+
+	if config.Created != nil {
+		return *config.Created, nil
+	}
+	return time.Time{}, nil
+}
+
+// ReferenceCreated returns the creation time of the image referenced by the
+// given reference name, as returned by ImageCreated.
+func (e Engine) ReferenceCreated(ctx context.Context, refname string) (time.Time, error) {
+	descriptorPaths, err := e.ResolveReference(ctx, refname)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return time.Time{}, errors.Errorf("tag not found: %s", refname)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return time.Time{}, errors.Errorf("tag is ambiguous: %s", refname)
+	}
+	return e.ImageCreated(ctx, descriptorPaths[0].Descriptor())
+}
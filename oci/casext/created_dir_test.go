@@ -0,0 +1,112 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestEngineReferenceCreated(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineReferenceCreated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	configCreated := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	annotationCreated := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		name          string
+		configCreated *time.Time
+		annotations   map[string]string
+		expected      time.Time
+	}{
+		{"config", &configCreated, nil, configCreated},
+		{"annotation", &configCreated, map[string]string{ispec.AnnotationCreated: annotationCreated.Format(time.RFC3339)}, annotationCreated},
+		{"invalid-annotation", &configCreated, map[string]string{ispec.AnnotationCreated: "not a time"}, configCreated},
+		{"missing", nil, nil, time.Time{}},
+	} {
+		configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+			Created: test.configCreated,
+			RootFS: ispec.RootFS{
+				Type: "layers",
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: unexpected error putting config: %+v", test.name, err)
+		}
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+			Versioned: ispecs.Versioned{
+				SchemaVersion: 2,
+			},
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Annotations: test.annotations,
+		})
+		if err != nil {
+			t.Fatalf("%s: unexpected error putting manifest: %+v", test.name, err)
+		}
+		if err := engineExt.UpdateReference(ctx, test.name, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}); err != nil {
+			t.Fatalf("%s: unexpected error updating reference: %+v", test.name, err)
+		}
+
+		created, err := engineExt.ReferenceCreated(ctx, test.name)
+		if err != nil {
+			t.Errorf("%s: unexpected error getting creation time: %+v", test.name, err)
+			continue
+		}
+		if !created.Equal(test.expected) {
+			t.Errorf("%s: expected creation time %v, got %v", test.name, test.expected, created)
+		}
+	}
+
+	if _, err := engineExt.ReferenceCreated(ctx, "does-not-exist"); err == nil {
+		t.Errorf("expected an error getting the creation time of a non-existent reference")
+	}
+}
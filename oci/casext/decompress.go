@@ -0,0 +1,79 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// DecompressLayer returns a reader which produces the uncompressed contents of
+// a layer blob with the given media type, read from reader. gzip and zstd
+// compressed layers (media types with a "+gzip" or "+zstd" suffix) are
+// decompressed, while uncompressed tar layers are passed through unchanged. An
+// error is returned for any other media type. Closing the returned reader
+// releases the resources used for decompression, but does not close reader.
+func DecompressLayer(reader io.Reader, mediaType string) (io.ReadCloser, error) {
+	base, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse media type %q", mediaType)
+	}
+
+	tarType, compression := base, ""
+	if idx := strings.LastIndex(base, "+"); idx >= 0 {
+		tarType, compression = base[:idx], base[idx+1:]
+	}
+	if !strings.HasSuffix(tarType, ".tar") {
+		return nil, errors.Errorf("unsupported layer media type: %s", mediaType)
+	}
+
+	switch compression {
+	case "":
+		return ioutil.NopCloser(reader), nil
+	case "gzip":
+		gzr, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "create gzip reader")
+		}
+		return gzr, nil
+	case "zstd":
+		zr, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "create zstd reader")
+		}
+		return zstdReader{zr}, nil
+	}
+	return nil, errors.Errorf("unsupported layer compression %q: %s", compression, mediaType)
+}
+
+// zstdReader wraps a zstd.Decoder, whose Close method doesn't implement
+// io.Closer.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (zr zstdReader) Close() error {
+	zr.Decoder.Close()
+	return nil
+}
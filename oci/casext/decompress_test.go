@@ -0,0 +1,93 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestDecompressLayer(t *testing.T) {
+	data := []byte("this is not really a tar archive, but DecompressLayer doesn't care")
+
+	var gzbuf bytes.Buffer
+	gzw := gzip.NewWriter(&gzbuf)
+	if _, err := gzw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdData := zw.EncodeAll(data, nil)
+	zw.Close()
+
+	for _, test := range []struct {
+		mediaType string
+		blob      []byte
+	}{
+		{ispec.MediaTypeImageLayer, data},
+		{ispec.MediaTypeImageLayerNonDistributable, data},
+		{ispec.MediaTypeImageLayerGzip, gzbuf.Bytes()},
+		{ispec.MediaTypeImageLayerNonDistributableGzip, gzbuf.Bytes()},
+		{MediaTypeImageLayerZstd, zstdData},
+		{MediaTypeImageLayerNonDistributableZstd, zstdData},
+	} {
+		reader, err := DecompressLayer(bytes.NewReader(test.blob), test.mediaType)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.mediaType, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Errorf("%s: unexpected read error: %+v", test.mediaType, err)
+		}
+		if err := reader.Close(); err != nil {
+			t.Errorf("%s: unexpected close error: %+v", test.mediaType, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: decompressed data doesn't match original data: got %q", test.mediaType, got)
+		}
+	}
+
+	for _, mediaType := range []string{
+		"",
+		ispec.MediaTypeImageConfig,
+		"application/vnd.oci.image.layer.v1.tar+bzip2",
+		"application/vnd.docker.image.rootfs.diff.tar.gzip",
+		"not a media type;;",
+	} {
+		if _, err := DecompressLayer(bytes.NewReader(data), mediaType); err == nil {
+			t.Errorf("%q: expected DecompressLayer to fail", mediaType)
+		}
+	}
+
+	// Corrupted compressed data must be detected.
+	if _, err := DecompressLayer(bytes.NewReader(data), ispec.MediaTypeImageLayerGzip); err == nil {
+		t.Errorf("expected DecompressLayer to fail with invalid gzip data")
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// fingerprintVersion is the version of the format hashed to produce a
+// fingerprint. It must be incremented whenever the format changes.
+const fingerprintVersion = 1
+
+// FingerprintOptions control which parts of an image are included in its
+// fingerprint.
+type FingerprintOptions struct {
+	// ExcludeAnnotations are the manifest annotations which are not included
+	// in the fingerprint.
+	ExcludeAnnotations []string
+
+	// IncludeCreated causes the creation timestamps of the image (the
+	// configuration's created field, the created field of each history entry
+	// and the ispec.AnnotationCreated annotation) to be included in the
+	// fingerprint. By default they are ignored.
+	IncludeCreated bool
+}
+
+// Fingerprint computes a digest of the meaningful contents of the image
+// referenced by the given manifest descriptor. The configuration (which
+// includes the DiffIDs of the layers) and manifest annotations are
+// canonicalised by re-encoding them, so the fingerprint doesn't depend on the
+// formatting of the blobs or on the compression of the layers.
+func (e Engine) Fingerprint(ctx context.Context, manifestDescriptor ispec.Descriptor, opt *FingerprintOptions) (digest.Digest, error) {
+	var fingerprintOptions FingerprintOptions
+	if opt != nil {
+		fingerprintOptions = *opt
+	}
+
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return "", errors.Errorf("fingerprint: cannot fingerprint a non-manifest descriptor: invalid media type '%s'", manifestDescriptor.MediaType)
+	}
+
+	manifestBlob, err := e.FromDescriptor(ctx, manifestDescriptor)
+	if err != nil {
+		return "", errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return "", errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	configBlob, err := e.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return "", errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return "", errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
+	}
+
+	annotations := map[string]string{}
+	for key, value := range manifest.Annotations {
+		annotations[key] = value
+	}
+	for _, key := range fingerprintOptions.ExcludeAnnotations {
+		delete(annotations, key)
+	}
+
+	if !fingerprintOptions.IncludeCreated {
+		delete(annotations, ispec.AnnotationCreated)
+		config.Created = nil
+		history := make([]ispec.History, len(config.History))
+		for idx, entry := range config.History {
+			entry.Created = nil
+			history[idx] = entry
+		}
+		config.History = history
+	}
+
+	// encoding/json sorts map keys, so this encoding is canonical.
+	data, err := json.Marshal(struct {
+		Version     int               `json:"version"`
+		Config      ispec.Image       `json:"config"`
+		Annotations map[string]string `json:"annotations"`
+	}{
+		Version:     fingerprintVersion,
+		Config:      config,
+		Annotations: annotations,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "encode fingerprint")
+	}
+	return cas.BlobAlgorithm.FromBytes(data), nil
+}
@@ -0,0 +1,127 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestEngineFingerprint(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineFingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	// putImage stores an image with the given creation time and manifest
+	// annotations, and returns its manifest descriptor.
+	putImage := func(created time.Time, annotations map[string]string) ispec.Descriptor {
+		configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+			Created: &created,
+			Author:  "umoci",
+			RootFS: ispec.RootFS{
+				Type:    "layers",
+				DiffIDs: []digest.Digest{digest.FromString("layer")},
+			},
+			History: []ispec.History{{Created: &created, CreatedBy: "test"}},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error putting config: %+v", err)
+		}
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+			Versioned: ispecs.Versioned{
+				SchemaVersion: 2,
+			},
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Annotations: annotations,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error putting manifest: %+v", err)
+		}
+		return ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}
+	}
+	fingerprint := func(descriptor ispec.Descriptor, opt *FingerprintOptions) digest.Digest {
+		fp, err := engineExt.Fingerprint(ctx, descriptor, opt)
+		if err != nil {
+			t.Fatalf("unexpected error fingerprinting %s: %+v", descriptor.Digest, err)
+		}
+		return fp
+	}
+
+	timeA := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeB := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	imageA := putImage(timeA, map[string]string{ispec.AnnotationCreated: timeA.Format(time.RFC3339), "build": "1"})
+	imageB := putImage(timeB, map[string]string{ispec.AnnotationCreated: timeB.Format(time.RFC3339), "build": "2"})
+	if imageA.Digest == imageB.Digest {
+		t.Fatalf("test images must differ")
+	}
+
+	// Timestamps are ignored by default, but other annotations are not.
+	if fingerprint(imageA, nil) != fingerprint(imageA, nil) {
+		t.Errorf("fingerprint is not stable")
+	}
+	if fingerprint(imageA, nil) == fingerprint(imageB, nil) {
+		t.Errorf("expected images with different annotations to have different fingerprints")
+	}
+	exclude := &FingerprintOptions{ExcludeAnnotations: []string{"build"}}
+	if fingerprint(imageA, exclude) != fingerprint(imageB, exclude) {
+		t.Errorf("expected images differing only in timestamps and excluded annotations to have the same fingerprint")
+	}
+	exclude.IncludeCreated = true
+	if fingerprint(imageA, exclude) == fingerprint(imageB, exclude) {
+		t.Errorf("expected images with different timestamps to have different fingerprints with IncludeCreated")
+	}
+
+	// Only manifests can be fingerprinted.
+	config := ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: imageA.Digest, Size: imageA.Size}
+	if _, err := engineExt.Fingerprint(ctx, config, nil); err == nil {
+		t.Errorf("expected an error fingerprinting a non-manifest descriptor")
+	}
+}
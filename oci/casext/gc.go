@@ -18,6 +18,10 @@
 package casext
 
 import (
+	"io"
+	"io/ioutil"
+	"os"
+
 	"github.com/apex/log"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -25,37 +29,29 @@ import (
 	"golang.org/x/net/context"
 )
 
-// GC will perform a mark-and-sweep garbage collection of the OCI image
-// referenced by the given CAS engine. The root set is taken to be the set of
-// references stored in the image, and all blobs not reachable by following a
-// descriptor path from the root set will be removed.
-//
-// GC will only call ListBlobs and ListReferences once, and assumes that there
-// is no change in the set of references or blobs after calling those
-// functions. In other words, it assumes it is the only user of the image that
-// is making modifications. Things will not go well if this assumption is
-// challenged.
-func (e Engine) GC(ctx context.Context) error {
+// referencedBlobs returns the set of blobs which are reachable from the
+// references stored in the image (the "black set" of a garbage collection).
+func (e Engine) referencedBlobs(ctx context.Context) (map[digest.Digest]struct{}, error) {
 	// Generate the root set of descriptors.
 	var root []ispec.Descriptor
 
 	names, err := e.ListReferences(ctx)
 	if err != nil {
-		return errors.Wrap(err, "get roots")
+		return nil, errors.Wrap(err, "get roots")
 	}
 
 	for _, name := range names {
 		// TODO: This code is no longer necessary once we have index.json.
 		descriptorPaths, err := e.ResolveReference(ctx, name)
 		if err != nil {
-			return errors.Wrapf(err, "get root %s", name)
+			return nil, errors.Wrapf(err, "get root %s", name)
 		}
 		if len(descriptorPaths) == 0 {
-			return errors.Errorf("tag not found: %s", name)
+			return nil, errors.Errorf("tag not found: %s", name)
 		}
 		if len(descriptorPaths) != 1 {
 			// TODO: Handle this more nicely.
-			return errors.Errorf("tag is ambiguous: %s", name)
+			return nil, errors.Errorf("tag is ambiguous: %s", name)
 		}
 		descriptor := descriptorPaths[0].Descriptor()
 		log.WithFields(log.Fields{
@@ -74,20 +70,73 @@ func (e Engine) GC(ctx context.Context) error {
 
 		reachables, err := e.Reachable(ctx, descriptor)
 		if err != nil {
-			return errors.Wrapf(err, "getting reachables from root %d", idx)
+			return nil, errors.Wrapf(err, "getting reachables from root %d", idx)
 		}
 		for _, reachable := range reachables {
 			black[reachable] = struct{}{}
 		}
 	}
+	return black, nil
+}
+
+// GCReport describes the blobs removed by GC.
+type GCReport struct {
+	// RemovedBlobs is the number of blobs which were removed.
+	RemovedBlobs int `json:"removed_blobs"`
+
+	// RemovedBytes is the total size (in bytes) of the removed blobs.
+	RemovedBytes int64 `json:"removed_bytes"`
+}
+
+// blobSize returns the size of the blob with the given digest. If the engine
+// returns a file, it is stat(2)ed rather than read.
+func (e Engine) blobSize(ctx context.Context, digest digest.Digest) (int64, error) {
+	reader, err := e.GetBlob(ctx, digest)
+	if err != nil {
+		return 0, errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	if statter, ok := reader.(interface {
+		Stat() (os.FileInfo, error)
+	}); ok {
+		fi, err := statter.Stat()
+		if err != nil {
+			return 0, errors.Wrap(err, "stat blob")
+		}
+		return fi.Size(), nil
+	}
+	size, err := io.Copy(ioutil.Discard, reader)
+	return size, errors.Wrap(err, "read blob")
+}
+
+// GC will perform a mark-and-sweep garbage collection of the OCI image
+// referenced by the given CAS engine. The root set is taken to be the set of
+// references stored in the image, and all blobs not reachable by following a
+// descriptor path from the root set will be removed. The number and total
+// size of the removed blobs are returned in the GCReport.
+//
+// GC will only call ListBlobs and ListReferences once, and assumes that there
+// is no change in the set of references or blobs after calling those
+// functions. In other words, it assumes it is the only user of the image that
+// is making modifications. Things will not go well if this assumption is
+// challenged. The only exception is the temporary state of other users of the
+// image, which the CAS engine is expected to protect from Clean (the dir
+// engine holds a flock(2) on its temporary directory for this purpose).
+func (e Engine) GC(ctx context.Context) (GCReport, error) {
+	var report GCReport
+
+	black, err := e.referencedBlobs(ctx)
+	if err != nil {
+		return report, errors.Wrap(err, "mark referenced blobs")
+	}
 
 	// Sweep all blobs in the white set.
 	blobs, err := e.ListBlobs(ctx)
 	if err != nil {
-		return errors.Wrap(err, "get blob list")
+		return report, errors.Wrap(err, "get blob list")
 	}
 
-	n := 0
 	for _, digest := range blobs {
 		if _, ok := black[digest]; ok {
 			// Digest is in the black set.
@@ -95,17 +144,22 @@ func (e Engine) GC(ctx context.Context) error {
 		}
 		log.Infof("garbage collecting blob: %s", digest)
 
+		size, err := e.blobSize(ctx, digest)
+		if err != nil {
+			return report, errors.Wrapf(err, "get size of unmarked blob %s", digest)
+		}
 		if err := e.DeleteBlob(ctx, digest); err != nil {
-			return errors.Wrapf(err, "remove unmarked blob %s", digest)
+			return report, errors.Wrapf(err, "remove unmarked blob %s", digest)
 		}
-		n++
+		report.RemovedBlobs++
+		report.RemovedBytes += size
 	}
 
 	// Finally, tell CAS to GC it.
 	if err := e.Clean(ctx); err != nil {
-		return errors.Wrapf(err, "clean engine")
+		return report, errors.Wrapf(err, "clean engine")
 	}
 
-	log.Debugf("garbage collected %d blobs", n)
-	return nil
+	log.Debugf("garbage collected %d blobs (%d bytes)", report.RemovedBlobs, report.RemovedBytes)
+	return report, nil
 }
@@ -0,0 +1,140 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestEngineGC(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineGC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	// Create a minimal image.
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader([]byte("layer data")))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{})
+	if err != nil {
+		t.Fatalf("PutBlobJSON: unexpected error: %+v", err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: ispecs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{
+			{
+				MediaType: ispec.MediaTypeImageLayer,
+				Digest:    layerDigest,
+				Size:      layerSize,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("PutBlobJSON: unexpected error: %+v", err)
+	}
+	manifestDescriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+	if err := engineExt.UpdateReference(ctx, "tag", manifestDescriptor); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// Nothing is removed from a consistent image.
+	report, err := engineExt.GC(ctx)
+	if err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	if report != (GCReport{}) {
+		t.Errorf("GC: removed blobs from consistent image: %+v", report)
+	}
+
+	// Add some orphan blobs.
+	var orphans []digest.Digest
+	var orphanSize int64
+	for _, data := range [][]byte{
+		[]byte("orphan blob"),
+		bytes.Repeat([]byte("another orphan blob"), 1024),
+	} {
+		digest, size, err := engineExt.PutBlob(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("PutBlob: unexpected error: %+v", err)
+		}
+		if size != int64(len(data)) {
+			t.Fatalf("PutBlob: unexpected size: expected %d got %d", len(data), size)
+		}
+		orphans = append(orphans, digest)
+		orphanSize += size
+	}
+
+	report, err = engineExt.GC(ctx)
+	if err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	if expected := (GCReport{RemovedBlobs: 2, RemovedBytes: orphanSize}); report != expected {
+		t.Errorf("GC: unexpected report: expected %+v got %+v", expected, report)
+	}
+
+	for _, orphan := range orphans {
+		if exists, err := engineExt.blobExists(ctx, orphan); err != nil {
+			t.Errorf("blobExists: unexpected error: %+v", err)
+		} else if exists {
+			t.Errorf("GC: orphan blob %s was not removed", orphan)
+		}
+	}
+
+	// The referenced image is intact.
+	if err := engineExt.VerifyReferences(ctx, "tag"); err != nil {
+		t.Errorf("GC: removed referenced blob: %+v", err)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"encoding/json"
 
+	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
@@ -32,13 +33,20 @@ import (
 // implementation, we cannot guarantee that two calls to PutBlobJSON() will
 // return the same digest.
 //
+// If the underlying engine is a cas.PrettyEngine with PrettyBlobs enabled, the
+// blob is indented rather than being stored in the compact form.
+//
 // TODO: Use a proper JSON serialisation library, which actually guarantees
 //       consistent output. Go's JSON library doesn't even attempt to sort
 //       map[...]... objects (which have their iteration order randomised in
 //       Go).
 func (e Engine) PutBlobJSON(ctx context.Context, data interface{}) (digest.Digest, int64, error) {
 	var buffer bytes.Buffer
-	if err := json.NewEncoder(&buffer).Encode(data); err != nil {
+	encoder := json.NewEncoder(&buffer)
+	if pretty, ok := e.Engine.(cas.PrettyEngine); ok && pretty.PrettyBlobs() {
+		encoder.SetIndent("", "\t")
+	}
+	if err := encoder.Encode(data); err != nil {
 		return "", -1, errors.Wrap(err, "encode JSON")
 	}
 	return e.PutBlob(ctx, &buffer)
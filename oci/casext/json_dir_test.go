@@ -26,6 +26,7 @@ import (
 	"testing"
 
 	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
@@ -197,3 +198,72 @@ func TestEngineBlobJSONReadonly(t *testing.T) {
 		readwrite(t, image)
 	}
 }
+
+func TestEngineBlobJSONPretty(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobJSONPretty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	type object struct {
+		A string `json:"A"`
+		B int64  `json:"B,omitempty"`
+	}
+	obj := object{"a value", 100}
+
+	var digests []digest.Digest
+	for _, pretty := range []bool{false, true} {
+		engine, err := dir.OpenWithOptions(image, &dir.Options{PrettyBlobs: pretty})
+		if err != nil {
+			t.Fatalf("unexpected error opening image: %+v", err)
+		}
+		engineExt := NewEngine(engine)
+		defer engine.Close()
+
+		blobDigest, _, err := engineExt.PutBlobJSON(ctx, obj)
+		if err != nil {
+			t.Fatalf("PutBlobJSON: unexpected error: %+v", err)
+		}
+		digests = append(digests, blobDigest)
+
+		blobReader, err := engine.GetBlob(ctx, blobDigest)
+		if err != nil {
+			t.Fatalf("GetBlob: unexpected error: %+v", err)
+		}
+		defer blobReader.Close()
+
+		gotBytes, err := ioutil.ReadAll(blobReader)
+		if err != nil {
+			t.Fatalf("GetBlob: failed to ReadAll: %+v", err)
+		}
+
+		expected := "{\"A\":\"a value\",\"B\":100}\n"
+		if pretty {
+			expected = "{\n\t\"A\": \"a value\",\n\t\"B\": 100\n}\n"
+		}
+		if string(gotBytes) != expected {
+			t.Errorf("GetBlob: unexpected blob (pretty=%v): expected=%q got=%q", pretty, expected, string(gotBytes))
+		}
+
+		// Both forms must decode to the same object.
+		var gotObject object
+		if err := json.Unmarshal(gotBytes, &gotObject); err != nil {
+			t.Errorf("GetBlob: got an invalid JSON blob: %+v", err)
+		}
+		if !reflect.DeepEqual(obj, gotObject) {
+			t.Errorf("GetBlob: got different object to original JSON. expected=%v got=%v", obj, gotObject)
+		}
+	}
+
+	if digests[0] == digests[1] {
+		t.Errorf("PutBlobJSON: pretty and compact blobs have the same digest %s", digests[0])
+	}
+}
@@ -0,0 +1,60 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The zstd-compressed layer media types, which are not defined by the
+// version of the image-spec that umoci currently uses.
+const (
+	// MediaTypeImageLayerZstd is the media type used for zstd compressed
+	// layers referenced by the manifest.
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// MediaTypeImageLayerNonDistributableZstd is the media type for zstd
+	// compressed layers referenced by the manifest but with distribution
+	// restrictions.
+	MediaTypeImageLayerNonDistributableZstd = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+)
+
+// IsNonDistributableMediaType returns whether the given media type is one of
+// the non-distributable layer media types (uncompressed, gzip or zstd).
+func IsNonDistributableMediaType(mediaType string) bool {
+	switch mediaType {
+	case ispec.MediaTypeImageLayerNonDistributable,
+		ispec.MediaTypeImageLayerNonDistributableGzip,
+		MediaTypeImageLayerNonDistributableZstd:
+		return true
+	}
+	return false
+}
+
+// IsLayerMediaType returns whether the given media type is one of the layer
+// media types known to umoci. This includes both distributable and
+// non-distributable layers.
+func IsLayerMediaType(mediaType string) bool {
+	switch mediaType {
+	case ispec.MediaTypeImageLayer,
+		ispec.MediaTypeImageLayerGzip,
+		MediaTypeImageLayerZstd:
+		return true
+	}
+	return IsNonDistributableMediaType(mediaType)
+}
@@ -0,0 +1,48 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestLayerMediaTypes(t *testing.T) {
+	for _, test := range []struct {
+		mediaType               string
+		layer, nonDistributable bool
+	}{
+		{ispec.MediaTypeImageLayer, true, false},
+		{ispec.MediaTypeImageLayerGzip, true, false},
+		{MediaTypeImageLayerZstd, true, false},
+		{ispec.MediaTypeImageLayerNonDistributable, true, true},
+		{ispec.MediaTypeImageLayerNonDistributableGzip, true, true},
+		{MediaTypeImageLayerNonDistributableZstd, true, true},
+		{ispec.MediaTypeImageConfig, false, false},
+		{ispec.MediaTypeImageManifest, false, false},
+		{"application/vnd.docker.image.rootfs.diff.tar.gzip", false, false},
+	} {
+		if layer := IsLayerMediaType(test.mediaType); layer != test.layer {
+			t.Errorf("IsLayerMediaType(%q): expected %v got %v", test.mediaType, test.layer, layer)
+		}
+		if nonDistributable := IsNonDistributableMediaType(test.mediaType); nonDistributable != test.nonDistributable {
+			t.Errorf("IsNonDistributableMediaType(%q): expected %v got %v", test.mediaType, test.nonDistributable, nonDistributable)
+		}
+	}
+}
@@ -18,7 +18,10 @@
 package casext
 
 import (
+	"sort"
+
 	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
@@ -30,10 +33,7 @@ func isKnownMediaType(mediaType string) bool {
 	return mediaType == ispec.MediaTypeDescriptor ||
 		mediaType == ispec.MediaTypeImageManifest ||
 		mediaType == ispec.MediaTypeImageIndex ||
-		mediaType == ispec.MediaTypeImageLayer ||
-		mediaType == ispec.MediaTypeImageLayerGzip ||
-		mediaType == ispec.MediaTypeImageLayerNonDistributable ||
-		mediaType == ispec.MediaTypeImageLayerNonDistributableGzip ||
+		IsLayerMediaType(mediaType) ||
 		mediaType == ispec.MediaTypeImageConfig
 }
 
@@ -106,6 +106,20 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]Descrip
 // descriptor. If there are multiple descriptors that match the refname they
 // are all replaced with the given descriptor.
 func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor ispec.Descriptor) error {
+	return e.UpdateReferences(ctx, map[string]ispec.Descriptor{refname: descriptor})
+}
+
+// UpdateReferences is equivalent to calling UpdateReference for each of the
+// (refname, descriptor) pairs in refs, except that the index is only written
+// once. Since cas.Engine.PutIndex is atomic, readers will either see all of
+// the updated references or none of them (even if umoci is interrupted while
+// updating the index).
+func (e Engine) UpdateReferences(ctx context.Context, refs map[string]ispec.Descriptor) error {
+	if len(refs) == 0 {
+		// Nothing to do.
+		return nil
+	}
+
 	// Get index to modify.
 	index, err := e.GetIndex(ctx)
 	if err != nil {
@@ -114,22 +128,35 @@ func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor
 
 	// TODO: Handle refname = "".
 	var newIndex []ispec.Descriptor
+	replaced := map[string]int{}
 	for _, descriptor := range index.Manifests {
-		if descriptor.Annotations[ispec.AnnotationRefName] != refname {
-			newIndex = append(newIndex, descriptor)
+		refname := descriptor.Annotations[ispec.AnnotationRefName]
+		if _, ok := refs[refname]; ok {
+			replaced[refname]++
+			continue
 		}
+		newIndex = append(newIndex, descriptor)
 	}
-	if len(newIndex)-len(index.Manifests) > 1 {
-		// Warn users if the operation is going to remove more than one references.
-		log.Warn("multiple references match the given reference name -- all of them have been replaced due to this ambiguity")
+
+	// Append the descriptors, in a stable order so the index is reproducible.
+	var refnames []string
+	for refname := range refs {
+		refnames = append(refnames, refname)
 	}
+	sort.Strings(refnames)
+	for _, refname := range refnames {
+		if replaced[refname] > 1 {
+			// Warn users if the operation is going to remove more than one references.
+			log.Warnf("multiple references match the reference name %q -- all of them have been replaced due to this ambiguity", refname)
+		}
 
-	// Append the descriptor.
-	if descriptor.Annotations == nil {
-		descriptor.Annotations = map[string]string{}
+		descriptor := refs[refname]
+		if descriptor.Annotations == nil {
+			descriptor.Annotations = map[string]string{}
+		}
+		descriptor.Annotations[ispec.AnnotationRefName] = refname
+		newIndex = append(newIndex, descriptor)
 	}
-	descriptor.Annotations[ispec.AnnotationRefName] = refname
-	newIndex = append(newIndex, descriptor)
 
 	// Commit to image.
 	index.Manifests = newIndex
@@ -180,6 +207,45 @@ func (e Engine) AddReferences(ctx context.Context, refname string, descriptors .
 	return nil
 }
 
+// Tag creates a new reference newName pointing to the same descriptor as the
+// existing reference oldName, without modifying any blobs. If newName already
+// exists, an error wrapping cas.ErrClobber is returned unless overwrite is
+// set (in which case the existing entries for newName are replaced). oldName
+// must resolve to exactly one descriptor.
+func (e Engine) Tag(ctx context.Context, oldName, newName string, overwrite bool) error {
+	descriptorPaths, err := e.ResolveReference(ctx, oldName)
+	if err != nil {
+		return errors.Wrapf(err, "resolve %s", oldName)
+	}
+	if len(descriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", oldName)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", oldName)
+	}
+	descriptor := descriptorPaths[0].Descriptor()
+
+	if !overwrite {
+		existing, err := e.ResolveReference(ctx, newName)
+		if err != nil {
+			return errors.Wrapf(err, "resolve %s", newName)
+		}
+		if len(existing) > 0 {
+			return errors.Wrapf(cas.ErrClobber, "tag already exists: %s", newName)
+		}
+	}
+
+	// Don't modify the annotations of the original descriptor.
+	annotations := map[string]string{}
+	for key, value := range descriptor.Annotations {
+		annotations[key] = value
+	}
+	descriptor.Annotations = annotations
+
+	return errors.Wrap(e.UpdateReference(ctx, newName, descriptor), "put reference")
+}
+
 // DeleteReference removes all entries in the index that match the given
 // refname.
 func (e Engine) DeleteReference(ctx context.Context, refname string) error {
@@ -210,8 +276,9 @@ func (e Engine) DeleteReference(ctx context.Context, refname string) error {
 }
 
 // ListReferences returns all of the ref.name entries that are specified in the
-// top-level index. Note that the list may contain duplicates, due to the
-// nature of references in the image-spec.
+// top-level index, sorted by name. Entries without a ref.name annotation are
+// ignored. Note that the list may contain duplicates, due to the nature of
+// references in the image-spec.
 func (e Engine) ListReferences(ctx context.Context) ([]string, error) {
 	// Get index.
 	index, err := e.GetIndex(ctx)
@@ -226,5 +293,6 @@ func (e Engine) ListReferences(ctx context.Context) ([]string, error) {
 			refs = append(refs, ref)
 		}
 	}
+	sort.Strings(refs)
 	return refs, nil
 }
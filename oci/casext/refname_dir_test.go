@@ -32,10 +32,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/opencontainers/go-digest"
 	ispecs "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
@@ -381,3 +383,229 @@ func TestEngineReferenceReadonly(t *testing.T) {
 		readwrite(t, image)
 	}
 }
+
+// putIndexEngine wraps a cas.Engine, counting the number of PutIndex calls
+// and optionally failing them.
+type putIndexEngine struct {
+	cas.Engine
+	calls int
+	fail  bool
+}
+
+func (e *putIndexEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	e.calls++
+	if e.fail {
+		return errors.Errorf("injected PutIndex failure")
+	}
+	return e.Engine.PutIndex(ctx, index)
+}
+
+func TestEngineUpdateReferences(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineUpdateReferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, NewEngine(engine))
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+
+	refs := map[string]ispec.Descriptor{}
+	for idx, test := range descMap {
+		refs[fmt.Sprintf("multi_tag_%d", idx)] = test.index
+	}
+
+	// If the index write fails, none of the references may be visible.
+	failEngine := &putIndexEngine{Engine: engine, fail: true}
+	if err := NewEngine(failEngine).UpdateReferences(ctx, refs); err == nil {
+		t.Errorf("UpdateReferences: expected error with failing PutIndex")
+	}
+	for name := range refs {
+		if gotDescriptorPaths, err := NewEngine(engine).ResolveReference(ctx, name); err != nil {
+			t.Errorf("ResolveReference: unexpected error: %+v", err)
+		} else if len(gotDescriptorPaths) > 0 {
+			t.Errorf("ResolveReference: got reference %q after failed UpdateReferences", name)
+		}
+	}
+
+	// All of the references must be written with a single index update.
+	countEngine := &putIndexEngine{Engine: engine}
+	if err := NewEngine(countEngine).UpdateReferences(ctx, refs); err != nil {
+		t.Fatalf("UpdateReferences: unexpected error: %+v", err)
+	}
+	if countEngine.calls != 1 {
+		t.Errorf("UpdateReferences: expected 1 PutIndex call, got %d", countEngine.calls)
+	}
+	for name, descriptor := range refs {
+		gotDescriptorPaths, err := NewEngine(engine).ResolveReference(ctx, name)
+		if err != nil {
+			t.Errorf("ResolveReference: unexpected error: %+v", err)
+			continue
+		}
+		if len(gotDescriptorPaths) == 0 {
+			t.Errorf("ResolveReference: reference %q missing after UpdateReferences", name)
+			continue
+		}
+		if got := gotDescriptorPaths[0].Root().Digest; got != descriptor.Digest {
+			t.Errorf("ResolveReference: %q has wrong root: expected %s got %s", name, descriptor.Digest, got)
+		}
+	}
+}
+
+func TestEngineListReferences(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineListReferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+
+	// An empty image has no references.
+	names, err := engineExt.ListReferences(ctx)
+	if err != nil {
+		t.Fatalf("ListReferences: unexpected error: %+v", err)
+	}
+	if len(names) != 0 {
+		t.Errorf("ListReferences: unexpected references in empty image: %v", names)
+	}
+
+	// Add the tags in reverse order, as well as an index entry without a
+	// reference name (which must be ignored).
+	if err := engineExt.UpdateReference(ctx, "zzz-tag", descMap[0].index); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "aaa-tag", descMap[1].index); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	index.Manifests = append(index.Manifests, descMap[2].index)
+	if err := engineExt.PutIndex(ctx, index); err != nil {
+		t.Fatalf("PutIndex: unexpected error: %+v", err)
+	}
+
+	names, err = engineExt.ListReferences(ctx)
+	if err != nil {
+		t.Fatalf("ListReferences: unexpected error: %+v", err)
+	}
+	if expected := []string{"aaa-tag", "zzz-tag"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("ListReferences: expected %v got %v", expected, names)
+	}
+}
+
+func TestEngineTag(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineTag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "v1.2.3", descMap[2].index); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "other", descMap[1].index); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	blobs, err := engineExt.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+
+	// Tagging a non-existent reference fails.
+	if err := engineExt.Tag(ctx, "does-not-exist", "latest", false); err == nil {
+		t.Errorf("Tag: expected error tagging non-existent reference")
+	}
+
+	if err := engineExt.Tag(ctx, "v1.2.3", "latest", false); err != nil {
+		t.Fatalf("Tag: unexpected error: %+v", err)
+	}
+	for _, name := range []string{"v1.2.3", "latest"} {
+		descriptorPaths, err := engineExt.ResolveReference(ctx, name)
+		if err != nil {
+			t.Fatalf("ResolveReference: unexpected error: %+v", err)
+		}
+		if len(descriptorPaths) != 1 {
+			t.Fatalf("ResolveReference: expected %q to resolve to one descriptor, got %d", name, len(descriptorPaths))
+		}
+		if got := descriptorPaths[0].Descriptor(); got.Digest != descMap[2].result.Digest {
+			t.Errorf("ResolveReference: %q resolved to %s, expected %s", name, got.Digest, descMap[2].result.Digest)
+		}
+	}
+
+	// No blobs were added.
+	newBlobs, err := engineExt.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	if len(newBlobs) != len(blobs) {
+		t.Errorf("Tag: number of blobs changed from %d to %d", len(blobs), len(newBlobs))
+	}
+
+	// Existing tags are only replaced if requested.
+	if err := engineExt.Tag(ctx, "other", "latest", false); errors.Cause(err) != cas.ErrClobber {
+		t.Errorf("Tag: expected cas.ErrClobber replacing existing tag: %+v", err)
+	}
+	if err := engineExt.Tag(ctx, "other", "latest", true); err != nil {
+		t.Fatalf("Tag: unexpected error replacing existing tag: %+v", err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatalf("ResolveReference: unexpected error: %+v", err)
+	}
+	if len(descriptorPaths) != 1 || descriptorPaths[0].Descriptor().Digest != descMap[1].result.Digest {
+		t.Errorf("Tag: latest wasn't replaced: %v", descriptorPaths)
+	}
+}
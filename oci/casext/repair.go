@@ -0,0 +1,174 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// RepairOptions specifies the behaviour of Repair.
+type RepairOptions struct {
+	// RemoveUnreferenced indicates that blobs which are not reachable from
+	// the top-level index should be removed. Otherwise they are only
+	// reported.
+	RemoveUnreferenced bool
+}
+
+// RepairReport describes the problems found (and fixed) by Repair.
+type RepairReport struct {
+	// DanglingReferences are the entries which were removed from the
+	// top-level index because the blob they referenced doesn't exist.
+	DanglingReferences []ispec.Descriptor `json:"dangling_references"`
+
+	// MissingBlobs are the blobs which are referenced by a blob reachable
+	// from the top-level index, but which don't exist. These are only
+	// reported, as removing the referencing blob would modify an image.
+	MissingBlobs []digest.Digest `json:"missing_blobs"`
+
+	// UnreferencedBlobs are the blobs which are not reachable from the
+	// top-level index. If RepairOptions.RemoveUnreferenced was set, these
+	// blobs have been removed.
+	UnreferencedBlobs []digest.Digest `json:"unreferenced_blobs"`
+}
+
+// blobExists returns whether the blob with the given digest exists.
+func (e Engine) blobExists(ctx context.Context, digest digest.Digest) (bool, error) {
+	reader, err := e.GetBlob(ctx, digest)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return false, nil
+		}
+		return false, err
+	}
+	reader.Close()
+	return true, nil
+}
+
+// Repair validates the image referenced by the CAS engine, and fixes any
+// inconsistencies found. Entries in the top-level index which reference blobs
+// that don't exist are removed, and blobs which are not reachable from the
+// top-level index are reported (and removed if requested). Repair is
+// conservative: it will never remove a blob that is reachable from any entry
+// in the top-level index (regardless of whether the entry has a reference
+// name), and blobs which are missing from an otherwise valid image are only
+// reported. If opt is nil, the default options are used.
+//
+// Like GC, Repair assumes it is the only user of the image that is making
+// modifications.
+func (e Engine) Repair(ctx context.Context, opt *RepairOptions) (RepairReport, error) {
+	var repairOpt RepairOptions
+	if opt != nil {
+		repairOpt = *opt
+	}
+	report := RepairReport{
+		DanglingReferences: []ispec.Descriptor{},
+		MissingBlobs:       []digest.Digest{},
+		UnreferencedBlobs:  []digest.Digest{},
+	}
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return report, errors.Wrap(err, "get top-level index")
+	}
+
+	// Remove all of the dangling entries from the index.
+	var roots []ispec.Descriptor
+	for _, descriptor := range index.Manifests {
+		exists, err := e.blobExists(ctx, descriptor.Digest)
+		if err != nil {
+			return report, errors.Wrapf(err, "check root %s", descriptor.Digest)
+		}
+		if !exists {
+			log.WithFields(log.Fields{
+				"name":   descriptor.Annotations[ispec.AnnotationRefName],
+				"digest": descriptor.Digest,
+			}).Infof("repair: removing dangling reference")
+			report.DanglingReferences = append(report.DanglingReferences, descriptor)
+			continue
+		}
+		roots = append(roots, descriptor)
+	}
+	if len(report.DanglingReferences) > 0 {
+		index.Manifests = roots
+		if err := e.PutIndex(ctx, index); err != nil {
+			return report, errors.Wrap(err, "replace index")
+		}
+	}
+
+	// Mark everything reachable from the remaining roots. We don't use
+	// Reachable here because we want to continue past missing blobs.
+	black := map[digest.Digest]struct{}{}
+	missing := map[digest.Digest]struct{}{}
+	for _, root := range roots {
+		if err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+			descriptor := descriptorPath.Descriptor()
+			if _, ok := black[descriptor.Digest]; ok {
+				return nil
+			}
+			exists, err := e.blobExists(ctx, descriptor.Digest)
+			if err != nil {
+				return errors.Wrapf(err, "check blob %s", descriptor.Digest)
+			}
+			if !exists {
+				if _, ok := missing[descriptor.Digest]; !ok {
+					log.WithFields(log.Fields{
+						"digest": descriptor.Digest,
+					}).Infof("repair: referenced blob is missing")
+					missing[descriptor.Digest] = struct{}{}
+					report.MissingBlobs = append(report.MissingBlobs, descriptor.Digest)
+				}
+				return ErrSkipDescriptor
+			}
+			black[descriptor.Digest] = struct{}{}
+			return nil
+		}); err != nil {
+			return report, errors.Wrapf(err, "mark from root %s", root.Digest)
+		}
+	}
+
+	// Find (and optionally sweep) all blobs in the white set.
+	blobs, err := e.ListBlobs(ctx)
+	if err != nil {
+		return report, errors.Wrap(err, "get blob list")
+	}
+	for _, digest := range blobs {
+		if _, ok := black[digest]; ok {
+			continue
+		}
+		report.UnreferencedBlobs = append(report.UnreferencedBlobs, digest)
+		if repairOpt.RemoveUnreferenced {
+			log.Infof("repair: removing unreferenced blob: %s", digest)
+			if err := e.DeleteBlob(ctx, digest); err != nil {
+				return report, errors.Wrapf(err, "remove unreferenced blob %s", digest)
+			}
+		}
+	}
+	if repairOpt.RemoveUnreferenced {
+		if err := e.Clean(ctx); err != nil {
+			return report, errors.Wrap(err, "clean engine")
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,162 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestEngineRepair(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineRepair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "valid", descMap[0].index); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// A reference to a blob that doesn't exist.
+	dangling := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("does not exist"),
+		Size:      1337,
+	}
+	if err := engineExt.UpdateReference(ctx, "dangling", dangling); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// An unreferenced blob.
+	unreferenced, _, err := engineExt.PutBlob(ctx, bytes.NewBufferString("unreferenced"))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+
+	// Check the report without removing anything.
+	report, err := engineExt.Repair(ctx, nil)
+	if err != nil {
+		t.Fatalf("Repair: unexpected error: %+v", err)
+	}
+	if len(report.DanglingReferences) != 1 || report.DanglingReferences[0].Digest != dangling.Digest {
+		t.Errorf("Repair: expected dangling reference %s, got %v", dangling.Digest, report.DanglingReferences)
+	}
+	if len(report.MissingBlobs) != 0 {
+		t.Errorf("Repair: unexpected missing blobs: %v", report.MissingBlobs)
+	}
+	found := false
+	for _, digest := range report.UnreferencedBlobs {
+		if digest == unreferenced {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Repair: unreferenced blob %s not reported: %v", unreferenced, report.UnreferencedBlobs)
+	}
+	if _, err := engineExt.GetBlob(ctx, unreferenced); err != nil {
+		t.Errorf("Repair: unreferenced blob removed without RemoveUnreferenced: %+v", err)
+	}
+
+	names, err := engineExt.ListReferences(ctx)
+	if err != nil {
+		t.Fatalf("ListReferences: unexpected error: %+v", err)
+	}
+	if len(names) != 1 || names[0] != "valid" {
+		t.Errorf("Repair: expected only the valid reference to remain, got %v", names)
+	}
+
+	// Now actually remove the unreferenced blobs.
+	report, err = engineExt.Repair(ctx, &RepairOptions{RemoveUnreferenced: true})
+	if err != nil {
+		t.Fatalf("Repair: unexpected error: %+v", err)
+	}
+	if len(report.DanglingReferences) != 0 {
+		t.Errorf("Repair: unexpected dangling references on second run: %v", report.DanglingReferences)
+	}
+	if _, err := engineExt.GetBlob(ctx, unreferenced); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("Repair: unreferenced blob was not removed: %+v", err)
+	}
+
+	// The referenced image must be untouched.
+	reachable, err := engineExt.Reachable(ctx, descMap[0].index)
+	if err != nil {
+		t.Fatalf("Reachable: unexpected error after repair: %+v", err)
+	}
+	for _, digest := range reachable {
+		if _, err := engineExt.GetBlob(ctx, digest); err != nil {
+			t.Errorf("Repair: referenced blob %s was removed: %+v", digest, err)
+		}
+	}
+
+	// A missing blob inside a referenced image is only reported.
+	paths, err := engineExt.Paths(ctx, descMap[0].index)
+	if err != nil {
+		t.Fatalf("Paths: unexpected error: %+v", err)
+	}
+	var layer digest.Digest
+	for _, path := range paths {
+		if path.Descriptor().MediaType == ispec.MediaTypeImageLayer {
+			layer = path.Descriptor().Digest
+			break
+		}
+	}
+	if layer == "" {
+		t.Fatalf("could not find layer in image")
+	}
+	if err := engineExt.DeleteBlob(ctx, layer); err != nil {
+		t.Fatalf("DeleteBlob: unexpected error: %+v", err)
+	}
+	report, err = engineExt.Repair(ctx, &RepairOptions{RemoveUnreferenced: true})
+	if err != nil {
+		t.Fatalf("Repair: unexpected error: %+v", err)
+	}
+	if len(report.MissingBlobs) != 1 || report.MissingBlobs[0] != layer {
+		t.Errorf("Repair: expected missing blob %s, got %v", layer, report.MissingBlobs)
+	}
+	if len(report.UnreferencedBlobs) != 0 {
+		t.Errorf("Repair: removed blobs of an incomplete image: %v", report.UnreferencedBlobs)
+	}
+}
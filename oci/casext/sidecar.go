@@ -0,0 +1,87 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AnnotationSidecarPrefix is the prefix of descriptor annotations which
+// reference "sidecar" blobs. A sidecar blob contains auxiliary metadata about
+// the blob referenced by the descriptor (such as an index of the contents of
+// a layer), and the value of the annotation is the digest of the sidecar
+// blob. Walk treats sidecar blobs as children of the descriptor, which means
+// that they will not be garbage collected while the descriptor is reachable.
+const AnnotationSidecarPrefix = "org.opensuse.umoci.sidecar."
+
+// sidecarMediaType is the media type used for the descriptors of sidecar
+// blobs, as the annotation doesn't contain the media type.
+const sidecarMediaType = "application/octet-stream"
+
+// sidecarDescriptors returns the set of descriptors for the sidecar blobs
+// referenced by the annotations of the given descriptor, sorted by annotation
+// key so that the order doesn't depend on map iteration.
+func sidecarDescriptors(descriptor ispec.Descriptor) []ispec.Descriptor {
+	var keys []string
+	for key := range descriptor.Annotations {
+		if strings.HasPrefix(key, AnnotationSidecarPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var sidecars []ispec.Descriptor
+	for _, key := range keys {
+		value := descriptor.Annotations[key]
+		sidecarDigest := digest.Digest(value)
+		if err := sidecarDigest.Validate(); err != nil {
+			log.Warnf("ignoring sidecar annotation %s with invalid digest %q: %v", key, value, err)
+			continue
+		}
+		sidecars = append(sidecars, ispec.Descriptor{
+			MediaType: sidecarMediaType,
+			Digest:    sidecarDigest,
+		})
+	}
+	return sidecars
+}
+
+// isSidecarPath returns whether the last descriptor in the given path is a
+// sidecar descriptor (as returned by sidecarDescriptors) referenced by the
+// annotations of its parent. The size of such descriptors is not known.
+func isSidecarPath(descriptorPath DescriptorPath) bool {
+	if len(descriptorPath.Walk) < 2 {
+		return false
+	}
+	descriptor := descriptorPath.Descriptor()
+	if descriptor.MediaType != sidecarMediaType {
+		return false
+	}
+	parent := descriptorPath.Walk[len(descriptorPath.Walk)-2]
+	for key, value := range parent.Annotations {
+		if strings.HasPrefix(key, AnnotationSidecarPrefix) && digest.Digest(value) == descriptor.Digest {
+			return true
+		}
+	}
+	return false
+}
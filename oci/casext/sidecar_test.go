@@ -0,0 +1,55 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestSidecarDescriptorsOrder(t *testing.T) {
+	descriptor := ispec.Descriptor{
+		MediaType:   ispec.MediaTypeImageLayerGzip,
+		Digest:      digest.FromString("layer"),
+		Annotations: map[string]string{"org.opencontainers.image.title": "layer"},
+	}
+	var expected []digest.Digest
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		sidecarDigest := digest.FromString(name)
+		descriptor.Annotations[AnnotationSidecarPrefix+name] = sidecarDigest.String()
+		expected = append(expected, sidecarDigest)
+	}
+	descriptor.Annotations[AnnotationSidecarPrefix+"invalid"] = "not a digest"
+
+	// Map iteration order is randomised, so check the order several times.
+	for i := 0; i < 20; i++ {
+		var got []digest.Digest
+		for _, sidecar := range sidecarDescriptors(descriptor) {
+			if sidecar.MediaType != sidecarMediaType {
+				t.Errorf("unexpected sidecar media type: %s", sidecar.MediaType)
+			}
+			got = append(got, sidecar.Digest)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("unexpected sidecar descriptors: expected %v got %v", expected, got)
+		}
+	}
+}
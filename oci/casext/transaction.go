@@ -0,0 +1,109 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Transaction is a cas.Engine which keeps track of the blobs written to an
+// image through it, so that they can be removed if the operation writing them
+// fails (making the operation all-or-nothing). Blobs which already existed
+// when the Transaction was created are never removed by Rollback.
+type Transaction struct {
+	cas.Engine
+
+	lock     sync.Mutex
+	existing map[digest.Digest]struct{}
+	written  map[digest.Digest]struct{}
+}
+
+// NewTransaction creates a new Transaction wrapping the given engine. All
+// writes made through the Transaction are tracked.
+func NewTransaction(ctx context.Context, engine cas.Engine) (*Transaction, error) {
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list existing blobs")
+	}
+	existing := map[digest.Digest]struct{}{}
+	for _, blob := range blobs {
+		existing[blob] = struct{}{}
+	}
+	return &Transaction{
+		Engine:   engine,
+		existing: existing,
+		written:  map[digest.Digest]struct{}{},
+	}, nil
+}
+
+// PutBlob adds a new blob to the image (see cas.Engine), and records it so
+// that it can be removed by Rollback.
+func (t *Transaction) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	blobDigest, size, err := t.Engine.PutBlob(ctx, reader)
+	if err != nil {
+		return blobDigest, size, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.existing[blobDigest]; !ok {
+		t.written[blobDigest] = struct{}{}
+	}
+	return blobDigest, size, nil
+}
+
+// PrettyBlobs implements cas.PrettyEngine by deferring to the wrapped engine.
+func (t *Transaction) PrettyBlobs() bool {
+	pretty, ok := t.Engine.(cas.PrettyEngine)
+	return ok && pretty.PrettyBlobs()
+}
+
+// Rollback removes all of the blobs written through the Transaction which did
+// not exist when the Transaction was created. Blobs which are referenced by
+// the image (such as if a reference was updated to point to them, possibly by
+// another user of the image) are not removed. Once Rollback returns, the
+// Transaction no longer tracks any written blobs.
+func (t *Transaction) Rollback(ctx context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	referenced, err := NewEngine(t.Engine).referencedBlobs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "mark referenced blobs")
+	}
+
+	for blob := range t.written {
+		if _, ok := referenced[blob]; ok {
+			log.Debugf("rollback: keeping referenced blob %s", blob)
+			continue
+		}
+		log.Debugf("rollback: removing blob %s", blob)
+		if err := t.Engine.DeleteBlob(ctx, blob); err != nil {
+			return errors.Wrapf(err, "remove blob %s", blob)
+		}
+		delete(t.written, blob)
+	}
+	return nil
+}
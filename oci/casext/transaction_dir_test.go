@@ -0,0 +1,120 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestTransactionRollback(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestTransactionRollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	existing, _, err := engine.PutBlob(ctx, bytes.NewBufferString("existing blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := NewTransaction(ctx, engine)
+	if err != nil {
+		t.Fatalf("unexpected error starting transaction: %+v", err)
+	}
+	txnExt := NewEngine(txn)
+
+	var written []digest.Digest
+	for _, data := range []string{"existing blob", "new blob"} {
+		blob, _, err := txnExt.PutBlob(ctx, bytes.NewBufferString(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, blob)
+	}
+
+	// Blobs which are referenced by the image must not be removed.
+	configDigest, configSize, err := txnExt.PutBlobJSON(ctx, ispec.Image{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{},
+	}
+	manifestDigest, manifestSize, err := txnExt.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txnExt.UpdateReference(ctx, "tag", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := txn.Rollback(ctx); err != nil {
+		t.Fatalf("unexpected error rolling back transaction: %+v", err)
+	}
+
+	for _, test := range []struct {
+		blob   digest.Digest
+		exists bool
+	}{
+		{existing, true},
+		{written[0], true},
+		{written[1], false},
+		{configDigest, true},
+		{manifestDigest, true},
+	} {
+		blob, err := engine.GetBlob(ctx, test.blob)
+		if err == nil {
+			blob.Close()
+		}
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("blob %s: expected exists=%v after rollback, got %v (%v)", test.blob, test.exists, exists, err)
+		}
+	}
+}
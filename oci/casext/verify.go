@@ -0,0 +1,162 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// VerifyReferences checks that every blob transitively referenced by the
+// given reference name (the manifest, its configuration, layers and so on)
+// exists in the image, returning a "missing blob" error for the first one
+// which doesn't. Only the existence of the blobs is checked (their contents
+// are not verified against their digests), which makes this a cheap check to
+// run before an operation which would otherwise fail part-way through on an
+// incomplete image.
+func (e Engine) VerifyReferences(ctx context.Context, refname string) error {
+	descriptorPaths, err := e.ResolveReference(ctx, refname)
+	if err != nil {
+		return errors.Wrap(err, "resolve reference")
+	}
+	if len(descriptorPaths) == 0 {
+		return errors.Errorf("reference not found: %s", refname)
+	}
+	for _, descriptorPath := range descriptorPaths {
+		if err := e.VerifyDescriptor(ctx, descriptorPath.Descriptor()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyDescriptor is the same as VerifyReferences, except that it checks
+// the blobs transitively referenced by the given descriptor.
+func (e Engine) VerifyDescriptor(ctx context.Context, root ispec.Descriptor) error {
+	checked := map[digest.Digest]struct{}{}
+	err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+		descriptor := descriptorPath.Descriptor()
+		if _, ok := checked[descriptor.Digest]; ok {
+			// We've already checked this blob and its children.
+			return ErrSkipDescriptor
+		}
+		exists, err := e.blobExists(ctx, descriptor.Digest)
+		if err != nil {
+			return errors.Wrapf(err, "check blob %s", descriptor.Digest)
+		}
+		if !exists {
+			return errors.Errorf("missing blob %s (%s)", descriptor.Digest, descriptor.MediaType)
+		}
+		checked[descriptor.Digest] = struct{}{}
+		return nil
+	})
+	return errors.Wrapf(err, "verify %s", root.Digest)
+}
+
+// BlobMismatch describes a blob whose contents don't match the descriptor
+// referencing it.
+type BlobMismatch struct {
+	// Descriptor is the descriptor referencing the blob.
+	Descriptor ispec.Descriptor
+
+	// Digest and Size are the actual digest and size of the blob contents.
+	Digest digest.Digest
+	Size   int64
+}
+
+// VerifyError is returned by Verify if any blobs don't match the descriptors
+// referencing them.
+type VerifyError struct {
+	// Mismatches contains every mismatched blob, in the order they were
+	// found.
+	Mismatches []BlobMismatch
+}
+
+// Error implements the error interface.
+func (err *VerifyError) Error() string {
+	var mismatches []string
+	for _, mismatch := range err.Mismatches {
+		mismatches = append(mismatches, fmt.Sprintf("%s (%s): got digest %s and size %d, expected size %d",
+			mismatch.Descriptor.Digest, mismatch.Descriptor.MediaType, mismatch.Digest, mismatch.Size, mismatch.Descriptor.Size))
+	}
+	return fmt.Sprintf("%d blobs do not match their descriptors: %s", len(err.Mismatches), strings.Join(mismatches, "; "))
+}
+
+// Verify reads every blob transitively referenced by the given descriptor,
+// and checks that its digest and size match the descriptor referencing it
+// (only the digest is checked for sidecar blobs, which are referenced by an
+// annotation that doesn't include their size).
+// Unlike VerifyDescriptor, the contents of every blob are read, so this can
+// be used to detect corruption of an image before distributing it. Rather
+// than stopping at the first mismatched blob, Verify returns a *VerifyError
+// listing all of the mismatched blobs (the children of a mismatched blob are
+// not checked, because its contents can't be trusted). Other errors, such as
+// missing blobs, are returned as-is.
+func (e Engine) Verify(ctx context.Context, root ispec.Descriptor) error {
+	checked := map[digest.Digest]struct{}{}
+	var mismatches []BlobMismatch
+	err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+		descriptor := descriptorPath.Descriptor()
+		if _, ok := checked[descriptor.Digest]; ok {
+			// We've already checked this blob and its children.
+			return ErrSkipDescriptor
+		}
+		checked[descriptor.Digest] = struct{}{}
+
+		algorithm := descriptor.Digest.Algorithm()
+		if !algorithm.Available() {
+			return errors.Errorf("unsupported digest algorithm of blob %s", descriptor.Digest)
+		}
+		reader, err := e.GetBlob(ctx, descriptor.Digest)
+		if err != nil {
+			return errors.Wrapf(err, "get blob %s", descriptor.Digest)
+		}
+		defer reader.Close()
+
+		digester := algorithm.Digester()
+		size, err := io.Copy(digester.Hash(), reader)
+		if err != nil {
+			return errors.Wrapf(err, "read blob %s", descriptor.Digest)
+		}
+		// Sidecar descriptors are synthesised from an annotation containing
+		// only the digest, so their size can't be checked.
+		sizeMismatch := size != descriptor.Size && !isSidecarPath(descriptorPath)
+		if digester.Digest() != descriptor.Digest || sizeMismatch {
+			mismatches = append(mismatches, BlobMismatch{
+				Descriptor: descriptor,
+				Digest:     digester.Digest(),
+				Size:       size,
+			})
+			return ErrSkipDescriptor
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "verify %s", root.Digest)
+	}
+	if len(mismatches) > 0 {
+		return &VerifyError{Mismatches: mismatches}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestEngineVerifyReferences(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineVerifyReferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	for idx, test := range descMap {
+		if err := engineExt.UpdateReference(ctx, fmt.Sprintf("tag_%d", idx), test.index); err != nil {
+			t.Fatalf("UpdateReference: unexpected error: %+v", err)
+		}
+	}
+
+	// All of the references are complete.
+	for idx := range descMap {
+		if err := engineExt.VerifyReferences(ctx, fmt.Sprintf("tag_%d", idx)); err != nil {
+			t.Errorf("VerifyReferences: unexpected error with complete image: %+v", err)
+		}
+	}
+
+	// Unknown references are an error.
+	if err := engineExt.VerifyReferences(ctx, "does-not-exist"); err == nil {
+		t.Errorf("VerifyReferences: expected an error with a non-existent reference")
+	}
+
+	// Remove one of the layers of tag_0.
+	manifestBlob, err := engineExt.FromDescriptor(ctx, descMap[0].result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := manifestBlob.Data.(ispec.Manifest)
+	manifestBlob.Close()
+	missing := manifest.Layers[len(manifest.Layers)-1].Digest
+	if err := engineExt.DeleteBlob(ctx, missing); err != nil {
+		t.Fatal(err)
+	}
+
+	err = engineExt.VerifyReferences(ctx, "tag_0")
+	if err == nil {
+		t.Fatalf("VerifyReferences: expected an error with a missing layer")
+	}
+	if !strings.Contains(err.Error(), "missing blob "+missing.String()) {
+		t.Errorf("VerifyReferences: expected error to mention missing blob %s: %v", missing, err)
+	}
+
+	// The other references are unaffected.
+	if err := engineExt.VerifyReferences(ctx, "tag_1"); err != nil {
+		t.Errorf("VerifyReferences: unexpected error with complete image: %+v", err)
+	}
+}
+
+func TestEngineVerify(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineVerify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+
+	// All of the blobs are intact.
+	for _, test := range descMap {
+		if err := engineExt.Verify(ctx, test.index); err != nil {
+			t.Errorf("Verify: unexpected error with intact image: %+v", err)
+		}
+	}
+
+	// Corrupt one of the layers of the first image, without changing its
+	// size.
+	manifestBlob, err := engineExt.FromDescriptor(ctx, descMap[0].result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := manifestBlob.Data.(ispec.Manifest)
+	manifestBlob.Close()
+	corrupt := manifest.Layers[1]
+
+	blobPath := filepath.Join(image, "blobs", corrupt.Digest.Algorithm().String(), corrupt.Digest.Hex())
+	data, err := ioutil.ReadFile(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := ioutil.WriteFile(blobPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = engineExt.Verify(ctx, descMap[0].index)
+	if err == nil {
+		t.Fatalf("Verify: expected an error with a corrupted layer")
+	}
+	verifyErr, ok := errors.Cause(err).(*VerifyError)
+	if !ok {
+		t.Fatalf("Verify: expected a *VerifyError: %+v", err)
+	}
+	if len(verifyErr.Mismatches) != 1 {
+		t.Fatalf("Verify: expected exactly one mismatch: %v", verifyErr)
+	}
+	mismatch := verifyErr.Mismatches[0]
+	if !reflect.DeepEqual(mismatch.Descriptor, corrupt) {
+		t.Errorf("Verify: unexpected mismatched descriptor: expected %v got %v", corrupt, mismatch.Descriptor)
+	}
+	if mismatch.Digest == corrupt.Digest {
+		t.Errorf("Verify: mismatch has the expected digest %s", mismatch.Digest)
+	}
+	if mismatch.Size != corrupt.Size {
+		t.Errorf("Verify: unexpected mismatch size: expected %d got %d", corrupt.Size, mismatch.Size)
+	}
+
+	// The other images are unaffected.
+	if err := engineExt.Verify(ctx, descMap[1].index); err != nil {
+		t.Errorf("Verify: unexpected error with intact image: %+v", err)
+	}
+}
+
+func TestEngineVerifySidecar(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineVerifySidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	layerData := "fake layer data"
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, strings.NewReader(layerData))
+	if err != nil {
+		t.Fatalf("put layer: %+v", err)
+	}
+	sidecarDigest, _, err := engineExt.PutBlobJSON(ctx, map[string][]string{
+		"paths": {"etc/passwd", "var/cache"},
+	})
+	if err != nil {
+		t.Fatalf("put sidecar: %+v", err)
+	}
+	layer := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    layerDigest,
+		Size:      layerSize,
+		Annotations: map[string]string{
+			AnnotationSidecarPrefix + "test": sidecarDigest.String(),
+		},
+	}
+
+	// The sidecar descriptor has no size, which must not be treated as a
+	// mismatch.
+	if err := engineExt.Verify(ctx, layer); err != nil {
+		t.Errorf("Verify: unexpected error with intact sidecar: %+v", err)
+	}
+
+	// Corrupting the sidecar must still be detected.
+	blobPath := filepath.Join(image, "blobs", sidecarDigest.Algorithm().String(), sidecarDigest.Hex())
+	if err := ioutil.WriteFile(blobPath, []byte(`{"paths":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = engineExt.Verify(ctx, layer)
+	verifyErr, ok := errors.Cause(err).(*VerifyError)
+	if !ok {
+		t.Fatalf("Verify: expected a *VerifyError with a corrupted sidecar: %+v", err)
+	}
+	if len(verifyErr.Mismatches) != 1 || verifyErr.Mismatches[0].Descriptor.Digest != sidecarDigest {
+		t.Errorf("Verify: expected only the sidecar to mismatch: %v", verifyErr)
+	}
+}
@@ -117,8 +117,17 @@ func (ws *walkState) recurse(ctx context.Context, descriptorPath DescriptorPath)
 		return err
 	}
 
-	// Get blob to recurse into.
+	// Sidecar blobs are children of the descriptor that references them.
 	descriptor := descriptorPath.Descriptor()
+	for _, sidecar := range sidecarDescriptors(descriptor) {
+		if err := ws.recurse(ctx, DescriptorPath{
+			Walk: append(descriptorPath.Walk, sidecar),
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Get blob to recurse into.
 	blob, err := ws.engine.FromDescriptor(ctx, descriptor)
 	if err != nil {
 		// Ignore cases where the descriptor points to an object we don't know
@@ -22,9 +22,11 @@ import (
 	"sort"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 )
 
 // FIXME: Because we are not a part of upstream, we have to add some tests that
@@ -159,6 +161,50 @@ func (g *Generator) AddConfigEnv(name, value string) {
 	g.image.Config.Env = append(g.image.Config.Env, env)
 }
 
+// SetConfigEnv sets the value of an environment variable to be used in a
+// container. As with AddConfigEnv, an existing entry for the variable is
+// replaced in place (so the order of the environment is preserved), and the
+// variable is only appended if it isn't already set. Unlike AddConfigEnv, any
+// duplicate entries for the variable are removed, and the name is validated:
+// it must be non-empty and cannot contain '=' or whitespace.
+func (g *Generator) SetConfigEnv(name, value string) error {
+	if name == "" {
+		return errors.Errorf("environment variable name cannot be empty")
+	}
+	if strings.IndexFunc(name, func(r rune) bool { return r == '=' || unicode.IsSpace(r) }) >= 0 {
+		return errors.Errorf("invalid environment variable name: %q", name)
+	}
+	entry := fmt.Sprintf("%s=%s", name, value)
+	env := []string{}
+	found := false
+	for _, v := range g.image.Config.Env {
+		if strings.HasPrefix(v, name+"=") {
+			if found {
+				continue
+			}
+			v, found = entry, true
+		}
+		env = append(env, v)
+	}
+	if !found {
+		env = append(env, entry)
+	}
+	g.image.Config.Env = env
+	return nil
+}
+
+// RemoveConfigEnv removes all entries for an environment variable from the
+// list of environment variables to be used in a container.
+func (g *Generator) RemoveConfigEnv(name string) {
+	env := []string{}
+	for _, v := range g.image.Config.Env {
+		if !strings.HasPrefix(v, name+"=") {
+			env = append(env, v)
+		}
+	}
+	g.image.Config.Env = env
+}
+
 // ConfigEnv returns the list of environment variables to be used in a container.
 func (g *Generator) ConfigEnv() []string {
 	copy := []string{}
@@ -246,8 +292,12 @@ func (g *Generator) ClearConfigLabels() {
 	g.image.Config.Labels = map[string]string{}
 }
 
-// AddConfigLabel adds a label to the set of arbitrary metadata for the container.
+// AddConfigLabel adds a label to the set of arbitrary metadata for the container,
+// replacing any existing label with the same name.
 func (g *Generator) AddConfigLabel(label, value string) {
+	if g.image.Config.Labels == nil {
+		g.ClearConfigLabels()
+	}
 	g.image.Config.Labels[label] = value
 }
 
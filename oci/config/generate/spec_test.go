@@ -257,6 +257,61 @@ func TestConfigEnv(t *testing.T) {
 	}
 }
 
+func TestConfigSetEnv(t *testing.T) {
+	g := New()
+
+	// Duplicate entries (which AddConfigEnv doesn't remove) are replaced by
+	// a single entry, in the position of the first one.
+	g.image.Config.Env = []string{"PATH=/bin", "HOME=/root", "PATH=/sbin"}
+	if err := g.SetConfigEnv("PATH", "/usr/bin"); err != nil {
+		t.Fatalf("unexpected error setting PATH: %+v", err)
+	}
+	if err := g.SetConfigEnv("PATH", "/usr/local/bin:/usr/bin"); err != nil {
+		t.Fatalf("unexpected error setting PATH: %+v", err)
+	}
+	env := []string{"PATH=/usr/local/bin:/usr/bin", "HOME=/root"}
+	if got := g.ConfigEnv(); !reflect.DeepEqual(env, got) {
+		t.Errorf("ConfigEnv doesn't match: expected %v, got %v", env, got)
+	}
+
+	for _, name := range []string{"", "A=B", "A B", "A\tB", "A\n"} {
+		if err := g.SetConfigEnv(name, "value"); err == nil {
+			t.Errorf("expected an error setting invalid name %q", name)
+		}
+	}
+	if got := g.ConfigEnv(); !reflect.DeepEqual(env, got) {
+		t.Errorf("ConfigEnv changed by invalid names: expected %v, got %v", env, got)
+	}
+
+	// Only exact names are removed.
+	g.AddConfigEnv("PATHS", "x")
+	g.RemoveConfigEnv("PATH")
+	env = []string{"HOME=/root", "PATHS=x"}
+	if got := g.ConfigEnv(); !reflect.DeepEqual(env, got) {
+		t.Errorf("ConfigEnv doesn't match: expected %v, got %v", env, got)
+	}
+	g.RemoveConfigEnv("NONEXISTENT")
+	if got := g.ConfigEnv(); !reflect.DeepEqual(env, got) {
+		t.Errorf("ConfigEnv doesn't match: expected %v, got %v", env, got)
+	}
+
+	// Existing variables keep their position, and new ones are appended.
+	g.image.Config.Env = []string{"PATH=/bin", "HOME=/root", "LANG=C"}
+	for _, kv := range [][2]string{
+		{"HOME", "/home/user"},
+		{"TERM", "xterm"},
+		{"PATH", "/usr/bin"},
+	} {
+		if err := g.SetConfigEnv(kv[0], kv[1]); err != nil {
+			t.Fatalf("unexpected error setting %s: %+v", kv[0], err)
+		}
+	}
+	env = []string{"PATH=/usr/bin", "HOME=/home/user", "LANG=C", "TERM=xterm"}
+	if got := g.ConfigEnv(); !reflect.DeepEqual(env, got) {
+		t.Errorf("ConfigEnv order not preserved: expected %v, got %v", env, got)
+	}
+}
+
 func TestConfigLabels(t *testing.T) {
 	g := New()
 	labels := map[string]string{
@@ -293,6 +348,24 @@ func TestConfigLabels(t *testing.T) {
 	}
 }
 
+func TestConfigLabelsNil(t *testing.T) {
+	// A zero Generator has no label map, which must be created as needed.
+	var g Generator
+	g.RemoveConfigLabel("nonexist")
+	g.AddConfigLabel("org.example.a", "1")
+	g.AddConfigLabel("org.example.b", "2")
+	g.AddConfigLabel("org.example.a", "3")
+	g.RemoveConfigLabel("org.example.b")
+
+	expected := map[string]string{"org.example.a": "3"}
+	if got := g.ConfigLabels(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("ConfigLabels doesn't match: expected %v, got %v", expected, got)
+	}
+	if got := g.Image().Config.Labels; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Config.Labels doesn't match: expected %v, got %v", expected, got)
+	}
+}
+
 func TestConfigStopSignal(t *testing.T) {
 	g := New()
 	signals := []string{
@@ -0,0 +1,322 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// The layout of a layer cache directory (PackOptions.LayerCacheDir) is as
+// follows. Each generated layer is stored (uncompressed) in
+// "blobs/<algorithm>/<encoded>", named by its DiffID. In addition, for each
+// cache key "keys/<key>" contains the DiffID of the layer generated for that
+// key. This means that layers with identical contents are only stored once.
+const (
+	cacheBlobsDir = "blobs"
+	cacheKeysDir  = "keys"
+)
+
+// layerCacheKeyVersion must be incremented whenever the layer generation code
+// changes in a way that would result in different layers for the same set of
+// deltas, so that stale cache entries are not used.
+const layerCacheKeyVersion = 3
+
+// cacheDelta is the representation of an mtree.InodeDelta used when computing
+// layer cache keys.
+type cacheDelta struct {
+	Type     mtree.DifferenceType `json:"type"`
+	Path     string               `json:"path"`
+	Keywords []string             `json:"keywords,omitempty"`
+}
+
+// layerCacheKey computes the cache key of the layer that would be generated
+// from the given deltas and options. The key is derived from the path, type
+// and new keyword values of every delta, so only the inode attributes tracked
+// by the mtree keywords used to generate the deltas are taken into account.
+// In particular, a cache directory should only be used with deltas that
+// include a content digest keyword (such as "sha256digest").
+func layerCacheKey(deltas []mtree.InodeDelta, opt PackOptions) (string, error) {
+	key := struct {
+		Version        int                `json:"version"`
+		MapOptions     MapOptions         `json:"map_options"`
+		MaxFileSize    int64              `json:"max_file_size"`
+		FileSizePolicy FileSizePolicy     `json:"file_size_policy"`
+		OnUnreadable   UnreadablePolicy   `json:"on_unreadable,omitempty"`
+		Timestamps     TimestampPolicy    `json:"timestamps,omitempty"`
+		SourceDate     string             `json:"source_date_epoch,omitempty"`
+		DedupWhiteouts bool               `json:"dedup_whiteouts,omitempty"`
+		FileFlags      bool               `json:"file_flags,omitempty"`
+		OmitRoot       bool               `json:"omit_root_entry,omitempty"`
+		Canonical      bool               `json:"canonical,omitempty"`
+		StrictOrder    bool               `json:"strict_dir_ordering,omitempty"`
+		XattrPrefixes  []string           `json:"xattr_prefixes,omitempty"`
+		Overrides      []MetadataOverride `json:"metadata_overrides,omitempty"`
+		Passwd         digest.Digest      `json:"passwd,omitempty"`
+		Group          digest.Digest      `json:"group,omitempty"`
+		Deltas         []cacheDelta       `json:"deltas"`
+	}{
+		Version:        layerCacheKeyVersion,
+		MapOptions:     opt.MapOptions,
+		MaxFileSize:    opt.MaxFileSize,
+		FileSizePolicy: opt.FileSizePolicy,
+		OnUnreadable:   opt.OnUnreadable,
+		Timestamps:     opt.Timestamps,
+		DedupWhiteouts: opt.DeduplicateWhiteouts,
+		FileFlags:      opt.PreserveFileFlags,
+		OmitRoot:       opt.OmitRootEntry,
+		Canonical:      opt.Canonical,
+		StrictOrder:    opt.StrictDirOrdering,
+		XattrPrefixes:  opt.XattrPrefixes,
+		Overrides:      opt.MetadataOverrides,
+		Deltas:         []cacheDelta{},
+	}
+	if !opt.SourceDateEpoch.IsZero() {
+		key.SourceDate = opt.SourceDateEpoch.UTC().Format(time.RFC3339Nano)
+	}
+
+	// The contents of the user databases affect the names in the layer.
+	for _, db := range []struct {
+		path   string
+		digest *digest.Digest
+	}{
+		{opt.PasswdFile, &key.Passwd},
+		{opt.GroupFile, &key.Group},
+	} {
+		if db.path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(db.path)
+		if err != nil {
+			return "", errors.Wrap(err, "read user database")
+		}
+		*db.digest = digest.Canonical.FromBytes(data)
+	}
+
+	for _, delta := range deltas {
+		cd := cacheDelta{
+			Type: delta.Type(),
+			Path: delta.Path(),
+		}
+		if entry := delta.New(); entry != nil {
+			cd.Keywords = mtree.KeyValToString(entry.AllKeys())
+			sort.Strings(cd.Keywords)
+		}
+		key.Deltas = append(key.Deltas, cd)
+	}
+	sort.Slice(key.Deltas, func(i, j int) bool {
+		return key.Deltas[i].Path < key.Deltas[j].Path
+	})
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", errors.Wrap(err, "encode cache key")
+	}
+	return cas.BlobAlgorithm.FromBytes(data).Encoded(), nil
+}
+
+// cachedLayerReader verifies the contents of a layer read from the cache.
+type cachedLayerReader struct {
+	fh       *os.File
+	verifier digest.Verifier
+	diffID   digest.Digest
+}
+
+func (r *cachedLayerReader) Read(p []byte) (int, error) {
+	n, err := r.fh.Read(p)
+	r.verifier.Write(p[:n])
+	if err == io.EOF && !r.verifier.Verified() {
+		log.Warnf("layer cache: removing corrupt cached layer %s", r.diffID)
+		os.Remove(r.fh.Name())
+		return n, errors.Errorf("cached layer %s failed verification", r.diffID)
+	}
+	return n, err
+}
+
+func (r *cachedLayerReader) Close() error {
+	return r.fh.Close()
+}
+
+// cachingLayerReader stores a layer in the cache as it is read. The layer is
+// only added to the cache once it has been read in its entirety without any
+// errors.
+type cachingLayerReader struct {
+	reader   io.ReadCloser
+	temp     *os.File
+	digester digest.Digester
+	cacheDir string
+	key      string
+}
+
+func (r *cachingLayerReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 && r.temp != nil {
+		if _, err := r.temp.Write(p[:n]); err != nil {
+			log.Warnf("layer cache: failed to write cached layer: %v", err)
+			r.discard()
+		} else {
+			r.digester.Hash().Write(p[:n])
+		}
+	}
+	if err == io.EOF && r.temp != nil {
+		if err := r.commit(); err != nil {
+			log.Warnf("layer cache: failed to store cached layer: %v", err)
+		}
+		r.discard()
+	}
+	return n, err
+}
+
+// commit moves the temporary file into the cache and adds the cache key.
+func (r *cachingLayerReader) commit() error {
+	if err := r.temp.Sync(); err != nil {
+		return errors.Wrap(err, "sync temporary file")
+	}
+
+	diffID := r.digester.Digest()
+	blobPath := filepath.Join(r.cacheDir, cacheBlobsDir, diffID.Algorithm().String(), diffID.Encoded())
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return errors.Wrap(err, "mkdir cache blob dir")
+	}
+	if err := os.Rename(r.temp.Name(), blobPath); err != nil {
+		return errors.Wrap(err, "rename cached layer")
+	}
+
+	keyPath := filepath.Join(r.cacheDir, cacheKeysDir, r.key)
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0755); err != nil {
+		return errors.Wrap(err, "mkdir cache key dir")
+	}
+	if err := ioutil.WriteFile(keyPath+".tmp", []byte(diffID.String()), 0644); err != nil {
+		return errors.Wrap(err, "write cache key")
+	}
+	if err := os.Rename(keyPath+".tmp", keyPath); err != nil {
+		return errors.Wrap(err, "rename cache key")
+	}
+
+	log.WithFields(log.Fields{
+		"key":    r.key,
+		"diffid": diffID,
+	}).Debugf("layer cache: stored layer")
+	return nil
+}
+
+// discard stops caching the layer and removes the temporary file.
+func (r *cachingLayerReader) discard() {
+	if r.temp != nil {
+		r.temp.Close()
+		os.Remove(r.temp.Name())
+		r.temp = nil
+	}
+}
+
+func (r *cachingLayerReader) Close() error {
+	r.discard()
+	return r.reader.Close()
+}
+
+// lookupCachedLayer returns a reader for the cached layer with the given key,
+// or nil if there is no such layer in the cache.
+func lookupCachedLayer(cacheDir, key string) (io.ReadCloser, error) {
+	value, err := ioutil.ReadFile(filepath.Join(cacheDir, cacheKeysDir, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "read cache key")
+	}
+
+	diffID, err := digest.Parse(strings.TrimSpace(string(value)))
+	if err != nil {
+		log.Warnf("layer cache: ignoring invalid cache key %s: %v", key, err)
+		return nil, nil
+	}
+	fh, err := os.Open(filepath.Join(cacheDir, cacheBlobsDir, diffID.Algorithm().String(), diffID.Encoded()))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "open cached layer")
+	}
+
+	return &cachedLayerReader{
+		fh:       fh,
+		verifier: diffID.Verifier(),
+		diffID:   diffID,
+	}, nil
+}
+
+// generateCachedLayer is a wrapper around GenerateLayerWithContext which uses
+// the layer cache in opt.LayerCacheDir.
+func generateCachedLayer(ctx context.Context, path string, deltas []mtree.InodeDelta, opt PackOptions) (io.ReadCloser, error) {
+	cacheDir := opt.LayerCacheDir
+	opt.LayerCacheDir = ""
+
+	key, err := layerCacheKey(deltas, opt)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute layer cache key")
+	}
+
+	cached, err := lookupCachedLayer(cacheDir, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "lookup layer cache")
+	}
+	if cached != nil {
+		log.WithFields(log.Fields{
+			"key": key,
+		}).Infof("layer cache: using cached layer")
+		return cached, nil
+	}
+
+	// Failing to store the layer in the cache is not fatal.
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		log.Warnf("layer cache: cannot create cache directory: %v", err)
+		return GenerateLayerWithContext(ctx, path, deltas, &opt)
+	}
+	temp, err := ioutil.TempFile(cacheDir, ".layer-")
+	if err != nil {
+		log.Warnf("layer cache: cannot create temporary file: %v", err)
+		return GenerateLayerWithContext(ctx, path, deltas, &opt)
+	}
+
+	reader, err := GenerateLayerWithContext(ctx, path, deltas, &opt)
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, err
+	}
+	return &cachingLayerReader{
+		reader:   reader,
+		temp:     temp,
+		digester: cas.BlobAlgorithm.Digester(),
+		cacheDir: cacheDir,
+		key:      key,
+	}, nil
+}
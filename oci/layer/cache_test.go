@@ -0,0 +1,149 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vbatts/go-mtree"
+)
+
+func TestGenerateLayerCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLayerCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	cacheDir := filepath.Join(dir, "cache")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get initial.
+	initDh, err := mtree.Walk(rootfs, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get post.
+	postDh, err := mtree.Walk(rootfs, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generate := func(opt *PackOptions) []byte {
+		reader, err := GenerateLayer(rootfs, diffs, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+
+		layer, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("unexpected error generating layer: %+v", err)
+		}
+		return layer
+	}
+
+	// The first generation populates the cache.
+	original := generate(&PackOptions{LayerCacheDir: cacheDir})
+	keys, err := ioutil.ReadDir(filepath.Join(cacheDir, cacheKeysDir))
+	if err != nil {
+		t.Fatalf("unexpected error reading cache keys: %+v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 cache key, got %d", len(keys))
+	}
+
+	// Modify the file without updating the deltas. The cache key is the same
+	// so we should get the cached layer.
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "file"), []byte("different contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cached := generate(&PackOptions{LayerCacheDir: cacheDir}); !bytes.Equal(cached, original) {
+		t.Errorf("expected to get cached layer")
+	}
+	if uncached := generate(&PackOptions{}); bytes.Equal(uncached, original) {
+		t.Errorf("expected to get a new layer without a cache")
+	}
+
+	// Different options result in a different key.
+	generate(&PackOptions{LayerCacheDir: cacheDir, MaxFileSize: 1024})
+	keys, err = ioutil.ReadDir(filepath.Join(cacheDir, cacheKeysDir))
+	if err != nil {
+		t.Fatalf("unexpected error reading cache keys: %+v", err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("expected 2 cache keys, got %d", len(keys))
+	}
+	generate(&PackOptions{LayerCacheDir: cacheDir, SourceDateEpoch: time.Unix(1500000000, 0)})
+	keys, err = ioutil.ReadDir(filepath.Join(cacheDir, cacheKeysDir))
+	if err != nil {
+		t.Fatalf("unexpected error reading cache keys: %+v", err)
+	}
+	if len(keys) != 3 {
+		t.Errorf("expected 3 cache keys, got %d", len(keys))
+	}
+
+	// Only changing Canonical must not return the non-canonical layer.
+	if canonical := generate(&PackOptions{LayerCacheDir: cacheDir, Canonical: true}); bytes.Equal(canonical, original) {
+		t.Errorf("expected a canonical layer rather than the cached layer")
+	}
+	keys, err = ioutil.ReadDir(filepath.Join(cacheDir, cacheKeysDir))
+	if err != nil {
+		t.Fatalf("unexpected error reading cache keys: %+v", err)
+	}
+	if len(keys) != 4 {
+		t.Errorf("expected 4 cache keys, got %d", len(keys))
+	}
+
+	// Corrupt cached layers must not be used.
+	blobs, err := filepath.Glob(filepath.Join(cacheDir, cacheBlobsDir, "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range blobs {
+		if err := ioutil.WriteFile(blob, []byte("corrupt"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader, err := GenerateLayer(rootfs, diffs, &PackOptions{LayerCacheDir: cacheDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(reader); err == nil {
+		t.Errorf("expected an error reading corrupt cached layer")
+	}
+	reader.Close()
+}
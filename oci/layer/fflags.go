@@ -0,0 +1,111 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// paxFileFlags is the PAX record used to store the inode flags of an entry.
+// The format is the same one used by star(1) and libarchive: a comma-separated
+// list of BSD-style flag names.
+const paxFileFlags = "SCHILY.fflags"
+
+// fileFlagNames maps the names used in paxFileFlags to Linux inode flags. The
+// first name for each flag is the one used when generating layers, the others
+// are accepted when extracting for compatibility with other tools.
+var fileFlagNames = []struct {
+	names []string
+	flag  uint32
+}{
+	{[]string{"sappnd", "uappnd"}, system.FileFlagAppend},
+	{[]string{"schg", "uchg"}, system.FileFlagImmutable},
+	{[]string{"nodump"}, system.FileFlagNoDump},
+	{[]string{"noatime"}, system.FileFlagNoAtime},
+}
+
+// supportedFileFlags is the set of inode flags which are stored in layers.
+var supportedFileFlags = func() uint32 {
+	var mask uint32
+	for _, entry := range fileFlagNames {
+		mask |= entry.flag
+	}
+	return mask
+}()
+
+// formatFileFlags converts the given inode flags to the paxFileFlags format.
+// Unsupported flags are ignored, and if there are no supported flags set an
+// empty string is returned.
+func formatFileFlags(flags uint32) string {
+	var names []string
+	for _, entry := range fileFlagNames {
+		if flags&entry.flag != 0 {
+			names = append(names, entry.names[0])
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// parseFileFlags converts the paxFileFlags value to inode flags. Unknown flag
+// names are ignored with a warning, as other tools support flags which have
+// no equivalent on Linux.
+func parseFileFlags(value string) uint32 {
+	var flags uint32
+outer:
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		for _, entry := range fileFlagNames {
+			for _, candidate := range entry.names {
+				if name == candidate {
+					flags |= entry.flag
+					continue outer
+				}
+			}
+		}
+		log.Warnf("ignoring unsupported file flag %q", name)
+	}
+	return flags
+}
+
+// isFileFlagsUnsupported returns whether the error returned by
+// system.[GS]etFileFlags indicates that the flags could not be used because
+// of the filesystem or our privileges (rather than a more serious error).
+func isFileFlagsUnsupported(err error) bool {
+	if os.IsPermission(errors.Cause(err)) {
+		return true
+	}
+	switch err := errors.Cause(err).(type) {
+	case *os.SyscallError:
+		switch err.Err {
+		case unix.ENOTTY, unix.EOPNOTSUPP, unix.EINVAL, unix.ENOSYS:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/pkg/system"
+)
+
+func TestFileFlagsFormat(t *testing.T) {
+	for _, test := range []struct {
+		flags uint32
+		value string
+	}{
+		{0, ""},
+		{system.FileFlagImmutable, "schg"},
+		{system.FileFlagAppend | system.FileFlagNoDump, "nodump,sappnd"},
+		{system.FileFlagImmutable | system.FileFlagAppend | system.FileFlagNoDump | system.FileFlagNoAtime, "noatime,nodump,sappnd,schg"},
+	} {
+		if got := formatFileFlags(test.flags); got != test.value {
+			t.Errorf("formatFileFlags(%#x): expected %q got %q", test.flags, test.value, got)
+		}
+		if got := parseFileFlags(test.value); got != test.flags {
+			t.Errorf("parseFileFlags(%q): expected %#x got %#x", test.value, test.flags, got)
+		}
+	}
+
+	// Aliases and unknown flags (such as BSD-only ones) from other tools.
+	if got, expected := parseFileFlags("uchg, uappnd,hidden,,nodump"), system.FileFlagImmutable|system.FileFlagAppend|system.FileFlagNoDump; got != expected {
+		t.Errorf("parseFileFlags: expected %#x got %#x", expected, got)
+	}
+}
+
+// changeFileFlags replaces the supported inode flags of the given path,
+// leaving any other flags (such as FS_EXTENTS_FL) untouched.
+func changeFileFlags(path string, flags uint32) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	oldFlags, err := system.GetFileFlags(fh)
+	if err != nil {
+		return err
+	}
+	return system.SetFileFlags(fh, (oldFlags&^supportedFileFlags)|flags)
+}
+
+// setTestFileFlags sets the inode flags of the given path, skipping the test
+// if the flags are not supported.
+func setTestFileFlags(t *testing.T, path string, flags uint32) {
+	if err := changeFileFlags(path, flags); err != nil {
+		if isFileFlagsUnsupported(err) {
+			t.Skipf("file flags not supported: %v", err)
+		}
+		t.Fatal(err)
+	}
+}
+
+func getTestFileFlags(t *testing.T, path string) uint32 {
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	flags, err := system.GetFileFlags(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flags & supportedFileFlags
+}
+
+func TestFileFlagsRoundTrip(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("setting the immutable flag requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestFileFlagsRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, path := range []string{src, dst, filepath.Join(src, "locked")} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"plain", "nodump", "appendonly", "locked/file"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]uint32{
+		"plain":       0,
+		"nodump":      system.FileFlagNoDump,
+		"appendonly":  system.FileFlagAppend,
+		"locked":      system.FileFlagImmutable,
+		"locked/file": system.FileFlagImmutable | system.FileFlagNoAtime,
+	}
+	// Make sure we can clean up after ourselves, since immutable and
+	// append-only files cannot be removed.
+	defer func() {
+		for _, root := range []string{src, filepath.Join(dst, "preserve")} {
+			for name := range expected {
+				changeFileFlags(filepath.Join(root, name), 0)
+			}
+		}
+	}()
+	for _, name := range []string{"plain", "nodump", "appendonly", "locked/file", "locked"} {
+		setTestFileFlags(t, filepath.Join(src, name), expected[name])
+	}
+
+	for _, preserve := range []bool{false, true} {
+		var buf bytes.Buffer
+		tg := newTarGenerator(&buf, PackOptions{PreserveFileFlags: preserve})
+		for _, name := range []string{"plain", "nodump", "appendonly", "locked", "locked/file"} {
+			if err := tg.AddFile(name, filepath.Join(src, name)); err != nil {
+				t.Fatalf("AddFile %s: unexpected error: %+v", name, err)
+			}
+		}
+		if err := tg.tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		root := filepath.Join(dst, "preserve")
+		if !preserve {
+			root = filepath.Join(dst, "nopreserve")
+		}
+		if err := UnpackLayer(root, &buf, nil); err != nil {
+			t.Fatalf("preserve=%v: UnpackLayer: unexpected error: %+v", preserve, err)
+		}
+
+		for name, flags := range expected {
+			if !preserve {
+				flags = 0
+			}
+			if got := getTestFileFlags(t, filepath.Join(root, name)); got != flags {
+				t.Errorf("preserve=%v: %s: expected flags %#x got %#x", preserve, name, flags, got)
+			}
+		}
+	}
+}
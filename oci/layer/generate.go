@@ -19,12 +19,19 @@ package layer
 
 import (
 	"io"
+	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/apex/log"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
 	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 )
 
 // inodeDeltas is a wrapper around []mtree.InodeDelta that allows for sorting
@@ -35,15 +42,474 @@ func (ids inodeDeltas) Len() int           { return len(ids) }
 func (ids inodeDeltas) Less(i, j int) bool { return ids[i].Path() < ids[j].Path() }
 func (ids inodeDeltas) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
 
+// treeInodeDeltas is a wrapper around []mtree.InodeDelta that sorts the
+// deltas in tree order (comparing paths component by component), which
+// guarantees that every directory comes before its contents. A plain
+// lexicographic sort doesn't guarantee this, because characters which sort
+// before '/' (or '.', for the root directory) can end up between a directory
+// and its children.
+type treeInodeDeltas []mtree.InodeDelta
+
+func (ids treeInodeDeltas) Len() int      { return len(ids) }
+func (ids treeInodeDeltas) Swap(i, j int) { ids[i], ids[j] = ids[j], ids[i] }
+func (ids treeInodeDeltas) Less(i, j int) bool {
+	a, b := ids[i].Path(), ids[j].Path()
+	if filepath.Clean(a) == filepath.Clean(b) {
+		// Whiteouts of a path must come before the path is re-added.
+		return ids[i].Type() == mtree.Missing && ids[j].Type() != mtree.Missing
+	}
+	return treePathLess(a, b)
+}
+
+// treePathLess returns whether the path a comes before b in tree order.
+func treePathLess(a, b string) bool {
+	splitPath := func(path string) []string {
+		path = filepath.Clean(path)
+		if path == "." || path == "/" {
+			return nil
+		}
+		return strings.Split(strings.Trim(path, "/"), "/")
+	}
+	as, bs := splitPath(a), splitPath(b)
+	for idx := 0; idx < len(as) && idx < len(bs); idx++ {
+		if as[idx] != bs[idx] {
+			return as[idx] < bs[idx]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// sortDeltas sorts the given deltas into the order in which their entries are
+// emitted in a layer. By default, all of the whiteouts (mtree.Missing deltas)
+// are emitted before any other entries, with each of the two sets sorted by
+// path. This ensures that a whiteout can never remove an entry added by the
+// same layer (such as a path which was deleted and then re-added). With
+// strictDirOrdering the deltas are instead sorted in tree order (so that
+// every directory precedes its contents, which emitting all whiteouts first
+// would break), with a whiteout only preceding other deltas for the same
+// path.
+func sortDeltas(deltas []mtree.InodeDelta, strictDirOrdering bool) {
+	if strictDirOrdering {
+		sort.Sort(treeInodeDeltas(deltas))
+		return
+	}
+	sort.Sort(inodeDeltas(deltas))
+	sort.SliceStable(deltas, func(i, j int) bool {
+		return deltas[i].Type() == mtree.Missing && deltas[j].Type() != mtree.Missing
+	})
+}
+
+// dedupWhiteouts returns the given (sorted) deltas without any mtree.Missing
+// deltas for paths inside a directory which is itself mtree.Missing. Such
+// whiteouts are redundant, because whiting out a directory removes everything
+// inside it. Note that only directories which have been removed are taken
+// into account -- a child of a directory which still exists (even if it was
+// modified) always keeps its whiteout.
+func dedupWhiteouts(deltas []mtree.InodeDelta) []mtree.InodeDelta {
+	removed := map[string]struct{}{}
+	var newDeltas []mtree.InodeDelta
+	for _, delta := range deltas {
+		if delta.Type() != mtree.Missing {
+			newDeltas = append(newDeltas, delta)
+			continue
+		}
+
+		name := filepath.Clean(delta.Path())
+		redundant := false
+		for parent := filepath.Dir(name); parent != name; name, parent = parent, filepath.Dir(parent) {
+			if _, ok := removed[parent]; ok {
+				redundant = true
+				break
+			}
+		}
+		if redundant {
+			log.Debugf("generate layer: dropping redundant whiteout '%s'", delta.Path())
+			continue
+		}
+		removed[filepath.Clean(delta.Path())] = struct{}{}
+		newDeltas = append(newDeltas, delta)
+	}
+	return newDeltas
+}
+
+// contentKeywords are the mtree keywords which describe the contents of an
+// inode (rather than its metadata). If a regular file has changed but none of
+// these keywords have, only its metadata was modified.
+var contentKeywords = map[mtree.Keyword]struct{}{
+	"type":         {},
+	"size":         {},
+	"link":         {},
+	"cksum":        {},
+	"md5digest":    {},
+	"rmd160digest": {},
+	"sha1digest":   {},
+	"sha256digest": {},
+	"sha384digest": {},
+	"sha512digest": {},
+}
+
+// MetadataOnlyStats describes the regular files in a set of deltas which were
+// modified without their contents changing (such as after an SELinux
+// relabel, or a chown). Layers cannot express metadata-only changes, so these
+// files are still included in full in the generated layer.
+type MetadataOnlyStats struct {
+	// Files is the number of regular files whose metadata (but not contents)
+	// changed.
+	Files int
+
+	// Bytes is the total size of those files.
+	Bytes int64
+}
+
+// CountMetadataOnly inspects which keywords changed in each of the given
+// deltas, and returns statistics about the regular files which will be
+// included in a layer generated from deltas only because their metadata
+// changed.
+func CountMetadataOnly(deltas []mtree.InodeDelta) MetadataOnlyStats {
+	var stats MetadataOnlyStats
+	for _, delta := range deltas {
+		if delta.Type() != mtree.Modified || delta.New() == nil {
+			continue
+		}
+
+		metadataOnly := true
+		for _, keyDelta := range delta.Diff() {
+			if _, ok := contentKeywords[keyDelta.Name().Prefix()]; ok {
+				metadataOnly = false
+				break
+			}
+		}
+		if !metadataOnly {
+			continue
+		}
+
+		var fileType string
+		var size int64
+		for _, kv := range delta.New().AllKeys() {
+			switch kv.Keyword().Prefix() {
+			case "type":
+				fileType = kv.Value()
+			case "size":
+				size, _ = strconv.ParseInt(kv.Value(), 10, 64)
+			}
+		}
+		if fileType != "file" {
+			continue
+		}
+		stats.Files++
+		stats.Bytes += size
+	}
+	return stats
+}
+
+// DeletionsSidecar is the name of the sidecar blob (see
+// casext.AnnotationSidecarPrefix) used to store the DeletionList of a layer.
+const DeletionsSidecar = "deletions"
+
+// DeletionList is an explicit list of the paths deleted by a layer, which is
+// intended to be stored as a sidecar of the layer so that tools can find the
+// deletions without having to interpret the whiteout entries of the layer.
+type DeletionList struct {
+	// Paths is the sorted list of deleted paths, relative to the root of
+	// the filesystem.
+	Paths []string `json:"paths"`
+}
+
+// Deletions returns the DeletionList of the layer generated from the given
+// deltas, which contains every mtree.Missing path (even those inside deleted
+// directories, regardless of PackOptions.DeduplicateWhiteouts).
+func Deletions(deltas []mtree.InodeDelta) DeletionList {
+	paths := []string{}
+	for _, delta := range deltas {
+		if delta.Type() == mtree.Missing {
+			paths = append(paths, filepath.Clean(delta.Path()))
+		}
+	}
+	sort.Strings(paths)
+	return DeletionList{Paths: paths}
+}
+
+// maskedPath returns whether the given path (relative to the root of the
+// layer) is masked, either because one of its parents is in the set of
+// masked directories or because mask returns true for it. In the latter case,
+// the path is added to the set.
+func maskedPath(path string, mask func(string) bool, masked map[string]struct{}) bool {
+	path = filepath.Clean(string(filepath.Separator) + path)
+	for parent := filepath.Dir(path); ; parent = filepath.Dir(parent) {
+		if _, ok := masked[parent]; ok {
+			return true
+		}
+		if parent == filepath.Dir(parent) {
+			break
+		}
+	}
+	if mask(path) {
+		masked[path] = struct{}{}
+		return true
+	}
+	return false
+}
+
+// MaskDeltas returns the given deltas without those masked by the given
+// mask function (see PackOptions.MaskFunc), keeping the order of the
+// remaining deltas. The deltas are checked in tree order, so that mask is not
+// called for paths inside masked directories.
+func MaskDeltas(deltas []mtree.InodeDelta, mask func(path string) bool) []mtree.InodeDelta {
+	sorted := make([]mtree.InodeDelta, len(deltas))
+	copy(sorted, deltas)
+	sort.Sort(treeInodeDeltas(sorted))
+
+	masked := map[string]struct{}{}
+	excluded := map[string]struct{}{}
+	for _, delta := range sorted {
+		if maskedPath(delta.Path(), mask, masked) {
+			log.Debugf("generate layer: masking path '%s'", delta.Path())
+			excluded[delta.Path()] = struct{}{}
+		}
+	}
+
+	var newDeltas []mtree.InodeDelta
+	for _, delta := range deltas {
+		if _, ok := excluded[delta.Path()]; !ok {
+			newDeltas = append(newDeltas, delta)
+		}
+	}
+	return newDeltas
+}
+
+// validateExcludePatterns returns an error if any of the given
+// PackOptions.ExcludePatterns is malformed.
+func validateExcludePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if err := mtreefilter.ValidateGlob(pattern); err != nil {
+			return errors.Wrap(err, "validate exclude pattern")
+		}
+	}
+	return nil
+}
+
+// excludedPath returns whether the given path (relative to the root of the
+// layer) or any of its parents matches one of the given (validated) exclude
+// patterns.
+func excludedPath(path string, patterns []string) bool {
+	path = filepath.Clean(string(filepath.Separator) + path)
+	for {
+		for _, pattern := range patterns {
+			if ok, _ := mtreefilter.GlobMatch(pattern, path); ok {
+				return true
+			}
+		}
+		if path == filepath.Dir(path) {
+			return false
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// excludeDeltas returns the given deltas without the mtree.Modified and
+// mtree.Extra deltas whose paths are excluded by the given patterns (see
+// PackOptions.ExcludePatterns). mtree.Missing deltas are always kept.
+func excludeDeltas(deltas []mtree.InodeDelta, patterns []string) []mtree.InodeDelta {
+	var newDeltas []mtree.InodeDelta
+	for _, delta := range deltas {
+		if delta.Type() != mtree.Missing && excludedPath(delta.Path(), patterns) {
+			log.Debugf("generate layer: excluding path '%s'", delta.Path())
+			continue
+		}
+		newDeltas = append(newDeltas, delta)
+	}
+	return newDeltas
+}
+
+// DefaultMaxDepth is the default value of PackOptions.MaxDepth. It is large
+// enough for any reasonable root filesystem (which is already limited to far
+// fewer components by PATH_MAX when accessed with a single path).
+const DefaultMaxDepth = 1024
+
+// checkDepth returns an error if the given path (relative to the root of the
+// layer) has more than maxDepth components. If maxDepth is zero,
+// DefaultMaxDepth is used, and if it is negative there is no limit.
+func checkDepth(path string, maxDepth int) error {
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	if maxDepth < 0 {
+		return nil
+	}
+	path = filepath.Clean(string(filepath.Separator) + path)
+	if depth := strings.Count(path, string(filepath.Separator)); path != string(filepath.Separator) && depth > maxDepth {
+		return errors.Errorf("path %s has %d components, which exceeds the maximum depth of %d", path, depth, maxDepth)
+	}
+	return nil
+}
+
+// SplitDeltas splits the given deltas into groups, such that generating a
+// layer (with GenerateLayer, the same path and the same opt) from each group
+// and applying the layers in order is equivalent to applying a single layer
+// generated from all of the deltas. The deltas are grouped in the order in
+// which GenerateLayer emits them, and each group is limited to an estimated
+// maxBytes of (uncompressed) tar data, computed from the "size" keyword of the
+// regular files being added, and to maxFiles entries (including whiteouts). A
+// new group is started as soon as either limit would be exceeded, and a limit
+// which is not positive is ignored. An entry which is larger than maxBytes by
+// itself is placed in a group of its own. All of the paths (within path) which
+// are hardlinks to the same inode are kept in the same group so that the links
+// are preserved, which may result in a group exceeding either limit. If
+// neither limit is positive, a single group is returned. Deltas which would be
+// dropped by opt.MaskFunc or opt.ExcludePatterns are removed before splitting,
+// so that no group is empty.
+func SplitDeltas(path string, deltas []mtree.InodeDelta, maxBytes int64, maxFiles int, opt *PackOptions) ([][]mtree.InodeDelta, error) {
+	var packOptions PackOptions
+	if opt != nil {
+		packOptions = *opt
+	}
+
+	deltas = append([]mtree.InodeDelta(nil), deltas...)
+	if packOptions.MaskFunc != nil {
+		deltas = MaskDeltas(deltas, packOptions.MaskFunc)
+	}
+	if len(packOptions.ExcludePatterns) > 0 {
+		if err := validateExcludePatterns(packOptions.ExcludePatterns); err != nil {
+			return nil, err
+		}
+		deltas = excludeDeltas(deltas, packOptions.ExcludePatterns)
+	}
+	if (maxBytes <= 0 && maxFiles <= 0) || len(deltas) == 0 {
+		return [][]mtree.InodeDelta{deltas}, nil
+	}
+
+	sortDeltas(deltas, packOptions.StrictDirOrdering)
+	if packOptions.DeduplicateWhiteouts {
+		deltas = dedupWhiteouts(deltas)
+	}
+
+	// Find the last delta referencing each hardlinked inode, so that we
+	// never split a group before every link to an inode has been added.
+	fsEval := fseval.DefaultFsEval
+	if packOptions.MapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+	inodes := make([]inodeKey, len(deltas))
+	hardlinked := make([]bool, len(deltas))
+	lastLink := map[inodeKey]int{}
+	for idx, delta := range deltas {
+		if delta.Type() == mtree.Missing {
+			continue
+		}
+		// Errors are ignored here, and will be reported by GenerateLayer.
+		statx, err := fsEval.Lstatx(filepath.Join(path, delta.Path()))
+		if err != nil || statx.Mode&unix.S_IFMT == unix.S_IFDIR || statx.Nlink <= 1 {
+			continue
+		}
+		inodes[idx] = inodeKey{dev: uint64(statx.Dev), ino: uint64(statx.Ino)}
+		hardlinked[idx] = true
+		lastLink[inodes[idx]] = idx
+	}
+
+	var (
+		groups    [][]mtree.InodeDelta
+		current   []mtree.InodeDelta
+		groupSize int64
+		linksEnd  = -1
+	)
+	for idx, delta := range deltas {
+		size := estimateDeltaSize(delta)
+		full := (maxBytes > 0 && groupSize+size > maxBytes) || (maxFiles > 0 && len(current) >= maxFiles)
+		if len(current) > 0 && full && linksEnd < idx {
+			groups = append(groups, current)
+			current, groupSize = nil, 0
+		}
+		current = append(current, delta)
+		groupSize += size
+		if hardlinked[idx] && lastLink[inodes[idx]] > linksEnd {
+			linksEnd = lastLink[inodes[idx]]
+		}
+	}
+	groups = append(groups, current)
+
+	log.WithFields(log.Fields{
+		"deltas": len(deltas),
+		"groups": len(groups),
+	}).Debugf("split layer deltas with a limit of %d bytes and %d entries", maxBytes, maxFiles)
+	return groups, nil
+}
+
+// EstimateLayerSize returns an estimate of the number of bytes of
+// (uncompressed) tar data in a layer generated from the given deltas, which
+// is the same estimate used by SplitDeltas.
+func EstimateLayerSize(deltas []mtree.InodeDelta) int64 {
+	var size int64
+	for _, delta := range deltas {
+		size += estimateDeltaSize(delta)
+	}
+	return size
+}
+
+// estimateDeltaSize returns an estimate of the number of bytes of tar data
+// generated for the given delta: a header block, followed by the contents of
+// the file (padded to a whole number of blocks) if it is a regular file.
+func estimateDeltaSize(delta mtree.InodeDelta) int64 {
+	const blockSize = 512
+
+	size := int64(blockSize)
+	if delta.Type() == mtree.Missing || delta.New() == nil {
+		return size
+	}
+
+	var (
+		fileType string
+		fileSize int64
+	)
+	for _, kv := range delta.New().AllKeys() {
+		switch kv.Keyword().Prefix() {
+		case "type":
+			fileType = kv.Value()
+		case "size":
+			fileSize, _ = strconv.ParseInt(kv.Value(), 10, 64)
+		}
+	}
+	if fileType == "file" {
+		size += (fileSize + blockSize - 1) / blockSize * blockSize
+	}
+	return size
+}
+
 // GenerateLayer creates a new OCI diff layer based on the mtree diff provided.
 // All of the mtree.Modified and mtree.Extra blobs are read relative to the
 // provided path (which should be the rootfs of the layer that was diffed). The
 // returned reader is for the *raw* tar data, it is the caller's responsibility
-// to gzip it.
-func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.ReadCloser, error) {
-	var mapOptions MapOptions
+// to gzip it. If opt is nil, the default options are used.
+func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *PackOptions) (io.ReadCloser, error) {
+	return GenerateLayerWithContext(context.Background(), path, deltas, opt)
+}
+
+// GenerateLayerWithContext is equivalent to GenerateLayer, except that
+// generation of the layer is aborted if ctx is cancelled. The context is
+// checked between entries, and once it has been cancelled the returned reader
+// fails with an error whose cause is ctx.Err().
+func GenerateLayerWithContext(ctx context.Context, path string, deltas []mtree.InodeDelta, opt *PackOptions) (io.ReadCloser, error) {
+	var packOptions PackOptions
 	if opt != nil {
-		mapOptions = *opt
+		packOptions = *opt
+	}
+
+	if packOptions.MaskFunc != nil {
+		deltas = MaskDeltas(deltas, packOptions.MaskFunc)
+	}
+	if len(packOptions.ExcludePatterns) > 0 {
+		if err := validateExcludePatterns(packOptions.ExcludePatterns); err != nil {
+			return nil, err
+		}
+		deltas = excludeDeltas(deltas, packOptions.ExcludePatterns)
+	}
+	for _, delta := range deltas {
+		if err := checkDepth(delta.Path(), packOptions.MaxDepth); err != nil {
+			return nil, errors.Wrap(err, "check delta")
+		}
+	}
+
+	if packOptions.LayerCacheDir != "" {
+		return generateCachedLayer(ctx, path, deltas, packOptions)
 	}
 
 	reader, writer := io.Pipe()
@@ -57,18 +523,28 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 		// We can't just dump all of the file contents into a tar file. We need
 		// to emulate a proper tar generator. Luckily there aren't that many
 		// things to emulate (and we can do them all in tar.go).
-		tg := newTarGenerator(writer, mapOptions)
+		tg := newTarGenerator(writer, packOptions)
 
-		// Sort the delta paths.
-		// FIXME: We need to add whiteouts first, otherwise we might end up
-		//        doing something silly like deleting a file which we actually
-		//        meant to modify.
-		sort.Sort(inodeDeltas(deltas))
+		// Sort the deltas, making sure that whiteouts are added first so we
+		// don't end up deleting a file which we actually meant to modify.
+		sortDeltas(deltas, packOptions.StrictDirOrdering)
+		if packOptions.DeduplicateWhiteouts {
+			deltas = dedupWhiteouts(deltas)
+		}
 
 		for _, delta := range deltas {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			name := delta.Path()
 			fullPath := filepath.Join(path, name)
 
+			if packOptions.OmitRootEntry && filepath.Clean(name) == "." {
+				log.Debugf("generate layer: omitting root directory entry")
+				continue
+			}
+
 			// XXX: It's possible that if we unlink a hardlink, we're going to
 			//      AddFile() for no reason. Maybe we should drop nlink= from
 			//      the set of keywords we care about?
@@ -85,6 +561,7 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 					return errors.Wrap(err, "generate whiteout layer file")
 				}
 			}
+			tg.progress(name)
 		}
 
 		if err := tg.tw.Close(); err != nil {
@@ -97,3 +574,219 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 
 	return reader, nil
 }
+
+// mergedEntry is a path provided by one of the source directories of
+// GenerateLayerFromDirs.
+type mergedEntry struct {
+	root  int
+	isDir bool
+}
+
+// mergeDirs walks each of the roots in order and returns the set of relative
+// paths in the merged tree, mapped to the root that provides each of them.
+// Later roots override earlier ones, and a non-directory overriding a
+// directory hides everything that was inside that directory. Symlinks are not
+// followed, and paths deeper than PackOptions.MaxDepth (see checkDepth) are
+// an error. Paths masked by PackOptions.MaskFunc (where the path given to the
+// mask is the path in the layer, inside target) or excluded by
+// PackOptions.ExcludePatterns are skipped.
+func mergeDirs(roots []string, target string, opt PackOptions) (map[string]mergedEntry, error) {
+	entries := map[string]mergedEntry{}
+	for idx, root := range roots {
+		err := filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, fullPath)
+			if err != nil {
+				return errors.Wrapf(err, "get relative path of %s", fullPath)
+			}
+			// Bail out early rather than walking a pathological tree (such as
+			// a directory bind-mounted inside itself) for a long time.
+			if err := checkDepth(rel, opt.MaxDepth); err != nil {
+				return err
+			}
+			layerPath := filepath.Join(string(filepath.Separator), target, rel)
+			if opt.MaskFunc != nil && opt.MaskFunc(layerPath) {
+				log.Debugf("generate layer: masking path '%s' from %s", rel, root)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if len(opt.ExcludePatterns) > 0 && excludedPath(layerPath, opt.ExcludePatterns) {
+				log.Debugf("generate layer: excluding path '%s' from %s", rel, root)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			entry := mergedEntry{root: idx, isDir: info.IsDir()}
+
+			if old, ok := entries[rel]; ok && !(old.isDir && entry.isDir) {
+				logFn := log.Debugf
+				if opt.WarnOnOverride {
+					logFn = log.Warnf
+				}
+				logFn("generate layer: %s from %s overrides %s", rel, root, roots[old.root])
+				if old.isDir {
+					prefix := rel + string(filepath.Separator)
+					for other := range entries {
+						if strings.HasPrefix(other, prefix) {
+							delete(entries, other)
+						}
+					}
+				}
+			}
+			entries[rel] = entry
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "walk %s", root)
+		}
+	}
+	return entries, nil
+}
+
+// GenerateLayerFromDirs creates a new OCI layer containing the merged contents
+// of the given source directories, placed under target (a path relative to the
+// root of the layer, "." or "" meaning the root itself). The roots are merged
+// in order, with later roots overriding earlier ones for the same relative
+// path. Directories present in several roots are merged, with the metadata of
+// the directory taken from the last root. As with GenerateLayer, the returned
+// reader is for the *raw* tar data. If opt is nil, the default options are
+// used (LayerCacheDir is ignored). Timestamps are handled in the same way as
+// GenerateLayer, so PackOptions.SourceDateEpoch can be used to make the layer
+// independent of when the source files were created.
+func GenerateLayerFromDirs(roots []string, target string, opt *PackOptions) (io.ReadCloser, error) {
+	var packOptions PackOptions
+	if opt != nil {
+		packOptions = *opt
+	}
+
+	if len(roots) == 0 {
+		return nil, errors.Errorf("no source directories given")
+	}
+	if err := validateExcludePatterns(packOptions.ExcludePatterns); err != nil {
+		return nil, err
+	}
+	target = filepath.Clean(string(filepath.Separator) + target)
+	target, _ = filepath.Rel(string(filepath.Separator), target)
+
+	entries, err := mergeDirs(roots, target, packOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "merge source directories")
+	}
+
+	var names []string
+	for rel := range entries {
+		names = append(names, rel)
+	}
+	if packOptions.StrictDirOrdering {
+		sort.Slice(names, func(i, j int) bool { return treePathLess(names[i], names[j]) })
+	} else {
+		sort.Strings(names)
+	}
+
+	reader, writer := io.Pipe()
+
+	go func() (Err error) {
+		// Close with the returned error.
+		defer func() {
+			writer.CloseWithError(errors.Wrap(Err, "generate layer"))
+		}()
+
+		tg := newTarGenerator(writer, packOptions)
+		for _, rel := range names {
+			name := filepath.Join(target, rel)
+			fullPath := filepath.Join(roots[entries[rel].root], rel)
+
+			if packOptions.OmitRootEntry && name == "." {
+				log.Debugf("generate layer: omitting root directory entry")
+				continue
+			}
+			if err := tg.AddFile(name, fullPath); err != nil {
+				log.Warnf("generate layer: could not add file '%s': %s", name, err)
+				return errors.Wrap(err, "generate layer file")
+			}
+			tg.progress(name)
+		}
+
+		if err := tg.tw.Close(); err != nil {
+			log.Warnf("generate layer: could not close tar.Writer: %s", err)
+			return errors.Wrap(err, "close tar writer")
+		}
+		return nil
+	}()
+
+	return reader, nil
+}
+
+// GenerateLayerFromFile creates a new OCI layer containing only the file at
+// the given source path, placed at target (a path relative to the root of the
+// layer). By default the layer has no entries for the parent directories of
+// target, so the metadata of those directories in the lower layers is left
+// untouched -- set PackOptions.ParentDirEntries to add them. As with AddFile,
+// a symlink at source is added as a symlink. The source must not be a
+// directory (use GenerateLayerFromDirs instead). As with GenerateLayer, the
+// returned reader is for the *raw* tar data. If opt is nil, the default
+// options are used (LayerCacheDir, ExcludePatterns and MaskFunc are ignored).
+func GenerateLayerFromFile(source, target string, opt *PackOptions) (io.ReadCloser, error) {
+	var packOptions PackOptions
+	if opt != nil {
+		packOptions = *opt
+	}
+
+	target = filepath.Clean(string(filepath.Separator) + target)
+	target, _ = filepath.Rel(string(filepath.Separator), target)
+	if target == "." {
+		return nil, errors.Errorf("target path cannot be the root of the layer")
+	}
+
+	// Check the source now, rather than failing half-way through the layer.
+	fi, err := os.Lstat(source)
+	if err != nil {
+		return nil, errors.Wrap(err, "lstat source")
+	}
+	if fi.IsDir() {
+		return nil, errors.Errorf("source %s is a directory", source)
+	}
+
+	var parents []string
+	if packOptions.ParentDirEntries {
+		for dir := filepath.Dir(target); dir != "."; dir = filepath.Dir(dir) {
+			parents = append([]string{dir}, parents...)
+		}
+	}
+
+	reader, writer := io.Pipe()
+
+	go func() (Err error) {
+		// Close with the returned error.
+		defer func() {
+			writer.CloseWithError(errors.Wrap(Err, "generate layer"))
+		}()
+
+		tg := newTarGenerator(writer, packOptions)
+		for _, dir := range parents {
+			if err := tg.addImplicitDir(dir); err != nil {
+				log.Warnf("generate layer: could not add directory '%s': %s", dir, err)
+				return errors.Wrap(err, "generate layer directory")
+			}
+			tg.progress(dir)
+		}
+		if err := tg.AddFile(target, source); err != nil {
+			log.Warnf("generate layer: could not add file '%s': %s", target, err)
+			return errors.Wrap(err, "generate layer file")
+		}
+		tg.progress(target)
+
+		if err := tg.tw.Close(); err != nil {
+			log.Warnf("generate layer: could not close tar.Writer: %s", err)
+			return errors.Wrap(err, "close tar writer")
+		}
+		return nil
+	}()
+
+	return reader, nil
+}
@@ -20,13 +20,23 @@ package layer
 import (
 	"archive/tar"
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 )
 
 func TestGenerate(t *testing.T) {
@@ -74,7 +84,7 @@ func TestGenerate(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	reader, err := GenerateLayer(dir, diffs, &MapOptions{})
+	reader, err := GenerateLayer(dir, diffs, &PackOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -136,7 +146,160 @@ func TestGenerate(t *testing.T) {
 	}
 }
 
+func TestGenerateDedupWhiteouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateDedupWhiteouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, path := range []string{
+		filepath.Join("removed", "a"),
+		filepath.Join("removed", "sub", "b"),
+		filepath.Join("removed-sibling", "c"),
+		filepath.Join("kept", "d"),
+		filepath.Join("kept", "e"),
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove an entire directory, as well as a single file in a directory
+	// which still exists.
+	if err := os.RemoveAll(filepath.Join(dir, "removed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "removed-sibling", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "kept", "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		dedup     bool
+		whiteouts []string
+	}{
+		{false, []string{
+			filepath.Join("kept", ".wh.d"),
+			".wh.removed",
+			filepath.Join("removed", ".wh.a"),
+			filepath.Join("removed", ".wh.sub"),
+			filepath.Join("removed", "sub", ".wh.b"),
+			filepath.Join("removed-sibling", ".wh.c"),
+		}},
+		{true, []string{
+			filepath.Join("kept", ".wh.d"),
+			".wh.removed",
+			filepath.Join("removed-sibling", ".wh.c"),
+		}},
+	} {
+		reader, err := GenerateLayer(dir, diffs, &PackOptions{DeduplicateWhiteouts: test.dedup})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var whiteouts []string
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if strings.HasPrefix(filepath.Base(hdr.Name), WhiteoutPrefix) {
+				whiteouts = append(whiteouts, hdr.Name)
+			}
+		}
+		reader.Close()
+
+		sort.Strings(whiteouts)
+		sort.Strings(test.whiteouts)
+		if !reflect.DeepEqual(whiteouts, test.whiteouts) {
+			t.Errorf("dedup=%v: unexpected whiteouts: expected %v got %v", test.dedup, test.whiteouts, whiteouts)
+		}
+	}
+}
+
 // Make sure that openSUSE/umoci#33 doesn't regress.
+func TestDeletions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestDeletions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, path := range []string{
+		filepath.Join("removed", "a"),
+		filepath.Join("kept", "b"),
+		filepath.Join("kept", "c"),
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove a directory and a file, and modify another file.
+	if err := os.RemoveAll(filepath.Join(dir, "removed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "kept", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "kept", "c"), []byte("new contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		filepath.Join("kept", "b"),
+		"removed",
+		filepath.Join("removed", "a"),
+	}
+	if paths := Deletions(diffs).Paths; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected deletions: expected %v, got %v", expected, paths)
+	}
+}
+
 func TestGenerateMissingFileError(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestGenerateError")
 	if err != nil {
@@ -188,7 +351,7 @@ func TestGenerateMissingFileError(t *testing.T) {
 	}
 
 	// Generate a layer where the changed file is missing after the diff.
-	reader, err := GenerateLayer(dir, diffs, &MapOptions{})
+	reader, err := GenerateLayer(dir, diffs, &PackOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -253,7 +416,7 @@ func TestGenerateWrongRootError(t *testing.T) {
 	}
 
 	// Generate a layer with the wrong root directory.
-	reader, err := GenerateLayer(filepath.Join(dir, "some"), diffs, &MapOptions{})
+	reader, err := GenerateLayer(filepath.Join(dir, "some"), diffs, &PackOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -270,3 +433,1602 @@ func TestGenerateWrongRootError(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateMaxFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateMaxFileSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Get initial.
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "small"), bytes.Repeat([]byte("x"), 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "large"), bytes.Repeat([]byte("x"), 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get post.
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With the default policy, generation should fail.
+	reader, err := GenerateLayer(dir, diffs, &PackOptions{
+		MaxFileSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, reader); err == nil {
+		t.Errorf("expected an error generating layer with a file exceeding the maximum size")
+	}
+	reader.Close()
+
+	// With FileSizeSkip, the large file should be omitted.
+	reader, err = GenerateLayer(dir, diffs, &PackOptions{
+		MaxFileSize:    1024,
+		FileSizePolicy: FileSizeSkip,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var gotSmall bool
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		switch hdr.Name {
+		case "small":
+			gotSmall = true
+		case "large":
+			t.Errorf("got file exceeding the maximum size in layer")
+		}
+	}
+	if !gotSmall {
+		t.Errorf("did not get small file")
+	}
+}
+
+// Make sure that trees with paths longer than PATH_MAX can be round-tripped.
+func TestGenerateUnpackDeepTree(t *testing.T) {
+	// Long paths are not supported by unpriv.
+	if os.Geteuid() != 0 {
+		t.Skip("deep tree round-trip requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateUnpackDeepTree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get initial.
+	initDh, err := mtree.Walk(src, nil, append(mtree.DefaultKeywords, "sha256digest"), fseval.DefaultFsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a directory tree which is far deeper than PATH_MAX. We don't go
+	// to thousands of levels because both go-mtree and securejoin are
+	// quadratic in the depth of the tree.
+	const depth = 256
+	component := strings.Repeat("d", 31) + "/"
+	deepDir := filepath.Join(src, strings.Repeat(component, depth))
+	if err := fseval.DefaultFsEval.MkdirAll(deepDir, 0755); err != nil {
+		t.Fatalf("mkdir deep tree: %+v", err)
+	}
+	fh, err := fseval.DefaultFsEval.Create(filepath.Join(deepDir, "file"))
+	if err != nil {
+		t.Fatalf("create deep file: %+v", err)
+	}
+	if _, err := fh.Write([]byte("deep contents")); err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	if err := fseval.DefaultFsEval.Symlink("file", filepath.Join(deepDir, "link")); err != nil {
+		t.Fatalf("symlink in deep tree: %+v", err)
+	}
+
+	// Get post.
+	postDh, err := mtree.Walk(src, nil, initDh.UsedKeywords(), fseval.DefaultFsEval)
+	if err != nil {
+		t.Fatalf("walk deep tree: %+v", err)
+	}
+
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(src, diffs, &PackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if err := UnpackLayer(dst, reader, &UnpackOptions{}); err != nil {
+		t.Fatalf("unpack deep tree: %+v", err)
+	}
+
+	// Make sure the unpacked tree matches the original. We ignore the
+	// sub-second timestamps, which are truncated by tar.
+	keywords := []mtree.Keyword{"type", "mode", "size", "link", "sha256digest"}
+	dstDh, err := mtree.Walk(dst, nil, keywords, fseval.DefaultFsEval)
+	if err != nil {
+		t.Fatalf("walk unpacked deep tree: %+v", err)
+	}
+	diffs, err = mtree.Compare(postDh, dstDh, keywords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, diff := range diffs {
+		t.Errorf("unexpected difference after round-trip: %s", diff)
+	}
+
+	linkname, err := fseval.DefaultFsEval.Readlink(filepath.Join(dst, strings.Repeat(component, depth), "link"))
+	if err != nil {
+		t.Fatalf("readlink deep symlink: %+v", err)
+	}
+	if linkname != "file" {
+		t.Errorf("deep symlink has wrong target: %s", linkname)
+	}
+}
+
+func TestCountMetadataOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestCountMetadataOnly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, size := range map[string]int{
+		"chmod":    1000,
+		"chmod2":   234,
+		"content":  500,
+		"resized":  100,
+		"subdir/a": 10,
+		"same":     50,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, bytes.Repeat([]byte("a"), size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keywords := []mtree.Keyword{"size", "type", "uid", "gid", "mode", "link", "nlink", "sha256digest", "xattr"}
+	initDh, err := mtree.Walk(dir, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Metadata-only changes.
+	if err := os.Chmod(filepath.Join(dir, "chmod"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "chmod2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "subdir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Content changes (which may also include metadata changes).
+	if err := ioutil.WriteFile(filepath.Join(dir, "content"), bytes.Repeat([]byte("b"), 500), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "resized"), []byte("short"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "resized"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// New files don't count.
+	if err := ioutil.WriteFile(filepath.Join(dir, "new"), []byte("new file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := MetadataOnlyStats{Files: 2, Bytes: 1234}
+	if stats := CountMetadataOnly(diffs); stats != expected {
+		t.Errorf("CountMetadataOnly: expected %+v, got %+v (diffs: %v)", expected, stats, diffs)
+	}
+}
+
+func TestGenerateOmitRootEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateOmitRootEntry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Modify the root directory, and add a new file to it.
+	if err := ioutil.WriteFile(filepath.Join(dir, "newfile"), []byte("new file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0711); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		omitRoot bool
+		expected []string
+	}{
+		{false, []string{"/", "newfile"}},
+		{true, []string{"newfile"}},
+	} {
+		reader, err := GenerateLayer(dir, diffs, &PackOptions{OmitRootEntry: test.omitRoot})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("unexpected error reading layer: %+v", err)
+			}
+			names = append(names, CleanPath("/"+hdr.Name))
+		}
+		reader.Close()
+
+		var expected []string
+		for _, name := range test.expected {
+			expected = append(expected, CleanPath("/"+name))
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("omitRoot=%v: unexpected layer entries: expected %v, got %v", test.omitRoot, expected, names)
+		}
+	}
+}
+
+func TestGenerateOnProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateOnProgress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		if err := ioutil.WriteFile(path, bytes.Repeat([]byte("x"), 1000*i), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		paths  []string
+		totals []uint64
+	)
+	reader, err := GenerateLayer(dir, diffs, &PackOptions{
+		OmitRootEntry: true,
+		OnProgress: func(bytesWritten uint64, path string) {
+			paths = append(paths, path)
+			totals = append(totals, bytesWritten)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		t.Fatalf("unexpected error reading layer: %+v", err)
+	}
+	reader.Close()
+
+	expected := []string{"file0", "file1", "file2", "file3", "file4"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("OnProgress called with unexpected paths: expected %v, got %v", expected, paths)
+	}
+	for i, total := range totals {
+		if i > 0 && total <= totals[i-1] {
+			t.Errorf("OnProgress totals are not increasing: %v", totals)
+			break
+		}
+	}
+	if len(totals) > 0 && totals[len(totals)-1] > uint64(size) {
+		t.Errorf("OnProgress reported %d bytes, but the layer is only %d bytes", totals[len(totals)-1], size)
+	}
+}
+
+func TestGenerateLayerWithContextCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLayerWithContextCancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("contents %d", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancel the context part of the way through generating the layer.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var added []string
+	reader, err := GenerateLayerWithContext(ctx, dir, diffs, &PackOptions{
+		OnProgress: func(_ uint64, path string) {
+			added = append(added, path)
+			if len(added) == 3 {
+				cancel()
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(ioutil.Discard, reader)
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("expected a cancellation error reading layer, got %+v", err)
+	}
+	if len(added) != 3 {
+		t.Errorf("expected generation to stop after 3 entries, got %v", added)
+	}
+}
+
+func TestGenerateStrictDirOrdering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateStrictDirOrdering")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// All of these names contain characters which sort before '/' and '.',
+	// which breaks a plain lexicographic sort.
+	for _, path := range []string{
+		"!bang",
+		" space",
+		"-dash",
+		"dir/child",
+		"dir/sub dir/file",
+		"dir/sub-dir",
+		"dir/sub/file",
+		"dir-sibling",
+		"dir!sibling/file",
+		"dir.sibling",
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(dir, 0711); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(dir, diffs, &PackOptions{StrictDirOrdering: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var names []string
+	seen := map[string]struct{}{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		name := filepath.Join("/", hdr.Name)
+		names = append(names, name)
+
+		// Every parent directory must have already been emitted.
+		if name != "/" {
+			for parent := filepath.Dir(name); ; parent = filepath.Dir(parent) {
+				if _, ok := seen[parent]; !ok {
+					t.Errorf("entry %s was emitted before its parent directory %s", name, parent)
+				}
+				if parent == "/" {
+					break
+				}
+			}
+		}
+		seen[name] = struct{}{}
+	}
+
+	if len(names) == 0 || names[0] != "/" {
+		t.Errorf("expected root directory to be the first entry: %v", names)
+	}
+	if len(names) != len(diffs) {
+		t.Errorf("expected %d entries, got %d: %v", len(diffs), len(names), names)
+	}
+}
+
+func TestTreePathLess(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		less bool
+	}{
+		{".", "!bang", true},
+		{"!bang", ".", false},
+		{"a", "a/b", true},
+		{"a/b", "a-b", true},
+		{"a-b", "a/b", false},
+		{"a/b/c", "a b", true},
+		{"a/b", "a/b", false},
+		{"a/b", "a/c", true},
+	} {
+		if less := treePathLess(test.a, test.b); less != test.less {
+			t.Errorf("treePathLess(%q, %q): expected %v, got %v", test.a, test.b, test.less, less)
+		}
+	}
+}
+
+func TestGenerateLayerFromDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLayerFromDirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "base")
+	overlay := filepath.Join(dir, "overlay")
+	for path, contents := range map[string]string{
+		"base/etc/config":      "base config",
+		"base/etc/other":       "base other",
+		"base/lib/a/file":      "hidden by overlay",
+		"base/bin/tool":        "base tool",
+		"overlay/etc/config":   "overlay config",
+		"overlay/lib/a":        "file replacing a directory",
+		"overlay/bin/tool/new": "directory replacing a file",
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader, err := GenerateLayerFromDirs([]string{base, overlay}, "/opt/app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	files := map[string]string{}
+	var dirs []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		name := CleanPath("/" + hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, name)
+			continue
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = string(contents)
+	}
+
+	expectedDirs := []string{"/opt/app", "/opt/app/bin", "/opt/app/bin/tool", "/opt/app/etc", "/opt/app/lib"}
+	if !reflect.DeepEqual(dirs, expectedDirs) {
+		t.Errorf("unexpected directories: expected %v, got %v", expectedDirs, dirs)
+	}
+	expectedFiles := map[string]string{
+		"/opt/app/etc/config":   "overlay config",
+		"/opt/app/etc/other":    "base other",
+		"/opt/app/lib/a":        "file replacing a directory",
+		"/opt/app/bin/tool/new": "directory replacing a file",
+	}
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("unexpected files: expected %v, got %v", expectedFiles, files)
+	}
+}
+
+func TestGenerateLayerFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLayerFromFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "my-ca.pem")
+	if err := ioutil.WriteFile(source, []byte("certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(source, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// archive/tar rounds timestamps to the nearest second.
+	sourceTime := time.Unix(1500000000, 0)
+	if err := os.Chtimes(source, sourceTime, sourceTime); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		name     string
+		typeflag byte
+		mode     int64
+		uid, gid int
+		mtime    int64
+		contents string
+	}
+	readEntries := func(opt *PackOptions) []entry {
+		reader, err := GenerateLayerFromFile(source, "/etc/ssl/certs/ca.pem", opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+
+		var entries []entry
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("unexpected error reading layer: %+v", err)
+			}
+			contents, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry{
+				name:     CleanPath("/" + hdr.Name),
+				typeflag: hdr.Typeflag,
+				mode:     hdr.Mode & 07777,
+				uid:      hdr.Uid,
+				gid:      hdr.Gid,
+				mtime:    hdr.ModTime.Unix(),
+				contents: string(contents),
+			})
+		}
+		return entries
+	}
+
+	// By default only the file itself is included, so that the metadata of
+	// its parent directories in lower layers is left alone.
+	uid, gid := os.Getuid(), os.Getgid()
+	file := entry{"/etc/ssl/certs/ca.pem", tar.TypeReg, 0644, uid, gid, sourceTime.Unix(), "certificate"}
+	if entries, expected := readEntries(nil), []entry{file}; !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected layer entries: expected %v, got %v", expected, entries)
+	}
+
+	// The parent directories have a fixed timestamp, so that inserting the
+	// same file twice gives the same layer.
+	expected := []entry{
+		{"/etc", tar.TypeDir, 0755, 0, 0, 0, ""},
+		{"/etc/ssl", tar.TypeDir, 0755, 0, 0, 0, ""},
+		{"/etc/ssl/certs", tar.TypeDir, 0755, 0, 0, 0, ""},
+		file,
+	}
+	for i := 0; i < 2; i++ {
+		if entries := readEntries(&PackOptions{ParentDirEntries: true}); !reflect.DeepEqual(entries, expected) {
+			t.Errorf("unexpected layer entries with parent directories: expected %v, got %v", expected, entries)
+		}
+	}
+
+	epoch := time.Unix(1234567890, 0)
+	for idx := range expected {
+		expected[idx].mtime = epoch.Unix()
+	}
+	if entries := readEntries(&PackOptions{ParentDirEntries: true, SourceDateEpoch: epoch}); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected layer entries with SourceDateEpoch: expected %v, got %v", expected, entries)
+	}
+
+	// Directories and the root are not valid.
+	if _, err := GenerateLayerFromFile(dir, "/etc/dir", nil); err == nil {
+		t.Errorf("expected error inserting a directory")
+	}
+	if _, err := GenerateLayerFromFile(source, "/", nil); err == nil {
+		t.Errorf("expected error inserting at the root")
+	}
+	if _, err := GenerateLayerFromFile(filepath.Join(dir, "nonexist"), "/etc/file", nil); err == nil {
+		t.Errorf("expected error inserting a non-existent file")
+	}
+}
+
+func TestGenerateLayerFromDirsSourceDateEpoch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLayerFromDirsSourceDateEpoch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	for _, path := range []string{"etc/config", "lib/a/file", "bin/tool"} {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	epoch := time.Unix(1500000000, 0)
+	generate := func() []byte {
+		reader, err := GenerateLayerFromDirs([]string{root}, "/opt/app", &PackOptions{SourceDateEpoch: epoch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		layer, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		return layer
+	}
+
+	first := generate()
+
+	// Change the timestamps of every file in the tree.
+	mtime := time.Now().Add(-time.Hour)
+	if err := filepath.Walk(root, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(path, mtime, mtime)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	second := generate()
+	if !bytes.Equal(first, second) {
+		t.Errorf("layers generated with SourceDateEpoch differ after changing timestamps")
+	}
+
+	tr := tar.NewReader(bytes.NewReader(second))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		if !hdr.ModTime.Equal(epoch) {
+			t.Errorf("%s: expected mtime %v, got %v", hdr.Name, epoch, hdr.ModTime)
+		}
+	}
+}
+
+func TestGenerateReproducible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateReproducible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a tree with plenty of entries (and xattrs) so that any
+	// dependence on map iteration order is likely to show up.
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("dir%d", i%4), fmt.Sprintf("file%d", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("contents %d", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if i%5 == 0 {
+			if err := os.Link(path, path+"-link"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for j := 0; j < 8; j++ {
+			name := fmt.Sprintf("user.umoci.test%d", j)
+			if err := unix.Lsetxattr(path, name, []byte(fmt.Sprintf("value %d", j)), 0); err != nil {
+				// Not all filesystems support user xattrs.
+				if err == unix.ENOTSUP || err == unix.EPERM {
+					break
+				}
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := os.Symlink("dir0/file0", filepath.Join(dir, "symlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		generate func() (io.ReadCloser, error)
+	}{
+		{"GenerateLayer", func() (io.ReadCloser, error) {
+			// GenerateLayer sorts the deltas in-place, so shuffle a copy.
+			shuffled := make([]mtree.InodeDelta, len(diffs))
+			for i, j := range rand.Perm(len(diffs)) {
+				shuffled[i] = diffs[j]
+			}
+			return GenerateLayer(dir, shuffled, nil)
+		}},
+		{"GenerateLayerFromDirs", func() (io.ReadCloser, error) {
+			return GenerateLayerFromDirs([]string{dir, dir}, "target", nil)
+		}},
+	} {
+		var first []byte
+		for i := 0; i < 10; i++ {
+			reader, err := test.generate()
+			if err != nil {
+				t.Fatalf("%s: %+v", test.name, err)
+			}
+			layer, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatalf("%s: unexpected error reading layer: %+v", test.name, err)
+			}
+			if first == nil {
+				first = layer
+			} else if !bytes.Equal(first, layer) {
+				t.Fatalf("%s: layer generated on run %d differs from the first run", test.name, i)
+			}
+		}
+	}
+}
+
+func TestGenerateMaxDepth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateMaxDepth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Symlinks are never followed, so symlink loops must be stored as-is.
+	loops := filepath.Join(dir, "loops")
+	if err := os.MkdirAll(filepath.Join(loops, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"dir/self": ".",
+		"dir/up":   "..",
+		"a":        "b",
+		"b":        "a",
+	} {
+		if err := os.Symlink(target, filepath.Join(loops, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader, err := GenerateLayerFromDirs([]string{loops}, ".", &PackOptions{MaxDepth: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	symlinks := map[string]string{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			symlinks[CleanPath(hdr.Name)] = hdr.Linkname
+		}
+	}
+	reader.Close()
+	expectedSymlinks := map[string]string{"dir/self": ".", "dir/up": "..", "a": "b", "b": "a"}
+	if !reflect.DeepEqual(symlinks, expectedSymlinks) {
+		t.Errorf("unexpected symlinks: expected %v, got %v", expectedSymlinks, symlinks)
+	}
+
+	// A tree deeper than MaxDepth must be rejected.
+	deep := filepath.Join(dir, "deep")
+	if err := os.MkdirAll(filepath.Join(deep, "a", "b", "c", "d", "e"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	initDh, err := mtree.Walk(deep, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(deep, "a", "b", "c", "d", "e", "file"), []byte("deep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	postDh, err := mtree.Walk(deep, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a/b/c/d/e/file has 6 components.
+	for _, test := range []struct {
+		name     string
+		generate func(opt *PackOptions) (io.ReadCloser, error)
+	}{
+		{"GenerateLayer", func(opt *PackOptions) (io.ReadCloser, error) {
+			return GenerateLayer(deep, diffs, opt)
+		}},
+		{"GenerateLayerFromDirs", func(opt *PackOptions) (io.ReadCloser, error) {
+			return GenerateLayerFromDirs([]string{deep}, ".", opt)
+		}},
+	} {
+		reader, err := test.generate(&PackOptions{MaxDepth: 5})
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, reader)
+			reader.Close()
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error with MaxDepth=5", test.name)
+		} else if !strings.Contains(err.Error(), "exceeds the maximum depth") {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+		}
+
+		// The default limit is far higher, and can also be disabled.
+		for _, maxDepth := range []int{0, -1} {
+			reader, err := test.generate(&PackOptions{MaxDepth: maxDepth})
+			if err != nil {
+				t.Fatalf("%s: unexpected error with MaxDepth=%d: %+v", test.name, maxDepth, err)
+			}
+			if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+				t.Errorf("%s: unexpected error with MaxDepth=%d: %+v", test.name, maxDepth, err)
+			}
+			reader.Close()
+		}
+	}
+}
+
+func TestGenerateMaskFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateMaskFunc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		"keep/file",
+		"masked/file",
+		"masked/sub/file",
+		"big/small",
+		"big/large",
+	} {
+		contents := "contents"
+		if strings.HasSuffix(path, "large") {
+			contents = strings.Repeat(contents, 1000)
+		}
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Mask the "masked" directory, and any file larger than 1000 bytes. The
+	// mask must never be consulted for paths inside a masked directory.
+	var consulted []string
+	mask := func(path string) bool {
+		consulted = append(consulted, path)
+		if path == "/masked" {
+			return true
+		}
+		fi, err := os.Lstat(filepath.Join(dir, path))
+		if err != nil {
+			t.Errorf("lstat %s: %v", path, err)
+			return false
+		}
+		return fi.Mode().IsRegular() && fi.Size() > 1000
+	}
+	expected := []string{"/", "/big", "/big/small", "/keep", "/keep/file"}
+
+	var got []string
+	for _, delta := range MaskDeltas(diffs, mask) {
+		got = append(got, filepath.Join("/", delta.Path()))
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("MaskDeltas: expected %v, got %v", expected, got)
+	}
+	for _, path := range consulted {
+		if strings.HasPrefix(path, "/masked/") {
+			t.Errorf("MaskDeltas: mask was consulted for %s inside a masked directory", path)
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		generate func(opt *PackOptions) (io.ReadCloser, error)
+	}{
+		{"GenerateLayer", func(opt *PackOptions) (io.ReadCloser, error) {
+			return GenerateLayer(dir, diffs, opt)
+		}},
+		{"GenerateLayerFromDirs", func(opt *PackOptions) (io.ReadCloser, error) {
+			return GenerateLayerFromDirs([]string{dir}, ".", opt)
+		}},
+	} {
+		consulted = nil
+		reader, err := test.generate(&PackOptions{MaskFunc: mask})
+		if err != nil {
+			t.Fatalf("%s: %+v", test.name, err)
+		}
+		var got []string
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: unexpected error reading layer: %+v", test.name, err)
+			}
+			got = append(got, CleanPath("/"+hdr.Name))
+		}
+		reader.Close()
+
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, expected, got)
+		}
+		for _, path := range consulted {
+			if strings.HasPrefix(path, "/masked/") {
+				t.Errorf("%s: mask was consulted for %s inside a masked directory", test.name, path)
+			}
+		}
+	}
+}
+
+func TestGenerateWhiteoutsFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateWhiteoutsFirst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "victim"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "victim", "old"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "a-file"), []byte("a file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keywords := append(mtree.DefaultKeywords, "sha256digest")
+	initDh, err := mtree.Walk(rootfs, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove the directory, and then re-add it with different contents. The
+	// deltas of both steps are combined, so "victim" is both whited out and
+	// re-added by the layer.
+	if err := os.RemoveAll(filepath.Join(rootfs, "victim")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(rootfs, "a-file")); err != nil {
+		t.Fatal(err)
+	}
+	midDh, err := mtree.Walk(rootfs, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(rootfs, "victim"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "victim", "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	postDh, err := mtree.Walk(rootfs, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := mtree.Compare(initDh, midDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := mtree.Compare(midDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, strict := range []bool{false, true} {
+		// Put the additions first, to make sure the order of the deltas
+		// doesn't matter.
+		var diffs []mtree.InodeDelta
+		diffs = append(diffs, added...)
+		for _, delta := range removed {
+			// Modified directories are already part of added.
+			if delta.Type() == mtree.Missing {
+				diffs = append(diffs, delta)
+			}
+		}
+
+		reader, err := GenerateLayer(rootfs, diffs, &PackOptions{StrictDirOrdering: strict})
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("strict=%v: unexpected error generating layer: %+v", strict, err)
+		}
+
+		var names []string
+		tr := tar.NewReader(bytes.NewReader(layer))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("strict=%v: unexpected error reading layer: %+v", strict, err)
+			}
+			names = append(names, filepath.Clean(hdr.Name))
+		}
+
+		whiteoutIdx, victimIdx := -1, -1
+		for idx, name := range names {
+			switch name {
+			case WhiteoutPrefix + "victim":
+				whiteoutIdx = idx
+			case "victim":
+				victimIdx = idx
+			}
+		}
+		if whiteoutIdx < 0 || victimIdx < 0 {
+			t.Fatalf("strict=%v: expected both a whiteout and an entry for victim: %v", strict, names)
+		}
+		if whiteoutIdx > victimIdx {
+			t.Errorf("strict=%v: whiteout of victim emitted after victim was re-added: %v", strict, names)
+		}
+		if !strict {
+			// Every whiteout must come before every other entry.
+			seenEntry := false
+			for _, name := range names {
+				isWhiteout := strings.HasPrefix(filepath.Base(name), WhiteoutPrefix)
+				if isWhiteout && seenEntry {
+					t.Errorf("strict=%v: whiteout %s emitted after a regular entry: %v", strict, name, names)
+				}
+				seenEntry = seenEntry || !isWhiteout
+			}
+		}
+
+		// Applying the layer on top of the original tree must result in the
+		// new contents of victim.
+		lower := filepath.Join(dir, fmt.Sprintf("lower-%v", strict))
+		if err := os.MkdirAll(filepath.Join(lower, "victim"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(lower, "victim", "old"), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := UnpackLayer(lower, bytes.NewReader(layer), &UnpackOptions{MapOptions: MapOptions{Rootless: os.Geteuid() != 0}}); err != nil {
+			t.Fatalf("strict=%v: unexpected error unpacking layer: %+v", strict, err)
+		}
+		if contents, err := ioutil.ReadFile(filepath.Join(lower, "victim", "new")); err != nil || string(contents) != "new" {
+			t.Errorf("strict=%v: expected victim/new to exist after unpacking: %q %v", strict, contents, err)
+		}
+		if _, err := os.Lstat(filepath.Join(lower, "victim", "old")); !os.IsNotExist(err) {
+			t.Errorf("strict=%v: expected victim/old to be removed after unpacking: %v", strict, err)
+		}
+	}
+}
+
+func TestSortDeltas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestSortDeltas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, path := range []string{"b", "d", "f"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"b", "f"} {
+		if err := os.Remove(filepath.Join(dir, path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"a", "c", "e"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sortDeltas(diffs, false)
+	var got []string
+	for _, delta := range diffs {
+		if filepath.Clean(delta.Path()) == "." {
+			continue
+		}
+		got = append(got, fmt.Sprintf("%s:%s", delta.Type(), delta.Path()))
+	}
+	expected := []string{
+		fmt.Sprintf("%s:b", mtree.Missing),
+		fmt.Sprintf("%s:f", mtree.Missing),
+		fmt.Sprintf("%s:a", mtree.Extra),
+		fmt.Sprintf("%s:c", mtree.Extra),
+		fmt.Sprintf("%s:e", mtree.Extra),
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected delta order: expected %v, got %v", expected, got)
+	}
+}
+
+func TestGenerateExcludePatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateExcludePatterns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles := func(paths ...string) {
+		for _, path := range paths {
+			path = filepath.Join(dir, path)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte("contents"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	writeFiles("var/log/old.log", "lib/old.pyc")
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"var/log/old.log", "lib/old.pyc"} {
+		if err := os.Remove(filepath.Join(dir, path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFiles(
+		"app/a.py",
+		"app/a.pyc",
+		"app/sub/b.pyc",
+		"var/log/new.log",
+		"var/log/keep.txt",
+		"build/out/x",
+	)
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patterns := []string{"**/*.pyc", "/var/log/*.log", "/build"}
+	excluded := []string{"/app/a.pyc", "/app/sub/b.pyc", "/var/log/new.log", "/build", "/build/out", "/build/out/x"}
+	kept := []string{"/app/a.py", "/app/sub", "/var/log/keep.txt"}
+
+	for _, test := range []struct {
+		name      string
+		generate  func(opt *PackOptions) (io.ReadCloser, error)
+		whiteouts []string
+	}{
+		{"GenerateLayer", func(opt *PackOptions) (io.ReadCloser, error) {
+			return GenerateLayer(dir, diffs, opt)
+		}, []string{"/var/log/" + WhiteoutPrefix + "old.log", "/lib/" + WhiteoutPrefix + "old.pyc"}},
+		{"GenerateLayerFromDirs", func(opt *PackOptions) (io.ReadCloser, error) {
+			return GenerateLayerFromDirs([]string{dir}, ".", opt)
+		}, nil},
+	} {
+		reader, err := test.generate(&PackOptions{ExcludePatterns: patterns})
+		if err != nil {
+			t.Fatalf("%s: %+v", test.name, err)
+		}
+		entries := map[string]struct{}{}
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: unexpected error reading layer: %+v", test.name, err)
+			}
+			entries[CleanPath("/"+hdr.Name)] = struct{}{}
+		}
+		reader.Close()
+
+		for _, path := range excluded {
+			if _, ok := entries[path]; ok {
+				t.Errorf("%s: excluded path %s was included in the layer", test.name, path)
+			}
+		}
+		// Deletions of excluded paths must still be emitted as whiteouts.
+		for _, path := range append(kept, test.whiteouts...) {
+			if _, ok := entries[path]; !ok {
+				t.Errorf("%s: expected path %s to be included in the layer", test.name, path)
+			}
+		}
+	}
+
+	// Malformed patterns must be rejected.
+	if _, err := GenerateLayer(dir, diffs, &PackOptions{ExcludePatterns: []string{"/tmp/[a-"}}); err == nil {
+		t.Errorf("GenerateLayer: expected an error with a malformed exclude pattern")
+	}
+	if _, err := GenerateLayerFromDirs([]string{dir}, ".", &PackOptions{ExcludePatterns: []string{"/tmp/[a-"}}); err == nil {
+		t.Errorf("GenerateLayerFromDirs: expected an error with a malformed exclude pattern")
+	}
+}
+
+func TestSplitDeltas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestSplitDeltas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, root := range []string{src, dst} {
+		if err := os.MkdirAll(filepath.Join(root, "old"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"old/a", "old/b", "keep"} {
+			if err := ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	initDh, err := mtree.Walk(src, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove a directory and add enough data for several layers (including
+	// a file which is larger than the limit by itself).
+	if err := os.RemoveAll(filepath.Join(src, "old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 1000)
+		if err := ioutil.WriteFile(filepath.Join(src, "new", fmt.Sprintf("file%d", i)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "big"), bytes.Repeat([]byte("big"), 3000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A hardlink which is emitted a few entries after the other link to its
+	// inode (which would otherwise end up in a different group).
+	if err := os.Link(filepath.Join(src, "new", "file1"), filepath.Join(src, "new", "file3-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(src, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a limit, everything ends up in one group.
+	groups, err := SplitDeltas(src, diffs, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || len(groups[0]) != len(diffs) {
+		t.Errorf("expected a single group without a limit, got %d groups", len(groups))
+	}
+
+	const maxBytes = 4096
+	groups, err = SplitDeltas(src, diffs, maxBytes, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) < 3 {
+		t.Fatalf("expected deltas to be split into at least 3 groups, got %d", len(groups))
+	}
+
+	var total int
+	linkGroups := map[string]int{}
+	for idx, group := range groups {
+		if len(group) == 0 {
+			t.Errorf("group %d is empty", idx)
+		}
+		for _, delta := range group {
+			switch delta.Path() {
+			case "new/file1", "new/file3-link":
+				linkGroups[delta.Path()] = idx
+			}
+		}
+		total += len(group)
+	}
+	if total != len(diffs) {
+		t.Errorf("expected %d deltas in total, got %d", len(diffs), total)
+	}
+	var totalSize int64
+	for _, group := range groups {
+		totalSize += EstimateLayerSize(group)
+	}
+	if expected := EstimateLayerSize(diffs); totalSize != expected {
+		t.Errorf("expected estimated size of groups to add up to %d, got %d", expected, totalSize)
+	}
+	if len(linkGroups) != 2 || linkGroups["new/file1"] != linkGroups["new/file3-link"] {
+		t.Errorf("expected hardlinks to be in the same group, got %v", linkGroups)
+	}
+
+	// Only groups containing the hardlinks may exceed the limit.
+	for idx, group := range groups {
+		var size int64
+		for _, delta := range group {
+			size += estimateDeltaSize(delta)
+		}
+		if size > maxBytes && len(group) != 1 && idx != linkGroups["new/file1"] {
+			t.Errorf("group %d has estimated size %d > %d with %d entries", idx, size, maxBytes, len(group))
+		}
+	}
+
+	// Applying each of the layers in order must produce the new tree.
+	for idx, group := range groups {
+		reader, err := GenerateLayer(src, group, &PackOptions{})
+		if err != nil {
+			t.Fatalf("generate layer %d: %+v", idx, err)
+		}
+		err = UnpackLayer(dst, reader, &UnpackOptions{MapOptions: MapOptions{Rootless: os.Geteuid() != 0}})
+		reader.Close()
+		if err != nil {
+			t.Fatalf("unpack layer %d: %+v", idx, err)
+		}
+	}
+
+	keywords := []mtree.Keyword{"type", "mode", "size", "link", "sha256digest"}
+	dstDh, err := mtree.Walk(dst, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err = mtree.Compare(postDh, dstDh, keywords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, diff := range diffs {
+		t.Errorf("unexpected difference after applying split layers: %s", diff)
+	}
+
+	// The hardlink must have been preserved.
+	linkInfo, err := os.Lstat(filepath.Join(dst, "new", "file3-link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Lstat(filepath.Join(dst, "new", "file1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(linkInfo, fileInfo) {
+		t.Errorf("expected new/file1 and new/file3-link to be hardlinks after applying split layers")
+	}
+}
+
+func TestSplitDeltasMaxFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestSplitDeltasMaxFiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// fileDeltas returns the deltas of the regular files in dir, so that the
+	// (modified) root directory doesn't affect the number of entries.
+	fileDeltas := func() []mtree.InodeDelta {
+		postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []mtree.InodeDelta
+		for _, diff := range diffs {
+			if diff.Path() != "." {
+				files = append(files, diff)
+			}
+		}
+		return files
+	}
+	groupSizes := func(groups [][]mtree.InodeDelta) []int {
+		var sizes []int
+		for _, group := range groups {
+			sizes = append(sizes, len(group))
+		}
+		return sizes
+	}
+
+	diffs := fileDeltas()
+	if len(diffs) != 10 {
+		t.Fatalf("expected 10 deltas, got %d", len(diffs))
+	}
+	groups, err := SplitDeltas(dir, diffs, 0, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes, expected := groupSizes(groups), []int{3, 3, 3, 1}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("unexpected group sizes with at most 3 files: expected %v got %v", expected, sizes)
+	}
+
+	// Hardlinks are never split, even if that exceeds the file limit.
+	if err := os.Link(filepath.Join(dir, "file2"), filepath.Join(dir, "file3-link")); err != nil {
+		t.Fatal(err)
+	}
+	groups, err = SplitDeltas(dir, fileDeltas(), 0, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes, expected := groupSizes(groups), []int{5, 3, 3}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("unexpected group sizes with a hardlink: expected %v got %v", expected, sizes)
+	}
+}
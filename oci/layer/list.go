@@ -0,0 +1,177 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// The types of a LayerEntry.
+const (
+	EntryFile      = "file"
+	EntryDirectory = "directory"
+	EntrySymlink   = "symlink"
+	EntryHardlink  = "hardlink"
+	EntryCharDev   = "char"
+	EntryBlockDev  = "block"
+	EntryFifo      = "fifo"
+
+	// EntryWhiteout is a whiteout, which removes Path from the lower layers.
+	EntryWhiteout = "whiteout"
+
+	// EntryOpaque is an opaque whiteout, which removes the contents of the
+	// directory Path in the lower layers.
+	EntryOpaque = "opaque"
+)
+
+// LayerEntry describes a single entry of a layer, as returned by ListLayer.
+type LayerEntry struct {
+	// Path is the path of the entry, relative to the root of the layer. For
+	// whiteouts, it is the path being removed (rather than the name of the
+	// whiteout entry itself).
+	Path string `json:"path"`
+
+	// Type is the type of the entry (one of the Entry* constants).
+	Type string `json:"type"`
+
+	// Mode is the permission bits of the entry (including the setuid,
+	// setgid and sticky bits), as stored in the layer.
+	Mode int64 `json:"mode"`
+
+	// Size is the size of the contents of the entry in the layer.
+	Size int64 `json:"size"`
+
+	// UID and GID are the owner of the entry.
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+
+	// Linkname is the target of a symlink or hardlink.
+	Linkname string `json:"linkname,omitempty"`
+}
+
+// sniffLayerMediaType guesses the media type of a layer blob from the first
+// bytes of its contents.
+func sniffLayerMediaType(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return ispec.MediaTypeImageLayerGzip
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return casext.MediaTypeImageLayerZstd
+	}
+	return ispec.MediaTypeImageLayer
+}
+
+// layerEntry converts a tar header into a LayerEntry.
+func layerEntry(hdr *tar.Header) (LayerEntry, error) {
+	entry := LayerEntry{
+		Path:     CleanPath(hdr.Name),
+		Mode:     hdr.Mode & 07777,
+		Size:     hdr.Size,
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Linkname: hdr.Linkname,
+	}
+
+	dir, file := filepath.Split(entry.Path)
+	switch {
+	case file == WhiteoutOpaque:
+		entry.Type = EntryOpaque
+		entry.Path = CleanPath(dir)
+		return entry, nil
+	case strings.HasPrefix(file, WhiteoutPrefix):
+		entry.Type = EntryWhiteout
+		entry.Path = filepath.Join(dir, strings.TrimPrefix(file, WhiteoutPrefix))
+		return entry, nil
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		entry.Type = EntryFile
+	case tar.TypeDir:
+		entry.Type = EntryDirectory
+	case tar.TypeSymlink:
+		entry.Type = EntrySymlink
+	case tar.TypeLink:
+		entry.Type = EntryHardlink
+		entry.Linkname = CleanPath(hdr.Linkname)
+	case tar.TypeChar:
+		entry.Type = EntryCharDev
+	case tar.TypeBlock:
+		entry.Type = EntryBlockDev
+	case tar.TypeFifo:
+		entry.Type = EntryFifo
+	default:
+		return LayerEntry{}, errors.Errorf("unsupported entry type for %s: %v", hdr.Name, hdr.Typeflag)
+	}
+	return entry, nil
+}
+
+// ListLayer reads the layer blob with the given digest from the engine, and
+// calls fn with each of the entries of the layer in the order they appear,
+// without extracting anything. The compression of the layer (gzip, zstd or
+// none) is detected from the contents of the blob. If fn returns an error,
+// listing stops and the error is returned.
+func ListLayer(ctx context.Context, engine cas.Engine, layerDigest digest.Digest, fn func(LayerEntry) error) error {
+	blob, err := engine.GetBlob(ctx, layerDigest)
+	if err != nil {
+		return errors.Wrap(err, "get layer blob")
+	}
+	defer blob.Close()
+
+	buffered := bufio.NewReader(blob)
+	header, err := buffered.Peek(4)
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "read layer blob")
+	}
+	layerRaw, err := casext.DecompressLayer(buffered, sniffLayerMediaType(header))
+	if err != nil {
+		return errors.Wrap(err, "decompress layer")
+	}
+	defer layerRaw.Close()
+
+	tr := tar.NewReader(layerRaw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		entry, err := layerEntry(hdr)
+		if err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"golang.org/x/net/context"
+)
+
+func TestListLayer(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestListLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the umask doesn't affect the expected modes.
+	if err := os.Chmod(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte("root:x:0:0::/root:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(rootfs, "etc", "passwd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("passwd", filepath.Join(rootfs, "etc", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, PackOptions{})
+	for _, name := range []string{"etc", "etc/link", "etc/passwd"} {
+		if err := tg.AddFile(name, filepath.Join(rootfs, name)); err != nil {
+			t.Fatalf("AddFile %s: unexpected error: %+v", name, err)
+		}
+	}
+	if err := tg.AddWhiteout("etc/group"); err != nil {
+		t.Fatalf("AddWhiteout: unexpected error: %+v", err)
+	}
+	if err := tg.tw.WriteHeader(&tar.Header{Name: "var/" + WhiteoutOpaque, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer := buf.Bytes()
+
+	var gzbuf bytes.Buffer
+	gzw := gzip.NewWriter(&gzbuf)
+	if _, err := gzw.Write(layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	expected := []LayerEntry{
+		{Path: "etc", Type: EntryDirectory, Mode: 0755},
+		{Path: "etc/link", Type: EntrySymlink, Mode: 0777, Linkname: "passwd"},
+		{Path: "etc/passwd", Type: EntryFile, Mode: 0644, Size: 26},
+		{Path: "etc/group", Type: EntryWhiteout},
+		{Path: "var", Type: EntryOpaque},
+	}
+
+	// Both compressed and uncompressed layers can be listed.
+	for _, blob := range [][]byte{layer, gzbuf.Bytes()} {
+		layerDigest, _, err := engine.PutBlob(context.Background(), bytes.NewReader(blob))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []LayerEntry
+		if err := ListLayer(context.Background(), engine, layerDigest, func(entry LayerEntry) error {
+			// Ownership depends on the test environment.
+			entry.UID, entry.GID = 0, 0
+			got = append(got, entry)
+			return nil
+		}); err != nil {
+			t.Fatalf("unexpected error listing layer: %+v", err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("unexpected layer entries:\nexpected %+v\ngot      %+v", expected, got)
+		}
+	}
+}
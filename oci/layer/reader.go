@@ -0,0 +1,149 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// LayerOpType is the type of a LayerOp.
+type LayerOpType int
+
+const (
+	// OpAddFile adds the entry described by LayerOp.Header at LayerOp.Path,
+	// replacing anything at that path in the lower layers. The contents of
+	// regular files are read from the LayerReader.
+	OpAddFile LayerOpType = iota
+
+	// OpRemoveFile removes LayerOp.Path (and everything inside it) from the
+	// lower layers.
+	OpRemoveFile
+
+	// OpOpaqueDir removes the contents of the directory LayerOp.Path in the
+	// lower layers, leaving the directory itself in place.
+	OpOpaqueDir
+)
+
+func (t LayerOpType) String() string {
+	switch t {
+	case OpAddFile:
+		return "add"
+	case OpRemoveFile:
+		return "remove"
+	case OpOpaqueDir:
+		return "opaque"
+	}
+	return fmt.Sprintf("LayerOpType(%d)", int(t))
+}
+
+// LayerOp is a single logical operation applied by a layer to the lower
+// layers, as returned by LayerReader.Next.
+type LayerOp struct {
+	// Type is the type of the operation.
+	Type LayerOpType
+
+	// Path is the cleaned path the operation applies to, relative to the root
+	// of the layer. For whiteouts, it is the path being removed (rather than
+	// the name of the whiteout entry itself).
+	Path string
+
+	// Header is the tar header of the entry for OpAddFile operations, and is
+	// nil for all other operations.
+	Header *tar.Header
+}
+
+// LayerReader reads the logical operations of a layer blob, taking care of
+// decompressing the blob and interpreting whiteouts. It is used in the same
+// way as a tar.Reader: Next advances to the next operation, and Read reads
+// the contents of the current OpAddFile operation (if it is a regular file).
+type LayerReader struct {
+	blob io.Closer
+	raw  io.ReadCloser
+	tr   *tar.Reader
+}
+
+// NewLayerReader opens the layer blob referenced by the given descriptor from
+// the engine. The blob is decompressed according to the media type of the
+// descriptor. The caller must Close the LayerReader when done.
+func NewLayerReader(ctx context.Context, engine cas.Engine, desc ispec.Descriptor) (*LayerReader, error) {
+	blob, err := engine.GetBlob(ctx, desc.Digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "get layer blob")
+	}
+	raw, err := casext.DecompressLayer(blob, desc.MediaType)
+	if err != nil {
+		blob.Close()
+		return nil, errors.Wrap(err, "decompress layer")
+	}
+	return &LayerReader{
+		blob: blob,
+		raw:  raw,
+		tr:   tar.NewReader(raw),
+	}, nil
+}
+
+// Next advances to the next operation in the layer. At the end of the layer,
+// Next returns io.EOF.
+func (lr *LayerReader) Next() (*LayerOp, error) {
+	hdr, err := lr.tr.Next()
+	if err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "read next entry")
+	}
+
+	entry, err := layerEntry(hdr)
+	if err != nil {
+		return nil, err
+	}
+	op := &LayerOp{Path: entry.Path}
+	switch entry.Type {
+	case EntryWhiteout:
+		op.Type = OpRemoveFile
+	case EntryOpaque:
+		op.Type = OpOpaqueDir
+	default:
+		op.Type = OpAddFile
+		op.Header = hdr
+	}
+	return op, nil
+}
+
+// Read reads from the contents of the current OpAddFile operation. It returns
+// io.EOF immediately for operations which have no contents.
+func (lr *LayerReader) Read(p []byte) (int, error) {
+	return lr.tr.Read(p)
+}
+
+// Close closes the layer blob.
+func (lr *LayerReader) Close() error {
+	if err := lr.raw.Close(); err != nil {
+		lr.blob.Close()
+		return errors.Wrap(err, "close decompressor")
+	}
+	return errors.Wrap(lr.blob.Close(), "close layer blob")
+}
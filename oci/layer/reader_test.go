@@ -0,0 +1,146 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestLayerReader(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestLayerReader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	contents := "root:x:0:0::/root:/bin/sh\n"
+	var gzbuf bytes.Buffer
+	gzw := gzip.NewWriter(&gzbuf)
+	tw := tar.NewWriter(gzw)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))},
+		{Name: "etc/.wh.group", Typeflag: tar.TypeReg},
+		{Name: "var/" + WhiteoutOpaque, Typeflag: tar.TypeReg},
+		{Name: "var/lib", Typeflag: tar.TypeSymlink, Linkname: "../lib"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := io.WriteString(tw, contents); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	layerDigest, layerSize, err := engine.PutBlob(context.Background(), &gzbuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+
+	lr, err := NewLayerReader(context.Background(), engine, desc)
+	if err != nil {
+		t.Fatalf("NewLayerReader: unexpected error: %+v", err)
+	}
+	defer lr.Close()
+
+	expected := []struct {
+		typ  LayerOpType
+		path string
+	}{
+		{OpAddFile, "etc"},
+		{OpAddFile, "etc/passwd"},
+		{OpRemoveFile, "etc/group"},
+		{OpOpaqueDir, "var"},
+		{OpAddFile, "var/lib"},
+	}
+	for idx := 0; ; idx++ {
+		op, err := lr.Next()
+		if err == io.EOF {
+			if idx != len(expected) {
+				t.Errorf("expected %d operations, got %d", len(expected), idx)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: unexpected error: %+v", err)
+		}
+		if idx >= len(expected) {
+			t.Errorf("unexpected operation %s %s", op.Type, op.Path)
+			continue
+		}
+		if op.Type != expected[idx].typ || op.Path != expected[idx].path {
+			t.Errorf("operation %d: expected %s %s, got %s %s", idx, expected[idx].typ, expected[idx].path, op.Type, op.Path)
+		}
+		if (op.Type == OpAddFile) != (op.Header != nil) {
+			t.Errorf("operation %d: unexpected header %v for %s", idx, op.Header, op.Type)
+		}
+
+		data, err := ioutil.ReadAll(lr)
+		if err != nil {
+			t.Fatalf("read contents of %s: unexpected error: %+v", op.Path, err)
+		}
+		if op.Path == "etc/passwd" {
+			if string(data) != contents {
+				t.Errorf("etc/passwd: expected contents %q, got %q", contents, string(data))
+			}
+		} else if len(data) != 0 {
+			t.Errorf("%s: expected no contents, got %q", op.Path, string(data))
+		}
+	}
+
+	// Unknown media types must be rejected.
+	desc.MediaType = "application/vnd.example.unknown"
+	if lr, err := NewLayerReader(context.Background(), engine, desc); err == nil {
+		lr.Close()
+		t.Errorf("expected NewLayerReader to fail with unknown media type")
+	}
+}
@@ -23,7 +23,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/apex/log"
@@ -40,6 +42,36 @@ type tarExtractor struct {
 
 	// fsEval is an fseval.FsEval used for extraction.
 	fsEval fseval.FsEval
+
+	// fileFlags are the inode flags to be applied by applyFileFlags, once
+	// all of the entries have been extracted (immutable files and
+	// directories cannot be modified after their flags are set).
+	fileFlags map[string]uint32
+
+	// entryFilter is consulted for every entry by unpackLayer (if set).
+	entryFilter EntryFilter
+
+	// includePrefix restricts which entries are extracted by unpackLayer (if
+	// set).
+	includePrefix string
+
+	// hardlinkFallback specifies how cross-device hardlinks are handled.
+	hardlinkFallback HardlinkFallback
+
+	// whiteoutFormat is the format of the whiteouts in the layers.
+	whiteoutFormat WhiteoutFormat
+
+	// keepWhiteouts causes whiteouts to be extracted as regular files.
+	keepWhiteouts bool
+
+	// overlayWhiteouts causes whiteouts to be extracted as overlayfs
+	// whiteouts.
+	overlayWhiteouts bool
+
+	// opaqueDirs are the directories to be marked as opaque by
+	// applyOpaqueDirs, once all of the entries have been extracted (the
+	// xattrs of a directory are replaced when its own entry is extracted).
+	opaqueDirs map[string]struct{}
 }
 
 // newTarExtractor creates a new tarExtractor.
@@ -52,7 +84,252 @@ func newTarExtractor(opt MapOptions) *tarExtractor {
 	return &tarExtractor{
 		mapOptions: opt,
 		fsEval:     fsEval,
+		fileFlags:  map[string]uint32{},
+		opaqueDirs: map[string]struct{}{},
+	}
+}
+
+// newUnpackExtractor creates a new tarExtractor configured with the given
+// UnpackOptions.
+func newUnpackExtractor(opt UnpackOptions) *tarExtractor {
+	te := newTarExtractor(opt.MapOptions)
+	te.entryFilter = opt.EntryFilter
+	te.includePrefix = opt.IncludePrefix
+	te.hardlinkFallback = opt.HardlinkFallback
+	te.whiteoutFormat = opt.WhiteoutFormat
+	te.keepWhiteouts = opt.KeepWhiteouts
+	te.overlayWhiteouts = opt.TranslateOverlayWhiteouts
+	return te
+}
+
+// isCrossDevice returns whether the error returned by fsEval.Link indicates
+// that the link target is on a different filesystem.
+func isCrossDevice(err error) bool {
+	switch err := errors.Cause(err).(type) {
+	case *os.LinkError:
+		return err.Err == unix.EXDEV
+	case *os.SyscallError:
+		return err.Err == unix.EXDEV
+	case syscall.Errno:
+		return err == unix.EXDEV
+	}
+	return false
+}
+
+// copyHardlink is used in place of creating a hardlink when the target is on
+// a different filesystem to path. The contents, mode, ownership and
+// timestamps of the (regular file) target are copied to a new file at path.
+func (te *tarExtractor) copyHardlink(target, path string) error {
+	fi, err := te.fsEval.Lstat(target)
+	if err != nil {
+		return errors.Wrap(err, "lstat hardlink target")
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.Errorf("cannot copy non-regular hardlink target %s", target)
+	}
+	stat, err := te.fsEval.Lstatx(target)
+	if err != nil {
+		return errors.Wrap(err, "lstatx hardlink target")
+	}
+
+	src, err := te.fsEval.Open(target)
+	if err != nil {
+		return errors.Wrap(err, "open hardlink target")
+	}
+	defer src.Close()
+
+	dst, err := te.fsEval.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "create hardlink copy")
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return errors.Wrap(err, "copy hardlink target")
+	}
+	if err := dst.Close(); err != nil {
+		return errors.Wrap(err, "close hardlink copy")
+	}
+
+	// The ownership is copied as-is, as it has already been mapped.
+	if err := te.fsEval.Lchown(path, int(stat.Uid), int(stat.Gid)); err != nil {
+		if !te.mapOptions.Rootless {
+			return errors.Wrap(err, "chown hardlink copy")
+		}
+		log.Warnf("rootless{%s} ignoring (usually) harmless EPERM on lchown", path)
+	}
+	if err := te.fsEval.Chmod(path, fi.Mode()); err != nil {
+		return errors.Wrap(err, "chmod hardlink copy")
+	}
+	atime := time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+	if err := te.fsEval.Lutimes(path, atime, fi.ModTime()); err != nil {
+		return errors.Wrap(err, "set hardlink copy times")
+	}
+	return nil
+}
+
+// forgetPath removes the pending inode flags and opaque directories of the
+// given path and everything inside it, because the path has been removed.
+func (te *tarExtractor) forgetPath(path string) {
+	for flagPath := range te.fileFlags {
+		if flagPath == path || strings.HasPrefix(flagPath, path+"/") {
+			delete(te.fileFlags, flagPath)
+		}
+	}
+	for opaquePath := range te.opaqueDirs {
+		if opaquePath == path || strings.HasPrefix(opaquePath, path+"/") {
+			delete(te.opaqueDirs, opaquePath)
+		}
+	}
+}
+
+// overlayOpaqueXattr is the xattr used by overlayfs to mark a directory as
+// opaque.
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// applyOpaqueDirs marks all of the directories which had an opaque whiteout
+// as opaque overlayfs directories. This must be called before applyFileFlags,
+// as the xattrs of immutable directories cannot be modified.
+func (te *tarExtractor) applyOpaqueDirs() error {
+	var paths []string
+	for path := range te.opaqueDirs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if err := te.fsEval.Lsetxattr(path, overlayOpaqueXattr, []byte("y"), 0); err != nil {
+			return errors.Wrapf(err, "set opaque xattr: %s", path)
+		}
+	}
+	te.opaqueDirs = map[string]struct{}{}
+	return nil
+}
+
+// unpackOverlayWhiteout extracts a whiteout entry (with the given name inside
+// dir) in the overlayfs format. Regular whiteouts are replaced with a 0:0
+// character device, while opaque whiteouts mark dir to be made opaque by
+// applyOpaqueDirs.
+func (te *tarExtractor) unpackOverlayWhiteout(dir, file string) error {
+	if err := te.fsEval.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrap(err, "mkdir parent")
 	}
+
+	if file == WhiteoutOpaque {
+		te.opaqueDirs[dir] = struct{}{}
+		return nil
+	}
+
+	path := filepath.Join(dir, strings.TrimPrefix(file, WhiteoutPrefix))
+	if err := te.fsEval.RemoveAll(path); err != nil {
+		return errors.Wrap(err, "whiteout remove all")
+	}
+	te.forgetPath(path)
+
+	mode := os.FileMode(system.Tarmode(tar.TypeChar))
+	if err := te.fsEval.Mknod(path, mode, unix.Mkdev(0, 0)); err != nil {
+		return errors.Wrap(err, "mknod overlay whiteout")
+	}
+	return nil
+}
+
+// isOverlayWhiteout returns whether the given entry is an overlayfs whiteout
+// (a 0:0 character device).
+func isOverlayWhiteout(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeChar && hdr.Devmajor == 0 && hdr.Devminor == 0
+}
+
+// isOverlayOpaque returns whether the given entry is an overlayfs opaque
+// directory.
+func isOverlayOpaque(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeDir && hdr.Xattrs[overlayOpaqueXattr] == "y"
+}
+
+// convertOverlayWhiteout converts an overlayfs whiteout entry into the
+// equivalent OCI whiteout, and returns whether the entry is an opaque
+// directory (whose xattr is removed). Opaque directories have no equivalent
+// single OCI entry, so the caller must clear them with clearOpaqueDir.
+func convertOverlayWhiteout(hdr *tar.Header) (opaque bool) {
+	switch {
+	case isOverlayWhiteout(hdr):
+		dir, file := filepath.Split(CleanPath(hdr.Name))
+		hdr.Name = filepath.Join(dir, WhiteoutPrefix+file)
+		hdr.Typeflag = tar.TypeReg
+		hdr.Mode = 0
+		hdr.Size = 0
+	case isOverlayOpaque(hdr):
+		delete(hdr.Xattrs, overlayOpaqueXattr)
+		return true
+	}
+	return false
+}
+
+// clearOpaqueDir removes the contents of the directory of the given entry
+// (inside root), as they come from lower layers which have been hidden by an
+// opaque directory. Entries inside the directory from the layer being
+// extracted come after the directory itself, and are thus unaffected.
+func (te *tarExtractor) clearOpaqueDir(root string, hdr *tar.Header) error {
+	dir, err := securejoin.SecureJoinVFS(root, CleanPath(hdr.Name), te.fsEval)
+	if err != nil {
+		return errors.Wrap(err, "sanitise symlinks in root")
+	}
+	fi, err := te.fsEval.Lstat(dir)
+	if err != nil || !fi.IsDir() {
+		// Nothing to clear.
+		return nil
+	}
+	children, err := te.fsEval.Readdir(dir)
+	if err != nil {
+		return errors.Wrap(err, "read opaque directory")
+	}
+	for _, child := range children {
+		path := filepath.Join(dir, child.Name())
+		if err := te.fsEval.RemoveAll(path); err != nil {
+			return errors.Wrap(err, "opaque remove all")
+		}
+		te.forgetPath(path)
+	}
+	return nil
+}
+
+// applyFileFlags sets the inode flags of all of the extracted entries which
+// had flags stored in the layer. If the flags cannot be set because they are
+// not supported (or we don't have the privileges required), a warning is
+// output and the flags are ignored.
+func (te *tarExtractor) applyFileFlags() error {
+	var paths []string
+	for path := range te.fileFlags {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if err := func() error {
+			fh, err := te.fsEval.Open(path)
+			if err != nil {
+				return errors.Wrap(err, "open")
+			}
+			defer fh.Close()
+
+			oldFlags, err := system.GetFileFlags(fh)
+			if err != nil {
+				return err
+			}
+			newFlags := (oldFlags &^ supportedFileFlags) | te.fileFlags[path]
+			if newFlags == oldFlags {
+				return nil
+			}
+			return system.SetFileFlags(fh, newFlags)
+		}(); err != nil {
+			if isFileFlagsUnsupported(err) {
+				log.Warnf("ignoring file flags of %s: %v", path, err)
+				continue
+			}
+			return errors.Wrapf(err, "restore file flags: %s", path)
+		}
+	}
+	te.fileFlags = map[string]uint32{}
+	return nil
 }
 
 // restoreMetadata applies the state described in tar.Header to the filesystem
@@ -70,9 +347,7 @@ func (te *tarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 
 	// Apply owner (only used in non-rootless case).
 	if !te.mapOptions.Rootless {
-		// XXX: While unpriv.Lchown doesn't make a whole lot of sense this
-		//      should _probably_ be put inside FsEval.
-		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+		if err := te.fsEval.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
 			return errors.Wrapf(err, "restore chown metadata: %s", path)
 		}
 	}
@@ -224,9 +499,12 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// files is meant to be. We specifically only produce regular files
 	// ('\x00') but it could be possible that someone produces a different
 	// Typeflag, expecting that the path is the only thing that matters in a
-	// whiteout entry.
-	if strings.HasPrefix(file, whPrefix) {
-		file = strings.TrimPrefix(file, whPrefix)
+	// whiteout entry. With keepWhiteouts, the entry is extracted as-is.
+	if strings.HasPrefix(file, WhiteoutPrefix) && te.overlayWhiteouts {
+		return te.unpackOverlayWhiteout(dir, file)
+	}
+	if strings.HasPrefix(file, WhiteoutPrefix) && !te.keepWhiteouts {
+		file = strings.TrimPrefix(file, WhiteoutPrefix)
 		path = filepath.Join(dir, file)
 
 		// Unfortunately we can't just stat the file here, because if we hit a
@@ -240,9 +518,14 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		if err := te.fsEval.RemoveAll(path); err != nil {
 			return errors.Wrap(err, "whiteout remove all")
 		}
+		te.forgetPath(path)
 		return nil
 	}
 
+	// Any flags from a previous entry for this path are replaced by the flags
+	// of this entry (if it has any).
+	delete(te.fileFlags, path)
+
 	// Get information about the path. This has to be done after we've dealt
 	// with whiteouts because it turns out that lstat(2) will return EPERM if
 	// you try to stat a whiteout on AUFS.
@@ -262,6 +545,7 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		if err := te.fsEval.RemoveAll(path); err != nil {
 			return errors.Wrap(err, "replace removeall")
 		}
+		te.forgetPath(path)
 	}
 
 	// Attempt to create the parent directory of the path we're unpacking.
@@ -338,8 +622,15 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 			return errors.Wrap(err, "remove link old")
 		}
 
-		// Link the new one.
-		if err := linkFn(linkname, path); err != nil {
+		// Link the new one. Hardlinks across filesystems (which can happen if
+		// the root has other filesystems mounted inside it) are copied
+		// instead if the user asked us to.
+		err := linkFn(linkname, path)
+		if hdr.Typeflag == tar.TypeLink && isCrossDevice(err) && te.hardlinkFallback == HardlinkFallbackCopy {
+			log.Warnf("hardlink %s crosses filesystems: copying %s instead", hdr.Name, hdr.Linkname)
+			err = te.copyHardlink(linkname, path)
+		}
+		if err != nil {
 			// FIXME: Currently this can break if tar hardlink entries occur
 			//        before we hit the entry those hardlinks link to. I have a
 			//        feeling that such archives are invalid, but the correct
@@ -402,5 +693,15 @@ out:
 		}
 	}
 
+	// Inode flags are only applied once the whole layer has been extracted.
+	if value, ok := hdr.PAXRecords[paxFileFlags]; ok {
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeDir:
+			if flags := parseFileFlags(value); flags != 0 {
+				te.fileFlags[path] = flags
+			}
+		}
+	}
+
 	return nil
 }
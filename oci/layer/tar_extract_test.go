@@ -26,6 +26,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/openSUSE/umoci/pkg/fseval"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"golang.org/x/sys/unix"
 )
@@ -232,7 +233,7 @@ func TestUnpackEntryWhiteout(t *testing.T) {
 			defer os.RemoveAll(dir)
 
 			rawDir, rawFile := filepath.Split(test.path)
-			wh := filepath.Join(rawDir, whPrefix+rawFile)
+			wh := filepath.Join(rawDir, WhiteoutPrefix+rawFile)
 
 			// Create the parent directory.
 			if err := os.MkdirAll(filepath.Join(dir, rawDir), 0755); err != nil {
@@ -613,3 +614,279 @@ func TestUnpackEntryMap(t *testing.T) {
 		}
 	}(t)
 }
+
+// exdevFsEval is an fseval.FsEval which pretends that every hardlink crosses
+// filesystems, so that cross-device hardlink handling can be tested without
+// having to set up separate mounts.
+type exdevFsEval struct {
+	fseval.FsEval
+}
+
+func (fs exdevFsEval) Link(linkname, path string) error {
+	return &os.LinkError{Op: "link", Old: linkname, New: path, Err: unix.EXDEV}
+}
+
+// TestUnpackEntryHardlinkFallback checks that hardlinks across filesystems are
+// handled according to the HardlinkFallback.
+func TestUnpackEntryHardlinkFallback(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		fallback HardlinkFallback
+	}{
+		{"Error", HardlinkFallbackError},
+		{"Copy", HardlinkFallbackCopy},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryHardlinkFallback")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			rootfs := filepath.Join(dir, "rootfs")
+			if err := os.Mkdir(rootfs, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			te := newUnpackExtractor(UnpackOptions{
+				MapOptions:       MapOptions{Rootless: os.Geteuid() != 0},
+				HardlinkFallback: test.fallback,
+			})
+			te.fsEval = exdevFsEval{te.fsEval}
+
+			ctrValue := []byte("some file contents")
+			mtime := time.Unix(123456, 0)
+			hdr := &tar.Header{
+				Name:     "file",
+				Uid:      os.Getuid(),
+				Gid:      os.Getgid(),
+				Mode:     0751,
+				Size:     int64(len(ctrValue)),
+				Typeflag: tar.TypeReg,
+				ModTime:  mtime,
+			}
+			if err := te.unpackEntry(rootfs, hdr, bytes.NewBuffer(ctrValue)); err != nil {
+				t.Fatalf("unexpected unpackEntry error: %+v", err)
+			}
+
+			hdr = &tar.Header{
+				Name:     "mnt/link",
+				Linkname: "file",
+				Typeflag: tar.TypeLink,
+			}
+			if err := os.Mkdir(filepath.Join(rootfs, "mnt"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			err = te.unpackEntry(rootfs, hdr, nil)
+			if test.fallback == HardlinkFallbackError {
+				if err == nil {
+					t.Fatalf("expected an error with a cross-device hardlink")
+				}
+				if !isCrossDevice(err) {
+					t.Errorf("expected EXDEV error, got %+v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected unpackEntry error: %+v", err)
+			}
+
+			path := filepath.Join(rootfs, "mnt/link")
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("unexpected readfile error: %+v", err)
+			}
+			if !bytes.Equal(ctrValue, got) {
+				t.Errorf("hardlink copy has wrong contents: expected=%q got=%q", string(ctrValue), string(got))
+			}
+
+			fi, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode() != 0751 {
+				t.Errorf("hardlink copy has wrong mode: expected=%o got=%o", 0751, fi.Mode())
+			}
+			if !fi.ModTime().Equal(mtime) {
+				t.Errorf("hardlink copy has wrong mtime: expected=%v got=%v", mtime, fi.ModTime())
+			}
+			if targetFi, err := os.Lstat(filepath.Join(rootfs, "file")); err != nil {
+				t.Fatal(err)
+			} else if os.SameFile(fi, targetFi) {
+				t.Errorf("hardlink copy is the same inode as the target")
+			}
+		})
+	}
+}
+
+func TestUnpackLayerOverlayWhiteouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerOverlayWhiteouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Overlay whiteouts can only be created with CAP_MKNOD.
+	if err := unix.Mknod(filepath.Join(dir, "mknod-test"), unix.S_IFCHR, int(unix.Mkdev(0, 0))); err != nil {
+		t.Logf("overlay whiteout tests require mknod: %v", err)
+		t.Skip()
+	}
+
+	root := filepath.Join(dir, "upper")
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "dir", "file"), []byte("lower file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The opaque directory's own entry comes after its opaque whiteout, and
+	// must not clear the opaque xattr.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "dir/" + WhiteoutPrefix + "file", Typeflag: tar.TypeReg},
+		{Name: "dir/" + WhiteoutPrefix + "missing", Typeflag: tar.TypeReg},
+		{Name: "opaque/" + WhiteoutOpaque, Typeflag: tar.TypeReg},
+		{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "opaque/new", Typeflag: tar.TypeReg, Mode: 0644},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UnpackLayer(root, &buf, &UnpackOptions{TranslateOverlayWhiteouts: true}); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+
+	for _, path := range []string{"dir/file", "dir/missing"} {
+		var stat unix.Stat_t
+		if err := unix.Lstat(filepath.Join(root, path), &stat); err != nil {
+			t.Errorf("overlay whiteout %s not created: %v", path, err)
+			continue
+		}
+		if stat.Mode&unix.S_IFMT != unix.S_IFCHR || stat.Rdev != 0 {
+			t.Errorf("%s is not an overlay whiteout: mode=%o rdev=%d", path, stat.Mode, stat.Rdev)
+		}
+	}
+
+	value := make([]byte, 16)
+	n, err := unix.Lgetxattr(filepath.Join(root, "opaque"), overlayOpaqueXattr, value)
+	if err != nil {
+		t.Errorf("opaque directory doesn't have %s: %v", overlayOpaqueXattr, err)
+	} else if string(value[:n]) != "y" {
+		t.Errorf("unexpected %s value: %q", overlayOpaqueXattr, value[:n])
+	}
+	if _, err := os.Lstat(filepath.Join(root, "opaque", "new")); err != nil {
+		t.Errorf("file in opaque directory not extracted: %v", err)
+	}
+
+	// None of the OCI whiteouts should have been extracted.
+	for _, path := range []string{"dir/" + WhiteoutPrefix + "file", "dir/" + WhiteoutPrefix + "missing", "opaque/" + WhiteoutOpaque} {
+		if _, err := os.Lstat(filepath.Join(root, path)); !os.IsNotExist(err) {
+			t.Errorf("OCI whiteout %s was extracted: %v", path, err)
+		}
+	}
+}
+
+func TestUnpackLayerOverlayWhiteoutFormat(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackLayerOverlayWhiteoutFormat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mapOptions := MapOptions{Rootless: os.Geteuid() != 0}
+	if err := UnpackLayer(root, makeTestLayer(t,
+		&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "dir/file", Size: 4},
+		&tar.Header{Name: "dir/keep", Size: 4},
+		&tar.Header{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "opaque/old", Size: 4},
+		&tar.Header{Name: "opaque/subdir/", Typeflag: tar.TypeDir, Mode: 0755},
+	), &UnpackOptions{MapOptions: mapOptions}); err != nil {
+		t.Fatalf("unexpected error unpacking base layer: %+v", err)
+	}
+
+	// A layer using the overlayfs whiteout format.
+	if err := UnpackLayer(root, makeTestLayer(t,
+		&tar.Header{Name: "dir/file", Typeflag: tar.TypeChar, Mode: 0600},
+		&tar.Header{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0711, Xattrs: map[string]string{overlayOpaqueXattr: "y"}},
+		&tar.Header{Name: "opaque/new", Size: 4},
+	), &UnpackOptions{
+		MapOptions:     mapOptions,
+		WhiteoutFormat: WhiteoutFormatOverlay,
+	}); err != nil {
+		t.Fatalf("unexpected error unpacking overlay layer: %+v", err)
+	}
+
+	for _, test := range []struct {
+		path   string
+		exists bool
+	}{
+		{"dir/file", false},
+		{"dir/keep", true},
+		{"opaque/old", false},
+		{"opaque/subdir", false},
+		{"opaque/new", true},
+	} {
+		_, err := os.Lstat(filepath.Join(root, test.path))
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("path %s: expected exists=%v, got err=%v", test.path, test.exists, err)
+		}
+	}
+
+	// The opaque directory itself must still have been extracted.
+	fi, err := os.Lstat(filepath.Join(root, "opaque"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0711 {
+		t.Errorf("expected opaque to have mode 0711, got %o", mode)
+	}
+	if _, err := unix.Lgetxattr(filepath.Join(root, "opaque"), overlayOpaqueXattr, make([]byte, 16)); err == nil {
+		t.Errorf("opaque directory has %s set", overlayOpaqueXattr)
+	}
+}
+
+func TestUnpackLayerOverlayOpaqueEntryFilter(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackLayerOverlayOpaqueEntryFilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mapOptions := MapOptions{Rootless: os.Geteuid() != 0}
+	if err := UnpackLayer(root, makeTestLayer(t,
+		&tar.Header{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "opaque/old", Size: 4},
+		&tar.Header{Name: "opaque/subdir/", Typeflag: tar.TypeDir, Mode: 0755},
+	), &UnpackOptions{MapOptions: mapOptions}); err != nil {
+		t.Fatalf("unexpected error unpacking base layer: %+v", err)
+	}
+
+	// Skipping an opaque directory must keep the contents it would have
+	// hidden, just like skipping an OCI opaque whiteout.
+	if err := UnpackLayer(root, makeTestLayer(t,
+		&tar.Header{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0711, Xattrs: map[string]string{overlayOpaqueXattr: "y"}},
+		&tar.Header{Name: "opaque/new", Size: 4},
+	), &UnpackOptions{
+		MapOptions:     mapOptions,
+		WhiteoutFormat: WhiteoutFormatOverlay,
+		EntryFilter: func(hdr *tar.Header) (bool, error) {
+			return hdr.Name == "opaque/", nil
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error unpacking overlay layer: %+v", err)
+	}
+
+	for _, path := range []string{"opaque/old", "opaque/subdir", "opaque/new"} {
+		if _, err := os.Lstat(filepath.Join(root, path)); err != nil {
+			t.Errorf("path %s: expected to exist: %v", path, err)
+		}
+	}
+}
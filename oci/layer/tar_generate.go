@@ -22,19 +22,22 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/iohelpers"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/openSUSE/umoci/third_party/user"
 	"github.com/pkg/errors"
 )
 
 // ignoreXattrList is a list of xattr names that should be ignored when
 // creating a new image layer, because they are host-specific and/or would be a
 // bad idea to unpack.
-// XXX: Maybe we should make this configurable so users can manually blacklist
-//      (or even whitelist) xattrs that they actually want included? Like how
-//      GNU tar's xattr setup works.
+// They can still be included by listing them in PackOptions.XattrPrefixes.
 var ignoreXattrList = map[string]struct{}{
 	// SELinux doesn't allow you to set SELinux policies generically. They're
 	// also host-specific. So just ignore them during extraction.
@@ -47,33 +50,59 @@ var ignoreXattrList = map[string]struct{}{
 type tarGenerator struct {
 	tw *tar.Writer
 
-	// mapOptions is the set of mapping options for modifying entries before
-	// they're added to the layer.
-	mapOptions MapOptions
+	// counter tracks the number of bytes of the archive written so far.
+	counter *iohelpers.CountingWriter
 
-	// Hardlink mapping.
-	inodes map[uint64]string
+	// packOptions is the set of options for generating the layer, including
+	// the mapping options for modifying entries before they're added to the
+	// layer.
+	packOptions PackOptions
+
+	// Hardlink mapping, from the (device, inode) pair of every file with more
+	// than one link to the first path it was added to the archive as.
+	inodes map[inodeKey]string
 
 	// fsEval is an fseval.FsEval used for extraction.
 	fsEval fseval.FsEval
 
+	// unames and gnames map IDs to the names from PackOptions.PasswdFile and
+	// PackOptions.GroupFile. They are loaded by loadNames.
+	namesLoaded    bool
+	unames, gnames map[int]string
+
 	// XXX: Should we add a saftey check to make sure we don't generate two of
 	//      the same path in a tar archive? This is not permitted by the spec.
 }
 
+// inodeKey uniquely identifies an inode on the host. Inode numbers are only
+// unique within a single filesystem, and a rootfs may span several of them.
+type inodeKey struct {
+	dev, ino uint64
+}
+
 // newTarGenerator creates a new tarGenerator using the provided writer as the
 // output writer.
-func newTarGenerator(w io.Writer, opt MapOptions) *tarGenerator {
+func newTarGenerator(w io.Writer, opt PackOptions) *tarGenerator {
 	fsEval := fseval.DefaultFsEval
-	if opt.Rootless {
+	if opt.MapOptions.Rootless {
 		fsEval = fseval.RootlessFsEval
 	}
 
+	counter := &iohelpers.CountingWriter{W: w}
 	return &tarGenerator{
-		tw:         tar.NewWriter(w),
-		mapOptions: opt,
-		inodes:     map[uint64]string{},
-		fsEval:     fsEval,
+		tw:          tar.NewWriter(counter),
+		counter:     counter,
+		packOptions: opt,
+		inodes:      map[inodeKey]string{},
+		fsEval:      fsEval,
+	}
+}
+
+// progress reports that the entry with the given name has been added to the
+// archive, if PackOptions.OnProgress is set.
+func (tg *tarGenerator) progress(name string) {
+	if tg.packOptions.OnProgress != nil {
+		tg.packOptions.OnProgress(uint64(tg.counter.N), name)
 	}
 }
 
@@ -104,6 +133,93 @@ func normalise(rawPath string, isDir bool) (string, error) {
 	return path, nil
 }
 
+// includeXattr returns whether the xattr with the given name should be stored
+// in the layer, according to PackOptions.XattrPrefixes.
+func (tg *tarGenerator) includeXattr(name string) bool {
+	prefixes := tg.packOptions.XattrPrefixes
+	// Some xattrs need to be skipped for sanity reasons, such as
+	// security.selinux, because they are very much host-specific and carrying
+	// them to other hosts would be a really bad idea. They are only included
+	// if the user explicitly asked for them by name.
+	if _, ignore := ignoreXattrList[name]; ignore {
+		for _, prefix := range prefixes {
+			if prefix == name {
+				return true
+			}
+		}
+		return false
+	}
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTimestamps modifies the timestamps of the given header to match the
+// TimestampPolicy and SourceDateEpoch of the generator.
+func (tg *tarGenerator) applyTimestamps(hdr *tar.Header) {
+	switch tg.packOptions.Timestamps {
+	case TimestampsMtime:
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+	case TimestampsAll:
+		// archive/tar drops atime and ctime unless the format is explicitly
+		// chosen.
+		hdr.Format = tar.FormatPAX
+	case TimestampsNone:
+		hdr.ModTime = time.Unix(0, 0)
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+	}
+
+	if epoch := tg.packOptions.SourceDateEpoch; !epoch.IsZero() {
+		hdr.ModTime = epoch
+		if !hdr.AccessTime.IsZero() {
+			hdr.AccessTime = epoch
+		}
+		if !hdr.ChangeTime.IsZero() {
+			hdr.ChangeTime = epoch
+		}
+	}
+}
+
+// canonicalise normalises the given header if PackOptions.Canonical is set.
+func (tg *tarGenerator) canonicalise(hdr *tar.Header) {
+	if !tg.packOptions.Canonical {
+		return
+	}
+	hdr.Uname = ""
+	hdr.Gname = ""
+	if hdr.Typeflag != tar.TypeChar && hdr.Typeflag != tar.TypeBlock {
+		hdr.Devmajor = 0
+		hdr.Devminor = 0
+	}
+}
+
+// unreadable is called when the file with the given name could not be read
+// while adding it to the archive (before anything has been written to the
+// archive). Depending on the UnreadablePolicy, either the error is returned or
+// the file is skipped.
+func (tg *tarGenerator) unreadable(name string, err error) error {
+	if os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+	switch tg.packOptions.OnUnreadable {
+	case UnreadableSkip:
+		log.Warnf("generate layer: skipping unreadable file '%s': %v", name, err)
+		return nil
+	case UnreadableWhiteout:
+		log.Warnf("generate layer: replacing unreadable file '%s' with whiteout: %v", name, err)
+		return tg.AddWhiteout(name)
+	}
+	return err
+}
+
 // AddFile adds a file from the filesystem to the tar archive. It copies all of
 // the relevant stat information about the file, and also attempts to track
 // hardlinks. This should be functionally equivalent to adding entries with GNU
@@ -112,13 +228,22 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 
 	fi, err := tg.fsEval.Lstat(path)
 	if err != nil {
-		return errors.Wrap(err, "add file lstat")
+		return tg.unreadable(name, errors.Wrap(err, "add file lstat"))
+	}
+
+	// Enforce the maximum file size before we do anything else.
+	if maxSize := tg.packOptions.MaxFileSize; maxSize > 0 && fi.Mode().IsRegular() && fi.Size() > maxSize {
+		if tg.packOptions.FileSizePolicy == FileSizeSkip {
+			log.Warnf("generate layer: skipping file '%s': size %d exceeds maximum file size %d", name, fi.Size(), maxSize)
+			return nil
+		}
+		return errors.Errorf("file '%s' size %d exceeds maximum file size %d", name, fi.Size(), maxSize)
 	}
 
 	linkname := ""
 	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
 		if linkname, err = tg.fsEval.Readlink(path); err != nil {
-			return errors.Wrap(err, "add file readlink")
+			return tg.unreadable(name, errors.Wrap(err, "add file readlink"))
 		}
 	}
 
@@ -147,7 +272,7 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	// by us.
 	statx, err := tg.fsEval.Lstatx(path)
 	if err != nil {
-		return errors.Wrapf(err, "lstatx %q", path)
+		return tg.unreadable(name, errors.Wrapf(err, "lstatx %q", path))
 	}
 	updateHeader(hdr, statx)
 
@@ -156,62 +281,95 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	// XXX: This should probably be moved to a function in tar_unix.go.
 	names, err := tg.fsEval.Llistxattr(path)
 	if err != nil {
-		return errors.Wrap(err, "get xattr list")
+		return tg.unreadable(name, errors.Wrap(err, "get xattr list"))
 	}
-	for _, name := range names {
-		// Some xattrs need to be skipped for sanity reasons, such as
-		// security.selinux, because they are very much host-specific and
-		// carrying them to other hosts would be a really bad idea.
-		if _, ignore := ignoreXattrList[name]; ignore {
+	// The order of the xattr list depends on the filesystem, so sort it to
+	// make sure that we read (and warn about) xattrs in the same order every
+	// time. Note that we rely on archive/tar to write the PAX records in a
+	// deterministic (sorted) order.
+	sort.Strings(names)
+	for _, xattr := range names {
+		if !tg.includeXattr(xattr) {
 			continue
 		}
 
-		value, err := tg.fsEval.Lgetxattr(path, name)
+		value, err := tg.fsEval.Lgetxattr(path, xattr)
 		if err != nil {
 			// XXX: I'm not sure if we're unprivileged whether Lgetxattr can
 			//      fail with EPERM. If it can, we should ignore it (like when
 			//      we try to clear xattrs).
-			return errors.Wrapf(err, "get xattr: %s", name)
+			return tg.unreadable(name, errors.Wrapf(err, "get xattr: %s", xattr))
 		}
 		// https://golang.org/issues/20698 -- We don't just error out here
 		// because it's not _really_ a fatal error. Currently it's unclear
 		// whether the stdlib will correctly handle reading or disable writing
 		// of these PAX headers so we have to track this ourselves.
 		if len(value) <= 0 {
-			log.Warnf("ignoring empty-valued xattr %s: disallowed by PAX standard", name)
+			log.Warnf("ignoring empty-valued xattr %s: disallowed by PAX standard", xattr)
 			continue
 		}
-		hdr.Xattrs[name] = string(value)
+		hdr.Xattrs[xattr] = string(value)
+	}
+
+	// Open regular files before we write anything to the archive, so that
+	// unreadable files can be skipped without corrupting the archive.
+	// Directories cannot be hardlinked, and files with a single link cannot
+	// have been added under another name.
+	key := inodeKey{dev: uint64(statx.Dev), ino: uint64(statx.Ino)}
+	canHardlink := !fi.IsDir() && statx.Nlink > 1
+	oldpath, isHardlink := "", false
+	if canHardlink {
+		oldpath, isHardlink = tg.inodes[key]
+	}
+	var fh *os.File
+	if !isHardlink && hdr.Typeflag == tar.TypeReg {
+		fh, err = tg.fsEval.Open(path)
+		if err != nil {
+			return tg.unreadable(name, errors.Wrap(err, "open file"))
+		}
+		defer fh.Close()
 	}
 
 	// Not all systems have the concept of an inode, but I'm not in the mood to
 	// handle this in a way that makes anything other than GNU/Linux happy
 	// right now. Handle hardlinks.
-	if oldpath, ok := tg.inodes[statx.Ino]; ok {
+	if isHardlink {
 		// We just hit a hardlink, so we just have to change the header.
 		hdr.Typeflag = tar.TypeLink
 		hdr.Linkname = oldpath
 		hdr.Size = 0
-	} else {
-		tg.inodes[statx.Ino] = name
+	}
+
+	// Store the inode flags of the file if requested. Hardlinks share the
+	// inode (and thus the flags) of the file they link to.
+	if tg.packOptions.PreserveFileFlags && !isHardlink {
+		if err := tg.addFileFlags(hdr, path, fh); err != nil {
+			return tg.unreadable(name, errors.Wrap(err, "get file flags"))
+		}
 	}
 
 	// Apply any header mappings.
-	if err := mapHeader(hdr, tg.mapOptions); err != nil {
+	if err := mapHeader(hdr, tg.packOptions.MapOptions); err != nil {
 		return errors.Wrap(err, "map header")
 	}
+	overrideHeader(hdr, tg.packOptions.MetadataOverrides)
+	if err := tg.resolveNames(hdr); err != nil {
+		return errors.Wrap(err, "resolve names")
+	}
+	tg.canonicalise(hdr)
+	tg.applyTimestamps(hdr)
 	if err := tg.tw.WriteHeader(hdr); err != nil {
 		return errors.Wrap(err, "write header")
 	}
 
+	// Only record the path for later hardlinks once the entry is actually in
+	// the archive, as an unreadable file may have been skipped above.
+	if canHardlink && !isHardlink {
+		tg.inodes[key] = name
+	}
+
 	// Write the contents of regular files.
 	if hdr.Typeflag == tar.TypeReg {
-		fh, err := tg.fsEval.Open(path)
-		if err != nil {
-			return errors.Wrap(err, "open file")
-		}
-		defer fh.Close()
-
 		n, err := io.Copy(tg.tw, fh)
 		if err != nil {
 			return errors.Wrap(err, "copy to layer")
@@ -224,7 +382,136 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	return nil
 }
 
-const whPrefix = ".wh."
+// loadNames parses PackOptions.PasswdFile and PackOptions.GroupFile (if they
+// are set). If an ID is listed several times, the first name is used (as with
+// getpwuid(3)).
+func (tg *tarGenerator) loadNames() error {
+	if tg.namesLoaded {
+		return nil
+	}
+	if path := tg.packOptions.PasswdFile; path != "" {
+		users, err := user.ParsePasswdFile(path)
+		if err != nil {
+			return errors.Wrap(err, "parse passwd file")
+		}
+		tg.unames = map[int]string{}
+		for _, u := range users {
+			if _, ok := tg.unames[u.Uid]; !ok {
+				tg.unames[u.Uid] = u.Name
+			}
+		}
+	}
+	if path := tg.packOptions.GroupFile; path != "" {
+		groups, err := user.ParseGroupFile(path)
+		if err != nil {
+			return errors.Wrap(err, "parse group file")
+		}
+		tg.gnames = map[int]string{}
+		for _, g := range groups {
+			if _, ok := tg.gnames[g.Gid]; !ok {
+				tg.gnames[g.Gid] = g.Name
+			}
+		}
+	}
+	tg.namesLoaded = true
+	return nil
+}
+
+// resolveNames sets the user and group names of the (already mapped) header
+// from PackOptions.PasswdFile and PackOptions.GroupFile, if they are set.
+func (tg *tarGenerator) resolveNames(hdr *tar.Header) error {
+	if err := tg.loadNames(); err != nil {
+		return err
+	}
+	if tg.unames != nil {
+		hdr.Uname = tg.unames[hdr.Uid]
+	}
+	if tg.gnames != nil {
+		hdr.Gname = tg.gnames[hdr.Gid]
+	}
+	return nil
+}
+
+// getFileFlags is used to get the inode flags of files, and is only
+// overridden by tests.
+var getFileFlags = system.GetFileFlags
+
+// addFileFlags stores the inode flags of the file at the given path in the
+// header, using the paxFileFlags PAX record. Only regular files and
+// directories can have inode flags. If the file is a regular file, fh must be
+// an open handle to it. If the flags cannot be read because they are not
+// supported, a warning is output and no flags are stored.
+func (tg *tarGenerator) addFileFlags(hdr *tar.Header, path string, fh *os.File) error {
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+	case tar.TypeDir:
+		dir, err := tg.fsEval.Open(path)
+		if err != nil {
+			return errors.Wrap(err, "open directory")
+		}
+		defer dir.Close()
+		fh = dir
+	default:
+		return nil
+	}
+
+	flags, err := getFileFlags(fh)
+	if err != nil {
+		if isFileFlagsUnsupported(err) {
+			log.Warnf("generate layer: ignoring file flags of %s: %v", hdr.Name, err)
+			return nil
+		}
+		return err
+	}
+	if value := formatFileFlags(flags & supportedFileFlags); value != "" {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[paxFileFlags] = value
+	}
+	return nil
+}
+
+const (
+	// WhiteoutPrefix is the filename prefix of whiteout entries in an OCI
+	// layer, as defined by the image-spec.
+	WhiteoutPrefix = ".wh."
+
+	// WhiteoutOpaque is the name of an opaque whiteout entry in an OCI layer,
+	// which hides all lower-layer entries of the directory containing it.
+	WhiteoutOpaque = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// addImplicitDir adds a directory entry with the given name which doesn't
+// correspond to any directory on the filesystem, such as the parent
+// directories of a file being inserted into a layer. The directory is owned
+// by root with mode 0755 (unless PackOptions.MetadataOverrides says
+// otherwise). Its modification time is the Unix epoch (unless
+// PackOptions.SourceDateEpoch is set), so that the entry doesn't depend on
+// when the layer was generated.
+func (tg *tarGenerator) addImplicitDir(name string) error {
+	name, err := normalise(name, true)
+	if err != nil {
+		return errors.Wrap(err, "normalise path")
+	}
+
+	hdr := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+	}
+	overrideHeader(hdr, tg.packOptions.MetadataOverrides)
+	if err := tg.resolveNames(hdr); err != nil {
+		return errors.Wrap(err, "resolve names")
+	}
+	tg.canonicalise(hdr)
+	tg.applyTimestamps(hdr)
+	if err := tg.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "write directory header")
+	}
+	return nil
+}
 
 // AddWhiteout adds a whiteout file for the given name inside the tar archive.
 // It's not recommended to add a file with AddFile and then white it out.
@@ -236,17 +523,20 @@ func (tg *tarGenerator) AddWhiteout(name string) error {
 
 	// Create the explicit whiteout for the file.
 	dir, file := filepath.Split(name)
-	whiteout := filepath.Join(dir, whPrefix+file)
+	whiteout := filepath.Join(dir, WhiteoutPrefix+file)
 	timestamp := time.Now()
 
 	// Add a dummy header for the whiteout file.
-	if err := tg.tw.WriteHeader(&tar.Header{
+	hdr := &tar.Header{
 		Name:       whiteout,
 		Size:       0,
 		ModTime:    timestamp,
 		AccessTime: timestamp,
 		ChangeTime: timestamp,
-	}); err != nil {
+	}
+	tg.canonicalise(hdr)
+	tg.applyTimestamps(hdr)
+	if err := tg.tw.WriteHeader(hdr); err != nil {
 		return errors.Wrap(err, "write whiteout header")
 	}
 
@@ -20,14 +20,20 @@ package layer
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 func TestTarGenerateAddFileNormal(t *testing.T) {
@@ -62,7 +68,7 @@ func TestTarGenerateAddFileNormal(t *testing.T) {
 		t.Fatalf("apply metadata: %s", err)
 	}
 
-	tg := newTarGenerator(writer, MapOptions{})
+	tg := newTarGenerator(writer, PackOptions{})
 	tr := tar.NewReader(reader)
 
 	// Create all of the tar entries in a goroutine so we can parse the tar
@@ -156,7 +162,7 @@ func TestTarGenerateAddFileDirectory(t *testing.T) {
 		t.Fatalf("apply metadata: %s", err)
 	}
 
-	tg := newTarGenerator(writer, MapOptions{})
+	tg := newTarGenerator(writer, PackOptions{})
 	tr := tar.NewReader(reader)
 
 	// Create all of the tar entries in a goroutine so we can parse the tar
@@ -243,7 +249,7 @@ func TestTarGenerateAddFileSymlink(t *testing.T) {
 		t.Fatalf("apply metadata: %s", err)
 	}
 
-	tg := newTarGenerator(writer, MapOptions{})
+	tg := newTarGenerator(writer, PackOptions{})
 	tr := tar.NewReader(reader)
 
 	// Create all of the tar entries in a goroutine so we can parse the tar
@@ -304,10 +310,10 @@ func TestTarGenerateAddFileSymlink(t *testing.T) {
 func parseWhiteout(path string) (string, error) {
 	path = filepath.Clean(path)
 	dir, file := filepath.Split(path)
-	if !strings.HasPrefix(file, whPrefix) {
+	if !strings.HasPrefix(file, WhiteoutPrefix) {
 		return "", fmt.Errorf("not a whiteout path: %s", path)
 	}
-	return filepath.Join(dir, strings.TrimPrefix(file, whPrefix)), nil
+	return filepath.Join(dir, strings.TrimPrefix(file, WhiteoutPrefix)), nil
 }
 
 func TestTarGenerateAddWhiteout(t *testing.T) {
@@ -327,7 +333,7 @@ func TestTarGenerateAddWhiteout(t *testing.T) {
 		"dir/.",
 	}
 
-	tg := newTarGenerator(writer, MapOptions{})
+	tg := newTarGenerator(writer, PackOptions{})
 	tr := tar.NewReader(reader)
 
 	// Create all of the whiteout entries in a goroutine so we can parse the
@@ -377,3 +383,712 @@ func TestTarGenerateAddWhiteout(t *testing.T) {
 		t.Errorf("not all paths had a whiteout entry generated (only read %d, expected %d)!", idx, len(paths))
 	}
 }
+
+func TestTarGenerateTimestamps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateTimestamps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("some data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, time.Unix(888, 0), time.Unix(123, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		policy         TimestampPolicy
+		modTime        time.Time
+		expectPAXTimes bool
+	}{
+		{TimestampsMtime, time.Unix(123, 0), false},
+		{TimestampsAll, time.Unix(123, 0), true},
+		{TimestampsNone, time.Unix(0, 0), false},
+	} {
+		var buf bytes.Buffer
+		tg := newTarGenerator(&buf, PackOptions{Timestamps: test.policy})
+		if err := tg.AddFile("file", path); err != nil {
+			t.Fatalf("AddFile: unexpected error: %s", err)
+		}
+		if err := tg.AddWhiteout("deleted"); err != nil {
+			t.Fatalf("AddWhiteout: unexpected error: %s", err)
+		}
+		if err := tg.tw.Close(); err != nil {
+			t.Fatalf("tw.Close: unexpected error: %s", err)
+		}
+
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("reading tar archive: %s", err)
+			}
+
+			_, hasAtime := hdr.PAXRecords["atime"]
+			_, hasCtime := hdr.PAXRecords["ctime"]
+			if hasAtime != test.expectPAXTimes || hasCtime != test.expectPAXTimes {
+				t.Errorf("policy %d: %s: expected atime/ctime PAX records to be present=%v, got atime=%v ctime=%v", test.policy, hdr.Name, test.expectPAXTimes, hasAtime, hasCtime)
+			}
+			if hdr.Name == "file" && !hdr.ModTime.Equal(test.modTime) {
+				t.Errorf("policy %d: hdr.ModTime: expected %s, got %s", test.policy, test.modTime, hdr.ModTime)
+			}
+			if hdr.Name == ".wh.deleted" && test.policy == TimestampsNone && !hdr.ModTime.Equal(test.modTime) {
+				t.Errorf("policy %d: whiteout hdr.ModTime: expected %s, got %s", test.policy, test.modTime, hdr.ModTime)
+			}
+		}
+	}
+}
+
+func TestTarGenerateSourceDateEpoch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateSourceDateEpoch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("some data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Unix(1500000000, 0)
+
+	generate := func(policy TimestampPolicy, mtime time.Time) []byte {
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		tg := newTarGenerator(&buf, PackOptions{Timestamps: policy, SourceDateEpoch: epoch})
+		if err := tg.AddFile("file", path); err != nil {
+			t.Fatalf("AddFile: unexpected error: %s", err)
+		}
+		if err := tg.AddWhiteout("deleted"); err != nil {
+			t.Fatalf("AddWhiteout: unexpected error: %s", err)
+		}
+		if err := tg.tw.Close(); err != nil {
+			t.Fatalf("tw.Close: unexpected error: %s", err)
+		}
+		return buf.Bytes()
+	}
+
+	for _, policy := range []TimestampPolicy{TimestampsDefault, TimestampsMtime, TimestampsAll, TimestampsNone} {
+		layer := generate(policy, time.Unix(123, 0))
+
+		tr := tar.NewReader(bytes.NewReader(layer))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("reading tar archive: %s", err)
+			}
+			if !hdr.ModTime.Equal(epoch) {
+				t.Errorf("policy %d: %s: hdr.ModTime: expected %s, got %s", policy, hdr.Name, epoch, hdr.ModTime)
+			}
+			for _, record := range []string{"atime", "ctime"} {
+				value, ok := hdr.PAXRecords[record]
+				if policy != TimestampsAll {
+					if ok {
+						t.Errorf("policy %d: %s: unexpected %s PAX record %q", policy, hdr.Name, record, value)
+					}
+				} else if value != fmt.Sprint(epoch.Unix()) {
+					t.Errorf("policy %d: %s: %s PAX record: expected %d, got %q", policy, hdr.Name, record, epoch.Unix(), value)
+				}
+			}
+		}
+
+		// The layer must not depend on the timestamps of the files.
+		if other := generate(policy, time.Unix(456, 0)); !bytes.Equal(layer, other) {
+			t.Errorf("policy %d: layer differs when file timestamps change", policy)
+		}
+	}
+}
+
+// TestTarGenerateCapabilities checks that file capabilities (which are stored
+// in the security.capability xattr) survive a round-trip through a layer.
+func TestTarGenerateCapabilities(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("setting file capabilities requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateCapabilities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ping")
+	if err := ioutil.WriteFile(path, []byte("not really ping"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// A VFS_CAP_REVISION_2 capability set of cap_net_raw=ep.
+	const (
+		vfsCapRevision2      = 0x02000000
+		vfsCapFlagsEffective = 0x000001
+		capNetRaw            = 13
+	)
+	var capBuf bytes.Buffer
+	for _, word := range []uint32{vfsCapRevision2 | vfsCapFlagsEffective, 1 << capNetRaw, 0, 0, 0} {
+		if err := binary.Write(&capBuf, binary.LittleEndian, word); err != nil {
+			t.Fatal(err)
+		}
+	}
+	capability := capBuf.Bytes()
+	if err := unix.Lsetxattr(path, "security.capability", capability, 0); err != nil {
+		t.Skipf("file capabilities not supported: %v", err)
+	}
+
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, PackOptions{})
+	if err := tg.AddFile("ping", path); err != nil {
+		t.Fatalf("AddFile: unexpected error: %s", err)
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %s", err)
+	}
+	layer := buf.Bytes()
+
+	tr := tar.NewReader(bytes.NewReader(layer))
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("reading tar archive: %s", err)
+	}
+	if value, ok := hdr.Xattrs["security.capability"]; !ok {
+		t.Errorf("security.capability xattr missing from tar entry: %v", hdr.Xattrs)
+	} else if value != string(capability) {
+		t.Errorf("security.capability xattr: expected %x, got %x", capability, value)
+	}
+
+	// The capability must be restored when unpacking.
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackLayer(root, bytes.NewReader(layer), nil); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+	value := make([]byte, 128)
+	n, err := unix.Lgetxattr(filepath.Join(root, "ping"), "security.capability", value)
+	if err != nil {
+		t.Fatalf("unexpected error getting capabilities of unpacked file: %v", err)
+	}
+	if !bytes.Equal(value[:n], capability) {
+		t.Errorf("unpacked security.capability xattr: expected %x, got %x", capability, value[:n])
+	}
+}
+
+func TestTarGenerateXattrPrefixes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateXattrPrefixes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"user.foo", "user.bar"} {
+		if err := unix.Lsetxattr(path, name, []byte("value of "+name), 0); err != nil {
+			t.Skipf("user xattrs not supported: %v", err)
+		}
+	}
+	// Another xattr outside the user namespace, if we can set one.
+	trusted := unix.Lsetxattr(path, "trusted.foo", []byte("value of trusted.foo"), 0) == nil
+
+	for _, test := range []struct {
+		prefixes []string
+		expected []string
+	}{
+		{nil, []string{"user.bar", "user.foo", "trusted.foo"}},
+		{[]string{"user."}, []string{"user.bar", "user.foo"}},
+		{[]string{"user.foo", "trusted."}, []string{"user.foo", "trusted.foo"}},
+		{[]string{"security."}, nil},
+	} {
+		var buf bytes.Buffer
+		tg := newTarGenerator(&buf, PackOptions{XattrPrefixes: test.prefixes})
+		if err := tg.AddFile("file", path); err != nil {
+			t.Fatalf("AddFile: unexpected error: %s", err)
+		}
+		if err := tg.tw.Close(); err != nil {
+			t.Fatalf("tw.Close: unexpected error: %s", err)
+		}
+
+		hdr, err := tar.NewReader(&buf).Next()
+		if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+		expected := map[string]string{}
+		for _, name := range test.expected {
+			if name == "trusted.foo" && !trusted {
+				continue
+			}
+			expected[name] = "value of " + name
+		}
+		got := hdr.Xattrs
+		if got == nil {
+			got = map[string]string{}
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("XattrPrefixes=%v: expected xattrs %v, got %v", test.prefixes, expected, got)
+		}
+	}
+}
+
+func TestTarGenerateCanonical(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateCanonical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A user database which would otherwise give names to the entries.
+	passwd := filepath.Join(dir, "passwd")
+	group := filepath.Join(dir, "group")
+	if err := ioutil.WriteFile(passwd, []byte(fmt.Sprintf("user:x:%d:%d::/:/bin/sh\n", os.Getuid(), os.Getgid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(group, []byte(fmt.Sprintf("group:x:%d:\n", os.Getgid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// makeRootfs creates the same rootfs in a new directory, but with
+	// different timestamps and with the xattrs set in the given order.
+	makeRootfs := func(name string, mtime time.Time, xattrs []string) string {
+		root := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(root, "etc", "file")
+		if err := ioutil.WriteFile(file, []byte("some contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, xattr := range xattrs {
+			if err := unix.Lsetxattr(file, xattr, []byte("value of "+xattr), 0); err != nil {
+				t.Skipf("user xattrs not supported: %v", err)
+			}
+		}
+		if err := os.Symlink("file", filepath.Join(root, "etc", "link")); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{"etc/file", "etc"} {
+			if err := os.Chtimes(filepath.Join(root, path), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return root
+	}
+
+	generate := func(root string) []byte {
+		var buf bytes.Buffer
+		tg := newTarGenerator(&buf, PackOptions{
+			Canonical:       true,
+			SourceDateEpoch: time.Unix(1500000000, 0),
+			PasswdFile:      passwd,
+			GroupFile:       group,
+		})
+		for _, name := range []string{"etc", "etc/file", "etc/link"} {
+			if err := tg.AddFile(name, filepath.Join(root, name)); err != nil {
+				t.Fatalf("AddFile(%s): unexpected error: %s", name, err)
+			}
+		}
+		if err := tg.AddWhiteout("deleted"); err != nil {
+			t.Fatalf("AddWhiteout: unexpected error: %s", err)
+		}
+		if err := tg.tw.Close(); err != nil {
+			t.Fatalf("tw.Close: unexpected error: %s", err)
+		}
+		return buf.Bytes()
+	}
+
+	layerA := generate(makeRootfs("a", time.Unix(123, 0), []string{"user.a", "user.b", "user.c"}))
+	layerB := generate(makeRootfs("b", time.Unix(456, 0), []string{"user.c", "user.a", "user.b"}))
+	if !bytes.Equal(layerA, layerB) {
+		t.Errorf("canonical layers of the same rootfs differ")
+	}
+
+	tr := tar.NewReader(bytes.NewReader(layerA))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+		if hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("%s: expected no user or group names, got %q and %q", hdr.Name, hdr.Uname, hdr.Gname)
+		}
+		if hdr.Devmajor != 0 || hdr.Devminor != 0 {
+			t.Errorf("%s: expected no device numbers, got %d:%d", hdr.Name, hdr.Devmajor, hdr.Devminor)
+		}
+		if hdr.Name == "etc/file" && len(hdr.Xattrs) != 3 {
+			t.Errorf("%s: expected 3 xattrs, got %v", hdr.Name, hdr.Xattrs)
+		}
+	}
+}
+
+func TestTarGenerateHardlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateHardlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("shared contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "c"), []byte("shared contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, PackOptions{})
+	for _, name := range []string{"a", "b", "c"} {
+		if err := tg.AddFile(name, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("AddFile(%s): unexpected error: %s", name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %s", err)
+	}
+
+	tr := tar.NewReader(&buf)
+	for _, expected := range []struct {
+		name     string
+		typeflag byte
+		linkname string
+		data     string
+	}{
+		{"a", tar.TypeReg, "", "shared contents"},
+		// Only the first path of a hardlinked inode should carry the data.
+		{"b", tar.TypeLink, "a", ""},
+		// Identical contents are not enough to make a hardlink.
+		{"c", tar.TypeReg, "", "shared contents"},
+	} {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+		if hdr.Name != expected.name {
+			t.Fatalf("expected entry %q, got %q", expected.name, hdr.Name)
+		}
+		if hdr.Typeflag != expected.typeflag {
+			t.Errorf("%s: expected typeflag %q, got %q", hdr.Name, expected.typeflag, hdr.Typeflag)
+		}
+		if hdr.Linkname != expected.linkname {
+			t.Errorf("%s: expected linkname %q, got %q", hdr.Name, expected.linkname, hdr.Linkname)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("%s: reading contents: %s", hdr.Name, err)
+		}
+		if string(data) != expected.data {
+			t.Errorf("%s: expected contents %q, got %q", hdr.Name, expected.data, string(data))
+		}
+	}
+}
+
+// unreadableFsEval is a fseval.FsEval which fails to open a particular file.
+type unreadableFsEval struct {
+	fseval.FsEval
+	unreadable string
+}
+
+func (fs unreadableFsEval) Open(path string) (*os.File, error) {
+	if path == fs.unreadable {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrPermission}
+	}
+	return fs.FsEval.Open(path)
+}
+
+func TestTarGenerateMetadataOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateMetadataOverrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "www", "html"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "www", "html", "index.html"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "www", "html", "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("index.html", filepath.Join(dir, "www", "html", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "wwwroot"), []byte("unrelated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	uid, gid := 33, 34
+	mode, secretMode := uint32(0755), uint32(0400)
+	overrides := []MetadataOverride{
+		{Path: "/www", UID: &uid, GID: &gid, Mode: &mode},
+		{Path: "www/html/secret", Mode: &secretMode},
+	}
+
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, PackOptions{MetadataOverrides: overrides})
+	for _, name := range []string{"www", "www/html", "www/html/index.html", "www/html/link", "www/html/secret", "wwwroot"} {
+		if err := tg.AddFile(name, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("AddFile %s: unexpected error: %s", name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %s", err)
+	}
+
+	expected := map[string]struct {
+		uid, gid int
+		mode     int64
+	}{
+		"www/":                {33, 34, 0755},
+		"www/html/":           {33, 34, 0755},
+		"www/html/index.html": {33, 34, 0755},
+		"www/html/secret":     {33, 34, 0400},
+		"wwwroot":             {os.Getuid(), os.Getgid(), 0600},
+	}
+
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink {
+			// Symlinks get the ownership but not the mode.
+			if hdr.Uid != 33 || hdr.Gid != 34 {
+				t.Errorf("%s: expected owner 33:34, got %d:%d", hdr.Name, hdr.Uid, hdr.Gid)
+			}
+			if hdr.Mode&07777 == 0755 {
+				t.Errorf("%s: mode override applied to symlink", hdr.Name)
+			}
+			continue
+		}
+
+		exp, ok := expected[hdr.Name]
+		if !ok {
+			t.Errorf("unexpected entry %s", hdr.Name)
+			continue
+		}
+		if hdr.Uid != exp.uid || hdr.Gid != exp.gid {
+			t.Errorf("%s: expected owner %d:%d, got %d:%d", hdr.Name, exp.uid, exp.gid, hdr.Uid, hdr.Gid)
+		}
+		if hdr.Mode&07777 != exp.mode {
+			t.Errorf("%s: expected mode %o, got %o", hdr.Name, exp.mode, hdr.Mode&07777)
+		}
+	}
+}
+
+func TestTarGenerateUserDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateUserDatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passwd := filepath.Join(dir, "passwd")
+	if err := ioutil.WriteFile(passwd, []byte("root:x:0:0:root:/root:/bin/sh\nwww-data:x:33:33::/var/www:/bin/false\nduplicate:x:33:33::/:/bin/false\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	group := filepath.Join(dir, "group")
+	if err := ioutil.WriteFile(group, []byte("root:x:0:\nwww-data:x:34:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"known", "unknown"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	knownUID, knownGID := 33, 34
+	unknownID := 1234
+	overrides := []MetadataOverride{
+		{Path: "known", UID: &knownUID, GID: &knownGID},
+		{Path: "unknown", UID: &unknownID, GID: &unknownID},
+	}
+
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, PackOptions{
+		MetadataOverrides: overrides,
+		PasswdFile:        passwd,
+		GroupFile:         group,
+	})
+	for _, name := range []string{"known", "unknown"} {
+		if err := tg.AddFile(name, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("AddFile %s: unexpected error: %s", name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %s", err)
+	}
+
+	expected := map[string][2]string{
+		"known":   {"www-data", "www-data"},
+		"unknown": {"", ""},
+	}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+		if names := [2]string{hdr.Uname, hdr.Gname}; names != expected[hdr.Name] {
+			t.Errorf("%s: expected names %v, got %v", hdr.Name, expected[hdr.Name], names)
+		}
+	}
+
+	// A missing user database is an error.
+	tg = newTarGenerator(ioutil.Discard, PackOptions{PasswdFile: filepath.Join(dir, "nonexistent")})
+	if err := tg.AddFile("known", filepath.Join(dir, "known")); err == nil {
+		t.Errorf("expected an error with a missing passwd file")
+	}
+}
+
+func TestTarGenerateUnreadable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateUnreadable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"good", "bad"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte("some data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		policy   UnreadablePolicy
+		expected []string
+		fail     bool
+	}{
+		{UnreadableError, nil, true},
+		{UnreadableSkip, []string{"good"}, false},
+		{UnreadableWhiteout, []string{"good", ".wh.bad"}, false},
+	} {
+		var buf bytes.Buffer
+		tg := newTarGenerator(&buf, PackOptions{OnUnreadable: test.policy})
+		tg.fsEval = unreadableFsEval{
+			FsEval:     tg.fsEval,
+			unreadable: filepath.Join(dir, "bad"),
+		}
+
+		var addErr error
+		for _, file := range []string{"good", "bad"} {
+			if err := tg.AddFile(file, filepath.Join(dir, file)); err != nil {
+				addErr = err
+				break
+			}
+		}
+		if test.fail {
+			if addErr == nil {
+				t.Errorf("policy %d: expected AddFile to fail", test.policy)
+			}
+			continue
+		}
+		if addErr != nil {
+			t.Errorf("policy %d: AddFile: unexpected error: %s", test.policy, addErr)
+			continue
+		}
+		if err := tg.tw.Close(); err != nil {
+			t.Fatalf("tw.Close: unexpected error: %s", err)
+		}
+
+		var got []string
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("policy %d: reading tar archive: %s", test.policy, err)
+			}
+			got = append(got, hdr.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("policy %d: unexpected entries: expected %v, got %v", test.policy, test.expected, got)
+		}
+	}
+}
+
+func TestTarGenerateUnreadableHardlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateUnreadableHardlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "first"), []byte("some data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "first"), filepath.Join(dir, "second")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail to get the flags of the first link only.
+	oldGetFileFlags := getFileFlags
+	defer func() { getFileFlags = oldGetFileFlags }()
+	calls := 0
+	getFileFlags = func(fh *os.File) (uint32, error) {
+		calls++
+		if calls == 1 {
+			return 0, errors.New("injected error")
+		}
+		return oldGetFileFlags(fh)
+	}
+
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, PackOptions{
+		OnUnreadable:      UnreadableSkip,
+		PreserveFileFlags: true,
+	})
+	for _, file := range []string{"first", "second"} {
+		if err := tg.AddFile(file, filepath.Join(dir, file)); err != nil {
+			t.Fatalf("AddFile(%s): unexpected error: %+v", file, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %s", err)
+	}
+
+	// The skipped link must not be referenced by the second one, which has
+	// to be stored in full instead.
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("reading tar archive: %s", err)
+	}
+	if hdr.Name != "second" || hdr.Typeflag != tar.TypeReg {
+		t.Errorf("expected second to be a regular file, got %s (type %c, linkname %q)", hdr.Name, hdr.Typeflag, hdr.Linkname)
+	}
+	if data, err := ioutil.ReadAll(tr); err != nil || string(data) != "some data" {
+		t.Errorf("unexpected contents of second: %q (%v)", data, err)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected only one entry in the archive")
+	}
+}
@@ -19,7 +19,6 @@ package layer
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	// Import is necessary for go-digest.
 	_ "crypto/sha256"
 	"fmt"
@@ -28,6 +27,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/apex/log"
@@ -36,8 +36,8 @@ import (
 	iconv "github.com/openSUSE/umoci/oci/config/convert"
 	"github.com/openSUSE/umoci/pkg/fseval"
 	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
 	"github.com/openSUSE/umoci/pkg/system"
-	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	rgen "github.com/opencontainers/runtime-tools/generate"
@@ -49,12 +49,56 @@ import (
 // root. It ensures that the state of the root is as close as possible to the
 // state used to create the layer. If an error is returned, the state of root
 // is undefined (unpacking is not guaranteed to be atomic).
-func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
-	var mapOptions MapOptions
+func UnpackLayer(root string, layer io.Reader, opt *UnpackOptions) error {
+	var unpackOptions UnpackOptions
 	if opt != nil {
-		mapOptions = *opt
+		unpackOptions = *opt
+	}
+	te := newUnpackExtractor(unpackOptions)
+	if err := te.unpackLayer(root, layer); err != nil {
+		return err
+	}
+	if err := te.applyOpaqueDirs(); err != nil {
+		return errors.Wrap(err, "apply opaque directories")
+	}
+	return errors.Wrap(te.applyFileFlags(), "apply file flags")
+}
+
+// includeEntry returns whether the given entry should be extracted, given the
+// includePrefix of the extractor. Whiteouts are matched using the path they
+// remove rather than their own name.
+func (te *tarExtractor) includeEntry(hdr *tar.Header) bool {
+	if te.includePrefix == "" {
+		return true
+	}
+
+	path := filepath.Clean(hdr.Name)
+	dir, file := filepath.Split(path)
+	switch {
+	case file == WhiteoutOpaque:
+		path = dir
+	case strings.HasPrefix(file, WhiteoutPrefix):
+		path = filepath.Join(dir, strings.TrimPrefix(file, WhiteoutPrefix))
+	}
+
+	// Parents of the prefix are included so that whiteouts of (and opaque
+	// whiteouts inside) them are applied, as well as their own metadata.
+	if !mtreefilter.MaskMatch(te.includePrefix, path) && !mtreefilter.MaskMatch(path, te.includePrefix) {
+		return false
+	}
+	if hdr.Typeflag == tar.TypeLink && !mtreefilter.MaskMatch(te.includePrefix, hdr.Linkname) {
+		log.Warnf("unpack layer: skipping hardlink %s: target %s is outside the included path %s", hdr.Name, hdr.Linkname, te.includePrefix)
+		return false
 	}
-	te := newTarExtractor(mapOptions)
+	return true
+}
+
+// unpackLayer unpacks all of the entries of the layer at the given root,
+// skipping any entries rejected by the entryFilter or outside of the
+// includePrefix. Any inode flags are not
+// applied until applyFileFlags is called, so that later layers can still modify
+// the extracted files.
+func (te *tarExtractor) unpackLayer(root string, layer io.Reader) error {
 	tr := tar.NewReader(layer)
 	for {
 		hdr, err := tr.Next()
@@ -64,6 +108,34 @@ func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
 		if err != nil {
 			return errors.Wrap(err, "read next entry")
 		}
+		// Overlay whiteouts are left as-is if we're extracting them as
+		// overlay whiteouts anyway.
+		var opaque bool
+		if te.whiteoutFormat == WhiteoutFormatOverlay && !te.overlayWhiteouts {
+			opaque = convertOverlayWhiteout(hdr)
+		}
+		if te.entryFilter != nil {
+			name := hdr.Name
+			skip, err := te.entryFilter(hdr)
+			if err != nil {
+				return errors.Wrapf(err, "filter entry: %s", name)
+			}
+			if skip {
+				log.Debugf("unpack layer: entry filter skipped %s", name)
+				continue
+			}
+		}
+		if !te.includeEntry(hdr) {
+			log.Debugf("unpack layer: skipped %s outside of included path", hdr.Name)
+			continue
+		}
+		// Opaque directories are only cleared once we know the entry is
+		// being extracted, so that skipping one keeps the lower contents.
+		if opaque && !te.keepWhiteouts {
+			if err := te.clearOpaqueDir(root, hdr); err != nil {
+				return errors.Wrapf(err, "clear opaque directory: %s", hdr.Name)
+			}
+		}
 		if err := te.unpackEntry(root, hdr, tr); err != nil {
 			return errors.Wrapf(err, "unpack entry: %s", hdr.Name)
 		}
@@ -75,22 +147,21 @@ func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
 // generated.
 const RootfsName = "rootfs"
 
-// isLayerType returns if the given MediaType is the media type of an image
-// layer blob. This includes both distributable and non-distributable images.
-func isLayerType(mediaType string) bool {
-	return mediaType == ispec.MediaTypeImageLayer || mediaType == ispec.MediaTypeImageLayerNonDistributable ||
-		mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip
-}
-
 // UnpackManifest extracts all of the layers in the given manifest, as well as
 // generating a runtime bundle and configuration. The rootfs is extracted to
 // <bundle>/<layer.RootfsName>. Some verification is done during image
 // extraction.
 //
 // FIXME: This interface is ugly.
-func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *MapOptions) (err error) {
+func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *UnpackOptions) (err error) {
 	engineExt := casext.NewEngine(engine)
 
+	var unpackOptions UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
+	}
+	mapOptions := unpackOptions.MapOptions
+
 	// Create the bundle directory. We only error out if config.json or rootfs/
 	// already exists, because we cannot be sure that the user intended us to
 	// extract over an existing bundle.
@@ -132,7 +203,7 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	defer func() {
 		if err != nil {
 			fsEval := fseval.DefaultFsEval
-			if opt != nil && opt.Rootless {
+			if mapOptions.Rootless {
 				fsEval = fseval.RootlessFsEval
 			}
 			// It's too late to care about errors.
@@ -141,11 +212,11 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	}()
 
 	// Make sure that the owner is correct.
-	rootUID, err := idtools.ToHost(0, opt.UIDMappings)
+	rootUID, err := idtools.ToHost(0, mapOptions.UIDMappings)
 	if err != nil {
 		return errors.Wrap(err, "ensure rootuid has mapping")
 	}
-	rootGID, err := idtools.ToHost(0, opt.GIDMappings)
+	rootGID, err := idtools.ToHost(0, mapOptions.GIDMappings)
 	if err != nil {
 		return errors.Wrap(err, "ensure rootgid has mapping")
 	}
@@ -185,65 +256,216 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 		return errors.Errorf("unpack manifest: config: unsupported rootfs.type: %s", config.RootFS.Type)
 	}
 
-	// Layer extraction.
+	// Layer extraction. We use the same tarExtractor for all of the layers so
+	// that inode flags are only applied once every layer has been extracted.
+	te := newUnpackExtractor(unpackOptions)
 	for idx, layerDescriptor := range manifest.Layers {
 		layerDiffID := config.RootFS.DiffIDs[idx]
 		log.Infof("unpack layer: %s", layerDescriptor.Digest)
 
-		layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
-		if err != nil {
-			return errors.Wrap(err, "get layer blob")
+		// Each layer is extracted in its own function, so that the layer blob
+		// and its decompressor are closed before the next layer is extracted.
+		if err := func() error {
+			layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
+			if err != nil {
+				return errors.Wrap(err, "get layer blob")
+			}
+			defer layerBlob.Close()
+			if !casext.IsLayerMediaType(layerBlob.MediaType) {
+				return errors.Errorf("unpack manifest: layer %s: blob is not correct mediatype: %s", layerBlob.Digest, layerBlob.MediaType)
+			}
+			layerGzip, ok := layerBlob.Data.(io.ReadCloser)
+			if !ok {
+				// Should _never_ be reached.
+				return errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+			}
+
+			// We have to extract the uncompressed version of the above layer
+			// (layers are usually gzip'd). Also note that we have to check the
+			// DiffID we're extracting (which is the sha256 sum of the
+			// *uncompressed* layer).
+			layerRaw, err := casext.DecompressLayer(layerGzip, layerBlob.MediaType)
+			if err != nil {
+				return errors.Wrapf(err, "unpack manifest: layer %s", layerBlob.Digest)
+			}
+			defer layerRaw.Close()
+			if !cas.IsSupportedAlgorithm(layerDiffID.Algorithm()) {
+				return errors.Errorf("unpack manifest: layer %s: unsupported diffid algorithm: %s", layerDescriptor.Digest, layerDiffID.Algorithm())
+			}
+			layerDigester := layerDiffID.Algorithm().Digester()
+			layer := io.TeeReader(layerRaw, layerDigester.Hash())
+
+			if err := te.unpackLayer(rootfsPath, layer); err != nil {
+				return errors.Wrap(err, "unpack layer")
+			}
+			// Different tar implementations can have different levels of redundant
+			// padding and other similar weird behaviours. While on paper they are
+			// all entirely valid archives, Go's tar.Reader implementation doesn't
+			// guarantee that the entire stream will be consumed (which can result
+			// in the later diff_id check failing because the digester didn't get
+			// the whole uncompressed stream). Just blindly consume anything left
+			// in the layer.
+			_, _ = io.Copy(ioutil.Discard, layer)
+			// XXX: Is it possible this breaks in the error path?
+			layerGzip.Close()
+
+			layerDigest := layerDigester.Digest()
+			if layerDigest != layerDiffID {
+				return errors.Errorf("unpack manifest: layer %s: diffid mismatch: got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
+			}
+			return nil
+		}(); err != nil {
+			return err
 		}
-		defer layerBlob.Close()
-		if !isLayerType(layerBlob.MediaType) {
-			return errors.Errorf("unpack manifest: layer %s: blob is not correct mediatype: %s", layerBlob.Digest, layerBlob.MediaType)
+	}
+	if err := te.applyOpaqueDirs(); err != nil {
+		return errors.Wrap(err, "apply opaque directories")
+	}
+	if err := te.applyFileFlags(); err != nil {
+		return errors.Wrap(err, "apply file flags")
+	}
+
+	// Generate a runtime configuration file from ispec.Image.
+	log.Infof("unpack configuration: %s", configBlob.Digest)
+	configFile, err := os.Create(configPath)
+	if err != nil {
+		return errors.Wrap(err, "open config.json")
+	}
+	defer configFile.Close()
+
+	if err := UnpackRuntimeJSON(ctx, engine, configFile, rootfsPath, manifest, &mapOptions); err != nil {
+		return errors.Wrap(err, "unpack config.json")
+	}
+	return nil
+}
+
+// LayerDirName returns the name of the directory (inside the destination
+// given to UnpackLayers) that the layer with the given index is extracted to.
+func LayerDirName(idx int) string {
+	return fmt.Sprintf("layer%d", idx)
+}
+
+// UnpackLayers extracts each of the layers in the given manifest into its own
+// directory (see LayerDirName) inside dest, rather than merging them into a
+// single root filesystem. Because the layers are independent, up to parallel
+// layers are extracted concurrently. Whiteouts are always kept as regular
+// files (see UnpackOptions.KeepWhiteouts), as there is nothing for them to
+// apply to, unless UnpackOptions.TranslateOverlayWhiteouts is set (which
+// makes the layer directories usable as overlayfs layers). The DiffID of
+// every layer is verified.
+func UnpackLayers(ctx context.Context, engine cas.Engine, dest string, manifest ispec.Manifest, parallel int, opt *UnpackOptions) error {
+	engineExt := casext.NewEngine(engine)
+
+	var unpackOptions UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
+	}
+	unpackOptions.KeepWhiteouts = true
+
+	if parallel < 1 {
+		return errors.Errorf("unpack layers: invalid parallelism %d", parallel)
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return errors.Wrap(err, "get config blob")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return errors.Errorf("unpack layers: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return errors.Errorf("unpack layers: image has %d layers but %d diffids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	// As with UnpackManifest, make sure that unprivileged users cannot
+	// recurse into the extracted layers.
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return errors.Wrap(err, "mkdir destination")
+	}
+	if err := os.Chmod(dest, 0700); err != nil {
+		return errors.Wrap(err, "chmod destination 0700")
+	}
+	for idx := range manifest.Layers {
+		if err := os.Mkdir(filepath.Join(dest, LayerDirName(idx)), 0755); err != nil {
+			return errors.Wrap(err, "mkdir layer directory")
 		}
-		layerGzip, ok := layerBlob.Data.(io.ReadCloser)
-		if !ok {
-			// Should _never_ be reached.
-			return errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+	}
+
+	unpackOne := func(idx int) error {
+		layerDescriptor := manifest.Layers[idx]
+		layerDiffID := config.RootFS.DiffIDs[idx]
+		log.Infof("unpack layer: %s", layerDescriptor.Digest)
+
+		blob, err := engine.GetBlob(ctx, layerDescriptor.Digest)
+		if err != nil {
+			return errors.Wrap(err, "get layer blob")
 		}
+		defer blob.Close()
 
-		// We have to extract a gzip'd version of the above layer. Also note
-		// that we have to check the DiffID we're extracting (which is the
-		// sha256 sum of the *uncompressed* layer).
-		layerRaw, err := gzip.NewReader(layerGzip)
+		layerRaw, err := casext.DecompressLayer(blob, layerDescriptor.MediaType)
 		if err != nil {
-			return errors.Wrap(err, "create gzip reader")
+			return err
 		}
-		layerDigester := digest.SHA256.Digester()
+		defer layerRaw.Close()
+
+		if !cas.IsSupportedAlgorithm(layerDiffID.Algorithm()) {
+			return errors.Errorf("unsupported diffid algorithm: %s", layerDiffID.Algorithm())
+		}
+		layerDigester := layerDiffID.Algorithm().Digester()
 		layer := io.TeeReader(layerRaw, layerDigester.Hash())
 
-		if err := UnpackLayer(rootfsPath, layer, opt); err != nil {
+		if err := UnpackLayer(filepath.Join(dest, LayerDirName(idx)), layer, &unpackOptions); err != nil {
 			return errors.Wrap(err, "unpack layer")
 		}
-		// Different tar implementations can have different levels of redundant
-		// padding and other similar weird behaviours. While on paper they are
-		// all entirely valid archives, Go's tar.Reader implementation doesn't
-		// guarantee that the entire stream will be consumed (which can result
-		// in the later diff_id check failing because the digester didn't get
-		// the whole uncompressed stream). Just blindly consume anything left
-		// in the layer.
+		// See UnpackManifest for why we need to consume the rest of the layer.
 		_, _ = io.Copy(ioutil.Discard, layer)
-		// XXX: Is it possible this breaks in the error path?
-		layerGzip.Close()
 
-		layerDigest := layerDigester.Digest()
-		if layerDigest != layerDiffID {
-			return errors.Errorf("unpack manifest: layer %s: diffid mismatch: got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
+		if layerDigest := layerDigester.Digest(); layerDigest != layerDiffID {
+			return errors.Errorf("diffid mismatch: got %s expected %s", layerDigest, layerDiffID)
 		}
+		return nil
 	}
 
-	// Generate a runtime configuration file from ispec.Image.
-	log.Infof("unpack configuration: %s", configBlob.Digest)
-	configFile, err := os.Create(configPath)
-	if err != nil {
-		return errors.Wrap(err, "open config.json")
+	// Each worker takes the next layer to extract, until either every layer
+	// has been extracted or one of them has failed.
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		next    int
+		errs    = make([]error, len(manifest.Layers))
+		aborted bool
+	)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				lock.Lock()
+				idx := next
+				next++
+				done := aborted || idx >= len(manifest.Layers)
+				lock.Unlock()
+				if done {
+					return
+				}
+
+				if err := unpackOne(idx); err != nil {
+					lock.Lock()
+					errs[idx] = errors.Wrapf(err, "unpack layer %d (%s)", idx, manifest.Layers[idx].Digest)
+					aborted = true
+					lock.Unlock()
+				}
+			}
+		}()
 	}
-	defer configFile.Close()
+	wg.Wait()
 
-	if err := UnpackRuntimeJSON(ctx, engine, configFile, rootfsPath, manifest, opt); err != nil {
-		return errors.Wrap(err, "unpack config.json")
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -18,20 +18,28 @@
 package layer
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
@@ -165,7 +173,440 @@ yRAbACGEEEIIIYQQQgghhBBCCKEr+wTE0sQyACgAAA==`,
 		},
 		Rootless: os.Geteuid() != 0,
 	}
-	if err := UnpackManifest(ctx, engineExt, bundle, manifest, mapOptions); err != nil {
+	if err := UnpackManifest(ctx, engineExt, bundle, manifest, &UnpackOptions{MapOptions: *mapOptions}); err != nil {
 		t.Errorf("unexpected UnpackManifest error: %+v\n", err)
 	}
 }
+
+// makeTestLayer creates an uncompressed layer containing the given entries.
+func makeTestLayer(t *testing.T, hdrs ...*tar.Header) io.Reader {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header %s: %+v", hdr.Name, err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size))); err != nil {
+				t.Fatalf("write contents %s: %+v", hdr.Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar writer: %+v", err)
+	}
+	return &buf
+}
+
+func TestUnpackLayerEntryFilter(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackLayerEntryFilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootless := &UnpackOptions{MapOptions: MapOptions{Rootless: os.Geteuid() != 0}}
+	if err := UnpackLayer(root, makeTestLayer(t,
+		&tar.Header{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "usr/bin", Size: 4},
+		&tar.Header{Name: "etc", Size: 4},
+		&tar.Header{Name: "keep", Size: 4},
+	), rootless); err != nil {
+		t.Fatalf("unexpected error unpacking base layer: %+v", err)
+	}
+
+	var seen []string
+	opt := &UnpackOptions{
+		MapOptions: rootless.MapOptions,
+		EntryFilter: func(hdr *tar.Header) (bool, error) {
+			seen = append(seen, hdr.Name)
+			switch {
+			case strings.HasPrefix(hdr.Name, "usr/share/doc"):
+				return true, nil
+			case hdr.Name == ".wh.keep":
+				return true, nil
+			case hdr.Name == "old-name":
+				hdr.Name = "new-name"
+			}
+			return false, nil
+		},
+	}
+	if err := UnpackLayer(root, makeTestLayer(t,
+		&tar.Header{Name: "usr/share/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "usr/share/doc/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "usr/share/doc/README", Size: 10},
+		&tar.Header{Name: "usr/share/man", Size: 10},
+		&tar.Header{Name: "old-name", Size: 3},
+		&tar.Header{Name: ".wh.etc"},
+		&tar.Header{Name: ".wh.keep"},
+	), opt); err != nil {
+		t.Fatalf("unexpected error unpacking filtered layer: %+v", err)
+	}
+
+	// The filter must have been called for every entry, including whiteouts.
+	expectedSeen := []string{"usr/share/", "usr/share/doc/", "usr/share/doc/README", "usr/share/man", "old-name", ".wh.etc", ".wh.keep"}
+	if !reflect.DeepEqual(seen, expectedSeen) {
+		t.Errorf("filter called with unexpected entries: expected %v, got %v", expectedSeen, seen)
+	}
+
+	for _, test := range []struct {
+		path   string
+		exists bool
+	}{
+		{"usr/bin", true},
+		{"usr/share/man", true},
+		{"usr/share/doc", false},
+		{"old-name", false},
+		{"new-name", true},
+		{"etc", false},
+		{"keep", true},
+	} {
+		_, err := os.Lstat(filepath.Join(root, test.path))
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("path %s: expected exists=%v, got err=%v", test.path, test.exists, err)
+		}
+	}
+
+	// Errors from the filter must abort the extraction.
+	opt.EntryFilter = func(hdr *tar.Header) (bool, error) {
+		return false, errors.New("filter error")
+	}
+	if err := UnpackLayer(root, makeTestLayer(t, &tar.Header{Name: "another", Size: 1}), opt); err == nil {
+		t.Errorf("expected an error from the entry filter")
+	}
+	if _, err := os.Lstat(filepath.Join(root, "another")); !os.IsNotExist(err) {
+		t.Errorf("entry was extracted despite filter error: %v", err)
+	}
+}
+
+func TestUnpackLayerIncludePrefix(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackLayerIncludePrefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	opt := &UnpackOptions{
+		MapOptions:    MapOptions{Rootless: os.Geteuid() != 0},
+		IncludePrefix: "/etc/ssh",
+	}
+	if err := UnpackLayer(root, makeTestLayer(t,
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0711},
+		&tar.Header{Name: "etc/passwd", Size: 4},
+		&tar.Header{Name: "etc/ssh/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "etc/ssh/sshd_config", Size: 4},
+		&tar.Header{Name: "etc/ssh/moduli", Size: 4},
+		&tar.Header{Name: "etc/sshd", Size: 4},
+		&tar.Header{Name: "usr/bin/ssh", Size: 4},
+	), opt); err != nil {
+		t.Fatalf("unexpected error unpacking base layer: %+v", err)
+	}
+	if err := UnpackLayer(root, makeTestLayer(t,
+		&tar.Header{Name: "etc/ssh/.wh.moduli"},
+		&tar.Header{Name: "etc/ssh/ssh_config", Size: 4},
+		&tar.Header{Name: "etc/ssh/passwd-link", Typeflag: tar.TypeLink, Linkname: "etc/passwd"},
+		&tar.Header{Name: "etc/ssh/config-link", Typeflag: tar.TypeLink, Linkname: "etc/ssh/ssh_config"},
+		&tar.Header{Name: "usr/.wh.bin"},
+	), opt); err != nil {
+		t.Fatalf("unexpected error unpacking second layer: %+v", err)
+	}
+
+	for _, test := range []struct {
+		path   string
+		exists bool
+	}{
+		{"etc", true},
+		{"etc/ssh/sshd_config", true},
+		{"etc/ssh/ssh_config", true},
+		{"etc/ssh/config-link", true},
+		// Whiteouts inside the prefix are still applied.
+		{"etc/ssh/moduli", false},
+		// Everything outside the prefix must be skipped.
+		{"etc/passwd", false},
+		{"etc/sshd", false},
+		{"etc/ssh/passwd-link", false},
+		{"usr", false},
+	} {
+		_, err := os.Lstat(filepath.Join(root, test.path))
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("path %s: expected exists=%v, got err=%v", test.path, test.exists, err)
+		}
+	}
+
+	// The parent directories of the prefix keep their metadata.
+	fi, err := os.Lstat(filepath.Join(root, "etc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0711 {
+		t.Errorf("expected etc to have mode 0711, got %o", mode)
+	}
+
+	// A whiteout of a parent of the prefix removes the prefix.
+	if err := UnpackLayer(root, makeTestLayer(t, &tar.Header{Name: ".wh.etc"}), opt); err != nil {
+		t.Fatalf("unexpected error unpacking whiteout layer: %+v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "etc")); !os.IsNotExist(err) {
+		t.Errorf("expected etc to be removed by whiteout: %v", err)
+	}
+}
+
+func TestUnpackLayers(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	// Each layer is described by the names of its (regular file) entries.
+	layers := [][]string{
+		{"etc", "bin"},
+		{".wh.etc", "new"},
+		{".wh.new", "bin"},
+	}
+	var (
+		diffIDs     []digest.Digest
+		descriptors []ispec.Descriptor
+	)
+	for idx, names := range layers {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, name := range names {
+			contents := fmt.Sprintf("layer %d", idx)
+			if strings.HasPrefix(name, WhiteoutPrefix) {
+				contents = ""
+			}
+			if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(tw, contents); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		diffIDs = append(diffIDs, digest.FromBytes(buf.Bytes()))
+
+		// Mix compressed and uncompressed layers.
+		mediaType := ispec.MediaTypeImageLayer
+		blob := buf.Bytes()
+		if idx != 1 {
+			var gzbuf bytes.Buffer
+			gzw := gzip.NewWriter(&gzbuf)
+			if _, err := gzw.Write(blob); err != nil {
+				t.Fatal(err)
+			}
+			if err := gzw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			mediaType = ispec.MediaTypeImageLayerGzip
+			blob = gzbuf.Bytes()
+		}
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader(blob))
+		if err != nil {
+			t.Fatal(err)
+		}
+		descriptors = append(descriptors, ispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+	}
+
+	makeManifest := func(diffIDs []digest.Digest) ispec.Manifest {
+		configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+			OS: "linux",
+			RootFS: ispec.RootFS{
+				Type:    "layers",
+				DiffIDs: diffIDs,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ispec.Manifest{
+			Versioned: specs.Versioned{
+				SchemaVersion: 2,
+			},
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Layers: descriptors,
+		}
+	}
+	manifest := makeManifest(diffIDs)
+	opt := &UnpackOptions{MapOptions: MapOptions{Rootless: os.Geteuid() != 0}}
+
+	for _, parallel := range []int{1, 3} {
+		dest := filepath.Join(root, fmt.Sprintf("dest-%d", parallel))
+		if err := UnpackLayers(ctx, engine, dest, manifest, parallel, opt); err != nil {
+			t.Fatalf("parallel=%d: unexpected UnpackLayers error: %+v", parallel, err)
+		}
+
+		// Every layer must have been extracted on its own, with whiteouts
+		// kept as regular files.
+		for idx, names := range layers {
+			layerDir := filepath.Join(dest, LayerDirName(idx))
+			fis, err := ioutil.ReadDir(layerDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, fi := range fis {
+				got = append(got, fi.Name())
+			}
+			expected := append([]string{}, names...)
+			sort.Strings(expected)
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("parallel=%d: layer %d: expected %v, got %v", parallel, idx, expected, got)
+			}
+			for _, name := range names {
+				contents, err := ioutil.ReadFile(filepath.Join(layerDir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.HasPrefix(name, WhiteoutPrefix) && string(contents) != fmt.Sprintf("layer %d", idx) {
+					t.Errorf("parallel=%d: layer %d: unexpected contents of %s: %q", parallel, idx, name, contents)
+				}
+			}
+		}
+	}
+
+	// A DiffID mismatch must be detected.
+	badDiffIDs := append([]digest.Digest{}, diffIDs...)
+	badDiffIDs[2] = digest.FromString("bad")
+	if err := UnpackLayers(ctx, engine, filepath.Join(root, "dest-bad"), makeManifest(badDiffIDs), 2, opt); err == nil {
+		t.Errorf("expected UnpackLayers to fail with a diffid mismatch")
+	} else if !strings.Contains(err.Error(), "diffid mismatch") {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
+
+func TestUnpackManifestUncompressed(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestUncompressed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	// An uncompressed layer followed by gzip and zstd compressed ones.
+	var (
+		diffIDs     []digest.Digest
+		descriptors []ispec.Descriptor
+	)
+	for idx, mediaType := range []string{ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerGzip, casext.MediaTypeImageLayerZstd} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		name := fmt.Sprintf("file%d", idx)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(name))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, name); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		diffIDs = append(diffIDs, digest.FromBytes(buf.Bytes()))
+
+		blob := buf.Bytes()
+		switch mediaType {
+		case ispec.MediaTypeImageLayerGzip:
+			var gzbuf bytes.Buffer
+			gzw := gzip.NewWriter(&gzbuf)
+			if _, err := gzw.Write(blob); err != nil {
+				t.Fatal(err)
+			}
+			if err := gzw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			blob = gzbuf.Bytes()
+		case casext.MediaTypeImageLayerZstd:
+			zw, err := zstd.NewWriter(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blob = zw.EncodeAll(blob, nil)
+		}
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader(blob))
+		if err != nil {
+			t.Fatal(err)
+		}
+		descriptors = append(descriptors, ispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS: "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: descriptors,
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackManifest(ctx, engine, bundle, manifest, &UnpackOptions{MapOptions: MapOptions{Rootless: os.Geteuid() != 0}}); err != nil {
+		t.Fatalf("unexpected UnpackManifest error: %+v", err)
+	}
+	for idx := range descriptors {
+		name := fmt.Sprintf("file%d", idx)
+		contents, err := ioutil.ReadFile(filepath.Join(bundle, RootfsName, name))
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+		} else if string(contents) != name {
+			t.Errorf("%s: unexpected contents %q", name, contents)
+		}
+	}
+}
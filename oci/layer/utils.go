@@ -21,8 +21,10 @@ import (
 	"archive/tar"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 )
@@ -39,6 +41,346 @@ type MapOptions struct {
 	Rootless bool `json:"rootless"`
 }
 
+// FileSizePolicy specifies how GenerateLayer handles files which are larger
+// than PackOptions.MaxFileSize.
+type FileSizePolicy int
+
+const (
+	// FileSizeError causes layer generation to fail if a file is too large.
+	// This is the default.
+	FileSizeError FileSizePolicy = iota
+
+	// FileSizeSkip causes files which are too large to be omitted from the
+	// layer (with a warning).
+	FileSizeSkip
+)
+
+// UnreadablePolicy specifies how GenerateLayer handles files which cannot be
+// read (because of permission or I/O errors, for instance).
+type UnreadablePolicy int
+
+const (
+	// UnreadableError causes layer generation to fail if a file cannot be
+	// read. This is the default.
+	UnreadableError UnreadablePolicy = iota
+
+	// UnreadableSkip causes files which cannot be read to be omitted from the
+	// layer (with a warning). Note that this means the previous version of
+	// the file (if there was one) will still be visible in the image.
+	UnreadableSkip
+
+	// UnreadableWhiteout causes files which cannot be read to be replaced
+	// with a whiteout in the layer (with a warning), so that the file is not
+	// present in the image at all.
+	UnreadableWhiteout
+)
+
+// HardlinkFallback specifies what the layer extraction code does when a
+// hardlink cannot be created because its target is on a different filesystem
+// (which can happen when the destination spans several mounts).
+type HardlinkFallback int
+
+const (
+	// HardlinkFallbackError causes extraction to fail if a hardlink cannot be
+	// created because of EXDEV. This is the default.
+	HardlinkFallbackError HardlinkFallback = iota
+
+	// HardlinkFallbackCopy causes the contents (and metadata) of the hardlink
+	// target to be copied to the link path instead, if the target is a
+	// regular file on a different filesystem. Note that the two paths will be
+	// separate inodes, so later modifications to one are not reflected in the
+	// other.
+	HardlinkFallbackCopy
+)
+
+// WhiteoutFormat specifies how whiteouts are represented in the layers being
+// extracted.
+type WhiteoutFormat int
+
+const (
+	// WhiteoutFormatOCI is the whiteout format described by the image-spec,
+	// where whiteouts are entries with a ".wh." prefix and opaque whiteouts
+	// are ".wh..wh..opq" entries. This is the default.
+	WhiteoutFormatOCI WhiteoutFormat = iota
+
+	// WhiteoutFormatOverlay is the format used by overlayfs (and layers
+	// created by copying the upperdir of an overlay mount), where whiteouts
+	// are 0:0 character devices and opaque directories have the
+	// "trusted.overlay.opaque" xattr set to "y". Layers using this format
+	// are interpreted as though they used the equivalent OCI whiteouts.
+	WhiteoutFormatOverlay
+)
+
+// TimestampPolicy specifies which timestamps of each file are stored in the
+// layers generated by GenerateLayer.
+type TimestampPolicy int
+
+const (
+	// TimestampsDefault stores whichever timestamps archive/tar stores by
+	// default. This is the default.
+	TimestampsDefault TimestampPolicy = iota
+
+	// TimestampsMtime only stores the modification time of each file, and
+	// never emits atime or ctime PAX records.
+	TimestampsMtime
+
+	// TimestampsAll stores the modification, access and change times of each
+	// file (the latter two as PAX records).
+	TimestampsAll
+
+	// TimestampsNone stores no timestamps. The modification time of every
+	// file is set to the Unix epoch, and no atime or ctime PAX records are
+	// emitted.
+	TimestampsNone
+)
+
+// PackOptions specifies the options used when generating layers from a
+// filesystem.
+type PackOptions struct {
+	// MapOptions are the UID and GID mappings used when generating the layer.
+	MapOptions MapOptions
+
+	// MaxFileSize is the maximum size (in bytes) of a regular file which can
+	// be added to the layer. If zero, there is no limit.
+	MaxFileSize int64
+
+	// FileSizePolicy specifies what should be done with files that exceed
+	// MaxFileSize.
+	FileSizePolicy FileSizePolicy
+
+	// OnUnreadable specifies what should be done with files that cannot be
+	// read. Files which no longer exist are always treated as an error.
+	OnUnreadable UnreadablePolicy
+
+	// Timestamps specifies which timestamps are stored for each file in the
+	// layer.
+	Timestamps TimestampPolicy
+
+	// SourceDateEpoch, if non-zero, replaces every timestamp stored in the
+	// layer (the modification time of each entry, as well as any atime and
+	// ctime PAX records kept by Timestamps) with the given time. This makes
+	// layers generated from the same files reproducible regardless of when
+	// the files were created, as with the SOURCE_DATE_EPOCH convention used
+	// by reproducible builds.
+	SourceDateEpoch time.Time
+
+	// Canonical normalises the headers of the entries in the layer so that
+	// they only depend on the information which is used when unpacking the
+	// layer. The user and group names are cleared (overriding PasswdFile and
+	// GroupFile), so that ownership is only stored numerically, and the device
+	// numbers of entries which are not device nodes are cleared. PAX records
+	// (such as xattrs) are always written in sorted order by archive/tar.
+	// Together with SourceDateEpoch, this makes layers generated from the
+	// same files byte-for-byte identical regardless of the host.
+	Canonical bool
+
+	// DeduplicateWhiteouts causes whiteouts for paths inside a directory
+	// which is itself being whited out to be omitted from the layer, as they
+	// are redundant.
+	DeduplicateWhiteouts bool
+
+	// MetadataOverrides are applied to the entries of the layer (after the
+	// MapOptions have been applied), replacing the ownership and permissions
+	// of the files in the root filesystem. If several overrides match an
+	// entry, later overrides take precedence.
+	MetadataOverrides []MetadataOverride
+
+	// PreserveFileFlags causes the inode flags of files (such as the
+	// immutable and append-only flags set with chattr(1)) to be stored in
+	// the layer. The flags are restored when unpacking if possible.
+	PreserveFileFlags bool
+
+	// XattrPrefixes, if non-empty, restricts the extended attributes stored
+	// in the layer to those whose names start with one of the given prefixes
+	// (such as "user." or "security."). By default all xattrs are stored
+	// (as SCHILY.xattr PAX records), except for host-specific xattrs such as
+	// "security.selinux". Those are only stored if their full name is listed
+	// in XattrPrefixes.
+	XattrPrefixes []string
+
+	// OmitRootEntry causes the root directory of the filesystem to never be
+	// included in the layer, even if its metadata has changed. By default an
+	// explicit "/" entry is added when the root was modified, which means
+	// that the mode, ownership and timestamps of the root directory in the
+	// merged image are replaced by those of the layer. Omitting it keeps the
+	// root directory of the lower layers (or the runtime's default) as-is,
+	// at the cost of changes to the root's metadata being lost. Entries
+	// inside the root directory are not affected.
+	OmitRootEntry bool
+
+	// ParentDirEntries causes GenerateLayerFromFile to add entries for each
+	// of the parent directories of the inserted file. They are not needed
+	// for the layer to be valid, and since the directories don't exist on the
+	// filesystem they are owned by root with mode 0755 and have a modification
+	// time of the Unix epoch (MetadataOverrides and SourceDateEpoch still
+	// apply). Note that applying such a layer replaces the metadata of the
+	// same directories in the lower layers, and replaces any of them which
+	// are symlinks with directories. Other functions ignore this option.
+	ParentDirEntries bool
+
+	// StrictDirOrdering causes the entries of the layer to be emitted in tree
+	// order, which guarantees that every directory entry precedes all of the
+	// entries inside it (some strict tar consumers require this). By default
+	// all whiteouts are emitted first, followed by the other entries, each
+	// sorted lexicographically by path. This breaks the guarantee for
+	// whiteouts, and for names containing characters that sort before '/'
+	// (such as a file named "!file" being emitted before the root directory).
+	// In tree order, a whiteout only precedes other entries for the same path.
+	StrictDirOrdering bool
+
+	// PasswdFile and GroupFile are paths to passwd(5) and group(5) files
+	// (usually the /etc/passwd and /etc/group of the image's rootfs) used to
+	// resolve the user and group names stored in the layer, from the owner
+	// of each entry (as seen inside the container). If unset, the names are
+	// resolved using the user database of the host. IDs which are not listed
+	// in the given file are stored without a name.
+	PasswdFile string
+	GroupFile  string
+
+	// WarnOnOverride causes GenerateLayerFromDirs to log a warning whenever a
+	// path provided by one source directory is overridden by a later one. By
+	// default such overrides are only logged at the debug level.
+	WarnOnOverride bool
+
+	// MaskFunc, if set, is consulted for every path which would be included
+	// in the layer (with the path given relative to the root of the layer,
+	// in the form "/etc/passwd"). If it returns true, the path is excluded
+	// from the layer. If a directory is masked, everything inside it is
+	// excluded without consulting MaskFunc. Whiteouts are masked in the same
+	// way as other entries.
+	MaskFunc func(path string) bool
+
+	// ExcludePatterns are glob patterns (see mtreefilter.GlobMatch, which
+	// supports "**" to match any number of path components) matched against
+	// every path which would be included in the layer, in the form
+	// "/etc/passwd". Modified and added paths matching any pattern (or inside
+	// a directory which matches) are excluded from the layer. Unlike
+	// MaskFunc, deletions are still emitted as whiteouts even if they match,
+	// so that excluded paths deleted from the rootfs are not left behind in
+	// the lower layers.
+	ExcludePatterns []string
+
+	// MaxDepth is the maximum number of path components of an entry in the
+	// layer. Generating a layer fails (naming the offending path) if any
+	// path is deeper than this, which guards against pathological trees such
+	// as a directory bind-mounted inside itself. If zero, DefaultMaxDepth is
+	// used. If negative, there is no limit.
+	MaxDepth int
+
+	// LayerCacheDir is the path to a directory used to cache generated
+	// layers. If set, GenerateLayer derives a cache key from the deltas and
+	// options, and returns the cached layer if there is one. Otherwise the
+	// newly generated layer is stored in the cache (keyed by its DiffID) once
+	// it has been completely read. The cache can be shared between images.
+	LayerCacheDir string
+
+	// OnProgress, if set, is called after each entry has been added to the
+	// layer with the total number of (uncompressed) bytes of the layer
+	// generated so far and the path of the entry in the layer. It is called
+	// from the goroutine generating the layer, and is not called if the layer
+	// is returned from LayerCacheDir.
+	OnProgress ProgressFunc
+}
+
+// ProgressFunc is called by GenerateLayer and GenerateLayerFromDirs to report
+// progress while a layer is generated. See PackOptions.OnProgress.
+type ProgressFunc func(bytesWritten uint64, path string)
+
+// EntryFilter is called with the header of each entry of a layer before it is
+// extracted. If it returns skip=true, the entry is not extracted. The filter
+// may also modify hdr (for instance, to rename the entry), in which case the
+// modified header is what gets extracted. Returning an error aborts the
+// extraction.
+type EntryFilter func(hdr *tar.Header) (skip bool, err error)
+
+// UnpackOptions specifies the options used when extracting layers to a
+// filesystem.
+type UnpackOptions struct {
+	// MapOptions are the UID and GID mappings used when extracting the layer.
+	MapOptions MapOptions
+
+	// EntryFilter, if set, is consulted for every entry in the layer before
+	// it is extracted. This includes whiteout entries: the filter is called
+	// before any whiteout handling, so skipping a whiteout means that the
+	// files it would have removed are kept, and renaming a whiteout changes
+	// which path is removed.
+	EntryFilter EntryFilter
+
+	// HardlinkFallback specifies what should be done with hardlinks that
+	// cannot be created because the target is on a different filesystem.
+	HardlinkFallback HardlinkFallback
+
+	// WhiteoutFormat specifies the format of the whiteouts in the layers
+	// being extracted. Whiteouts are converted to the OCI format before
+	// EntryFilter is called, so filters always see OCI whiteouts.
+	WhiteoutFormat WhiteoutFormat
+
+	// KeepWhiteouts causes whiteout entries to be extracted as (empty)
+	// regular files with their ".wh." names, rather than removing the paths
+	// they refer to. This is only useful when extracting a layer on its own,
+	// where there is nothing for the whiteouts to apply to.
+	KeepWhiteouts bool
+
+	// TranslateOverlayWhiteouts causes whiteouts to be converted to the
+	// overlayfs format, for extracting layers into the upperdir (or a
+	// lowerdir) of an overlay mount. Whiteouts are extracted as 0:0
+	// character devices (replacing the path they refer to), and opaque
+	// whiteouts set the "trusted.overlay.opaque" xattr of their directory.
+	// Creating overlay whiteouts requires CAP_MKNOD and CAP_SYS_ADMIN. If
+	// set, KeepWhiteouts is ignored.
+	TranslateOverlayWhiteouts bool
+
+	// IncludePrefix, if set, restricts extraction to the given path (relative
+	// to the root filesystem) and everything inside it. Whiteouts are still
+	// applied if they remove a path inside IncludePrefix (or one of its
+	// parents), and the entries for the parent directories of IncludePrefix
+	// are extracted so that their metadata is correct. Hardlinks inside
+	// IncludePrefix to files outside it are skipped.
+	IncludePrefix string
+}
+
+// MetadataOverride describes the ownership and permissions that the entries
+// of a generated layer should have, regardless of the ownership and
+// permissions of the files in the root filesystem.
+type MetadataOverride struct {
+	// Path is the path (relative to the root filesystem) the override
+	// applies to. The override applies to the path and everything inside it,
+	// using the same matching rules as mtreefilter.MaskFilter.
+	Path string `json:"path"`
+
+	// UID is the owner of matching entries (in the container), if non-nil.
+	UID *int `json:"uid,omitempty"`
+
+	// GID is the group of matching entries (in the container), if non-nil.
+	GID *int `json:"gid,omitempty"`
+
+	// Mode contains the permission bits (including the setuid, setgid and
+	// sticky bits) of matching entries, if non-nil. It is not applied to
+	// symlinks.
+	Mode *uint32 `json:"mode,omitempty"`
+}
+
+// overrideHeader applies all of the MetadataOverrides that match the given
+// tar.Header.
+func overrideHeader(hdr *tar.Header, overrides []MetadataOverride) {
+	for _, override := range overrides {
+		if !mtreefilter.MaskMatch(override.Path, hdr.Name) {
+			continue
+		}
+		if override.UID != nil {
+			hdr.Uid = *override.UID
+			hdr.Uname = ""
+		}
+		if override.GID != nil {
+			hdr.Gid = *override.GID
+			hdr.Gname = ""
+		}
+		if override.Mode != nil && hdr.Typeflag != tar.TypeSymlink {
+			hdr.Mode = (hdr.Mode &^ 07777) | int64(*override.Mode&07777)
+		}
+	}
+}
+
 // mapHeader maps a tar.Header generated from the filesystem so that it
 // describes the inode as it would be observed by a container process. In
 // particular this involves apply an ID mapping from the host filesystem to the
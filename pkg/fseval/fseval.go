@@ -60,6 +60,9 @@ type FsEval interface {
 	// Chmod is equivalent to os.Chmod.
 	Chmod(path string, mode os.FileMode) error
 
+	// Lchown is equivalent to os.Lchown.
+	Lchown(path string, uid, gid int) error
+
 	// Lutimes is equivalent to os.Lutimes.
 	Lutimes(path string, atime, mtime time.Time) error
 
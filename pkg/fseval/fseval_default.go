@@ -18,7 +18,9 @@
 package fseval
 
 import (
+	"io"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/openSUSE/umoci/pkg/system"
@@ -30,24 +32,57 @@ import (
 // do any trickery and calls directly to the relevant os.* functions (and does
 // not wrap KeywordFunc). This should be used by default, because there are no
 // weird side-effects.
+//
+// The only exception is paths which are longer than PATH_MAX (such as the
+// paths inside very deep directory trees), which cannot be passed to the
+// kernel directly. For these paths, the parent directory is resolved
+// piece-by-piece with openat(2) and the operation is done through a short
+// /proc/self/fd path relative to the parent directory.
 var DefaultFsEval FsEval = osFsEval(0)
 
 // osFsEval is a hack to be able to make DefaultFsEval a const.
 type osFsEval int
 
+// withShortPath calls fn with a path equivalent to the given path that is
+// short enough to be passed to the kernel. If the path is already short
+// enough, fn is called with path unchanged.
+func withShortPath(path string, fn func(path string) error) error {
+	if len(path) < unix.PathMax {
+		return fn(path)
+	}
+	dir, base, err := system.OpenParent(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return fn(system.ProcSelfFdPath(dir, base))
+}
+
 // Open is equivalent to os.Open.
 func (fs osFsEval) Open(path string) (*os.File, error) {
-	return os.Open(path)
+	var fh *os.File
+	err := withShortPath(path, func(path string) error {
+		var err error
+		fh, err = os.Open(path)
+		return err
+	})
+	return fh, err
 }
 
 // Create is equivalent to os.Create.
 func (fs osFsEval) Create(path string) (*os.File, error) {
-	return os.Create(path)
+	var fh *os.File
+	err := withShortPath(path, func(path string) error {
+		var err error
+		fh, err = os.Create(path)
+		return err
+	})
+	return fh, err
 }
 
 // Readdir is equivalent to os.Readdir.
 func (fs osFsEval) Readdir(path string) ([]os.FileInfo, error) {
-	fh, err := os.Open(path)
+	fh, err := fs.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -57,92 +92,200 @@ func (fs osFsEval) Readdir(path string) ([]os.FileInfo, error) {
 
 // Lstat is equivalent to os.Lstat.
 func (fs osFsEval) Lstat(path string) (os.FileInfo, error) {
-	return os.Lstat(path)
+	var fi os.FileInfo
+	err := withShortPath(path, func(path string) error {
+		var err error
+		fi, err = os.Lstat(path)
+		return err
+	})
+	return fi, err
 }
 
 // Lstatx is equivalent to unix.Lstat.
 func (fs osFsEval) Lstatx(path string) (unix.Stat_t, error) {
 	var s unix.Stat_t
-	err := unix.Lstat(path, &s)
+	err := withShortPath(path, func(path string) error {
+		return unix.Lstat(path, &s)
+	})
 	return s, err
 }
 
 // Readlink is equivalent to os.Readlink.
 func (fs osFsEval) Readlink(path string) (string, error) {
-	return os.Readlink(path)
+	var linkname string
+	err := withShortPath(path, func(path string) error {
+		var err error
+		linkname, err = os.Readlink(path)
+		return err
+	})
+	return linkname, err
 }
 
 // Symlink is equivalent to os.Symlink.
 func (fs osFsEval) Symlink(linkname, path string) error {
-	return os.Symlink(linkname, path)
+	return withShortPath(path, func(path string) error {
+		return os.Symlink(linkname, path)
+	})
 }
 
 // Link is equivalent to os.Link.
 func (fs osFsEval) Link(linkname, path string) error {
-	return os.Link(linkname, path)
+	return withShortPath(linkname, func(linkname string) error {
+		return withShortPath(path, func(path string) error {
+			return os.Link(linkname, path)
+		})
+	})
 }
 
 // Chmod is equivalent to os.Chmod.
 func (fs osFsEval) Chmod(path string, mode os.FileMode) error {
-	return os.Chmod(path, mode)
+	return withShortPath(path, func(path string) error {
+		return os.Chmod(path, mode)
+	})
+}
+
+// Lchown is equivalent to os.Lchown.
+func (fs osFsEval) Lchown(path string, uid, gid int) error {
+	return withShortPath(path, func(path string) error {
+		return os.Lchown(path, uid, gid)
+	})
 }
 
 // Lutimes is equivalent to os.Lutimes.
 func (fs osFsEval) Lutimes(path string, atime, mtime time.Time) error {
-	return system.Lutimes(path, atime, mtime)
+	if len(path) < unix.PathMax {
+		return system.Lutimes(path, atime, mtime)
+	}
+	// system.Lutimes refuses to resolve /proc/self/fd paths, so we need to
+	// use the parent directory directly.
+	dir, base, err := system.OpenParent(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return system.LutimesAt(dir, base, atime, mtime)
 }
 
 // Remove is equivalent to os.Remove.
 func (fs osFsEval) Remove(path string) error {
-	return os.Remove(path)
+	return withShortPath(path, func(path string) error {
+		return os.Remove(path)
+	})
 }
 
 // RemoveAll is equivalent to os.RemoveAll.
 func (fs osFsEval) RemoveAll(path string) error {
-	return os.RemoveAll(path)
+	return withShortPath(path, func(path string) error {
+		return os.RemoveAll(path)
+	})
 }
 
 // Mkdir is equivalent to os.Mkdir.
 func (fs osFsEval) Mkdir(path string, perm os.FileMode) error {
-	return os.Mkdir(path, perm)
+	return withShortPath(path, func(path string) error {
+		return os.Mkdir(path, perm)
+	})
 }
 
 // Mknod is equivalent to unix.Mknod.
 func (fs osFsEval) Mknod(path string, mode os.FileMode, dev uint64) error {
-	return unix.Mknod(path, uint32(mode), int(dev))
+	return withShortPath(path, func(path string) error {
+		return unix.Mknod(path, uint32(mode), int(dev))
+	})
 }
 
 // MkdirAll is equivalent to os.MkdirAll.
 func (fs osFsEval) MkdirAll(path string, perm os.FileMode) error {
-	return os.MkdirAll(path, perm)
+	if len(path) < unix.PathMax {
+		return os.MkdirAll(path, perm)
+	}
+
+	// os.MkdirAll doesn't handle long paths, so find the deepest ancestor
+	// that already exists and create everything below it ourselves.
+	var missing []string
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		var fi os.FileInfo
+		err := withShortPath(p, func(p string) error {
+			var err error
+			fi, err = os.Stat(p)
+			return err
+		})
+		if err == nil {
+			if !fi.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: p, Err: unix.ENOTDIR}
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		missing = append(missing, p)
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+	for idx := len(missing) - 1; idx >= 0; idx-- {
+		if err := fs.Mkdir(missing[idx], perm); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
 // Llistxattr is equivalent to system.Llistxattr
 func (fs osFsEval) Llistxattr(path string) ([]string, error) {
-	return system.Llistxattr(path)
+	var xattrs []string
+	err := withShortPath(path, func(path string) error {
+		var err error
+		xattrs, err = system.Llistxattr(path)
+		return err
+	})
+	return xattrs, err
 }
 
 // Lremovexattr is equivalent to system.Lremovexattr
 func (fs osFsEval) Lremovexattr(path, name string) error {
-	return unix.Lremovexattr(path, name)
+	return withShortPath(path, func(path string) error {
+		return unix.Lremovexattr(path, name)
+	})
 }
 
 // Lsetxattr is equivalent to system.Lsetxattr
 func (fs osFsEval) Lsetxattr(path, name string, value []byte, flags int) error {
-	return unix.Lsetxattr(path, name, value, flags)
+	return withShortPath(path, func(path string) error {
+		return unix.Lsetxattr(path, name, value, flags)
+	})
 }
 
 // Lgetxattr is equivalent to system.Lgetxattr
 func (fs osFsEval) Lgetxattr(path string, name string) ([]byte, error) {
-	return system.Lgetxattr(path, name)
+	var value []byte
+	err := withShortPath(path, func(path string) error {
+		var err error
+		value, err = system.Lgetxattr(path, name)
+		return err
+	})
+	return value, err
 }
 
 // Lclearxattrs is equivalent to system.Lclearxattrs
 func (fs osFsEval) Lclearxattrs(path string) error {
-	return system.Lclearxattrs(path)
+	return withShortPath(path, func(path string) error {
+		return system.Lclearxattrs(path)
+	})
 }
 
-// KeywordFunc returns a wrapper around the given mtree.KeywordFunc.
+// KeywordFunc returns a wrapper around the given mtree.KeywordFunc. The
+// wrapper only differs from the original if the path is too long to be passed
+// to the kernel.
 func (fs osFsEval) KeywordFunc(fn mtree.KeywordFunc) mtree.KeywordFunc {
-	return fn
+	return func(path string, info os.FileInfo, r io.Reader) ([]mtree.KeyVal, error) {
+		var kv []mtree.KeyVal
+		err := withShortPath(path, func(path string) error {
+			var err error
+			kv, err = fn(path, info, r)
+			return err
+		})
+		return kv, err
+	}
 }
@@ -0,0 +1,59 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package iohelpers
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCountingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	cw := &CountingWriter{W: &buf}
+
+	for _, chunk := range []string{"hello", " ", "world", ""} {
+		if _, err := io.WriteString(cw, chunk); err != nil {
+			t.Fatalf("unexpected error writing %q: %v", chunk, err)
+		}
+	}
+	if cw.N != int64(buf.Len()) {
+		t.Errorf("counted %d bytes, but %d were written", cw.N, buf.Len())
+	}
+	if buf.String() != "hello world" {
+		t.Errorf("unexpected contents written: %q", buf.String())
+	}
+}
+
+func TestCountingReader(t *testing.T) {
+	data := strings.Repeat("umoci", 1000)
+	cr := &CountingReader{R: strings.NewReader(data)}
+
+	got, err := ioutil.ReadAll(cr)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if cr.N != int64(len(data)) {
+		t.Errorf("counted %d bytes, but %d were read", cr.N, len(data))
+	}
+	if string(got) != data {
+		t.Errorf("unexpected contents read")
+	}
+}
@@ -0,0 +1,232 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mtreecache implements a cache of file content digests, which can be
+// used to avoid rehashing unchanged files when repeatedly walking (or checking)
+// a filesystem tree with go-mtree.
+package mtreecache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// digestKeyword is the mtree keyword whose values are cached.
+const digestKeyword mtree.Keyword = "sha256digest"
+
+// cacheVersion is the version of the serialised cache format. Caches with a
+// different version are ignored.
+const cacheVersion = 1
+
+// entry is a cached digest, together with the inode attributes that were used
+// to determine whether the file has changed since it was hashed.
+type entry struct {
+	Size   int64  `json:"size"`
+	Mtime  int64  `json:"mtime"`
+	Inode  uint64 `json:"inode"`
+	Digest string `json:"sha256"`
+}
+
+// cacheFile is the serialised form of a Cache.
+type cacheFile struct {
+	Version int              `json:"version"`
+	Entries map[string]entry `json:"entries"`
+}
+
+// Cache is a cache of the sha256 digests of regular files, keyed by their path
+// (relative to the root of the walk). A cached digest is only used if the
+// size, mtime and inode number of the file are unchanged since it was
+// computed, otherwise the file is rehashed. Note that the ctime of a file is
+// not considered, because it is modified by unpriv.Open when reading files
+// in rootless mode. Cache is not safe for concurrent use.
+type Cache struct {
+	entries map[string]entry
+
+	// newHash is used to hash files which are not in the cache. It is only
+	// overridden by tests.
+	newHash func() hash.Hash
+}
+
+// New returns a new empty Cache.
+func New() *Cache {
+	return &Cache{
+		entries: map[string]entry{},
+		newHash: sha256.New,
+	}
+}
+
+// Load reads a Cache previously written with Save. If the cache was written
+// with an incompatible version of the format, an empty Cache is returned.
+func Load(r io.Reader) (*Cache, error) {
+	var file cacheFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, errors.Wrap(err, "decode digest cache")
+	}
+	c := New()
+	if file.Version != cacheVersion {
+		log.Debugf("mtreecache: ignoring digest cache with unknown version %d", file.Version)
+		return c, nil
+	}
+	if file.Entries != nil {
+		c.entries = file.Entries
+	}
+	return c, nil
+}
+
+// Save writes the contents of the Cache to the given writer, in a form that
+// can be read with Load.
+func (c *Cache) Save(w io.Writer) error {
+	file := cacheFile{
+		Version: cacheVersion,
+		Entries: c.entries,
+	}
+	return errors.Wrap(json.NewEncoder(w).Encode(file), "encode digest cache")
+}
+
+// Walk is equivalent to mtree.Walk, except that if the "sha256digest" keyword
+// is requested then the digests of regular files are taken from the cache
+// where possible. After Walk returns the cache only contains entries for the
+// files that were found during the walk.
+func (c *Cache) Walk(root string, excludes []mtree.ExcludeFunc, keywords []mtree.Keyword, fs mtree.FsEval) (*mtree.DirectoryHierarchy, error) {
+	var (
+		wantDigest bool
+		walkKws    []mtree.Keyword
+	)
+	for _, kw := range keywords {
+		if kw.Prefix() == digestKeyword {
+			wantDigest = true
+			continue
+		}
+		walkKws = append(walkKws, kw)
+	}
+	if !wantDigest {
+		return mtree.Walk(root, excludes, keywords, fs)
+	}
+	if fs == nil {
+		fs = mtree.DefaultFsEval{}
+	}
+
+	dh, err := mtree.Walk(root, excludes, walkKws, fs)
+	if err != nil {
+		return nil, err
+	}
+
+	var hits, misses int
+	entries := map[string]entry{}
+	for idx := range dh.Entries {
+		e := &dh.Entries[idx]
+		if e.Type != mtree.RelativeType && e.Type != mtree.FullType {
+			continue
+		}
+		path, err := e.Path()
+		if err != nil {
+			return nil, errors.Wrap(err, "get entry path")
+		}
+		fullPath := filepath.Join(root, path)
+		fi, err := fs.Lstat(fullPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "lstat entry")
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		key, ok := statEntry(fi)
+		if cached, hit := c.entries[path]; ok && hit && cached.matches(key) {
+			key.Digest = cached.Digest
+			hits++
+		} else {
+			key.Digest, err = c.hashFile(fs, fullPath)
+			if err != nil {
+				return nil, errors.Wrapf(err, "hash %s", path)
+			}
+			misses++
+		}
+		if ok {
+			entries[path] = key
+		}
+		e.Keywords = append(e.Keywords, mtree.KeyVal(string(digestKeyword)+"="+key.Digest))
+	}
+	c.entries = entries
+
+	log.WithFields(log.Fields{
+		"hits":   hits,
+		"misses": misses,
+	}).Debugf("mtreecache: walked %s", root)
+	return dh, nil
+}
+
+// Check is equivalent to mtree.Check, except that the walk of root is done
+// with Walk so that cached digests are used where possible.
+func (c *Cache) Check(root string, dh *mtree.DirectoryHierarchy, keywords []mtree.Keyword, fs mtree.FsEval) ([]mtree.InodeDelta, error) {
+	if keywords == nil {
+		keywords = dh.UsedKeywords()
+	}
+	newDh, err := c.Walk(root, nil, keywords, fs)
+	if err != nil {
+		return nil, err
+	}
+	return mtree.Compare(dh, newDh, keywords)
+}
+
+// hashFile computes the hex-encoded digest of the file at the given path.
+func (c *Cache) hashFile(fs mtree.FsEval, path string) (string, error) {
+	fh, err := fs.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "open file")
+	}
+	defer fh.Close()
+
+	h := c.newHash()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", errors.Wrap(err, "read file")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// statEntry returns an entry (without a digest) describing the given file. If
+// the underlying stat information is not available, the file cannot be cached
+// and false is returned.
+func statEntry(fi os.FileInfo) (entry, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return entry{}, false
+	}
+	return entry{
+		Size:  fi.Size(),
+		Mtime: fi.ModTime().UnixNano(),
+		Inode: uint64(st.Ino),
+	}, true
+}
+
+// matches returns whether the cached entry describes the same file as other,
+// ignoring the digest.
+func (e entry) matches(other entry) bool {
+	return e.Size == other.Size &&
+		e.Mtime == other.Mtime &&
+		e.Inode == other.Inode
+}
@@ -0,0 +1,193 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreecache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vbatts/go-mtree"
+)
+
+var testKeywords = []mtree.Keyword{"size", "type", "mode", "link", "sha256digest"}
+
+// countingCache replaces the hash function of c with one that increments
+// *count every time a file is hashed.
+func countingCache(c *Cache, count *int) *Cache {
+	c.newHash = func() hash.Hash {
+		*count++
+		return sha256.New()
+	}
+	return c
+}
+
+// reload round-trips the cache through Save and Load.
+func reload(t *testing.T, c *Cache) *Cache {
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatalf("unexpected error saving cache: %+v", err)
+	}
+	loaded, err := Load(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error loading cache: %+v", err)
+	}
+	return loaded
+}
+
+func TestCacheCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCacheCheck-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	for _, path := range []string{"a", "b/c"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, path), []byte("contents of "+path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached walk must produce the same digests as go-mtree.
+	spec, err := mtree.Walk(root, nil, testKeywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashed int
+	cache := countingCache(New(), &hashed)
+	diffs, err := cache.Check(root, spec, testKeywords, nil)
+	if err != nil {
+		t.Fatalf("unexpected error in first check: %+v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no diffs in first check, got %v", diffs)
+	}
+	if hashed != 2 {
+		t.Errorf("expected 2 files to be hashed in first check, got %d", hashed)
+	}
+
+	// A second check of the unchanged tree must not hash anything.
+	hashed = 0
+	cache = countingCache(reload(t, cache), &hashed)
+	diffs, err = cache.Check(root, spec, testKeywords, nil)
+	if err != nil {
+		t.Fatalf("unexpected error in second check: %+v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no diffs in second check, got %v", diffs)
+	}
+	if hashed != 0 {
+		t.Errorf("expected no files to be hashed in second check, got %d", hashed)
+	}
+
+	// Changing the size of a file must cause it to be rehashed.
+	if err := ioutil.WriteFile(filepath.Join(root, "a"), []byte("new contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hashed = 0
+	diffs, err = cache.Check(root, spec, testKeywords, nil)
+	if err != nil {
+		t.Fatalf("unexpected error after changing size: %+v", err)
+	}
+	if len(diffs) != 1 || diffs[0].Path() != "a" || diffs[0].Type() != mtree.Modified {
+		t.Errorf("expected a to be modified, got %v", diffs)
+	}
+	if hashed != 1 {
+		t.Errorf("expected 1 file to be hashed after changing size, got %d", hashed)
+	}
+
+	// Changing the contents of a file without changing its size must also be
+	// noticed, because the mtime changes.
+	oldInfo, err := os.Lstat(filepath.Join(root, "b/c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "b/c"), []byte("CONTENTS OF b/c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := oldInfo.ModTime().Add(time.Second)
+	if err := os.Chtimes(filepath.Join(root, "b/c"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	hashed = 0
+	diffs, err = cache.Check(root, spec, testKeywords, nil)
+	if err != nil {
+		t.Fatalf("unexpected error after changing mtime: %+v", err)
+	}
+	if len(diffs) != 2 {
+		t.Errorf("expected a and b/c to be modified, got %v", diffs)
+	}
+	if hashed != 1 {
+		t.Errorf("expected 1 file to be hashed after changing mtime, got %d", hashed)
+	}
+}
+
+func TestCacheWalkPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCacheWalkPrune-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, path := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := New()
+	if _, err := cache.Walk(dir, nil, testKeywords, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.entries) != 2 {
+		t.Errorf("expected 2 cache entries, got %v", cache.entries)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Walk(dir, nil, testKeywords, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.entries["b"]; ok || len(cache.entries) != 1 {
+		t.Errorf("expected stale entry for b to be removed, got %v", cache.entries)
+	}
+}
+
+func TestLoadUnknownVersion(t *testing.T) {
+	cache, err := Load(bytes.NewBufferString(`{"version": 1000, "entries": {"a": {"sha256": "abc"}}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(cache.entries) != 0 {
+		t.Errorf("expected cache with unknown version to be ignored, got %v", cache.entries)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// splitGlobPath splits the given path (or pattern) into its components, with
+// the path considered to be relative to '/'.
+func splitGlobPath(path string) []string {
+	path = filepath.Clean("/" + path)
+	if path == "/" {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+// ValidateGlob returns an error if the given pattern is not a valid pattern
+// for GlobMatch.
+func ValidateGlob(pattern string) error {
+	for _, part := range splitGlobPath(pattern) {
+		if _, err := filepath.Match(part, ""); err != nil {
+			return errors.Wrapf(err, "invalid glob %q", pattern)
+		}
+	}
+	return nil
+}
+
+// GlobMatch returns whether the given path matches the glob pattern. Both the
+// pattern and the path are considered to be relative to '/', and are matched
+// component by component with the semantics of filepath.Match, except that a
+// "**" component matches any number (including zero) of path components. For
+// example, "**/*.pyc" matches every file with a ".pyc" extension and
+// "/var/log/*.log" matches the ".log" files directly inside /var/log. An
+// error is only returned if the pattern is malformed.
+func GlobMatch(pattern, path string) (bool, error) {
+	if err := ValidateGlob(pattern); err != nil {
+		return false, err
+	}
+	return globMatch(splitGlobPath(pattern), splitGlobPath(path)), nil
+}
+
+// globMatch matches the (already validated) pattern components against the
+// path components.
+func globMatch(pattern, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			for idx := 0; idx <= len(path); idx++ {
+				if globMatch(pattern, path[idx:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(path) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern[0], path[0]); !ok {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0
+}
@@ -0,0 +1,78 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern, path string
+		expected      bool
+	}{
+		{"**/*.pyc", "/a.pyc", true},
+		{"**/*.pyc", "/usr/lib/python/a.pyc", true},
+		{"**/*.pyc", "usr/lib/python/a.pyc", true},
+		{"**/*.pyc", "/usr/lib/python/a.py", false},
+		{"**/*.pyc", "/usr/lib/a.pyc/b", false},
+		{"/var/log/*.log", "/var/log/messages.log", true},
+		{"var/log/*.log", "/var/log/messages.log", true},
+		{"/var/log/*.log", "/var/log/messages", false},
+		{"/var/log/*.log", "/var/log/nested/messages.log", false},
+		{"/var/log/*.log", "/other/var/log/messages.log", false},
+		{"/var/**/*.log", "/var/log/nested/messages.log", true},
+		{"/var/**/*.log", "/var/messages.log", true},
+		{"/var/**", "/var", true},
+		{"/var/**", "/var/a/b/c", true},
+		{"/var/**", "/variable", false},
+		{"**/cache/**", "/home/user/.cache/x", false},
+		{"**/cache/**", "/var/cache/apt/x", true},
+		{"**/**/*.o", "/a/b.o", true},
+		{"/tmp/[a-c]?", "/tmp/b1", true},
+		{"/tmp/[a-c]?", "/tmp/d1", false},
+		{"/", "/", true},
+		{"/", "/a", false},
+		{"*", "/a", true},
+		{"*", "/a/b", false},
+	} {
+		got, err := GlobMatch(test.pattern, test.path)
+		if err != nil {
+			t.Errorf("GlobMatch(%q, %q): unexpected error: %+v", test.pattern, test.path, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("GlobMatch(%q, %q) got %v expected %v", test.pattern, test.path, got, test.expected)
+		}
+	}
+}
+
+func TestGlobMatchInvalid(t *testing.T) {
+	for _, pattern := range []string{
+		"/tmp/[a-",
+		"**/[",
+		"/a/\\",
+	} {
+		if err := ValidateGlob(pattern); err == nil {
+			t.Errorf("ValidateGlob(%q): expected an error", pattern)
+		}
+		if _, err := GlobMatch(pattern, "/some/path"); err == nil {
+			t.Errorf("GlobMatch(%q): expected an error", pattern)
+		}
+	}
+}
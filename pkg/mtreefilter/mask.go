@@ -19,6 +19,7 @@ package mtreefilter
 
 import (
 	"path/filepath"
+	"regexp"
 
 	"github.com/apex/log"
 	"github.com/vbatts/go-mtree"
@@ -38,22 +39,42 @@ func isParent(a, b string) bool {
 	return a == b
 }
 
+// MaskMatch returns whether the given path is matched by the mask, which is
+// the case if the path is the mask or a lexical child of the mask. Both paths
+// are considered to be relative to '/'.
+func MaskMatch(mask, path string) bool {
+	return isParent(filepath.Join("/", mask), filepath.Join("/", path))
+}
+
 // MaskFilter is a factory for FilterFuncs that will mask all InodeDelta paths
 // that are lexical children of any path in the mask slice. All paths are
 // considered to be relative to '/'.
 func MaskFilter(masks []string) FilterFunc {
 	return func(path string) bool {
-		// Convert the path to be cleaned and relative-to-root.
-		path = filepath.Join("/", path)
-
 		// Check that no masks are matched.
 		for _, mask := range masks {
-			// Mask also needs to be cleaned and relative-to-root.
-			mask = filepath.Join("/", mask)
+			if MaskMatch(mask, path) {
+				log.Debugf("maskfilter: ignoring path %q matched by mask %q", filepath.Join("/", path), filepath.Join("/", mask))
+				return false
+			}
+		}
 
-			// Is it a parent?
-			if isParent(mask, path) {
-				log.Debugf("maskfilter: ignoring path %q matched by mask %q", path, mask)
+		return true
+	}
+}
+
+// MaskRegexpFilter is a factory for FilterFuncs that will mask all InodeDelta
+// paths that match any of the given regular expressions. Paths are matched
+// after being cleaned and made relative to '/', so the regular expressions
+// should be written against paths of the form "/usr/lib/foo". Note that (as
+// with regexp.MatchString) a pattern matches if any part of the path matches,
+// so patterns should be anchored if a full match is required.
+func MaskRegexpFilter(patterns []*regexp.Regexp) FilterFunc {
+	return func(path string) bool {
+		path = filepath.Join("/", path)
+		for _, pattern := range patterns {
+			if pattern.MatchString(path) {
+				log.Debugf("maskfilter: ignoring path %q matched by regexp %q", path, pattern.String())
 				return false
 			}
 		}
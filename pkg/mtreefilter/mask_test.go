@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"testing"
 
 	"github.com/vbatts/go-mtree"
@@ -55,6 +56,26 @@ func TestIsParent(t *testing.T) {
 	}
 }
 
+func TestMaskMatch(t *testing.T) {
+	for _, test := range []struct {
+		mask, path string
+		expected   bool
+	}{
+		{"/var/www", "var/www", true},
+		{"var/www", "/var/www/", true},
+		{"/var/www", "var/www/html/index.html", true},
+		{"var/www/", "./var/www/html", true},
+		{"/var/www", "var/wwwroot", false},
+		{"/var/www", "var", false},
+		{"/", "etc/passwd", true},
+	} {
+		got := MaskMatch(test.mask, test.path)
+		if got != test.expected {
+			t.Errorf("MaskMatch(%q, %q) got %v expected %v", test.mask, test.path, got, test.expected)
+		}
+	}
+}
+
 func TestMaskDeltas(t *testing.T) {
 	dir, err := ioutil.TempDir("", "TestMaskDeltas-")
 	if err != nil {
@@ -142,3 +163,85 @@ func TestMaskDeltas(t *testing.T) {
 		}
 	}
 }
+
+func TestMaskRegexpFilter(t *testing.T) {
+	pycache := regexp.MustCompile(`.*/__pycache__/.*`)
+	for _, test := range []struct {
+		path     string
+		expected bool
+	}{
+		{"usr/lib/python3/__pycache__/foo.cpython-36.pyc", false},
+		{"/usr/lib/python3/__pycache__/a/b", false},
+		{"./__pycache__/foo.pyc", false},
+		{"usr/lib/python3/__pycache__", true},
+		{"usr/lib/python3/foo.py", true},
+		{"usr/lib/python3/not__pycache__/foo.pyc", true},
+	} {
+		got := MaskRegexpFilter([]*regexp.Regexp{pycache})(test.path)
+		if got != test.expected {
+			t.Errorf("MaskRegexpFilter(%q)(%q) got %v expected %v", pycache, test.path, got, test.expected)
+		}
+	}
+}
+
+func TestMaskRegexpDeltas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMaskRegexpDeltas-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtreeKeywords := append(mtree.DefaultKeywords, "sha256digest")
+
+	pycache := filepath.Join(dir, "lib", "__pycache__")
+	if err := os.MkdirAll(pycache, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib", "mod.py"), []byte("import os"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pycache, "old.pyc"), []byte("old bytecode"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	originalDh, err := mtree.Walk(dir, nil, mtreeKeywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Modify, add and remove files both inside and outside __pycache__.
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib", "mod.py"), []byte("import sys"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(pycache, "old.pyc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pycache, "mod.pyc"), []byte("new bytecode"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	newDh, err := mtree.Walk(dir, nil, mtreeKeywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := mtree.Compare(originalDh, newDh, mtreeKeywords)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter := MaskRegexpFilter([]*regexp.Regexp{regexp.MustCompile(`.*/__pycache__/.*`)})
+	newDiff := FilterDeltas(diff, filter)
+
+	foundMod := false
+	for _, delta := range newDiff {
+		if MaskMatch("lib/__pycache__/old.pyc", delta.Path()) || MaskMatch("lib/__pycache__/mod.pyc", delta.Path()) {
+			t.Errorf("expected %q (%v) to be masked", delta.Path(), delta.Type())
+		}
+		if delta.Path() == filepath.Join("lib", "mod.py") {
+			foundMod = true
+		}
+	}
+	if !foundMod {
+		t.Errorf("expected lib/mod.py to not be masked: %v", newDiff)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/vbatts/go-mtree"
+)
+
+// DeltaFilterFunc is a function used when filtering deltas with
+// FilterInodeDeltas. Unlike FilterFunc, it has access to the entire delta.
+type DeltaFilterFunc func(delta mtree.InodeDelta) bool
+
+// FilterInodeDeltas is equivalent to FilterDeltas, except that it takes a
+// DeltaFilterFunc. Only entries which have `filter(delta) == true` will be
+// included in the returned slice.
+func FilterInodeDeltas(deltas []mtree.InodeDelta, filter DeltaFilterFunc) []mtree.InodeDelta {
+	var filtered []mtree.InodeDelta
+	for _, delta := range deltas {
+		if filter(delta) {
+			filtered = append(filtered, delta)
+		}
+	}
+	return filtered
+}
+
+// entryModTime returns the modification time of the given entry, using the
+// "time" or "tar_time" keywords. ok is false if the entry has neither.
+func entryModTime(entry *mtree.Entry) (modTime time.Time, ok bool) {
+	for _, kv := range entry.AllKeys() {
+		switch kv.Keyword() {
+		case "time", "tar_time":
+		default:
+			continue
+		}
+		parts := strings.SplitN(kv.Value(), ".", 2)
+		sec, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		var nsec int64
+		if len(parts) == 2 {
+			nsec, err = strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return time.Time{}, false
+			}
+		}
+		return time.Unix(sec, nsec), true
+	}
+	return time.Time{}, false
+}
+
+// SinceFilter is a factory for DeltaFilterFuncs that will only keep the deltas
+// of inodes which were modified after the given time (as determined by the
+// "time" or "tar_time" keyword of the new entry). Deltas for inodes without
+// either keyword are always kept. Deletions have no modification time, so
+// they are only kept if includeDeletions is set.
+func SinceFilter(since time.Time, includeDeletions bool) DeltaFilterFunc {
+	return func(delta mtree.InodeDelta) bool {
+		if delta.Type() == mtree.Missing {
+			return includeDeletions
+		}
+		modTime, ok := entryModTime(delta.New())
+		if !ok {
+			log.Debugf("sincefilter: keeping path %q without modification time", delta.Path())
+			return true
+		}
+		if !modTime.After(since) {
+			log.Debugf("sincefilter: ignoring path %q modified at %s", delta.Path(), modTime)
+			return false
+		}
+		return true
+	}
+}
+
+// TypeFilter is a factory for DeltaFilterFuncs that will only keep the deltas
+// with one of the given types (such as mtree.Missing, to only keep
+// deletions).
+func TypeFilter(types ...mtree.DifferenceType) DeltaFilterFunc {
+	return func(delta mtree.InodeDelta) bool {
+		for _, typ := range types {
+			if delta.Type() == typ {
+				return true
+			}
+		}
+		log.Debugf("typefilter: ignoring path %q with delta type %s", delta.Path(), delta.Type())
+		return false
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vbatts/go-mtree"
+)
+
+func TestSinceFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSinceFilter-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtreeKeywords := []mtree.Keyword{"type", "size", "tar_time", "sha256digest"}
+
+	// Create some files.
+	for _, file := range []string{"old", "new", "deleted"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	originalDh, err := mtree.Walk(dir, nil, mtreeKeywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Modify the files, with the "old" modification happening before the
+	// cutoff and the "new" modification after.
+	since := time.Unix(1500000000, 0)
+	if err := ioutil.WriteFile(filepath.Join(dir, "old"), []byte("old change"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "old"), since, since.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "new"), []byte("new change"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "new"), since, since.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dir, since, since.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	newDh, err := mtree.Walk(dir, nil, mtreeKeywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := mtree.Compare(originalDh, newDh, mtreeKeywords)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		includeDeletions bool
+		expected         []string
+	}{
+		{true, []string{"deleted", "new"}},
+		{false, []string{"new"}},
+	} {
+		var got []string
+		for _, delta := range FilterInodeDeltas(diff, SinceFilter(since, test.includeDeletions)) {
+			got = append(got, delta.Path())
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("SinceFilter(includeDeletions=%v): expected %v, got %v", test.includeDeletions, test.expected, got)
+		}
+	}
+}
+
+func TestTypeFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestTypeFilter-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtreeKeywords := []mtree.Keyword{"type", "size", "sha256digest"}
+
+	for _, file := range []string{"modified", "deleted"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	originalDh, err := mtree.Walk(dir, nil, mtreeKeywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "modified"), []byte("changed contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "added"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+
+	newDh, err := mtree.Walk(dir, nil, mtreeKeywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := mtree.Compare(originalDh, newDh, mtreeKeywords)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		types    []mtree.DifferenceType
+		expected []string
+	}{
+		{[]mtree.DifferenceType{mtree.Missing}, []string{"deleted"}},
+		{[]mtree.DifferenceType{mtree.Modified, mtree.Extra}, []string{"added", "modified"}},
+		{nil, nil},
+	} {
+		var got []string
+		for _, delta := range FilterInodeDeltas(diff, TypeFilter(test.types...)) {
+			got = append(got, delta.Path())
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("TypeFilter(%v): expected %v, got %v", test.types, test.expected, got)
+		}
+	}
+}
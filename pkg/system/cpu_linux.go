@@ -0,0 +1,182 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// cgroupRoot is where cgroupfs is expected to be mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// EffectiveCPUs returns the number of CPUs that the current process can
+// actually make use of. This is runtime.NumCPU() limited by the CPU quota of
+// the cgroup the process is in (both cgroup v1 and v2 are supported), so that
+// callers sizing worker pools don't over-subscribe a container which has been
+// limited to a fraction of the host. The result is always at least 1.
+func EffectiveCPUs() int {
+	ncpu := runtime.NumCPU()
+
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return ncpu
+	}
+	defer f.Close()
+
+	quota, err := cgroupCPUQuota(f, cgroupRoot)
+	if err != nil || quota <= 0 {
+		return ncpu
+	}
+	return limitCPUs(ncpu, quota)
+}
+
+// limitCPUs limits ncpu to the given (fractional) quota of CPUs, rounding the
+// quota up.
+func limitCPUs(ncpu int, quota float64) int {
+	limit := int(math.Ceil(quota))
+	if limit < 1 {
+		limit = 1
+	}
+	if limit < ncpu {
+		return limit
+	}
+	return ncpu
+}
+
+// parseProcCgroup parses the contents of /proc/<pid>/cgroup, returning a map
+// of controller names to cgroup paths. The cgroup v2 unified hierarchy is
+// stored with an empty controller name.
+func parseProcCgroup(r io.Reader) (map[string]string, error) {
+	paths := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[1] == "" {
+			paths[""] = fields[2]
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			paths[controller] = fields[2]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read cgroup list")
+	}
+	return paths, nil
+}
+
+// parseCPUMax parses the contents of the cgroup v2 cpu.max file, returning
+// the quota as a number of CPUs. A quota of 0 means there is no limit.
+func parseCPUMax(data string) (float64, error) {
+	fields := strings.Fields(data)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, errors.Errorf("invalid cpu.max: %q", data)
+	}
+	if fields[0] == "max" {
+		return 0, nil
+	}
+	period := "100000"
+	if len(fields) == 2 {
+		period = fields[1]
+	}
+	return parseCFSQuota(fields[0], period)
+}
+
+// parseCFSQuota converts a CFS quota and period (in microseconds) into a
+// number of CPUs. A negative quota (as used by cgroup v1) means there is no
+// limit, and is returned as 0.
+func parseCFSQuota(quotaStr, periodStr string) (float64, error) {
+	quota, err := strconv.ParseInt(strings.TrimSpace(quotaStr), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "parse cfs quota")
+	}
+	period, err := strconv.ParseInt(strings.TrimSpace(periodStr), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "parse cfs period")
+	}
+	if quota <= 0 || period <= 0 {
+		return 0, nil
+	}
+	return float64(quota) / float64(period), nil
+}
+
+// readCgroupFile reads the given file from the cgroup at path in the
+// hierarchy mounted at mount. If the process's cgroup is not visible (such as
+// inside a container with its own cgroup namespace or a bind-mounted
+// hierarchy), the root of the mount is used instead.
+func readCgroupFile(mount, path, name string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(mount, path, name))
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(filepath.Join(mount, name))
+	}
+	return string(data), err
+}
+
+// cgroupCPUQuota returns the CPU quota (as a number of CPUs) of the cgroup
+// described by procCgroup (the contents of /proc/self/cgroup), with the cgroup
+// hierarchies mounted under root. A quota of 0 means there is no limit.
+func cgroupCPUQuota(procCgroup io.Reader, root string) (float64, error) {
+	paths, err := parseProcCgroup(procCgroup)
+	if err != nil {
+		return 0, err
+	}
+
+	// cgroup v1 has a separate "cpu" hierarchy.
+	if path, ok := paths["cpu"]; ok {
+		for _, mount := range []string{"cpu", "cpu,cpuacct", "cpuacct,cpu"} {
+			mount = filepath.Join(root, mount)
+			quota, err := readCgroupFile(mount, path, "cpu.cfs_quota_us")
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return 0, errors.Wrap(err, "read cfs quota")
+			}
+			period, err := readCgroupFile(mount, path, "cpu.cfs_period_us")
+			if err != nil {
+				return 0, errors.Wrap(err, "read cfs period")
+			}
+			return parseCFSQuota(quota, period)
+		}
+	}
+
+	// cgroup v2 has a single unified hierarchy.
+	if path, ok := paths[""]; ok {
+		data, err := readCgroupFile(root, path, "cpu.max")
+		if os.IsNotExist(err) {
+			return 0, nil
+		} else if err != nil {
+			return 0, errors.Wrap(err, "read cpu.max")
+		}
+		return parseCPUMax(data)
+	}
+	return 0, nil
+}
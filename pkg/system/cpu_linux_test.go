@@ -0,0 +1,178 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCPUMax(t *testing.T) {
+	for _, test := range []struct {
+		data  string
+		quota float64
+		fail  bool
+	}{
+		{"max 100000\n", 0, false},
+		{"200000 100000\n", 2, false},
+		{"150000 100000", 1.5, false},
+		{"50000", 0.5, false},
+		{"", 0, true},
+		{"foo 100000", 0, true},
+		{"1 2 3", 0, true},
+	} {
+		quota, err := parseCPUMax(test.data)
+		if test.fail {
+			if err == nil {
+				t.Errorf("expected error parsing %q", test.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %+v", test.data, err)
+			continue
+		}
+		if quota != test.quota {
+			t.Errorf("parsing %q: expected quota %v, got %v", test.data, test.quota, quota)
+		}
+	}
+}
+
+func TestLimitCPUs(t *testing.T) {
+	for _, test := range []struct {
+		ncpu     int
+		quota    float64
+		expected int
+	}{
+		{8, 2, 2},
+		{8, 1.5, 2},
+		{8, 0.1, 1},
+		{4, 16, 4},
+		{4, 4, 4},
+	} {
+		if got := limitCPUs(test.ncpu, test.quota); got != test.expected {
+			t.Errorf("limitCPUs(%d, %v): expected %d, got %d", test.ncpu, test.quota, test.expected, got)
+		}
+	}
+}
+
+func writeCgroupFiles(t *testing.T, root string, files map[string]string) {
+	for path, data := range files {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCgroupCPUQuota(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		procCgroup string
+		files      map[string]string
+		quota      float64
+	}{
+		{
+			name:       "v2",
+			procCgroup: "0::/user.slice/ci.scope\n",
+			files: map[string]string{
+				"user.slice/ci.scope/cpu.max": "200000 100000\n",
+			},
+			quota: 2,
+		},
+		{
+			name:       "v2-unlimited",
+			procCgroup: "0::/user.slice/ci.scope\n",
+			files: map[string]string{
+				"user.slice/ci.scope/cpu.max": "max 100000\n",
+			},
+			quota: 0,
+		},
+		{
+			name:       "v2-namespaced",
+			procCgroup: "0::/\n",
+			files: map[string]string{
+				"cpu.max": "300000 100000\n",
+			},
+			quota: 3,
+		},
+		{
+			name:       "v2-no-controller",
+			procCgroup: "0::/user.slice\n",
+			files:      map[string]string{},
+			quota:      0,
+		},
+		{
+			name:       "v1",
+			procCgroup: "12:memory:/docker/abc\n4:cpu,cpuacct:/docker/abc\n1:name=systemd:/docker/abc\n",
+			files: map[string]string{
+				"cpu,cpuacct/docker/abc/cpu.cfs_quota_us":  "150000\n",
+				"cpu,cpuacct/docker/abc/cpu.cfs_period_us": "100000\n",
+			},
+			quota: 1.5,
+		},
+		{
+			name:       "v1-bind-mounted",
+			procCgroup: "4:cpu,cpuacct:/docker/abc\n",
+			files: map[string]string{
+				"cpu/cpu.cfs_quota_us":  "400000\n",
+				"cpu/cpu.cfs_period_us": "100000\n",
+			},
+			quota: 4,
+		},
+		{
+			name:       "v1-unlimited",
+			procCgroup: "4:cpu,cpuacct:/\n",
+			files: map[string]string{
+				"cpu,cpuacct/cpu.cfs_quota_us":  "-1\n",
+				"cpu,cpuacct/cpu.cfs_period_us": "100000\n",
+			},
+			quota: 0,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "umoci-system.TestCgroupCPUQuota")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			writeCgroupFiles(t, root, test.files)
+
+			quota, err := cgroupCPUQuota(strings.NewReader(test.procCgroup), root)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if quota != test.quota {
+				t.Errorf("expected quota %v, got %v", test.quota, quota)
+			}
+		})
+	}
+}
+
+func TestEffectiveCPUs(t *testing.T) {
+	if ncpu := EffectiveCPUs(); ncpu < 1 {
+		t.Errorf("EffectiveCPUs returned invalid value %d", ncpu)
+	}
+}
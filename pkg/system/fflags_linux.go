@@ -0,0 +1,66 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Linux inode flags, as described in ioctl_iflags(2). Only the flags which
+// are meaningful to store in an image are listed here.
+const (
+	FileFlagImmutable uint32 = 0x00000010 // FS_IMMUTABLE_FL
+	FileFlagAppend    uint32 = 0x00000020 // FS_APPEND_FL
+	FileFlagNoDump    uint32 = 0x00000040 // FS_NODUMP_FL
+	FileFlagNoAtime   uint32 = 0x00000080 // FS_NOATIME_FL
+)
+
+// The FS_IOC_[GS]ETFLAGS ioctls are defined as taking a long (even though the
+// kernel actually uses an int), so their numbers depend on the size of a long.
+// golang.org/x/sys/unix doesn't define them, so we compute them using the
+// asm-generic _IOR and _IOW encodings.
+var (
+	fsIocGetFlags = uintptr(2<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 1)
+	fsIocSetFlags = uintptr(1<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 2)
+)
+
+// GetFileFlags returns the inode flags of the given file, using the
+// FS_IOC_GETFLAGS ioctl.
+func GetFileFlags(fh *os.File) (uint32, error) {
+	var flags uint32
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fh.Fd(), fsIocGetFlags, uintptr(unsafe.Pointer(&flags)))
+	if errno != 0 {
+		return 0, errors.Wrapf(os.NewSyscallError("ioctl(FS_IOC_GETFLAGS)", errno), "get flags of %s", fh.Name())
+	}
+	return flags, nil
+}
+
+// SetFileFlags sets the inode flags of the given file, using the
+// FS_IOC_SETFLAGS ioctl. Setting FileFlagImmutable or FileFlagAppend
+// requires CAP_LINUX_IMMUTABLE.
+func SetFileFlags(fh *os.File, flags uint32) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fh.Fd(), fsIocSetFlags, uintptr(unsafe.Pointer(&flags)))
+	if errno != 0 {
+		return errors.Wrapf(os.NewSyscallError("ioctl(FS_IOC_SETFLAGS)", errno), "set flags of %s", fh.Name())
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// maxPathChunk is the maximum length of the path we will pass to a single
+// openat(2) call when resolving a long path. It is well below PATH_MAX so
+// that we never hit ENAMETOOLONG while walking.
+const maxPathChunk = 2048
+
+// OpenParent opens the parent directory of the given path, by resolving the
+// path one chunk at a time with openat(2) rather than passing the whole path
+// to the kernel (which would fail with ENAMETOOLONG if the path is longer
+// than PATH_MAX). It returns an O_PATH handle to the parent directory and the
+// final component of the path. Note that symlinks in the parent components
+// are followed, as with any other path lookup.
+func OpenParent(path string) (*os.File, string, error) {
+	path = filepath.Clean(path)
+	dir, base := filepath.Split(path)
+	if base == "" || base == "." || base == ".." {
+		return nil, "", errors.Errorf("open parent: invalid path %s", path)
+	}
+
+	dirfd := unix.AT_FDCWD
+	if filepath.IsAbs(dir) {
+		dir = strings.TrimPrefix(dir, "/")
+		fd, err := unix.Open("/", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, "", &os.PathError{Op: "open", Path: "/", Err: err}
+		}
+		dirfd = fd
+	}
+
+	components := strings.Split(strings.Trim(dir, "/"), "/")
+	for len(components) > 0 && components[0] != "" {
+		// Take as many components as will fit in a single chunk. A single
+		// component can never be longer than NAME_MAX, so this always makes
+		// progress.
+		n, size := 0, 0
+		for n < len(components) && (n == 0 || size+len(components[n])+1 <= maxPathChunk) {
+			size += len(components[n]) + 1
+			n++
+		}
+		chunk := strings.Join(components[:n], "/")
+		components = components[n:]
+
+		fd, err := unix.Openat(dirfd, chunk, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if dirfd != unix.AT_FDCWD {
+			unix.Close(dirfd)
+		}
+		if err != nil {
+			return nil, "", &os.PathError{Op: "openat", Path: chunk, Err: err}
+		}
+		dirfd = fd
+	}
+
+	if dirfd == unix.AT_FDCWD {
+		fd, err := unix.Open(".", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, "", &os.PathError{Op: "open", Path: ".", Err: err}
+		}
+		dirfd = fd
+	}
+	return os.NewFile(uintptr(dirfd), dir), base, nil
+}
+
+// ProcSelfFdPath returns a path through /proc/self/fd that refers to the
+// given name inside the directory referenced by dir. The returned path is
+// short, regardless of how long the original path of dir was, so it can be
+// passed to syscalls which don't have an *at(2) equivalent (such as
+// lsetxattr(2)). dir must remain open while the returned path is in use.
+func ProcSelfFdPath(dir *os.File, name string) string {
+	return filepath.Join("/proc/self/fd", strconv.Itoa(int(dir.Fd())), name)
+}
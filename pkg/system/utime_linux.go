@@ -53,3 +53,18 @@ func Lutimes(path string, atime, mtime time.Time) error {
 	}
 	return nil
 }
+
+// LutimesAt is equivalent to Lutimes, except that the path is resolved
+// relative to the given directory (which may have been opened with O_PATH).
+func LutimesAt(dir *os.File, name string, atime, mtime time.Time) error {
+	times := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+
+	err := unix.UtimesNanoAt(int(dir.Fd()), name, times, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return &os.PathError{Op: "lutimes", Path: filepath.Join(dir.Name(), name), Err: err}
+	}
+	return nil
+}
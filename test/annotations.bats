@@ -0,0 +1,94 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci annotations --format=json" {
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --manifest.annotation "com.example.key=value" --config.label "com.example.label=label"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci annotations --image "${IMAGE}:${TAG}-new" --format json
+	[ "$status" -eq 0 ]
+
+	annotationsFile="$(setup_tmpdir)/annotations"
+	echo "$output" > "$annotationsFile"
+
+	sane_run jq -SMr '.manifest["com.example.key"]' "$annotationsFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "value" ]]
+
+	sane_run jq -SMr '.config["com.example.label"]' "$annotationsFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "label" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci annotations --diff" {
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-a" --manifest.annotation "com.example.changed=old" --manifest.annotation "com.example.removed=gone"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-b" --manifest.annotation "com.example.changed=new" --manifest.annotation "com.example.added=here"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci annotations --image "${IMAGE}:${TAG}-a" --diff "${TAG}-b" --format json
+	[ "$status" -eq 0 ]
+
+	diffFile="$(setup_tmpdir)/diff"
+	echo "$output" > "$diffFile"
+
+	sane_run jq -SMr '.added[] | select(.key == "com.example.added") | .new' "$diffFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "here" ]]
+
+	sane_run jq -SMr '.changed[] | select(.key == "com.example.changed") | .old + "->" + .new' "$diffFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "old->new" ]]
+
+	sane_run jq -SMr '.removed[] | select(.key == "com.example.removed") | .old' "$diffFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "gone" ]]
+
+	# The smoke test of the human-readable output.
+	umoci annotations --image "${IMAGE}:${TAG}-a" --diff "${TAG}-b"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep '^+ manifest com.example.added=here'
+	echo "$output" | grep '^- manifest com.example.removed=gone'
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci annotations [missing args]" {
+	umoci annotations
+	[ "$status" -ne 0 ]
+
+	umoci annotations --image "${IMAGE}:${TAG}" --format yaml
+	[ "$status" -ne 0 ]
+}
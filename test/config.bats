@@ -380,6 +380,7 @@ function teardown() {
 
 @test "umoci config --config.env" {
 	BUNDLE="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
 
 	# Modify env.
 	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.env "VARIABLE1=unused"
@@ -410,6 +411,22 @@ function teardown() {
 	[[ "$VARIABLE1" == "test" ]]
 	[[ "$VARIABLE2" == "what" ]]
 
+	# Setting an existing variable must not move it.
+	umoci config --image "${IMAGE}:${TAG}-new" --tag "${TAG}-new2" --config.env "VARIABLE1=again"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-new2" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	sane_run jq -SMr '.process.env[]' "$BUNDLE_B/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$(grep -n '^VARIABLE1=' <<<"$output")" == *":VARIABLE1=again" ]]
+	var1="$(grep -n '^VARIABLE1=' <<<"$output" | cut -d: -f1)"
+	var2="$(grep -n '^VARIABLE2=' <<<"$output" | cut -d: -f1)"
+	[ "$var1" -lt "$var2" ]
+
 	image-verify "${IMAGE}"
 }
 
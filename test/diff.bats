@@ -0,0 +1,67 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci diff" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# An image has no differences to itself.
+	umoci diff --image "${IMAGE}:${TAG}" "${TAG}"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Add a file and change the configuration.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}-new" --config.env "NEWVAR=value"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci diff --image "${IMAGE}:${TAG}" --json "${TAG}-new"
+	[ "$status" -eq 0 ]
+	diff="$(tail -n1 <<<"$output")"
+
+	# Only the new file must be reported.
+	sane_run jq -SMr '.paths[] | "\(.type) \(.path)"' <<<"$diff"
+	[ "$status" -eq 0 ]
+	[ "$output" = "added newfile" ]
+	sane_run jq -SMr '.config[] | "\(.type) \(.field) \(.key) \(.new)"' <<<"$diff"
+	[ "$status" -eq 0 ]
+	[ "$output" = "added env NEWVAR value" ]
+
+	# Unknown tags must fail.
+	umoci diff --image "${IMAGE}:${TAG}" "${TAG}-nonexistent"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
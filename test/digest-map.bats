@@ -0,0 +1,63 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci digest-map" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci digest-map --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	digestMap="$(setup_tmpdir)/digest-map"
+	echo "$output" > "$digestMap"
+
+	# The digests must match the contents of the unpacked rootfs.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	expected="$(setup_tmpdir)/expected"
+	(cd "$BUNDLE/rootfs" && find . -type f -printf '%P\n' | sort | while read -r path; do
+		echo "$path sha256:$(sha256sum "$path" | cut -d' ' -f1)"
+	done) > "$expected"
+	sane_run jq -SMr 'to_entries | .[] | "\(.key) \(.value)"' "$digestMap"
+	[ "$status" -eq 0 ]
+	[[ "$(sort <<<"$output")" == "$(cat "$expected")" ]]
+
+	# Changes made by repack must be reflected in the digest map.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	chmod +w "$BUNDLE/rootfs/etc/." && rm -f "$BUNDLE/rootfs/etc/passwd"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	umoci digest-map --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.newfile' <<<"$output")" == "sha256:$(echo "new file" | sha256sum | cut -d' ' -f1)" ]]
+	[[ "$(jq -SMr '.["etc/passwd"]' <<<"$output")" == "null" ]]
+
+	image-verify "${IMAGE}"
+}
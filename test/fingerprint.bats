@@ -0,0 +1,95 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci fingerprint" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci fingerprint --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == sha256:* ]]
+	original="$output"
+
+	# The fingerprint must be stable.
+	umoci fingerprint --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$original" ]]
+
+	# Creation timestamps are ignored by default.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-a" --created "2010-01-01T00:00:00Z" --history.created "2010-01-01T00:00:00Z" --manifest.annotation "org.opencontainers.image.created=2010-01-01T00:00:00Z"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-b" --created "2020-01-01T00:00:00Z" --history.created "2020-01-01T00:00:00Z" --manifest.annotation "org.opencontainers.image.created=2020-01-01T00:00:00Z"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci fingerprint --image "${IMAGE}:${TAG}-a"
+	[ "$status" -eq 0 ]
+	fingerprintA="$output"
+	umoci fingerprint --image "${IMAGE}:${TAG}-b"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$fingerprintA" ]]
+
+	# ... unless --include-created is given.
+	umoci fingerprint --image "${IMAGE}:${TAG}-a" --include-created
+	[ "$status" -eq 0 ]
+	createdA="$output"
+	umoci fingerprint --image "${IMAGE}:${TAG}-b" --include-created
+	[ "$status" -eq 0 ]
+	[[ "$output" != "$createdA" ]]
+
+	# Annotations are included unless they are excluded.
+	umoci config --image "${IMAGE}:${TAG}-a" --tag "${TAG}-c" --history.created "2010-01-01T00:00:00Z" --manifest.annotation "org.example.build-id=1234"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}-a" --tag "${TAG}-d" --history.created "2010-01-01T00:00:00Z" --manifest.annotation "org.example.build-id=5678"
+	[ "$status" -eq 0 ]
+	umoci fingerprint --image "${IMAGE}:${TAG}-c"
+	[ "$status" -eq 0 ]
+	fingerprintC="$output"
+	umoci fingerprint --image "${IMAGE}:${TAG}-d"
+	[ "$status" -eq 0 ]
+	[[ "$output" != "$fingerprintC" ]]
+	umoci fingerprint --image "${IMAGE}:${TAG}-c" --exclude-annotation org.example.build-id
+	[ "$status" -eq 0 ]
+	fingerprintC="$output"
+	umoci fingerprint --image "${IMAGE}:${TAG}-d" --exclude-annotation org.example.build-id
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$fingerprintC" ]]
+
+	# Changing the contents of the image changes the fingerprint.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci fingerprint --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	[[ "$output" != "$original" ]]
+}
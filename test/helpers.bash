@@ -43,6 +43,11 @@ function requires() {
 					skip "test requires ${var}"
 				fi
 				;;
+			mksquashfs)
+				if ! command -v mksquashfs >/dev/null; then
+					skip "test requires ${var}"
+				fi
+				;;
 			*)
 				fail "BUG: Invalid requires ${var}."
 				;;
@@ -79,7 +84,7 @@ function umoci() {
 	args+=("$1")
 
 	# We're rootless if we're asked to unpack something.
-	if [[ "$ROOTLESS" != 0 && "$1" == "unpack" ]]; then
+	if [[ "$ROOTLESS" != 0 && ( "$1" == "unpack" || "$1" == "unpack-layers" ) ]]; then
 		args+=("--rootless")
 	fi
 
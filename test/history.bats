@@ -0,0 +1,79 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci history --format=json" {
+	image-verify "${IMAGE}"
+
+	umoci history --image "${IMAGE}:${TAG}" --format json
+	[ "$status" -eq 0 ]
+	historyJSON="$output"
+
+	# The entries must match the image history.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SM '[.history[] | .created_by]' <<<"$output")" == "$(jq -SM '[.[] | .created_by]' <<<"$historyJSON")" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci history --format=dockerfile" {
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --history.created_by '/bin/sh -c #(nop)  ENV PATH=/usr/bin' --history.comment "set the path"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}-new" --history.created_by '/bin/sh -c #(nop) COPY file:abcdef in /srv '
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}-new" --history.created_by '|1 VERSION=1.0 /bin/sh -c make install'
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}-new" --history.created_by 'WORKDIR /srv # buildkit'
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}-new" --history.created_by 'some custom build step'
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci history --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	[[ "$(head -n3 <<<"$output" | tail -n1)" == "FROM scratch" ]]
+	grep -Fx '# set the path' <<<"$output"
+	grep -Fx 'ENV PATH=/usr/bin' <<<"$output"
+	grep -Fx 'COPY file:abcdef /srv' <<<"$output"
+	grep -Fx 'RUN VERSION=1.0 make install' <<<"$output"
+	grep -Fx 'WORKDIR /srv' <<<"$output"
+	grep -Fx '# unknown instruction (empty layer): some custom build step' <<<"$output"
+
+	# The default format is dockerfile.
+	dockerfile="$output"
+	umoci history --image "${IMAGE}:${TAG}-new" --format dockerfile
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$dockerfile" ]]
+
+	# Unknown formats must be rejected.
+	umoci history --image "${IMAGE}:${TAG}-new" --format xml
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
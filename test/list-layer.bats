@@ -0,0 +1,62 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci list-layer" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Add a file and remove another, so the new layer has a whiteout.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	chmod +w "$BUNDLE/rootfs/etc/." && rm -f "$BUNDLE/rootfs/etc/passwd"
+	# The summary is the last line of output (logs go to stderr).
+	umoci repack --image "${IMAGE}:${TAG}-new" --json "$BUNDLE"
+	[ "$status" -eq 0 ]
+	layer="$(tail -n1 <<<"$output" | jq -SMr '.layers[0].digest')"
+	image-verify "${IMAGE}"
+
+	umoci list-layer --layout "${IMAGE}" "$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"newfile"* ]]
+	[[ "$output" == *"[whiteout] etc/passwd"* ]]
+
+	umoci list-layer --layout "${IMAGE}" --json "$layer"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.[] | select(.path == "newfile") | .type' <<<"$output"
+	[ "$status" -eq 0 ]
+	[ "$output" = "file" ]
+
+	# Blobs which don't exist must fail.
+	umoci list-layer --layout "${IMAGE}" "sha256:$(echo "missing" | sha256sum | cut -d' ' -f1)"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
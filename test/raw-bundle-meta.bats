@@ -0,0 +1,83 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci raw bundle-meta" {
+	BUNDLE="$(setup_tmpdir)"
+	FILE="$(setup_tmpdir)/file"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# There are no metadata files to start with.
+	umoci raw bundle-meta "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Add some metadata files.
+	echo "some metadata" > "$FILE"
+	umoci raw bundle-meta --add "first=$FILE" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci raw bundle-meta --add second=- "$BUNDLE" <<<"other metadata"
+	[ "$status" -eq 0 ]
+
+	umoci raw bundle-meta "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	[[ "${lines[0]}" == "first" ]]
+	[[ "${lines[1]}" == "second" ]]
+
+	umoci raw bundle-meta --extract first "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "some metadata" ]]
+
+	# The metadata must survive a repack with --refresh-bundle.
+	touch "$BUNDLE/rootfs/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-new" --refresh-bundle "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci raw bundle-meta --extract second "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "other metadata" ]]
+
+	# Remove one of the files.
+	umoci raw bundle-meta --remove first "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci raw bundle-meta "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[[ "${lines[0]}" == "second" ]]
+
+	# Invalid names are rejected.
+	umoci raw bundle-meta --add "../escape=$FILE" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci raw bundle-meta --extract missing "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
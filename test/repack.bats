@@ -724,3 +724,959 @@ function teardown() {
 	[ "$numLinesB" -gt "$numLinesA" ]
 	[ "$numLinesC" -gt "$numLinesB" ]
 }
+
+@test "umoci repack --max-file-size" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Create a small and a large file.
+	echo "small file" > "$BUNDLE_A/rootfs/smallfile"
+	dd if=/dev/zero of="$BUNDLE_A/rootfs/largefile" bs=1K count=2048
+
+	# Invalid sizes and policies must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-new" --max-file-size "not a size" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-new" --max-file-size 1MB --max-file-size-policy "bad" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	# By default, repacking with a large file must fail.
+	umoci repack --image "${IMAGE}:${TAG}-new" --max-file-size 1MB "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -ne 0 ]
+
+	# With the skip policy, the large file is left out.
+	umoci repack --image "${IMAGE}:${TAG}-new" --max-file-size 1MB --max-file-size-policy skip "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	[ -f "$BUNDLE_B/rootfs/smallfile" ]
+	! [ -e "$BUNDLE_B/rootfs/largefile" ]
+}
+
+@test "umoci repack --layer-cache-dir" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	CACHE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image twice.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# Make the same change to both bundles.
+	echo "cached file" > "$BUNDLE_A/rootfs/newfile"
+	echo "cached file" > "$BUNDLE_B/rootfs/newfile"
+	touch -d "2017-01-01T00:00:00Z" "$BUNDLE_A/rootfs/newfile" "$BUNDLE_B/rootfs/newfile" "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+
+	# The first repack populates the cache.
+	umoci repack --image "${IMAGE}:${TAG}-a" --layer-cache-dir "$CACHE" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	sane_run find "$CACHE/keys" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+
+	# The second repack uses the cache, and produces the same layer.
+	umoci --log=info repack --image "${IMAGE}:${TAG}-b" --layer-cache-dir "$CACHE" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"using cached layer"* ]]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-a" --json
+	[ "$status" -eq 0 ]
+	layerA="$(jq -SMr '.history[-1].layer.digest' <<<"$output")"
+	umoci stat --image "${IMAGE}:${TAG}-b" --json
+	[ "$status" -eq 0 ]
+	layerB="$(jq -SMr '.history[-1].layer.digest' <<<"$output")"
+	[ "$layerA" = "$layerB" ]
+}
+
+@test "umoci repack --changes-out" {
+	BUNDLE="$(setup_tmpdir)"
+	CHANGES="$(setup_tmpdir)/changes.json"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Add, modify and delete some files (and make a masked change).
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	chmod +w "$BUNDLE/rootfs/etc/." && echo "modified" >> "$BUNDLE/rootfs/etc/passwd"
+	rm -f "$BUNDLE/rootfs/etc/group"
+	mkdir -p "$BUNDLE/rootfs/masked" && touch "$BUNDLE/rootfs/masked/file"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --mask-path /masked --changes-out "$CHANGES" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.[] | select(.path == "newfile") | .type' "$CHANGES"
+	[ "$status" -eq 0 ]
+	[ "$output" = "added" ]
+	sane_run jq -SMr '.[] | select(.path == "etc/passwd") | .type' "$CHANGES"
+	[ "$status" -eq 0 ]
+	[ "$output" = "modified" ]
+	sane_run jq -SMr '.[] | select(.path == "etc/group") | .type' "$CHANGES"
+	[ "$status" -eq 0 ]
+	[ "$output" = "deleted" ]
+
+	# Masked paths are not included.
+	sane_run jq -SMr '.[] | select(.path | startswith("masked")) | .path' "$CHANGES"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+}
+
+@test "umoci repack --mask-regex" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Create some Python bytecode caches as well as a normal file.
+	mkdir -p "$BUNDLE_A/rootfs/usr/lib/pymod/__pycache__"
+	echo "import os" > "$BUNDLE_A/rootfs/usr/lib/pymod/mod.py"
+	echo "bytecode" > "$BUNDLE_A/rootfs/usr/lib/pymod/__pycache__/mod.pyc"
+	mkdir -p "$BUNDLE_A/rootfs/__pycache__/nested"
+	echo "bytecode" > "$BUNDLE_A/rootfs/__pycache__/nested/other.pyc"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --mask-regex '.*/__pycache__/.*' "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# The unmasked file must be included.
+	[ -f "$BUNDLE_B/rootfs/usr/lib/pymod/mod.py" ]
+	[[ "$(cat "$BUNDLE_B/rootfs/usr/lib/pymod/mod.py")" == "import os" ]]
+
+	# But nothing inside __pycache__ should be.
+	! [ -e "$BUNDLE_B/rootfs/usr/lib/pymod/__pycache__/mod.pyc" ]
+	! [ -e "$BUNDLE_B/rootfs/__pycache__/nested" ]
+
+	# Invalid regular expressions must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-new" --mask-regex '(unclosed' "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [created annotation]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# manifest_created prints the created annotation of the given tag.
+	manifest_created() {
+		manifest="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$1"'") | .digest' "$IMAGE/index.json")"
+		jq -r '.annotations["org.opencontainers.image.created"] // "<none>"' "$IMAGE/blobs/${manifest/://}"
+	}
+
+	# --history.created is used for the annotation.
+	echo "file a" > "$BUNDLE/rootfs/a"
+	umoci repack --image "${IMAGE}:${TAG}-a" --history.created "2017-05-04T12:34:56+02:00" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[ "$(manifest_created "${TAG}-a")" = "2017-05-04T10:34:56Z" ]
+
+	# As is SOURCE_DATE_EPOCH.
+	export SOURCE_DATE_EPOCH=1500000000
+	umoci repack --image "${IMAGE}:${TAG}-b" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[ "$(manifest_created "${TAG}-b")" = "2017-07-14T02:40:00Z" ]
+	umoci stat --image "${IMAGE}:${TAG}-b" --json
+	[ "$status" -eq 0 ]
+	[ "$(jq -SMr '.history[-1].created' <<<"$output")" = "2017-07-14T02:40:00Z" ]
+
+	# An invalid SOURCE_DATE_EPOCH must be rejected.
+	export SOURCE_DATE_EPOCH=yesterday
+	umoci repack --image "${IMAGE}:${TAG}-b" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	unset SOURCE_DATE_EPOCH
+
+	# The value can be overridden.
+	umoci repack --image "${IMAGE}:${TAG}-c" --created-annotation "2020-01-02T03:04:05Z" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[ "$(manifest_created "${TAG}-c")" = "2020-01-02T03:04:05Z" ]
+
+	# ... or omitted.
+	umoci repack --image "${IMAGE}:${TAG}-c" --no-created-annotation "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[ "$(manifest_created "${TAG}-c")" = "<none>" ]
+
+	umoci repack --image "${IMAGE}:${TAG}-d" --created-annotation "2020-01-02T03:04:05Z" --no-created-annotation "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-d" --created-annotation "not a date" "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --verify-bundle" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The digest of the mtree manifest must be recorded.
+	sane_run jq -SMr '.mtree_digest' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "sha256:"* ]]
+	[ "$(sha256sum "$BUNDLE"/*.mtree | cut -d' ' -f1)" = "${output#sha256:}" ]
+
+	# An unmodified bundle verifies fine.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-new" --verify-bundle --refresh-bundle "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The refreshed metadata must also verify.
+	echo "another file" > "$BUNDLE/rootfs/anotherfile"
+	umoci repack --image "${IMAGE}:${TAG}-new2" --verify-bundle "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Modify the mtree manifest behind umoci's back.
+	chmod +w "$BUNDLE"/*.mtree
+	echo "newfile type=file size=9 mode=0644" >> "$BUNDLE"/*.mtree
+
+	umoci repack --image "${IMAGE}:${TAG}-new3" --verify-bundle "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"has been modified"* ]]
+	image-verify "${IMAGE}"
+
+	# The tag must not have been created.
+	umoci stat --image "${IMAGE}:${TAG}-new3"
+	[ "$status" -ne 0 ]
+
+	# --verify-bundle doesn't make sense with --from-scratch.
+	umoci repack --image "${IMAGE}:${TAG}-new3" --verify-bundle --from-scratch "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --digest-cache" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# The first repack creates the cache.
+	echo "new file" > "$BUNDLE_A/rootfs/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-new" --digest-cache "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[ -f "$BUNDLE_A/umoci-digests.json" ]
+
+	# The cache must contain the digest of the new file.
+	sane_run jq -SMr '.entries["newfile"].sha256' "$BUNDLE_A/umoci-digests.json"
+	[ "$status" -eq 0 ]
+	[ "$output" = "$(sha256sum "$BUNDLE_A/rootfs/newfile" | cut -d' ' -f1)" ]
+
+	# Modifications must still be detected with a populated cache.
+	echo "modified file" > "$BUNDLE_A/rootfs/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-new2" --digest-cache --refresh-bundle "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-new2" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[ "$(cat "$BUNDLE_B/rootfs/newfile")" = "modified file" ]
+
+	# An unchanged bundle produces an empty layer.
+	umoci repack --image "${IMAGE}:${TAG}-new3" --digest-cache "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new3" --json
+	[ "$status" -eq 0 ]
+	numLinesA="$(echo "$output" | jq -SMr '.history | length')"
+	umoci stat --image "${IMAGE}:${TAG}-new2" --json
+	[ "$status" -eq 0 ]
+	numLinesB="$(echo "$output" | jq -SMr '.history | length')"
+	[ "$numLinesA" -eq "$((numLinesB + 1))" ]
+
+	# A corrupt cache is ignored.
+	echo "garbage" > "$BUNDLE_A/umoci-digests.json"
+	umoci repack --image "${IMAGE}:${TAG}-new4" --digest-cache "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --max-layer-size" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayersA="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')"
+
+	# Add a large diff, which should be split into (at least) three layers.
+	mkdir "$BUNDLE_A/rootfs/big"
+	for i in $(seq 1 6); do
+		head -c 300000 /dev/urandom > "$BUNDLE_A/rootfs/big/file$i"
+	done
+
+	# --dry-run reports the size of each layer.
+	umoci repack --image "${IMAGE}:${TAG}-new" --max-layer-size 700KB --dry-run "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	[ "$(grep -c "^estimated size of layer" <<<"$output")" -ge 3 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --max-layer-size 700KB "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	numLayersB="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')"
+	[ "$numLayersB" -ge "$((numLayersA + 3))" ]
+
+	# The split layers must produce the same rootfs.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	for i in $(seq 1 6); do
+		cmp "$BUNDLE_A/rootfs/big/file$i" "$BUNDLE_B/rootfs/big/file$i"
+	done
+
+	# Invalid sizes are rejected.
+	umoci repack --image "${IMAGE}:${TAG}-new2" --max-layer-size 0 "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-new2" --max-layer-size invalid "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --max-layers" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayersA="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')"
+
+	# A diff which --max-layer-size alone would split into at least three layers.
+	mkdir "$BUNDLE_A/rootfs/big"
+	for i in $(seq 1 6); do
+		head -c 300000 /dev/urandom > "$BUNDLE_A/rootfs/big/file$i"
+	done
+
+	# --max-layers takes precedence, raising the size of each layer.
+	umoci repack --image "${IMAGE}:${TAG}-new" --max-layer-size 700KB --max-layers 2 --dry-run "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	[ "$(grep -c "^estimated size of layer .*/2:" <<<"$output")" -eq 2 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --max-layer-size 700KB --max-layers 2 "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	numLayersB="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')"
+	[ "$numLayersB" -eq "$((numLayersA + 2))" ]
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	for i in $(seq 1 6); do
+		cmp "$BUNDLE_A/rootfs/big/file$i" "$BUNDLE_B/rootfs/big/file$i"
+	done
+
+	# --max-layers requires --max-layer-size, and must be positive.
+	umoci repack --image "${IMAGE}:${TAG}-new2" --max-layers 2 "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-new2" --max-layer-size 700KB --max-layers 0 "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --dry-run" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Add, modify and delete some files (and make a masked change).
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	chmod +w "$BUNDLE/rootfs/etc/." && echo "modified" >> "$BUNDLE/rootfs/etc/passwd"
+	rm -f "$BUNDLE/rootfs/etc/group"
+	mkdir -p "$BUNDLE/rootfs/masked" && touch "$BUNDLE/rootfs/masked/file"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	blobs="$output"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --mask-path /masked --dry-run "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep -qx $'added\tnewfile'
+	echo "$output" | grep -qx $'modified\tetc/passwd'
+	echo "$output" | grep -qx $'deleted\tetc/group'
+	! echo "$output" | grep -q "masked"
+	echo "$output" | grep -q "^estimated layer size: [0-9]* bytes"
+
+	# The changes are sorted by path.
+	paths="$(echo "$output" | grep -v "^estimated" | cut -f2)"
+	[ "$paths" = "$(echo "$paths" | LC_ALL=C sort)" ]
+
+	# Nothing was written to the image.
+	image-verify "${IMAGE}"
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -ne 0 ]
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "$output" = "$blobs" ]
+
+	# Incompatible options.
+	umoci repack --image "${IMAGE}:${TAG}-new" --dry-run --refresh-bundle "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --json" {
+	BUNDLE="$(setup_tmpdir)"
+	SUMMARY="$(setup_tmpdir)/summary.json"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+
+	# The summary is the last line of output (logs go to stderr).
+	umoci repack --image "${IMAGE}:${TAG}-new" --json "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "$output" | tail -n1 > "$SUMMARY"
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.tag' "$SUMMARY"
+	[ "$status" -eq 0 ]
+	[ "$output" = "${TAG}-new" ]
+	sane_run jq -SMr '.layers | length' "$SUMMARY"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 1 ]
+	sane_run jq -SMr '.bytes_written > 0 and .duration >= 0' "$SUMMARY"
+	[ "$status" -eq 0 ]
+	[ "$output" = "true" ]
+
+	# The digests must match the new image.
+	manifest="$(jq -SMr '.manifest.digest' "$SUMMARY")"
+	layer="$(jq -SMr '.layers[0].digest' "$SUMMARY")"
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[ -f "$IMAGE/blobs/${manifest/://}" ]
+	sane_run jq -SMr '.layers[-1].digest' "$IMAGE/blobs/${manifest/://}"
+	[ "$status" -eq 0 ]
+	[ "$output" = "$layer" ]
+}
+
+@test "umoci repack --verify-reproducible" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Add and modify some files.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	mkdir -p "$BUNDLE/rootfs/newdir" && echo "another file" > "$BUNDLE/rootfs/newdir/file"
+	chmod +w "$BUNDLE/rootfs/etc/." && echo "modified" >> "$BUNDLE/rootfs/etc/passwd"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --verify-reproducible "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The layer must be the same as one generated without verification.
+	umoci repack --image "${IMAGE}:${TAG}-noverify" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	layerA="$(jq -SMr '.history[-1].diff_id' <<<"$output")"
+	umoci stat --image "${IMAGE}:${TAG}-noverify" --json
+	[ "$status" -eq 0 ]
+	layerB="$(jq -SMr '.history[-1].diff_id' <<<"$output")"
+	[ "$layerA" = "$layerB" ]
+}
+
+@test "umoci repack --metadata-overrides" {
+	# We need to be able to chown files to check the ownership.
+	requires root
+
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	OVERRIDES="$(setup_tmpdir)/overrides.json"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	mkdir -p "$BUNDLE_A/rootfs/var/www/html"
+	echo "index" > "$BUNDLE_A/rootfs/var/www/html/index.html"
+	echo "config" > "$BUNDLE_A/rootfs/var/www/config"
+	echo "unrelated" > "$BUNDLE_A/rootfs/var/wwwroot"
+
+	cat >"$OVERRIDES" <<EOF
+[
+	{"path": "/var/www", "uid": 33, "gid": 1234, "mode": "0750"},
+	{"path": "var/www/config", "mode": "0600"}
+]
+EOF
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --metadata-overrides "$OVERRIDES" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	sane_run stat -c '%u:%g:%a' "$BUNDLE_B/rootfs/var/www/html/index.html"
+	[ "$status" -eq 0 ]
+	[ "$output" = "33:1234:750" ]
+	sane_run stat -c '%u:%g:%a' "$BUNDLE_B/rootfs/var/www/config"
+	[ "$status" -eq 0 ]
+	[ "$output" = "33:1234:600" ]
+	sane_run stat -c '%u:%g' "$BUNDLE_B/rootfs/var/wwwroot"
+	[ "$status" -eq 0 ]
+	[ "$output" = "0:0" ]
+
+	# Invalid overrides must be rejected.
+	echo '[{"path": "/var/www", "mode": "0999"}]' >"$OVERRIDES"
+	umoci repack --image "${IMAGE}:${TAG}-bad" --metadata-overrides "$OVERRIDES" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --since" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make an old change, a new change and a deletion.
+	echo "old change" > "$BUNDLE/rootfs/oldfile"
+	touch -d "2010-01-01T00:00:00Z" "$BUNDLE/rootfs/oldfile"
+	echo "new change" > "$BUNDLE/rootfs/newfile"
+	touch -d "2020-01-01T00:00:00Z" "$BUNDLE/rootfs/newfile"
+	chmod +w "$BUNDLE/rootfs/etc/." && rm -f "$BUNDLE/rootfs/etc/group"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --since "2015-01-01T00:00:00Z" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Check the contents of the new layer.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	layer="$(jq -SMr '.history[-1].layer.digest' <<<"$output" | tr : /)"
+	sane_run tar tzf "$IMAGE/blobs/$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"newfile"* ]]
+	[[ "$output" != *"oldfile"* ]]
+	[[ "$output" == *"etc/.wh.group"* ]]
+
+	# --since-ignore-deletions requires --since.
+	umoci repack --image "${IMAGE}:${TAG}-new" --since-ignore-deletions "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --deletions-only" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Make an addition, a modification and a deletion.
+	echo "new file" > "$BUNDLE_A/rootfs/newfile"
+	chmod +w "$BUNDLE_A/rootfs/etc/." && echo "modified" >> "$BUNDLE_A/rootfs/etc/passwd" && rm -f "$BUNDLE_A/rootfs/etc/group"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --deletions-only "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer must only contain the whiteout.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	layer="$(jq -SMr '.history[-1].layer.digest' <<<"$output" | tr : /)"
+	sane_run tar tzf "$IMAGE/blobs/$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "etc/.wh.group" ]]
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	! [ -e "$BUNDLE_B/rootfs/etc/group" ]
+	! [ -e "$BUNDLE_B/rootfs/newfile" ]
+	[[ "$(tail -n1 "$BUNDLE_B/rootfs/etc/passwd")" != "modified" ]]
+
+	# --deletions-only conflicts with other ways of selecting deltas, and the
+	# refreshed bundle metadata would be wrong.
+	umoci repack --image "${IMAGE}:${TAG}-new" --deletions-only --since "2015-01-01T00:00:00Z" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-new" --deletions-only --from-scratch "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-new" --deletions-only --refresh-bundle "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --from-scratch" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Make some changes, including a deletion.
+	echo "new file" > "$BUNDLE_A/rootfs/newfile"
+	chmod +w "$BUNDLE_A/rootfs/etc/." && rm -f "$BUNDLE_A/rootfs/etc/group"
+
+	# The mtree metadata isn't needed (or used).
+	rm -f "$BUNDLE_A"/sha256_*.mtree
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --from-scratch --history.created_by "flatten" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The image must only have the new layer and history entry.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[ "$(jq -SM '.history | length' <<<"$output")" -eq 1 ]
+	[[ "$(jq -SMr '.history[0].created_by' <<<"$output")" == "flatten" ]]
+	[[ "$(jq -SMr '.history[0].empty_layer' <<<"$output")" != "true" ]]
+
+	# The layer must contain the whole rootfs, without any whiteouts.
+	layer="$(jq -SMr '.history[0].layer.digest' <<<"$output" | tr : /)"
+	sane_run tar tzf "$IMAGE/blobs/$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"newfile"* ]]
+	[[ "$output" == *"etc/passwd"* ]]
+	[[ "$output" != *".wh."* ]]
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# The unpacked image must match the modified rootfs.
+	[ -f "$BUNDLE_B/rootfs/newfile" ]
+	! [ -e "$BUNDLE_B/rootfs/etc/group" ]
+
+	# --since cannot be used with --from-scratch.
+	umoci repack --image "${IMAGE}:${TAG}-new" --from-scratch --since "2015-01-01T00:00:00Z" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack [no changes]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Repack without making any changes.
+	umoci repack --image "${IMAGE}:${TAG}-new" --history.created_by "ENV a=b" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# A history entry must be added, but no layer.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numHistoryA="$(jq -SM '.history | length' <<<"$output")"
+	numLayersA="$(jq -SM '[.history[] | select(.empty_layer | not)] | length' <<<"$output")"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	numHistoryB="$(jq -SM '.history | length' <<<"$output")"
+	numLayersB="$(jq -SM '[.history[] | select(.empty_layer | not)] | length' <<<"$output")"
+
+	[ "$numHistoryB" -eq "$((numHistoryA + 1))" ]
+	[ "$numLayersB" -eq "$numLayersA" ]
+	[[ "$(jq -SMr '.history[-1].empty_layer' <<<"$output")" == "true" ]]
+	[[ "$(jq -SMr '.history[-1].created_by' <<<"$output")" == "ENV a=b" ]]
+}
+
+@test "umoci repack --layer-media-type" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+
+	# Invalid media types must be rejected.
+	for mediatype in "not a media type" "application/vnd.oci.image.config.v1+json" "application/vnd.oci.image.layer.v1.tar"; do
+		umoci repack --image "${IMAGE}:${TAG}-new" --layer-media-type "$mediatype" "$BUNDLE"
+		[ "$status" -ne 0 ]
+	done
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --layer-media-type "application/vnd.docker.image.rootfs.diff.tar.gzip" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# The new layer must use the given media type.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '[.history[] | select(.empty_layer != true)][-1].layer.mediaType' <<<"$output")" == "application/vnd.docker.image.rootfs.diff.tar.gzip" ]]
+}
+
+@test "umoci repack --compress=none" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	echo "new file" > "$BUNDLE_A/rootfs/newfile"
+
+	# Invalid compression types must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-new" --compress "lzma" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-new" --compress "none" --seekable-gzip "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --compress "none" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer must be an uncompressed tar archive.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '[.history[] | select(.empty_layer != true)][-1].layer.mediaType' <<<"$output")" == "application/vnd.oci.image.layer.v1.tar" ]]
+	layer="$(jq -SMr '[.history[] | select(.empty_layer != true)][-1].layer.digest' <<<"$output")"
+	tar -tf "$IMAGE/blobs/${layer/://}" | grep -q '^newfile$'
+
+	# And it must be possible to unpack the image again.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$(cat "$BUNDLE_B/rootfs/newfile")" == "new file" ]]
+}
+
+@test "umoci repack --rsyncable-gzip" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	echo "new file" > "$BUNDLE_A/rootfs/newfile"
+
+	# It only makes sense with plain gzip compression.
+	umoci repack --image "${IMAGE}:${TAG}-new" --compress "zstd" --rsyncable-gzip "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-new" --seekable-gzip --rsyncable-gzip "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --rsyncable-gzip "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer must be a normal gzip compressed tar archive.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '[.history[] | select(.empty_layer != true)][-1].layer.mediaType' <<<"$output")" == "application/vnd.oci.image.layer.v1.tar+gzip" ]]
+	layer="$(jq -SMr '[.history[] | select(.empty_layer != true)][-1].layer.digest' <<<"$output")"
+	gzip -dc "$IMAGE/blobs/${layer/://}" | tar -t | grep -q '^newfile$'
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$(cat "$BUNDLE_B/rootfs/newfile")" == "new file" ]]
+}
+
+@test "umoci repack --compress=zstd" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	echo "new file" > "$BUNDLE_A/rootfs/newfile"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --compress "zstd" --seekable-gzip "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --compress "zstd" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer must be a zstd compressed tar archive.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '[.history[] | select(.empty_layer != true)][-1].layer.mediaType' <<<"$output")" == "application/vnd.oci.image.layer.v1.tar+zstd" ]]
+
+	# And it must be possible to unpack the image again.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$(cat "$BUNDLE_B/rootfs/newfile")" == "new file" ]]
+}
+
+@test "umoci repack --record-deletions" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Delete a file and a directory.
+	chmod +w "$BUNDLE/rootfs/etc/." && rm -f "$BUNDLE/rootfs/etc/group"
+	chmod -R +w "$BUNDLE/rootfs/usr/share" && rm -rf "$BUNDLE/rootfs/usr/share"
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --record-deletions "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer must reference a deletions sidecar.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	sidecar="$(jq -SMr '[.history[] | select(.empty_layer != true)][-1].layer.annotations["org.opensuse.umoci.sidecar.deletions"]' <<<"$output")"
+	[[ "$sidecar" == sha256:* ]]
+
+	# Which must list all of the deleted paths, but not the new file.
+	deletions="$(jq -SMr '.paths[]' "$IMAGE/blobs/${sidecar/://}")"
+	grep -Fx "etc/group" <<<"$deletions"
+	grep -Fx "usr/share" <<<"$deletions"
+	! grep -Fx "newfile" <<<"$deletions"
+
+	# The sidecar must not be garbage collected.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -f "$IMAGE/blobs/${sidecar/://}" ]
+}
+
+@test "umoci repack --max-compressed-layer-size" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Random data doesn't compress.
+	dd if=/dev/urandom of="$BUNDLE/rootfs/random" bs=1M count=2
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --max-compressed-layer-size 1MB "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"exceeds maximum size"* ]]
+	image-verify "${IMAGE}"
+
+	# The tag must not have been created.
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -ne 0 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --max-compressed-layer-size 4MB "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Invalid sizes must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-new" --max-compressed-layer-size invalid "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci {un,re}pack --meta-path" {
+	BUNDLE="$(setup_tmpdir)"
+	META="$(setup_tmpdir)/meta.json"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --meta-path "$META" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# The metadata must only be stored at --meta-path.
+	[ -f "$META" ]
+	! [ -e "$BUNDLE/umoci.json" ]
+
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+
+	# Without --meta-path the bundle metadata cannot be found.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --meta-path "$META" --refresh-bundle "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The refreshed metadata must refer to the new image.
+	digest="$(jq -SMr '.from_descriptor_path.descriptor_walk[0].digest' "$META")"
+	[ -f "$BUNDLE/${digest/:/_}.mtree" ]
+	! [ -e "$BUNDLE/umoci.json" ]
+}
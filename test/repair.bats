@@ -0,0 +1,100 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci repair [missing args]" {
+	umoci repair
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repair [consistent]" {
+	image-verify "${IMAGE}"
+
+	# Check how many blobs there were.
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+
+	# A consistent image shouldn't be modified.
+	umoci repair --layout "${IMAGE}" --gc
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+}
+
+@test "umoci repair [oci-layout]" {
+	# Corrupt the oci-layout.
+	echo "garbage" > "$IMAGE/oci-layout"
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci repair --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"rewrote oci-layout"* ]]
+	image-verify "${IMAGE}"
+
+	# Unsupported versions must not be touched.
+	echo '{"imageLayoutVersion":"9.9.9"}' > "$IMAGE/oci-layout"
+	umoci repair --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	grep -q "9.9.9" "$IMAGE/oci-layout"
+}
+
+@test "umoci repair [dangling and unreferenced]" {
+	# Remove the manifest of the tag, making the reference dangling.
+	manifest="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "$IMAGE/index.json")"
+	rm -f "$IMAGE/blobs/${manifest/://}"
+
+	# The dangling reference is removed, and the orphaned blobs are reported.
+	umoci repair --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"removed dangling reference \"$TAG\""* ]]
+	[[ "$output" == *"unreferenced blob"* ]]
+	image-verify "${IMAGE}"
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	! [[ "$output" == *"$TAG"* ]]
+
+	# Check how many blobs there were.
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+
+	# Now remove the unreferenced blobs.
+	umoci repair --layout "${IMAGE}" --gc
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"removed unreferenced blob"* ]]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -lt "$nblobs" ]
+}
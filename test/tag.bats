@@ -51,6 +51,41 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci list --sort" {
+	image-verify "${IMAGE}"
+
+	# Create some images with known creation times, in an unsorted order.
+	umoci config --image "${IMAGE}:${TAG}" --tag "zzz-oldest" --created "2000-01-01T00:00:00Z"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "aaa-newest" --created "2020-01-01T00:00:00Z"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "mmm-middle" --created "2010-01-01T00:00:00Z"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Sort by creation time.
+	umoci list --layout "${IMAGE}" --sort created
+	[ "$status" -eq 0 ]
+	sane_run grep -E '^(aaa|mmm|zzz)-' <<<"$output"
+	[ "${lines[0]}" = "zzz-oldest" ]
+	[ "${lines[1]}" = "mmm-middle" ]
+	[ "${lines[2]}" = "aaa-newest" ]
+
+	# Sort by name.
+	umoci list --layout "${IMAGE}" --sort name
+	[ "$status" -eq 0 ]
+	sane_run grep -E '^(aaa|mmm|zzz)-' <<<"$output"
+	[ "${lines[0]}" = "aaa-newest" ]
+	[ "${lines[1]}" = "mmm-middle" ]
+	[ "${lines[2]}" = "zzz-oldest" ]
+
+	# Unknown sort keys must be rejected.
+	umoci list --layout "${IMAGE}" --sort size
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci list [missing args]" {
 	umoci ls
 	[ "$status" -ne 0 ]
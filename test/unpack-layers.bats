@@ -0,0 +1,85 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci unpack-layers" {
+	BUNDLE="$(setup_tmpdir)"
+	DEST="$(setup_tmpdir)/layers"
+
+	image-verify "${IMAGE}"
+
+	# Add a layer which deletes and creates a file.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	rm -f "$BUNDLE/rootfs/etc/passwd"
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack-layers --image "${IMAGE}:${TAG}-new" --parallel 4 "$DEST"
+	[ "$status" -eq 0 ]
+
+	# There must be one directory for each layer.
+	nlayers="$(ls "$DEST" | wc -l)"
+	[ "$nlayers" -ge 2 ]
+	last="$DEST/layer$((nlayers - 1))"
+	[ -d "$last" ]
+
+	# The last layer must only contain our changes, with the whiteout kept.
+	[ -f "$last/newfile" ]
+	[[ "$(cat "$last/newfile")" == "new file" ]]
+	[ -f "$last/etc/.wh.passwd" ]
+	! [ -e "$last/etc/passwd" ]
+
+	# The lower layers must not be affected by the whiteout.
+	[ -f "$DEST/layer0/etc/passwd" ]
+	! [ -e "$DEST/layer0/newfile" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack-layers [invalid arguments]" {
+	DEST="$(setup_tmpdir)/layers"
+
+	# Missing destination.
+	umoci unpack-layers --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Too many arguments.
+	umoci unpack-layers --image "${IMAGE}:${TAG}" "$DEST" too many arguments
+	[ "$status" -ne 0 ]
+
+	# Invalid --parallel.
+	umoci unpack-layers --image "${IMAGE}:${TAG}" --parallel 0 "$DEST"
+	[ "$status" -ne 0 ]
+	! [ -e "$DEST" ]
+
+	image-verify "${IMAGE}"
+}
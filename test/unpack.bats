@@ -152,3 +152,126 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci unpack --hardlink-fallback" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Invalid policies must be rejected.
+	umoci unpack --image "${IMAGE}:${TAG}" --hardlink-fallback=invalid "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	# Both valid policies work fine when no hardlinks cross filesystems.
+	umoci unpack --image "${IMAGE}:${TAG}" --hardlink-fallback=error "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --hardlink-fallback=copy "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	# The results must be identical.
+	gomtree -p "$BUNDLE_B/rootfs" -f "$BUNDLE_C"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [missing blob]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Remove one of the layers of the image.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	layer="$(jq -SMr '[.history[] | select(.empty_layer | not)][-1].layer.digest' <<<"$output")"
+	rm -f "$IMAGE/blobs/$(tr : / <<<"$layer")"
+
+	# Unpacking must fail up-front, mentioning the missing blob.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"missing blob $layer"* ]]
+	! [ -d "$BUNDLE/rootfs" ]
+}
+
+@test "umoci unpack --squashfs" {
+	requires mksquashfs
+
+	BUNDLE="$(setup_tmpdir)"
+	SQUASHFS="$(setup_tmpdir)/rootfs.squashfs"
+
+	image-verify "${IMAGE}"
+
+	# Unpack to a bundle as well as a squashfs image.
+	umoci unpack --image "${IMAGE}:${TAG}" --squashfs "$SQUASHFS" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -f "$SQUASHFS" ]
+
+	# The squashfs image must contain the rootfs.
+	sane_run unsquashfs -l "$SQUASHFS"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"etc/passwd"* ]]
+
+	# The bundle can be omitted.
+	rm -f "$SQUASHFS"
+	umoci unpack --image "${IMAGE}:${TAG}" --squashfs "$SQUASHFS"
+	[ "$status" -eq 0 ]
+	[ -f "$SQUASHFS" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --json" {
+	BUNDLE="$(setup_tmpdir)"
+	SUMMARY="$(setup_tmpdir)/summary.json"
+
+	image-verify "${IMAGE}"
+
+	# The summary is the last line of output (logs go to stderr).
+	umoci unpack --image "${IMAGE}:${TAG}" --json "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "$output" | tail -n1 > "$SUMMARY"
+	bundle-verify "$BUNDLE"
+
+	sane_run jq -SMr '.tag' "$SUMMARY"
+	[ "$status" -eq 0 ]
+	[ "$output" = "${TAG}" ]
+	sane_run jq -SMr '.bundle' "$SUMMARY"
+	[ "$status" -eq 0 ]
+	[ "$output" = "$BUNDLE" ]
+	sane_run jq -SMr '(.manifest.digest | startswith("sha256:")) and (.layers | length > 0) and .duration >= 0' "$SUMMARY"
+	[ "$status" -eq 0 ]
+	[ "$output" = "true" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --extract-path" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --extract-path=/etc "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Only /etc should have been extracted.
+	[ -f "$BUNDLE_A/rootfs/etc/passwd" ]
+	[ ! -e "$BUNDLE_A/rootfs/bin" ]
+	[ ! -e "$BUNDLE_A/rootfs/usr" ]
+
+	# The contents of /etc must match a full unpack.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	sane_run diff -r "$BUNDLE_A/rootfs/etc" "$BUNDLE_B/rootfs/etc"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}